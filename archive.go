@@ -0,0 +1,394 @@
+// archive.go
+
+// 介绍:
+// 本文件实现了 WAL 段的轮转和归档,以及基于归档的按时间点恢复(PITR)。
+//
+// 数据文件只在检查点时重写,WAL 在两次检查点之间持续增长。使用 WithWALSegmentSize 之后,
+// WAL 达到段大小时后台的轮转器会执行一次检查点: 把内存中的数据写入新的数据文件并清空 WAL,
+// 被清空的内容就是一个 WAL 段。使用 WithWALArchive 时每个段在清空之前被复制到归档目录,
+// 文件名包含段中第一条和最后一条记录的 LSN;不归档时段被直接丢弃。
+// 打开数据库时的检查点同样会归档上一次运行留下的 WAL,因此归档中的记录是连续的。
+//
+// 每条 WAL 记录都带有写入时的时间戳。RestoreToPoint 从一份全量备份开始,按照 LSN 的顺序
+// 重放增量备份和归档中的 WAL 记录,在第一条超过目标 LSN 或目标时间的记录之前停止,
+// 得到数据库在那个时间点的状态。集合的创建和删除也记录在 WAL 中,同样会被重放。
+//
+// 轮转需要短暂地阻塞所有写操作,耗时与数据量成正比;增量备份读取 WAL 期间轮转会被推迟。
+
+package jsonDB
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// WALSegmentExt 是归档的 WAL 段的扩展名
+const WALSegmentExt = ".wal"
+
+// WithWALSegmentSize 设置 WAL 段的大小,WAL 达到这个大小时在后台轮转
+// 默认为 0,WAL 只在打开数据库时被检查点清空
+func WithWALSegmentSize(size int64) Option {
+	return func(db *Database) {
+		db.walSegmentSize = size
+	}
+}
+
+// WithWALArchive 在轮转和检查点清空 WAL 之前把它作为一个段保存到目录 dir,用于 RestoreToPoint
+func WithWALArchive(dir string) Option {
+	return func(db *Database) {
+		db.walArchiveDir = dir
+	}
+}
+
+// WALSegment 是归档目录中的一个 WAL 段
+type WALSegment struct {
+	Name     string // 文件名
+	FirstLSN uint64 // 段中第一条记录的 LSN
+	LastLSN  uint64 // 段中最后一条记录的 LSN
+	Size     int64  // 文件大小
+}
+
+// ListWALArchive 返回归档目录中的所有 WAL 段,按照 LSN 排序
+// 目录中的其他文件会被忽略,目录不存在时返回空切片
+func ListWALArchive(dir string) ([]WALSegment, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []WALSegment
+	for _, entry := range entries {
+		first, last, ok := parseWALSegmentName(entry.Name())
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, WALSegment{Name: entry.Name(), FirstLSN: first, LastLSN: last, Size: info.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].FirstLSN != segments[j].FirstLSN {
+			return segments[i].FirstLSN < segments[j].FirstLSN
+		}
+		return segments[i].LastLSN < segments[j].LastLSN
+	})
+	return segments, nil
+}
+
+// walSegmentName 返回段的文件名,LSN 补齐到相同的宽度,使文件名的字母顺序与 LSN 的顺序一致
+func walSegmentName(first, last uint64) string {
+	return fmt.Sprintf("%020d-%020d%s", first, last, WALSegmentExt)
+}
+
+// parseWALSegmentName 从段的文件名中解析第一条和最后一条记录的 LSN
+func parseWALSegmentName(name string) (first, last uint64, ok bool) {
+	base, found := strings.CutSuffix(name, WALSegmentExt)
+	if !found {
+		return 0, 0, false
+	}
+	firstPart, lastPart, found := strings.Cut(base, "-")
+	if !found {
+		return 0, 0, false
+	}
+	first, err1 := strconv.ParseUint(firstPart, 10, 64)
+	last, err2 := strconv.ParseUint(lastPart, 10, 64)
+	return first, last, err1 == nil && err2 == nil && first <= last
+}
+
+// startWALRotator 在设置了段大小时启动后台轮转器
+func (db *Database) startWALRotator() {
+	if db.walSegmentSize <= 0 {
+		return
+	}
+	db.rotatorWg.Add(1)
+	go db.runWALRotator()
+}
+
+// runWALRotator 在收到通知时轮转 WAL,直到数据库被关闭
+func (db *Database) runWALRotator() {
+	defer db.rotatorWg.Done()
+	for {
+		select {
+		case <-db.rotatorStop:
+			return
+		case <-db.walRotate:
+			if err := db.rotateWAL(); err != nil {
+				db.logTo(LogSubsystemWAL, LogLevelError, "Failed to rotate WAL", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// requestWALRotation 在 WAL 达到段大小时通知轮转器,不会阻塞
+// 调用方需要持有 db.mu
+func (db *Database) requestWALRotation() {
+	if db.walSegmentSize <= 0 || db.walSize < db.walSegmentSize {
+		return
+	}
+	select {
+	case db.walRotate <- struct{}{}:
+	default:
+	}
+}
+
+// rotateWAL 通过一次检查点轮转 WAL
+// 有读者正在读取 WAL 时跳过这次轮转,之后的写入会再次触发
+func (db *Database) rotateWAL() error {
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+
+	if !db.walReaders.TryLock() {
+		db.logTo(LogSubsystemWAL, LogLevelDebug, "WAL is being read, postponing rotation")
+		return nil
+	}
+	defer db.walReaders.Unlock()
+
+	db.mu.RLock()
+	size := db.walSize
+	db.mu.RUnlock()
+	if size < db.walSegmentSize {
+		return nil
+	}
+
+	db.logTo(LogSubsystemWAL, LogLevelInfo, "Rotating WAL segment", slog.Int64("size", size))
+	return db.checkpoint()
+}
+
+// archiveWAL 把当前的 WAL 文件复制到归档目录,没有设置归档目录或者 WAL 为空时什么都不做
+// 调用方需要持有 db.mu
+func (db *Database) archiveWAL() error {
+	if db.walArchiveDir == "" {
+		return nil
+	}
+	path := filepath.Join(db.dbPath, WALFileName)
+	var first uint64
+	// 段原样复制,加密的记录不需要解密,只读取明文保存的 LSN
+	err := scanRecords(path, WALFileName, fileConfig{raw: true}, decodeWALFileRecord, func(rec *FileRecord) error {
+		if rec.Err != nil {
+			return &CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: rec.Err}
+		}
+		first = rec.LSN
+		return errStopScan
+	})
+	if err == nil {
+		// WAL 中没有记录
+		return nil
+	}
+	if err != errStopScan {
+		return err
+	}
+
+	if err := os.MkdirAll(db.walArchiveDir, DBDirPerm); err != nil {
+		return err
+	}
+	last := atomic.LoadUint64(&db.lsn)
+	name := walSegmentName(first, last)
+	tmpPath := filepath.Join(db.walArchiveDir, name+".tmp")
+	os.Remove(tmpPath)
+	if err := copyBackupFile(path, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(db.walArchiveDir, name)); err != nil {
+		return err
+	}
+
+	db.logTo(LogSubsystemWAL, LogLevelInfo, "Archived WAL segment", slog.String("segment", name))
+	return nil
+}
+
+// RecoveryTarget 描述按时间点恢复的目标,两个字段都为零值时重放所有可用的记录
+type RecoveryTarget struct {
+	LSN  uint64    // 不为 0 时只重放 LSN 不大于它的记录
+	Time time.Time // 不为零值时只重放在这个时间或者之前写入的记录
+}
+
+// reached 返回 rec 是否已经超过了恢复目标
+// 没有时间戳的旧记录无法与目标时间比较,视为在目标时间之前
+func (t RecoveryTarget) reached(rec *FileRecord) bool {
+	if t.LSN != 0 && rec.LSN > t.LSN {
+		return true
+	}
+	return !t.Time.IsZero() && rec.Timestamp != 0 && time.Unix(0, rec.Timestamp).After(t.Time)
+}
+
+// RecoveryResult 描述按时间点恢复的结果
+type RecoveryResult struct {
+	Base       *BackupManifest // 作为起点的全量备份的清单,可以用它的 CreateIndexes 重新创建索引
+	LSN        uint64          // 恢复后的数据库包含 LSN 不大于它的所有写入
+	Time       time.Time       // 最后一条被重放的记录的时间,没有重放任何记录时为备份的时间
+	WALRecords int64           // 重放的 WAL 记录数量
+}
+
+// walSource 是按时间点恢复时的一个 WAL 来源
+type walSource struct {
+	path  string
+	first uint64 // 来源中第一条记录的 LSN
+	live  bool   // 是否是数据库目录中当前的 WAL,末尾不完整的记录被丢弃而不是视为损坏
+}
+
+// RestoreToPoint 从备份和归档的 WAL 恢复数据库在某个时间点的状态,替换 dbDir 中的数据库
+//
+// 介绍:
+// backupDirs 中第一份必须是全量备份,之后可以是按顺序创建的增量备份,规则与 RestoreFromDir 相同。
+// 全量备份之后的写入从增量备份和 archiveDir 中的 WAL 段重放,按照 LSN 的顺序进行,
+// 在第一条超过 target 的记录之前停止;不同来源中重复的记录只重放一次,缺少记录时返回 ErrIncompleteWAL。
+// dbDir 中当前的 WAL 包含最后一次归档之后的写入,作为最后一个来源一起重放,不会随着旧的目录被丢弃。
+// 以时间为目标时,如果所有可用的记录都早于目标时间并且 dbDir 中没有当前的 WAL,
+// 无法确认目标时间之前的写入都已经重放,同样返回 ErrIncompleteWAL;恢复到最新的状态应该使用零值的 target。
+// tar 格式的备份需要先解压到目录中。所有文件在临时目录中校验并合成,成功之后才替换 dbDir,
+// 调用方需要保证恢复期间没有进程打开了 dbDir 中的数据库。
+//
+// 参数:
+// - dbDir: 数据库目录,不存在时会被创建
+// - archiveDir: WithWALArchive 设置的归档目录,为空时只使用增量备份中的记录
+// - target: 恢复的目标,不能早于全量备份
+// - backupDirs: BackupToDir 写出的备份目录,按创建的顺序排列
+//
+// 返回值:
+// - *RecoveryResult: 恢复到的 LSN 和时间
+// - error: 备份无效时返回包装了 ErrInvalidBackup 的错误,WAL 不连续或者达不到目标 LSN 时返回包装了 ErrIncompleteWAL 的错误
+func RestoreToPoint(dbDir, archiveDir string, target RecoveryTarget, backupDirs ...string) (*RecoveryResult, error) {
+	manifests, err := verifyBackupChain(backupDirs)
+	if err != nil {
+		return nil, err
+	}
+	base := manifests[0]
+	if target.LSN != 0 && target.LSN < base.LSN {
+		return nil, fmt.Errorf("%w: target LSN %d is before the base backup at LSN %d", ErrInvalidBackup, target.LSN, base.LSN)
+	}
+	if !target.Time.IsZero() && target.Time.Before(base.CreatedAt) {
+		return nil, fmt.Errorf("%w: target time %v is before the base backup at %v", ErrInvalidBackup, target.Time, base.CreatedAt)
+	}
+
+	var sources []walSource
+	for i := 1; i < len(backupDirs); i++ {
+		sources = append(sources, walSource{path: filepath.Join(backupDirs[i], WALFileName), first: manifests[i].BaseLSN + 1})
+	}
+	if archiveDir != "" {
+		segments, err := ListWALArchive(archiveDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list WAL archive: %w", err)
+		}
+		for _, segment := range segments {
+			sources = append(sources, walSource{path: filepath.Join(archiveDir, segment.Name), first: segment.FirstLSN})
+		}
+	}
+	sort.SliceStable(sources, func(i, j int) bool { return sources[i].first < sources[j].first })
+
+	// 当前的 WAL 中是最后一次检查点之后的写入,它们不在归档中,必须在替换目录之前重放
+	livePath := filepath.Join(dbDir, WALFileName)
+	_, err = os.Stat(livePath)
+	live := err == nil
+	if live {
+		sources = append(sources, walSource{path: livePath, live: true})
+	}
+
+	staging, err := newRestoreStaging(dbDir)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	dir := filepath.Join(staging, "db")
+	if err := os.Mkdir(dir, DBDirPerm); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{DataFileName, MetaFileName} {
+		if err := copyBackupFile(filepath.Join(backupDirs[0], name), filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &RecoveryResult{Base: base, LSN: base.LSN, Time: base.CreatedAt}
+	reached, err := replayWALSources(filepath.Join(dir, WALFileName), sources, target, result)
+	if err != nil {
+		return nil, err
+	}
+	if target.LSN != 0 && result.LSN < target.LSN {
+		return nil, fmt.Errorf("%w: WAL ends at LSN %d, before the target LSN %d", ErrIncompleteWAL, result.LSN, target.LSN)
+	}
+	if !target.Time.IsZero() && !reached && !live {
+		return nil, fmt.Errorf("%w: WAL ends at %v, before the target time %v", ErrIncompleteWAL, result.Time, target.Time)
+	}
+
+	if err := replaceDatabaseDir(dbDir, dir); err != nil {
+		return nil, fmt.Errorf("failed to replace database directory: %w", err)
+	}
+	return result, nil
+}
+
+// replayWALSources 按照 LSN 的顺序把 sources 中 result.LSN 之后、target 之前的记录写入 path
+// 打开数据库时这些记录会像普通的 WAL 一样被重放。加密的记录原样复制,不需要密钥
+// 返回值表示是否遇到了超过 target 的记录
+func replayWALSources(path string, sources []walSource, target RecoveryTarget, result *RecoveryResult) (bool, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, DBFilePerm)
+	if err != nil {
+		return false, err
+	}
+	writer := bufio.NewWriter(file)
+	records := newRecordWriter(writer, WALFileName, nil)
+	reached := false
+	for _, source := range sources {
+		if reached {
+			break
+		}
+		err = scanRecords(source.path, WALFileName, fileConfig{raw: true}, decodeWALFileRecord, func(rec *FileRecord) error {
+			if rec.Err != nil {
+				if source.live {
+					// 当前的 WAL 末尾可能有写入到一半的记录,打开数据库时同样会被截断
+					return errStopScan
+				}
+				return &CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: rec.Err}
+			}
+			if rec.LSN <= result.LSN {
+				return nil
+			}
+			if rec.LSN != result.LSN+1 {
+				return fmt.Errorf("%w: no record for LSN %d before %s", ErrIncompleteWAL, result.LSN+1, rec.File)
+			}
+			if target.reached(rec) {
+				reached = true
+				return errStopScan
+			}
+			if _, err := records.writeStored(rec.KeyID, rec.stored); err != nil {
+				return err
+			}
+			result.LSN = rec.LSN
+			if rec.Timestamp != 0 {
+				result.Time = time.Unix(0, rec.Timestamp)
+			}
+			result.WALRecords++
+			return nil
+		})
+		if err == errStopScan {
+			err = nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return reached, err
+}
@@ -0,0 +1,206 @@
+package jsonDB
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// currentLSN 返回数据库当前的 LSN
+func currentLSN(db *Database) uint64 {
+	snap := db.Snapshot()
+	defer snap.Release()
+	return snap.Seq()
+}
+
+func TestWALRotationAndArchive(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, archive := filepath.Join(dir, "db"), filepath.Join(dir, "archive")
+	db, err := NewDatabase("id", dbPath, runtime.NumCPU(), WithLogLevel(LogLevelOff), WithWALSegmentSize(1024), WithWALArchive(archive))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	// 每一批写入超过段大小,等待轮转器把它归档之后再写入下一批
+	for batch := 1; batch <= 3; batch++ {
+		for i := 0; i < 15; i++ {
+			if _, err := db.Insert(map[string]interface{}{"id": fmt.Sprint(batch, "-", i), "payload": "0123456789012345678901234567890123456789"}); err != nil {
+				t.Fatalf("Failed to insert document: %v", err)
+			}
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			segments, _ := ListWALArchive(archive)
+			if len(segments) >= batch {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Expected the WAL to be rotated into the archive")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	db.Insert(map[string]interface{}{"id": "last"})
+	lsn := currentLSN(db)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	// 重新打开时归档剩余的 WAL,归档中的段是连续的
+	db, err = NewDatabase("id", dbPath, runtime.NumCPU(), WithLogLevel(LogLevelOff), WithWALArchive(archive))
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if db.Count() != 46 {
+		t.Errorf("Expected 46 documents after rotation, got %d", db.Count())
+	}
+	segments, err := ListWALArchive(archive)
+	if err != nil || len(segments) != 4 {
+		t.Fatalf("Expected 4 archived segments, got %v %v", segments, err)
+	}
+	next := uint64(1)
+	for _, segment := range segments {
+		if segment.FirstLSN != next {
+			t.Errorf("Expected segment starting at LSN %d, got %+v", next, segment)
+		}
+		next = segment.LastLSN + 1
+	}
+	if next != lsn+1 {
+		t.Errorf("Expected the archive to end at LSN %d, got %d", lsn, next-1)
+	}
+}
+
+func TestRestoreToPoint(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, archive, base := filepath.Join(dir, "db"), filepath.Join(dir, "archive"), filepath.Join(dir, "base")
+	open := func() *Database {
+		db, err := NewDatabase("id", dbPath, runtime.NumCPU(), WithLogLevel(LogLevelOff), WithWALArchive(archive))
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		return db
+	}
+
+	db := open()
+	db.Insert(map[string]interface{}{"id": "a"})
+	if _, err := db.BackupToDir(context.Background(), base); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	db.Insert(map[string]interface{}{"id": "b"})
+	afterB := currentLSN(db)
+	orders, _ := db.CreateCollection("orders", "id")
+	orders.Insert(map[string]interface{}{"id": "o1"})
+	time.Sleep(10 * time.Millisecond)
+	beforeDeploy := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	// 错误的操作: 删除集合和文档
+	db.DropCollection("orders")
+	db.Delete("a")
+	end := currentLSN(db)
+	db.Close()
+	// 重新打开数据库时归档上一次运行的 WAL
+	open().Close()
+
+	restore := func(target RecoveryTarget) *Database {
+		t.Helper()
+		restored := filepath.Join(dir, "restored")
+		result, err := RestoreToPoint(restored, archive, target, base)
+		if err != nil {
+			t.Fatalf("RestoreToPoint(%+v) failed: %v", target, err)
+		}
+		if result.Time.After(beforeDeploy) && !target.Time.IsZero() {
+			t.Errorf("Replayed a record after the target time: %+v", result)
+		}
+		db, err := NewDatabase("id", restored, runtime.NumCPU(), WithLogLevel(LogLevelOff))
+		if err != nil {
+			t.Fatalf("Failed to open restored database: %v", err)
+		}
+		return db
+	}
+
+	db = restore(RecoveryTarget{Time: beforeDeploy})
+	if _, ok := db.Get("a"); !ok {
+		t.Error("Expected document deleted after the target time")
+	}
+	if coll, err := db.Collection("orders"); err != nil || coll.Count() != 1 {
+		t.Errorf("Expected collection dropped after the target time, got %v", err)
+	}
+	db.Close()
+
+	db = restore(RecoveryTarget{LSN: afterB})
+	if _, ok := db.Get("b"); !ok {
+		t.Error("Expected document written before the target LSN")
+	}
+	if _, err := db.Collection("orders"); err == nil {
+		t.Error("Expected collection created after the target LSN to be absent")
+	}
+	db.Close()
+
+	db = restore(RecoveryTarget{})
+	if _, ok := db.Get("a"); ok || db.Count() != 1 {
+		t.Errorf("Expected all records to be replayed, got %d documents", db.Count())
+	}
+	if _, err := db.Collection("orders"); err == nil {
+		t.Error("Expected dropped collection to stay dropped")
+	}
+	db.Close()
+
+	if _, err := RestoreToPoint(filepath.Join(dir, "x"), archive, RecoveryTarget{LSN: end + 10}, base); !errors.Is(err, ErrIncompleteWAL) {
+		t.Errorf("Expected ErrIncompleteWAL for a target beyond the archive, got %v", err)
+	}
+	if _, err := RestoreToPoint(filepath.Join(dir, "x"), "", RecoveryTarget{LSN: end}, base); !errors.Is(err, ErrIncompleteWAL) {
+		t.Errorf("Expected ErrIncompleteWAL without an archive, got %v", err)
+	}
+	if _, err := RestoreToPoint(filepath.Join(dir, "x"), archive, RecoveryTarget{Time: beforeDeploy.Add(-time.Hour)}, base); !errors.Is(err, ErrInvalidBackup) {
+		t.Errorf("Expected ErrInvalidBackup for a target before the backup, got %v", err)
+	}
+}
+
+func TestRestoreToPointUsesLiveWAL(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, archive, base := filepath.Join(dir, "db"), filepath.Join(dir, "archive"), filepath.Join(dir, "base")
+	db, err := NewDatabase("id", dbPath, runtime.NumCPU(), WithLogLevel(LogLevelOff), WithWALArchive(archive))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.Insert(map[string]interface{}{"id": "a"})
+	if _, err := db.BackupToDir(context.Background(), base); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	db.Insert(map[string]interface{}{"id": "b"})
+	time.Sleep(10 * time.Millisecond)
+	target := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	db.Insert(map[string]interface{}{"id": "bad"})
+	db.Close()
+
+	// 没有当前的 WAL 时,无法确认目标时间之前的写入都在归档中
+	if _, err := RestoreToPoint(filepath.Join(dir, "x"), archive, RecoveryTarget{Time: target}, base); !errors.Is(err, ErrIncompleteWAL) {
+		t.Errorf("Expected ErrIncompleteWAL without the live WAL, got %v", err)
+	}
+
+	// 最后一次归档之后的写入只在数据库目录的 WAL 中,原地恢复时同样被重放
+	result, err := RestoreToPoint(dbPath, archive, RecoveryTarget{Time: target}, base)
+	if err != nil {
+		t.Fatalf("RestoreToPoint failed: %v", err)
+	}
+	if result.WALRecords != 1 {
+		t.Errorf("Expected one replayed record, got %+v", result)
+	}
+	db, err = NewDatabase("id", dbPath, runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to open restored database: %v", err)
+	}
+	defer db.Close()
+	if _, ok := db.Get("b"); !ok {
+		t.Error("Expected the document written before the target time")
+	}
+	if _, ok := db.Get("bad"); ok {
+		t.Error("Expected the document written after the target time to be absent")
+	}
+}
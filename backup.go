@@ -0,0 +1,793 @@
+// backup.go
+
+// 介绍:
+// 本文件实现了数据库运行期间的在线备份,以及从备份恢复数据库。
+//
+// 创建备份时短暂地持有提交锁,在同一时刻创建快照、记录元数据和索引目录,之后在快照上写出文档,
+// 写出期间写操作不会被阻塞,也不会出现在备份中。备份由几个文件和一个清单文件 backup.json 组成:
+// 全量备份包含 data.db 和 meta.db;增量备份包含 meta.db 和基准 LSN 之后的 WAL 记录(wal.log)。
+// 清单记录了备份的 LSN、每个文件的大小和 SHA-256 校验和,以及所有集合上的索引定义,
+// 因为索引不会被持久化,恢复之后可以通过 BackupManifest.CreateIndexes 重新创建。
+//
+// 恢复时先把备份解压到数据库目录旁边的临时目录并校验所有文件,然后把全量备份和之后的增量备份
+// 合成为一个完整的数据库目录,增量备份中的 WAL 记录在打开数据库时重放。
+// 所有校验都通过之后才用新目录替换原来的数据库目录,校验失败时原来的数据库保持不变。
+//
+// WAL 只保留最近一次检查点之后的记录,而打开数据库和轮转 WAL(见 archive.go)时会执行检查点,
+// 因此增量备份的基准必须是在最近一次检查点之后创建的备份,否则返回 ErrBackupBaseUnavailable。
+
+package jsonDB
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// BackupManifestName 是备份清单的文件名
+	BackupManifestName = "backup.json"
+
+	// backupVersion 是备份格式的版本
+	backupVersion = 1
+	// backupCheckInterval 是写出备份时检查 context 是否取消的间隔(文档数量)
+	backupCheckInterval = 1024
+)
+
+// BackupManifest 描述一份备份,保存在备份的 backup.json 中
+type BackupManifest struct {
+	Version     int               `json:"version"`               // 备份格式的版本
+	LSN         uint64            `json:"lsn"`                   // 备份包含 LSN 不大于它的所有写入
+	BaseLSN     uint64            `json:"baseLsn,omitempty"`     // 增量备份只包含 LSN 大于它的写入
+	Incremental bool              `json:"incremental,omitempty"` // 是否为增量备份
+	CreatedAt   time.Time         `json:"createdAt"`             // 备份对应的时间点
+	Documents   int64             `json:"documents,omitempty"`   // 全量备份中的文档数量
+	WALRecords  int64             `json:"walRecords,omitempty"`  // 增量备份中的 WAL 记录数量
+	Files       []BackupFile      `json:"files"`                 // 备份中的文件,不包括清单本身
+	Indexes     []IndexDefinition `json:"indexes,omitempty"`     // 备份时所有集合上的索引
+}
+
+// BackupFile 是备份中的一个文件
+type BackupFile struct {
+	Name   string `json:"name"`   // 文件名,例如 DataFileName
+	Size   int64  `json:"size"`   // 文件大小
+	SHA256 string `json:"sha256"` // 文件内容的 SHA-256,十六进制
+}
+
+// IndexDefinition 描述一个索引,用于在恢复之后重新创建索引
+type IndexDefinition struct {
+	Collection  string        `json:"collection,omitempty"`  // 集合名称,默认集合为空字符串
+	Fields      []string      `json:"fields"`                // 索引的字段,单字段索引只有一个字段
+	Composite   bool          `json:"composite,omitempty"`   // 是否为复合索引
+	TTL         bool          `json:"ttl,omitempty"`         // 是否为 TTL 索引
+	ExpireAfter time.Duration `json:"expireAfter,omitempty"` // TTL 索引中文档在字段时间之后多久过期
+}
+
+// BackupOption 是 Backup 和 BackupToDir 的可选配置项
+type BackupOption func(*backupConfig)
+
+type backupConfig struct {
+	incremental bool
+	since       uint64
+}
+
+// BackupSince 创建增量备份,只包含 LSN 大于 lsn 的写入
+// lsn 通常是上一份备份的 BackupManifest.LSN
+func BackupSince(lsn uint64) BackupOption {
+	return func(c *backupConfig) {
+		c.incremental = true
+		c.since = lsn
+	}
+}
+
+// Backup 方法创建一份时间点一致的备份,以 tar 格式写入 w
+//
+// 介绍:
+// Backup 只在开始时短暂地等待正在进行的写操作完成,之后在快照上写出文档,不会阻塞写操作。
+// 备份包含所有集合,无论在哪个集合上调用。tar 中文件的大小需要预先知道,
+// 因此每个文件先写入临时目录中的临时文件,再复制到 w 中。
+//
+// 参数:
+// - ctx: 取消 ctx 会停止备份并返回 ctx.Err(),已经写入 w 的内容不是一份有效的备份
+// - w: 输出
+// - opts: 可选配置项,例如 BackupSince
+//
+// 返回值:
+// - *BackupManifest: 备份的清单,BackupManifest.LSN 可以作为下一次增量备份的基准
+// - error: 写入失败、ctx 被取消或者增量备份的基准不可用时返回错误
+func (db *Database) Backup(ctx context.Context, w io.Writer, opts ...BackupOption) (*BackupManifest, error) {
+	sink := &tarBackupSink{writer: tar.NewWriter(w)}
+	return db.backup(ctx, sink, opts)
+}
+
+// BackupToDir 方法创建一份时间点一致的备份,写入目录 dir
+//
+// 介绍:
+// 与 Backup 相同,但是备份的文件直接写入 dir,不需要临时文件。dir 不存在时会被创建,
+// 已经存在时必须为空。清单最后写入,只有包含 backup.json 的目录才是完整的备份。
+//
+// 参数:
+// - ctx: 取消 ctx 会停止备份并返回 ctx.Err()
+// - dir: 备份目录
+// - opts: 可选配置项,例如 BackupSince
+//
+// 返回值:
+// - *BackupManifest: 备份的清单
+// - error: dir 不为空、写入失败、ctx 被取消或者增量备份的基准不可用时返回错误
+func (db *Database) BackupToDir(ctx context.Context, dir string, opts ...BackupOption) (*BackupManifest, error) {
+	if err := os.MkdirAll(dir, DBDirPerm); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %w", err)
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("backup directory %s is not empty", dir)
+	}
+	return db.backup(ctx, &dirBackupSink{dir: dir}, opts)
+}
+
+// backupState 是在提交锁内同时记录的备份内容
+type backupState struct {
+	snap     *Snapshot   // 默认集合上的快照,它的序列号就是备份的 LSN
+	colls    []*Database // 快照创建时的所有集合
+	meta     dbMeta      // 快照创建时的元数据
+	walStart uint64      // WAL 中第一条记录之前的 LSN
+	indexes  []IndexDefinition
+}
+
+// captureBackupState 在提交锁内创建快照并记录元数据和索引目录,此时没有正在进行的写操作
+func (db *Database) captureBackupState() *backupState {
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+
+	state := &backupState{snap: db.root.newSnapshotLocked(), colls: db.allCollections()}
+	db.mu.RLock()
+	state.meta = db.buildMeta()
+	state.walStart = db.walStartLSN
+	db.mu.RUnlock()
+	state.meta.LSN = state.snap.seq
+
+	for _, coll := range state.colls {
+		state.indexes = append(state.indexes, coll.indexDefinitions()...)
+	}
+	return state
+}
+
+// indexDefinitions 返回集合上所有索引的定义,按索引名称排序
+func (db *Database) indexDefinitions() []IndexDefinition {
+	var defs []IndexDefinition
+	db.indexes.Range(func(_, value interface{}) bool {
+		switch idx := value.(type) {
+		case *Index:
+			expireAfter, ttl := idx.TTL()
+			defs = append(defs, IndexDefinition{Collection: db.name, Fields: []string{idx.field}, TTL: ttl, ExpireAfter: expireAfter})
+		case *CompositeIndex:
+			defs = append(defs, IndexDefinition{Collection: db.name, Fields: append([]string(nil), idx.fields...), Composite: true})
+		}
+		return true
+	})
+	sort.Slice(defs, func(i, j int) bool {
+		return strings.Join(defs[i].Fields, "-") < strings.Join(defs[j].Fields, "-")
+	})
+	return defs
+}
+
+// backup 创建一份备份并写入 sink
+func (db *Database) backup(ctx context.Context, sink backupSink, opts []BackupOption) (*BackupManifest, error) {
+	start := time.Now()
+	var cfg backupConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if cfg.incremental {
+		// 读取 WAL 期间不能轮转,否则需要的记录可能在读取之前被清空
+		db.walReaders.RLock()
+		defer db.walReaders.RUnlock()
+	}
+	state := db.captureBackupState()
+	defer state.snap.Release()
+
+	manifest := &BackupManifest{
+		Version:     backupVersion,
+		LSN:         state.meta.LSN,
+		BaseLSN:     cfg.since,
+		Incremental: cfg.incremental,
+		CreatedAt:   state.snap.created,
+		Indexes:     state.indexes,
+	}
+	db.log(LogLevelInfo, "Creating backup", slog.Uint64("lsn", manifest.LSN), slog.Bool("incremental", cfg.incremental), slog.Uint64("base_lsn", cfg.since))
+
+	if cfg.incremental {
+		if cfg.since > manifest.LSN {
+			return nil, fmt.Errorf("%w: base LSN %d is ahead of the database LSN %d", ErrInvalidBackup, cfg.since, manifest.LSN)
+		}
+		if cfg.since < state.walStart {
+			return nil, fmt.Errorf("%w: base LSN %d, oldest retained LSN %d", ErrBackupBaseUnavailable, cfg.since, state.walStart+1)
+		}
+	}
+
+	var files []BackupFile
+	add := func(name string, write func(w io.Writer) error) error {
+		file, err := sink.writeFile(name, write)
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		files = append(files, file)
+		return nil
+	}
+
+	// 备份中的文件使用当前的密钥加密,恢复之后使用同样的密钥打开
+	c, err := currentCipher(db.keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the current encryption key: %w", err)
+	}
+	if cfg.incremental {
+		err = add(WALFileName, func(w io.Writer) (err error) {
+			manifest.WALRecords, err = db.writeBackupWAL(ctx, w, c, cfg.since, manifest.LSN)
+			return err
+		})
+	} else {
+		err = add(DataFileName, func(w io.Writer) (err error) {
+			manifest.Documents, err = writeBackupData(ctx, w, c, state)
+			return err
+		})
+	}
+	if err == nil {
+		err = add(MetaFileName, func(w io.Writer) error {
+			data, err := msgpack.Marshal(state.meta)
+			if err == nil {
+				_, err = w.Write(data)
+			}
+			return err
+		})
+	}
+	if err == nil {
+		manifest.Files = files
+		var data []byte
+		if data, err = json.MarshalIndent(manifest, "", "  "); err == nil {
+			err = sink.finish(data)
+		}
+	}
+	if err != nil {
+		db.log(LogLevelError, "Backup failed", slog.Uint64("lsn", manifest.LSN), slog.Any("error", err))
+		return nil, err
+	}
+
+	db.log(LogLevelInfo, "Backup completed", slog.String("op", "backup"), slog.Uint64("lsn", manifest.LSN), slog.Int64("count", manifest.Documents), slog.Int64("wal_records", manifest.WALRecords), slog.Duration("duration", time.Since(start)))
+	return manifest, nil
+}
+
+// writeBackupData 把快照中所有集合的文档以数据文件的格式写入 w,返回写入的文档数量
+// c 不为 nil 时记录使用它加密
+func writeBackupData(ctx context.Context, w io.Writer, c *recordCipher, state *backupState) (int64, error) {
+	writer := bufio.NewWriter(w)
+	records := newRecordWriter(writer, DataFileName, c)
+	count, err := state.forEachRecord(ctx, func(record []byte) error {
+		_, err := records.write(record, 0, 0)
+		return err
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, writer.Flush()
+}
+
+// forEachRecord 对快照中所有集合的每个文档调用 fn,参数是文档在数据文件中的记录,返回文档数量
+func (state *backupState) forEachRecord(ctx context.Context, fn func(record []byte) error) (int64, error) {
+	var count int64
+	var err error
+	for _, coll := range state.colls {
+		// 快照只遍历一个集合,其他集合使用相同序列号的视图,视图不需要注册,由 state.snap 保留旧版本
+		view := &Snapshot{db: coll, seq: state.snap.seq, created: state.snap.created}
+		view.forEach(func(id string, data map[string]interface{}) bool {
+			if count%backupCheckInterval == 0 {
+				if err = ctx.Err(); err != nil {
+					return false
+				}
+			}
+			var record []byte
+			if record, err = encodeDataRecord(coll.id, id, data); err == nil {
+				err = fn(record)
+			}
+			count++
+			return err == nil
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// writeBackupWAL 把 WAL 中 LSN 在 (since, until] 之间的记录写入 w,返回写入的记录数量
+// 记录的内容保持不变,c 不为 nil 时使用它重新加密
+func (db *Database) writeBackupWAL(ctx context.Context, w io.Writer, c *recordCipher, since, until uint64) (int64, error) {
+	writer := bufio.NewWriter(w)
+	records := newRecordWriter(writer, WALFileName, c)
+	var count int64
+	err := db.scanWALRange(since, until, func(rec *FileRecord) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		count++
+		_, err := records.write(rec.Raw, rec.LSN, rec.Timestamp)
+		return err
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, writer.Flush()
+}
+
+// scanWALRange 按顺序对 WAL 中 LSN 在 (since, until] 之间的每条记录调用 fn
+//
+// WAL 通过单独的只读句柄读取,不持有提交锁和文件锁,调用方持有 walReaders 的读锁防止 WAL 在读取期间被轮转。
+// LSN 不大于 until 的记录在调用之前已经完整地写入了文件,
+// 文件末尾不完整的记录一定属于之后的写操作,可以忽略。WAL 中缺少这个范围内的记录时返回错误。
+func (db *Database) scanWALRange(since, until uint64, fn func(rec *FileRecord) error) error {
+	last := since
+	err := scanRecords(filepath.Join(db.dbPath, WALFileName), WALFileName, fileConfig{keys: db.keys}, decodeWALFileRecord, func(rec *FileRecord) error {
+		if rec.Err != nil {
+			return &CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: rec.Err}
+		}
+		if rec.LSN <= since {
+			return nil
+		}
+		if rec.LSN > until {
+			return errStopScan
+		}
+		last = rec.LSN
+		return fn(rec)
+	})
+	if err == errStopScan || isTorn(err) {
+		err = nil
+	}
+	if err == nil && last != until {
+		err = fmt.Errorf("WAL ends at LSN %d, expected %d", last, until)
+	}
+	return err
+}
+
+// backupSink 是备份的输出
+type backupSink interface {
+	// writeFile 写入备份中的一个文件,write 负责写出文件的内容
+	writeFile(name string, write func(w io.Writer) error) (BackupFile, error)
+	// finish 写入清单,完成备份
+	finish(manifest []byte) error
+}
+
+// dirBackupSink 把备份写入一个目录
+type dirBackupSink struct {
+	dir string
+}
+
+func (s *dirBackupSink) writeFile(name string, write func(w io.Writer) error) (BackupFile, error) {
+	file, err := os.OpenFile(filepath.Join(s.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, DBFilePerm)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	hw := newHashingWriter(file)
+	err = write(hw)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return hw.file(name), err
+}
+
+func (s *dirBackupSink) finish(manifest []byte) error {
+	path := filepath.Join(s.dir, BackupManifestName)
+	if err := os.WriteFile(path+".tmp", manifest, DBFilePerm); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// tarBackupSink 把备份以 tar 格式写入一个 io.Writer
+type tarBackupSink struct {
+	writer *tar.Writer
+}
+
+func (s *tarBackupSink) writeFile(name string, write func(w io.Writer) error) (BackupFile, error) {
+	tmp, err := os.CreateTemp("", "jsondb-backup-*")
+	if err != nil {
+		return BackupFile{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hw := newHashingWriter(tmp)
+	if err := write(hw); err != nil {
+		return BackupFile{}, err
+	}
+	file := hw.file(name)
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return file, err
+	}
+	if err := s.writeHeader(name, file.Size); err != nil {
+		return file, err
+	}
+	_, err = io.Copy(s.writer, tmp)
+	return file, err
+}
+
+func (s *tarBackupSink) finish(manifest []byte) error {
+	if err := s.writeHeader(BackupManifestName, int64(len(manifest))); err != nil {
+		return err
+	}
+	if _, err := s.writer.Write(manifest); err != nil {
+		return err
+	}
+	// 只结束 tar 归档,不关闭底层的 io.Writer
+	return s.writer.Close()
+}
+
+func (s *tarBackupSink) writeHeader(name string, size int64) error {
+	return s.writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     DBFilePerm,
+		Size:     size,
+		ModTime:  time.Now(),
+	})
+}
+
+// hashingWriter 在写入的同时计算内容的大小和 SHA-256
+type hashingWriter struct {
+	w    io.Writer
+	sum  hash.Hash
+	size int64
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	return &hashingWriter{w: w, sum: sha256.New()}
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.sum.Write(p[:n])
+	hw.size += int64(n)
+	return n, err
+}
+
+// file 返回已经写入的内容对应的 BackupFile
+func (hw *hashingWriter) file(name string) BackupFile {
+	return BackupFile{Name: name, Size: hw.size, SHA256: hex.EncodeToString(hw.sum.Sum(nil))}
+}
+
+// CreateIndexes 方法在恢复后的数据库上重新创建备份时存在的索引
+// 索引所在的集合不存在时返回 *CollectionNotFoundError
+func (m *BackupManifest) CreateIndexes(db *Database) error {
+	for _, def := range m.Indexes {
+		if len(def.Fields) == 0 {
+			continue
+		}
+		coll, err := db.Collection(def.Collection)
+		if err != nil {
+			return err
+		}
+		switch {
+		case def.Composite:
+			coll.CreateCompositeIndex(def.Fields)
+		case def.TTL:
+			coll.CreateIndex(def.Fields[0], IndexTTL(def.ExpireAfter))
+		default:
+			coll.CreateIndex(def.Fields[0])
+		}
+	}
+	return nil
+}
+
+// Restore 用 tar 格式的备份替换 dbDir 中的数据库
+//
+// 介绍:
+// backups 中第一份必须是全量备份,之后是按顺序创建的增量备份,每一份增量备份的基准 LSN
+// 不能大于前一份备份的 LSN。所有备份先被解压到 dbDir 旁边的临时目录并校验大小和 SHA-256,
+// 合成新的数据库目录之后才替换 dbDir,任何一步失败时 dbDir 保持不变。
+// 调用方需要保证恢复期间没有进程打开了 dbDir 中的数据库。
+//
+// 参数:
+// - dbDir: 数据库目录,不存在时会被创建
+// - backups: Backup 写出的备份,按创建的顺序排列
+//
+// 返回值:
+// - *BackupManifest: 最后一份备份的清单,可以用它的 CreateIndexes 重新创建索引
+// - error: 备份无效时返回包装了 ErrInvalidBackup 的错误,其他错误来自文件操作
+func Restore(dbDir string, backups ...io.Reader) (*BackupManifest, error) {
+	staging, err := newRestoreStaging(dbDir)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	dirs := make([]string, len(backups))
+	for i, r := range backups {
+		dirs[i] = filepath.Join(staging, fmt.Sprintf("backup-%d", i+1))
+		if err := extractBackup(r, dirs[i]); err != nil {
+			return nil, fmt.Errorf("failed to extract backup %d: %w", i+1, err)
+		}
+	}
+	return restoreBackups(dbDir, staging, dirs)
+}
+
+// RestoreFromDir 用 BackupToDir 写出的备份目录替换 dbDir 中的数据库
+// 备份的顺序、校验和替换的规则与 Restore 相同,备份目录本身不会被修改
+func RestoreFromDir(dbDir string, backupDirs ...string) (*BackupManifest, error) {
+	staging, err := newRestoreStaging(dbDir)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	return restoreBackups(dbDir, staging, backupDirs)
+}
+
+// newRestoreStaging 在 dbDir 旁边创建恢复使用的临时目录,保证之后的重命名在同一个文件系统中进行
+func newRestoreStaging(dbDir string) (string, error) {
+	staging := filepath.Clean(dbDir) + ".restore"
+	if err := os.RemoveAll(staging); err != nil {
+		return "", fmt.Errorf("failed to remove stale restore directory: %w", err)
+	}
+	if err := os.MkdirAll(staging, DBDirPerm); err != nil {
+		return "", fmt.Errorf("failed to create restore directory: %w", err)
+	}
+	return staging, nil
+}
+
+// extractBackup 把 tar 格式的备份解压到 dir
+func extractBackup(r io.Reader, dir string) error {
+	if err := os.Mkdir(dir, DBDirPerm); err != nil {
+		return err
+	}
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || !validBackupFileName(header.Name) {
+			return fmt.Errorf("%w: unexpected entry %q", ErrInvalidBackup, header.Name)
+		}
+		file, err := os.OpenFile(filepath.Join(dir, header.Name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, DBFilePerm)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, reader)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// validBackupFileName 检查备份中的文件名不包含路径
+func validBackupFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name && !strings.ContainsAny(name, `/\`)
+}
+
+// restoreBackups 校验 dirs 中的备份,在 staging 中合成数据库目录并替换 dbDir
+func restoreBackups(dbDir, staging string, dirs []string) (*BackupManifest, error) {
+	manifests, err := verifyBackupChain(dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	target := filepath.Join(staging, "db")
+	if err := os.Mkdir(target, DBDirPerm); err != nil {
+		return nil, err
+	}
+	last := len(dirs) - 1
+	if err := copyBackupFile(filepath.Join(dirs[0], DataFileName), filepath.Join(target, DataFileName)); err != nil {
+		return nil, err
+	}
+	if err := copyBackupFile(filepath.Join(dirs[last], MetaFileName), filepath.Join(target, MetaFileName)); err != nil {
+		return nil, err
+	}
+	if err := mergeBackupWAL(filepath.Join(target, WALFileName), dirs, manifests); err != nil {
+		return nil, err
+	}
+
+	if err := replaceDatabaseDir(dbDir, target); err != nil {
+		return nil, fmt.Errorf("failed to replace database directory: %w", err)
+	}
+	return manifests[last], nil
+}
+
+// verifyBackupChain 校验 dirs 中的每一份备份,并检查它们能否组成连续的备份链
+func verifyBackupChain(dirs []string) ([]*BackupManifest, error) {
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("%w: no backup to restore", ErrInvalidBackup)
+	}
+	manifests := make([]*BackupManifest, len(dirs))
+	for i, dir := range dirs {
+		manifest, err := verifyBackup(dir)
+		if err != nil {
+			return nil, fmt.Errorf("backup %d: %w", i+1, err)
+		}
+		manifests[i] = manifest
+	}
+	if err := checkBackupChain(manifests); err != nil {
+		return nil, err
+	}
+	return manifests, nil
+}
+
+// verifyBackup 读取备份目录中的清单,检查所有文件的大小和校验和
+func verifyBackup(dir string) (*BackupManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, BackupManifestName))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s not found", ErrInvalidBackup, BackupManifestName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: failed to decode manifest: %v", ErrInvalidBackup, err)
+	}
+	if manifest.Version != backupVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBackup, manifest.Version)
+	}
+
+	required := []string{DataFileName, MetaFileName}
+	if manifest.Incremental {
+		required = []string{WALFileName, MetaFileName}
+	}
+	listed := make(map[string]bool, len(manifest.Files))
+	for _, file := range manifest.Files {
+		if !validBackupFileName(file.Name) {
+			return nil, fmt.Errorf("%w: invalid file name %q", ErrInvalidBackup, file.Name)
+		}
+		listed[file.Name] = true
+		if err := verifyBackupFile(filepath.Join(dir, file.Name), file); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range required {
+		if !listed[name] {
+			return nil, fmt.Errorf("%w: %s is missing", ErrInvalidBackup, name)
+		}
+	}
+	return &manifest, nil
+}
+
+// verifyBackupFile 检查文件的大小和 SHA-256 与清单一致
+func verifyBackupFile(path string, want BackupFile) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s is missing", ErrInvalidBackup, want.Name)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hw := newHashingWriter(io.Discard)
+	if _, err := io.Copy(hw, file); err != nil {
+		return err
+	}
+	if got := hw.file(want.Name); got != want {
+		return fmt.Errorf("%w: checksum mismatch for %s: expected %d bytes with SHA-256 %s, got %d bytes with %s",
+			ErrInvalidBackup, want.Name, want.Size, want.SHA256, got.Size, got.SHA256)
+	}
+	return nil
+}
+
+// checkBackupChain 检查备份能否按顺序组成连续的备份链
+func checkBackupChain(manifests []*BackupManifest) error {
+	if manifests[0].Incremental {
+		return fmt.Errorf("%w: the first backup must be a full backup", ErrInvalidBackup)
+	}
+	for i := 1; i < len(manifests); i++ {
+		prev, m := manifests[i-1], manifests[i]
+		if !m.Incremental {
+			return fmt.Errorf("%w: backup %d is a full backup, only the first backup can be a full backup", ErrInvalidBackup, i+1)
+		}
+		if m.BaseLSN > prev.LSN {
+			return fmt.Errorf("%w: backup %d starts after LSN %d, but backup %d ends at LSN %d", ErrInvalidBackup, i+1, m.BaseLSN, i, prev.LSN)
+		}
+		if m.LSN < prev.LSN {
+			return fmt.Errorf("%w: backup %d ends at LSN %d, before backup %d", ErrInvalidBackup, i+1, m.LSN, i)
+		}
+	}
+	return nil
+}
+
+// mergeBackupWAL 把增量备份中的 WAL 记录按顺序合并到 path,跳过已经包含在之前备份中的记录
+// 加密的记录原样复制,不需要密钥
+func mergeBackupWAL(path string, dirs []string, manifests []*BackupManifest) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, DBFilePerm)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	records := newRecordWriter(writer, WALFileName, nil)
+	lsn := manifests[0].LSN
+	for i := 1; i < len(dirs) && err == nil; i++ {
+		err = scanRecords(filepath.Join(dirs[i], WALFileName), WALFileName, fileConfig{raw: true}, decodeWALFileRecord, func(rec *FileRecord) error {
+			if rec.Err != nil {
+				return &CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: rec.Err}
+			}
+			if rec.LSN <= lsn {
+				return nil
+			}
+			_, err := records.writeStored(rec.KeyID, rec.stored)
+			return err
+		})
+		lsn = manifests[i].LSN
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copyBackupFile 复制一个文件并 fsync
+func copyBackupFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, DBFilePerm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// replaceDatabaseDir 用 newDir 替换 dbDir,原来的目录先被重命名,替换成功后才删除
+func replaceDatabaseDir(dbDir, newDir string) error {
+	old := filepath.Clean(dbDir) + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(dbDir, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(newDir, dbDir); err != nil {
+		os.Rename(old, dbDir)
+		return err
+	}
+	return os.RemoveAll(old)
+}
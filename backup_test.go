@@ -0,0 +1,182 @@
+package jsonDB
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	db.LogLevelOff()
+
+	for _, id := range []string{"1", "2", "3"} {
+		db.Insert(map[string]interface{}{"id": id, "age": 20})
+	}
+	db.CreateIndex("age")
+	users, err := db.CreateCollection("users", "name")
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	users.Insert(map[string]interface{}{"name": "alice", "expires": time.Now().Add(time.Hour)})
+	users.CreateIndex("expires", IndexTTL(0))
+
+	var full bytes.Buffer
+	manifest, err := db.Backup(context.Background(), &full)
+	if err != nil {
+		t.Fatalf("Full backup failed: %v", err)
+	}
+	if manifest.Incremental || manifest.Documents != 4 || len(manifest.Indexes) != 2 {
+		t.Errorf("Unexpected full backup manifest: %+v", manifest)
+	}
+
+	// 增量备份只包含全量备份之后的写入
+	db.Update("1", map[string]interface{}{"age": 30})
+	db.Delete("2")
+	orders, _ := db.CreateCollection("orders", "id")
+	orders.Insert(map[string]interface{}{"id": "o1"})
+	var incr1 bytes.Buffer
+	m1, err := db.Backup(context.Background(), &incr1, BackupSince(manifest.LSN))
+	// 更新、删除、创建集合和插入各一条记录
+	if err != nil || !m1.Incremental || m1.WALRecords != 4 {
+		t.Fatalf("Unexpected incremental backup: %+v %v", m1, err)
+	}
+	db.Insert(map[string]interface{}{"id": "4"})
+	dir := filepath.Join(t.TempDir(), "incr2")
+	m2, err := db.BackupToDir(context.Background(), dir, BackupSince(m1.LSN))
+	if err != nil || m2.WALRecords != 1 {
+		t.Fatalf("Unexpected incremental backup: %+v %v", m2, err)
+	}
+	if _, err := db.BackupToDir(context.Background(), dir); err == nil {
+		t.Error("Expected error for a non-empty backup directory")
+	}
+
+	// 恢复全量备份和增量备份
+	target := filepath.Join(t.TempDir(), "restored")
+	restored, err := Restore(target, bytes.NewReader(full.Bytes()), bytes.NewReader(incr1.Bytes()))
+	if err != nil || restored.LSN != m1.LSN {
+		t.Fatalf("Restore failed: %+v %v", restored, err)
+	}
+	if _, err := RestoreFromDir(target+"2", dir); !errors.Is(err, ErrInvalidBackup) {
+		t.Errorf("Expected ErrInvalidBackup for an incremental backup without a base, got %v", err)
+	}
+	fullDir, incr1Dir := filepath.Join(t.TempDir(), "full"), filepath.Join(t.TempDir(), "incr1")
+	if err := extractBackup(bytes.NewReader(full.Bytes()), fullDir); err != nil {
+		t.Fatalf("Failed to extract backup: %v", err)
+	}
+	if err := extractBackup(bytes.NewReader(incr1.Bytes()), incr1Dir); err != nil {
+		t.Fatalf("Failed to extract backup: %v", err)
+	}
+	if _, err := RestoreFromDir(target, fullDir, dir); !errors.Is(err, ErrInvalidBackup) {
+		t.Errorf("Expected ErrInvalidBackup for a gap in the backup chain, got %v", err)
+	}
+	if _, err := RestoreFromDir(target, fullDir, incr1Dir, dir); err != nil {
+		t.Errorf("Expected to restore over the same directory, got %v", err)
+	}
+	if _, err := RestoreFromDir(target, fullDir, filepath.Join(t.TempDir(), "missing")); !errors.Is(err, ErrInvalidBackup) {
+		t.Errorf("Expected ErrInvalidBackup for a missing backup, got %v", err)
+	}
+	if _, err := Restore(target, bytes.NewReader(full.Bytes()), bytes.NewReader(incr1.Bytes()), bytes.NewReader(nil)); err == nil {
+		t.Error("Expected error for an empty backup")
+	}
+
+	// 校验和不匹配的备份不会替换已有的数据库
+	corrupted := append([]byte(nil), full.Bytes()...)
+	corrupted[bytes.Index(corrupted, []byte("alice"))] = 'A'
+	if _, err := Restore(target, bytes.NewReader(corrupted)); !errors.Is(err, ErrInvalidBackup) {
+		t.Errorf("Expected ErrInvalidBackup for a corrupted backup, got %v", err)
+	}
+
+	copyDB, err := NewDatabase("id", target, runtime.NumCPU())
+	if err != nil {
+		t.Fatalf("Failed to open restored database: %v", err)
+	}
+	defer copyDB.Close()
+	copyDB.LogLevelOff()
+	if err := restored.CreateIndexes(copyDB); err != nil {
+		t.Fatalf("Failed to create indexes: %v", err)
+	}
+
+	if doc, ok := copyDB.Get("1"); !ok || !jsonEqual(doc["age"], 30) {
+		t.Errorf("Expected updated document, got %v", doc)
+	}
+	if _, ok := copyDB.Get("2"); ok {
+		t.Error("Expected deleted document to stay deleted")
+	}
+	if _, ok := copyDB.Get("4"); !ok {
+		t.Error("Expected document from the second incremental backup")
+	}
+	copyOrders, err := copyDB.Collection("orders")
+	if err != nil || copyOrders.Count() != 1 {
+		t.Errorf("Expected restored collection, got %v", err)
+	}
+	copyUsers, _ := copyDB.Collection("users")
+	if indexes := copyUsers.Indexes(); len(indexes) != 1 || indexes[0] != "expires" {
+		t.Errorf("Expected restored TTL index, got %v", indexes)
+	}
+	if indexes := copyDB.Indexes(); len(indexes) != 1 || indexes[0] != "age" {
+		t.Errorf("Expected restored index, got %v", indexes)
+	}
+}
+
+func TestBackupConsistencyAndCancel(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { cleanupTestDB(t, db) }()
+	db.LogLevelOff()
+
+	for i := 0; i < 100; i++ {
+		db.Insert(generateTestDocument(i))
+	}
+
+	// 备份期间的写入不会出现在备份中
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 100; i < 200; i++ {
+			db.Insert(generateTestDocument(i))
+		}
+	}()
+	var buf bytes.Buffer
+	manifest, err := db.Backup(context.Background(), &buf)
+	<-done
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	target := filepath.Join(t.TempDir(), "restored")
+	if _, err := Restore(target, &buf); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	restored, err := NewDatabase("id", target, runtime.NumCPU())
+	if err != nil {
+		t.Fatalf("Failed to open restored database: %v", err)
+	}
+	if restored.Count() != manifest.Documents {
+		t.Errorf("Expected %d documents, got %d", manifest.Documents, restored.Count())
+	}
+	restored.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.Backup(ctx, &bytes.Buffer{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	// 重新打开数据库会执行检查点,之前的备份不能再作为增量备份的基准
+	db.Insert(generateTestDocument(200))
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db, err = NewDatabase("id", testDBPath, runtime.NumCPU())
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	db.LogLevelOff()
+	if _, err := db.Backup(context.Background(), &bytes.Buffer{}, BackupSince(manifest.LSN)); !errors.Is(err, ErrBackupBaseUnavailable) {
+		t.Errorf("Expected ErrBackupBaseUnavailable, got %v", err)
+	}
+}
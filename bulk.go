@@ -0,0 +1,246 @@
+// bulk.go
+
+// 介绍:
+// 本文件实现了基于 Filter 的批量写操作: UpdateMany、DeleteMany、FindOneAndUpdate 和 FindOneAndDelete。
+// 这些方法先通过 forEachMatch(会尽量利用索引)找到候选文档,然后重新检查 Filter 并执行修改,
+// 如果文档在两步之间被并发修改为不再匹配,它不会被修改,也不会被计入匹配数量。
+//
+// UpdateMany 和 DeleteMany 在一个事务中执行,所有修改作为一条批量 WAL 记录提交:
+// 要么全部生效,要么(某个文档的修改失败时)全部不生效。与并发写入冲突时整个操作会重试。
+// FindOneAndUpdate 和 FindOneAndDelete 只修改一个文档,在持有文档写锁的情况下完成匹配和修改。
+
+package jsonDB
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// bulkConflictRetries 是 UpdateMany 和 DeleteMany 因为并发写入冲突而重试的最大次数
+const bulkConflictRetries = 3
+
+// UpdateResult 描述批量更新的结果
+type UpdateResult struct {
+	MatchedCount  int64 // 满足 Filter 的文档数量
+	ModifiedCount int64 // 实际被修改的文档数量(更新后内容不变的文档不计入)
+}
+
+// DeleteResult 描述批量删除的结果
+type DeleteResult struct {
+	DeletedCount int64 // 被删除的文档数量
+}
+
+// ReturnDocument 指定 FindOneAndUpdate 返回更新前还是更新后的文档
+type ReturnDocument int
+
+const (
+	// ReturnDocumentBefore 返回更新前的文档
+	ReturnDocumentBefore ReturnDocument = iota
+	// ReturnDocumentAfter 返回更新后的文档
+	ReturnDocumentAfter
+)
+
+// UpdateMany 方法将 updates 应用到所有满足 filter 的文档上
+//
+// 介绍:
+// UpdateMany 的更新语义与 Update 相同,即将 updates 中的字段浅层覆盖到文档上。
+// 如果某个文档更新后内容没有变化,则不会被写入,也不计入 ModifiedCount。
+// 所有文档的更新在一个事务中提交,其他读者不会看到只更新了一部分文档的状态。
+//
+// 参数:
+// - filter: 要更新的文档需要满足的条件
+// - updates: 包含要更新的字段和其新值的映射
+//
+// 返回值:
+// - UpdateResult: 匹配和修改的文档数量,出错时为零值
+// - error: 如果某个文档更新失败(例如被钩子或模式拒绝),返回该错误,此时没有任何文档被修改
+func (db *Database) UpdateMany(filter Filter, updates map[string]interface{}) (UpdateResult, error) {
+	start := time.Now()
+	db.log(LogLevelDebug, "Attempting to update many documents", slog.Any("filter", filter), slog.Any("updates", updates))
+
+	var result UpdateResult
+	err := db.runBulkTx("update_many", func(tx *Tx) error {
+		result = UpdateResult{}
+		for _, id := range db.matchingIDs(filter) {
+			current, ok := tx.Get(id)
+			if !ok || !matchFilter(current, filter) {
+				continue
+			}
+			result.MatchedCount++
+			if !changesDocument(current, updates) {
+				continue
+			}
+			if err := tx.Update(id, updates); err != nil {
+				return err
+			}
+			result.ModifiedCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return UpdateResult{}, err
+	}
+
+	db.log(LogLevelInfo, "UpdateMany completed", slog.String("op", "update_many"), slog.Int64("count", result.MatchedCount), slog.Int64("modified", result.ModifiedCount), slog.Duration("duration", time.Since(start)))
+	return result, nil
+}
+
+// DeleteMany 方法删除所有满足 filter 的文档
+//
+// 参数:
+// - filter: 要删除的文档需要满足的条件
+//
+// 返回值:
+// - DeleteResult: 被删除的文档数量,出错时为零值
+// - error: 如果某个文档删除失败(例如被钩子拒绝),返回该错误,此时没有任何文档被删除
+func (db *Database) DeleteMany(filter Filter) (DeleteResult, error) {
+	start := time.Now()
+	db.log(LogLevelDebug, "Attempting to delete many documents", slog.Any("filter", filter))
+
+	var result DeleteResult
+	err := db.runBulkTx("delete_many", func(tx *Tx) error {
+		result = DeleteResult{}
+		for _, id := range db.matchingIDs(filter) {
+			current, ok := tx.Get(id)
+			if !ok || !matchFilter(current, filter) {
+				continue
+			}
+			if err := tx.Delete(id); err != nil {
+				return err
+			}
+			result.DeletedCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return DeleteResult{}, err
+	}
+
+	db.log(LogLevelInfo, "DeleteMany completed", slog.String("op", "delete_many"), slog.Int64("count", result.DeletedCount), slog.Duration("duration", time.Since(start)))
+	return result, nil
+}
+
+// FindOneAndUpdate 方法原子地找到一个满足 filter 的文档并更新它
+//
+// 参数:
+// - filter: 要更新的文档需要满足的条件
+// - updates: 包含要更新的字段和其新值的映射
+// - returnDoc: 返回更新前(ReturnDocumentBefore)还是更新后(ReturnDocumentAfter)的文档
+//
+// 返回值:
+// - map[string]interface{}: 根据 returnDoc 返回的文档副本
+// - error: 没有文档匹配时返回 ErrNoDocuments,更新失败时返回相应的错误
+func (db *Database) FindOneAndUpdate(filter Filter, updates map[string]interface{}, returnDoc ReturnDocument) (map[string]interface{}, error) {
+	db.log(LogLevelDebug, "Attempting to find one and update", slog.Any("filter", filter))
+
+	for _, id := range db.matchingIDs(filter) {
+		var before, after map[string]interface{}
+		err := db.modifyDocument(id, func(current map[string]interface{}) (map[string]interface{}, error) {
+			if !matchFilter(current, filter) {
+				return nil, errFilterMismatch
+			}
+			before = current
+			after = mergeUpdates(current, updates)
+			if !changesDocument(current, updates) {
+				return nil, errDocumentUnchanged
+			}
+			return after, nil
+		})
+		if errors.Is(err, errFilterMismatch) || errors.Is(err, ErrDocumentNotFound) {
+			// 文档在匹配之后被并发修改或删除,尝试下一个候选文档
+			continue
+		}
+		if err != nil && !errors.Is(err, errDocumentUnchanged) {
+			return nil, err
+		}
+
+		if returnDoc == ReturnDocumentAfter {
+			return copyDocumentData(after), nil
+		}
+		return copyDocumentData(before), nil
+	}
+	return nil, ErrNoDocuments
+}
+
+// FindOneAndDelete 方法原子地找到一个满足 filter 的文档并删除它
+//
+// 返回值:
+// - map[string]interface{}: 被删除的文档
+// - error: 没有文档匹配时返回 ErrNoDocuments,删除失败时返回相应的错误
+func (db *Database) FindOneAndDelete(filter Filter) (map[string]interface{}, error) {
+	db.log(LogLevelDebug, "Attempting to find one and delete", slog.Any("filter", filter))
+
+	for _, id := range db.matchingIDs(filter) {
+		deletedDoc, deleted, err := db.deleteDocument(id, filterCheck(filter))
+		if err != nil && !errors.Is(err, errFilterMismatch) {
+			return nil, err
+		}
+		if deleted {
+			return copyDocumentData(deletedDoc), nil
+		}
+	}
+	return nil, ErrNoDocuments
+}
+
+// runBulkTx 在一个事务中执行批量操作 fn,与并发写入冲突时重试
+// 事务读过的文档(包括匹配之后没有被修改的文档)在提交前被其他人修改时视为冲突
+func (db *Database) runBulkTx(op string, fn func(tx *Tx) error) error {
+	for attempt := 0; ; attempt++ {
+		err := db.RunInTx(fn)
+		if errors.Is(err, ErrConflict) && attempt < bulkConflictRetries {
+			db.log(LogLevelWarn, "Bulk operation conflicted with a concurrent write, retrying", slog.String("op", op), slog.Int("attempt", attempt), slog.Any("error", err))
+			continue
+		}
+		if err != nil {
+			db.log(LogLevelError, "Bulk operation failed", slog.String("op", op), slog.Any("error", err))
+		}
+		return err
+	}
+}
+
+// errFilterMismatch 表示文档在加锁后已不再满足 Filter
+var errFilterMismatch = errors.New("document no longer matches the filter")
+
+// filterCheck 返回供 deleteDocument 使用的检查函数,文档不满足 filter 时返回 errFilterMismatch
+func filterCheck(filter Filter) func(current map[string]interface{}) error {
+	return func(current map[string]interface{}) error {
+		if !matchFilter(current, filter) {
+			return errFilterMismatch
+		}
+		return nil
+	}
+}
+
+// matchingIDs 返回当前满足 filter 的所有文档ID
+func (db *Database) matchingIDs(filter Filter) []string {
+	var ids []string
+	db.forEachMatch(filter, func(id string, _ *Document) bool {
+		ids = append(ids, id)
+		return true
+	})
+	return ids
+}
+
+// changesDocument 判断将 updates 应用到 current 上是否会改变文档内容
+func changesDocument(current, updates map[string]interface{}) bool {
+	for k, v := range updates {
+		old, ok := current[k]
+		if !ok || !jsonEqual(old, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyDocumentData 返回文档数据的浅拷贝
+func copyDocumentData(doc map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		return nil
+	}
+	docCopy := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		docCopy[k] = v
+	}
+	return docCopy
+}
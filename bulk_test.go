@@ -0,0 +1,104 @@
+package jsonDB
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFilterBulkOperations(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	for i := 0; i < 10; i++ {
+		doc := map[string]interface{}{"id": string(rune('a' + i)), "age": 20 + i*5, "active": true}
+		if _, err := db.Insert(doc); err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+	}
+	db.CreateIndex("age")
+
+	if got := len(db.Find(Filter{"age": map[string]interface{}{"$gte": 40}})); got != 6 {
+		t.Errorf("Find returned %d documents, expected 6", got)
+	}
+
+	result, err := db.UpdateMany(Filter{"age": map[string]interface{}{"$gt": 50}}, map[string]interface{}{"active": false})
+	if err != nil || result.MatchedCount != 3 || result.ModifiedCount != 3 {
+		t.Errorf("UpdateMany returned %+v, %v; expected 3 matched and modified", result, err)
+	}
+	// 再次执行相同的更新,文档匹配但不会被修改
+	result, _ = db.UpdateMany(Filter{"age": map[string]interface{}{"$gt": 50}}, map[string]interface{}{"active": false})
+	if result.MatchedCount != 3 || result.ModifiedCount != 0 {
+		t.Errorf("Repeated UpdateMany returned %+v, expected 3 matched and 0 modified", result)
+	}
+
+	before, err := db.FindOneAndUpdate(Filter{"id": "a"}, map[string]interface{}{"age": 21}, ReturnDocumentBefore)
+	if err != nil || before["age"] != 20 {
+		t.Errorf("FindOneAndUpdate returned %v, %v; expected pre-image with age 20", before, err)
+	}
+	if _, err := db.FindOneAndUpdate(Filter{"id": "missing"}, nil, ReturnDocumentAfter); !errors.Is(err, ErrNoDocuments) {
+		t.Errorf("Expected ErrNoDocuments, got %v", err)
+	}
+
+	deleted, err := db.DeleteMany(Filter{"active": false})
+	if err != nil || deleted.DeletedCount != 3 {
+		t.Errorf("DeleteMany returned %+v, %v; expected 3 deleted", deleted, err)
+	}
+	if doc, err := db.FindOneAndDelete(Filter{"age": 21}); err != nil || doc["id"] != "a" {
+		t.Errorf("FindOneAndDelete returned %v, %v", doc, err)
+	}
+	if count := db.Count(); count != 6 {
+		t.Errorf("Expected 6 documents, got %d", count)
+	}
+}
+
+func TestBulkOperationsAreAtomic(t *testing.T) {
+	db, err := NewDatabase("id", t.TempDir(), runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	for _, id := range []string{"a", "b", "c"} {
+		db.Insert(map[string]interface{}{"id": id, "active": true})
+	}
+
+	// 所有匹配的文档作为一条批量 WAL 记录提交
+	lsn := atomic.LoadUint64(&db.lsn)
+	result, err := db.UpdateMany(Filter{"active": true}, map[string]interface{}{"level": 1})
+	if err != nil || result.ModifiedCount != 3 {
+		t.Fatalf("UpdateMany returned %+v, %v; expected 3 modified", result, err)
+	}
+	if written := atomic.LoadUint64(&db.lsn) - lsn; written != 1 {
+		t.Errorf("Expected one WAL record for UpdateMany, got %d", written)
+	}
+
+	// 某个文档被拒绝时,其他文档也不会被修改或删除
+	errLocked := errors.New("locked")
+	db.BeforeUpdate(func(id string, oldDoc, newDoc map[string]interface{}) error {
+		if id == "b" {
+			return errLocked
+		}
+		return nil
+	})
+	db.BeforeDelete(func(id string, doc map[string]interface{}) error {
+		if id == "c" {
+			return errLocked
+		}
+		return nil
+	})
+	result, err = db.UpdateMany(Filter{"active": true}, map[string]interface{}{"level": 2})
+	if !errors.Is(err, errLocked) || result != (UpdateResult{}) {
+		t.Errorf("UpdateMany returned %+v, %v; expected the hook error and an empty result", result, err)
+	}
+	if found := db.Find(Filter{"level": 2}); len(found) != 0 {
+		t.Errorf("Expected no partial update, got %v", found)
+	}
+	deleted, err := db.DeleteMany(Filter{"active": true})
+	if !errors.Is(err, errLocked) || deleted.DeletedCount != 0 {
+		t.Errorf("DeleteMany returned %+v, %v; expected the hook error and no deletions", deleted, err)
+	}
+	if count := db.Count(); count != 3 {
+		t.Errorf("Expected no partial delete, got %d documents", count)
+	}
+}
@@ -0,0 +1,450 @@
+// client.go
+
+// 介绍:
+// client 包是 jsondb-server 的 Go 客户端,Client 实现了 jsonDB.Store 接口,
+// 只依赖 jsonDB.Store 的代码可以在嵌入式数据库和远程服务器之间切换而不需要修改。
+//
+// Client 通过一个共享的 http.Client 复用连接,可以安全地被多个 goroutine 同时使用。
+// 幂等的调用(读取、查询、删除、创建索引)在网络错误和 502/503/504 响应时按照指数退避自动重试,
+// 插入和更新不会被重试,以免重复执行。
+//
+// 服务器返回的错误被转换为 *Error,它可以通过 errors.Is 和 errors.As 与 jsonDB 包中的错误比较,
+// 例如 errors.Is(err, jsonDB.ErrDocumentNotFound)、errors.As(err, &validationErr),
+// 因此错误处理代码在两种模式下也是一样的。
+//
+// 与嵌入式数据库不同的是,文档经过 JSON 编码传输,读取到的数字总是 float64,时间总是字符串。
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AlexiaAshford/jsonDB"
+	"github.com/AlexiaAshford/jsonDB/server"
+)
+
+// 客户端的默认配置
+const (
+	DefaultTimeout      = 30 * time.Second
+	DefaultMaxIdleConns = 16
+	DefaultMaxRetries   = 3
+	DefaultRetryBackoff = 100 * time.Millisecond
+)
+
+// Client 是 jsondb-server 上一个集合的客户端
+type Client struct {
+	baseURL    string
+	collection string // URL 中的集合名称
+	httpClient *http.Client
+
+	timeout      time.Duration
+	maxIdleConns int
+	maxRetries   int
+	retryBackoff time.Duration
+	onError      func(op string, err error)
+}
+
+// 确保 *Client 实现了 jsonDB.Store
+var _ jsonDB.Store = (*Client)(nil)
+
+// Option 是 New 的可选配置项
+type Option func(*Client)
+
+// WithHTTPClient 使用调用方提供的 http.Client,WithTimeout 和 WithMaxIdleConns 不再生效
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTimeout 设置每个 HTTP 请求的超时时间,默认为 DefaultTimeout
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithMaxIdleConns 设置连接池中保持的空闲连接数量,默认为 DefaultMaxIdleConns
+func WithMaxIdleConns(n int) Option {
+	return func(c *Client) {
+		c.maxIdleConns = n
+	}
+}
+
+// WithRetries 设置幂等调用的最大重试次数和第一次重试前的等待时间,之后每次重试的等待时间加倍
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.retryBackoff = backoff
+	}
+}
+
+// WithErrorHandler 设置没有错误返回值的方法(例如 Get 和 Query)调用失败时的处理函数
+// 默认使用标准库的 log 包记录错误
+func WithErrorHandler(fn func(op string, err error)) Option {
+	return func(c *Client) {
+		c.onError = fn
+	}
+}
+
+// New 创建一个连接到 baseURL 上的 jsondb-server 的客户端,返回的客户端操作默认集合
+//
+// 参数:
+// - baseURL: 服务器的地址,例如 http://localhost:8080
+// - opts: 可选配置项
+//
+// 返回值:
+// - *Client: 新创建的客户端
+// - error: baseURL 无法解析时返回错误
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid server URL '%s'", baseURL)
+	}
+
+	c := &Client{
+		baseURL:      strings.TrimRight(baseURL, "/"),
+		collection:   server.DefaultCollection,
+		timeout:      DefaultTimeout,
+		maxIdleConns: DefaultMaxIdleConns,
+		maxRetries:   DefaultMaxRetries,
+		retryBackoff: DefaultRetryBackoff,
+		onError: func(op string, err error) {
+			log.Printf("jsonDB client: %s failed: %v", op, err)
+		},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConns = c.maxIdleConns
+		transport.MaxIdleConnsPerHost = c.maxIdleConns
+		c.httpClient = &http.Client{Transport: transport, Timeout: c.timeout}
+	}
+	return c, nil
+}
+
+// Collection 返回操作指定集合的客户端,空字符串表示默认集合
+// 返回的客户端与 c 共享连接池,集合不存在时后续的操作返回 jsonDB.ErrCollectionNotFound
+func (c *Client) Collection(name string) *Client {
+	coll := *c
+	coll.collection = name
+	if name == "" {
+		coll.collection = server.DefaultCollection
+	}
+	return &coll
+}
+
+// Close 关闭连接池中的空闲连接
+func (c *Client) Close() {
+	c.httpClient.CloseIdleConnections()
+}
+
+// Insert 插入一个文档,docData 可以是 map[string]interface{} 或 JSON 字符串
+// 插入不会被重试,网络错误时文档可能已经被插入
+func (c *Client) Insert(docData interface{}) (string, error) {
+	var body []byte
+	switch v := docData.(type) {
+	case map[string]interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode document: %w", err)
+		}
+		body = data
+	case string:
+		if !json.Valid([]byte(v)) {
+			return "", errors.New("failed to parse JSON string: invalid JSON")
+		}
+		body = []byte(v)
+	default:
+		return "", fmt.Errorf("unsupported input type: %T", docData)
+	}
+
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err := c.do(http.MethodPost, c.docsPath(), body, false, "", &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// Update 使用 updates 更新文档,更新不会被重试
+func (c *Client) Update(id string, updates map[string]interface{}) error {
+	body, err := json.Marshal(updates)
+	if err != nil {
+		return fmt.Errorf("failed to encode updates: %w", err)
+	}
+	return c.do(http.MethodPatch, c.docPath(id), body, false, id, nil)
+}
+
+// Delete 删除文档,文档不存在时不返回错误
+func (c *Client) Delete(id string) error {
+	return c.do(http.MethodDelete, c.docPath(id), nil, true, id, nil)
+}
+
+// Get 读取文档,文档不存在或者请求失败时第二个返回值为 false
+func (c *Client) Get(id string) (map[string]interface{}, bool) {
+	var doc map[string]interface{}
+	err := c.do(http.MethodGet, c.docPath(id), nil, true, id, &doc)
+	if err != nil {
+		if !errors.Is(err, jsonDB.ErrDocumentNotFound) {
+			c.onError("Get", err)
+		}
+		return nil, false
+	}
+	return doc, true
+}
+
+// GetAll 返回集合中的所有文档
+func (c *Client) GetAll() []map[string]interface{} {
+	return c.documents("GetAll", http.MethodGet, c.docsPath(), nil)
+}
+
+// Query 返回 field 字段等于 value 的文档
+func (c *Client) Query(field string, value interface{}) []map[string]interface{} {
+	return c.documents("Query", http.MethodPost, c.path("query"), map[string]interface{}{
+		"field": field,
+		"value": value,
+	})
+}
+
+// RangeQuery 返回 field 字段在 [min, max] 范围内的文档
+func (c *Client) RangeQuery(field string, min, max interface{}) []map[string]interface{} {
+	return c.documents("RangeQuery", http.MethodPost, c.path("query", "range"), map[string]interface{}{
+		"field": field,
+		"min":   min,
+		"max":   max,
+	})
+}
+
+// FuzzyQuery 返回 field 字段匹配 pattern 的文档
+func (c *Client) FuzzyQuery(field, pattern string) []map[string]interface{} {
+	return c.documents("FuzzyQuery", http.MethodPost, c.path("query", "fuzzy"), map[string]interface{}{
+		"field":   field,
+		"pattern": pattern,
+	})
+}
+
+// QueryComposite 返回多个字段分别等于 values 的文档
+func (c *Client) QueryComposite(fields []string, values []interface{}) []map[string]interface{} {
+	return c.documents("QueryComposite", http.MethodPost, c.path("query", "composite"), map[string]interface{}{
+		"fields": fields,
+		"values": values,
+	})
+}
+
+// Find 返回满足 filter 的文档
+func (c *Client) Find(filter jsonDB.Filter) []map[string]interface{} {
+	return c.documents("Find", http.MethodPost, c.path("find"), map[string]interface{}{
+		"filter": filter,
+	})
+}
+
+// CreateIndex 在服务器上为 field 字段创建索引,支持 jsonDB.IndexTTL 选项
+func (c *Client) CreateIndex(field string, opts ...jsonDB.IndexOption) {
+	req := map[string]interface{}{"field": field}
+	index := &jsonDB.Index{}
+	for _, opt := range opts {
+		opt(index)
+	}
+	if expireAfter, ok := index.TTL(); ok {
+		req["ttlSeconds"] = expireAfter.Seconds()
+	}
+	c.createIndex(req)
+}
+
+// CreateCompositeIndex 在服务器上为多个字段创建复合索引
+func (c *Client) CreateCompositeIndex(fields []string) {
+	c.createIndex(map[string]interface{}{"fields": fields})
+}
+
+// Indexes 返回集合上所有索引的名称,请求失败时返回 nil
+func (c *Client) Indexes() []string {
+	var resp struct {
+		Indexes []string `json:"indexes"`
+	}
+	if err := c.do(http.MethodGet, c.path("indexes"), nil, true, "", &resp); err != nil {
+		c.onError("Indexes", err)
+		return nil
+	}
+	return resp.Indexes
+}
+
+// DropIndex 删除指定名称的索引,索引不存在时返回的错误满足 errors.Is(err, jsonDB.ErrIndexNotFound)
+func (c *Client) DropIndex(name string) error {
+	return c.do(http.MethodDelete, c.path("indexes", name), nil, true, "", nil)
+}
+
+// ListCollections 返回服务器上所有命名集合的名称,不包括默认集合,请求失败时返回 nil
+func (c *Client) ListCollections() []string {
+	var resp struct {
+		Collections []string `json:"collections"`
+	}
+	if err := c.do(http.MethodGet, "/collections", nil, true, "", &resp); err != nil {
+		c.onError("ListCollections", err)
+		return nil
+	}
+	var names []string
+	for _, name := range resp.Collections {
+		if name != server.DefaultCollection {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Count 返回集合中的文档数量,请求失败时返回 0
+func (c *Client) Count() int64 {
+	var resp struct {
+		Count int64 `json:"count"`
+	}
+	if err := c.do(http.MethodGet, c.path("count"), nil, true, "", &resp); err != nil {
+		c.onError("Count", err)
+		return 0
+	}
+	return resp.Count
+}
+
+// createIndex 发送创建索引的请求,服务器忽略已经存在的索引,因此请求可以重试
+func (c *Client) createIndex(req map[string]interface{}) {
+	body, err := json.Marshal(req)
+	if err == nil {
+		err = c.do(http.MethodPost, c.path("indexes"), body, true, "", nil)
+	}
+	if err != nil {
+		c.onError("CreateIndex", err)
+	}
+}
+
+// documents 发送一个返回文档列表的只读请求
+func (c *Client) documents(op, method, path string, req interface{}) []map[string]interface{} {
+	var body []byte
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			c.onError(op, fmt.Errorf("failed to encode request: %w", err))
+			return nil
+		}
+		body = data
+	}
+
+	var resp struct {
+		Documents []map[string]interface{} `json:"documents"`
+	}
+	if err := c.do(method, path, body, true, "", &resp); err != nil {
+		c.onError(op, err)
+		return nil
+	}
+	return resp.Documents
+}
+
+// do 发送一个请求并把响应体解码到 out
+// idempotent 为 true 时,网络错误和 502/503/504 响应会按照指数退避重试
+// id 是请求操作的文档ID,用于构造 *jsonDB.DocumentNotFoundError 等错误
+func (c *Client) do(method, path string, body []byte, idempotent bool, id string, out interface{}) error {
+	attempts := 1
+	if idempotent {
+		attempts += c.maxRetries
+	}
+
+	var lastErr error
+	backoff := c.retryBackoff
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		retry, err := c.roundTrip(method, path, body, id, out)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+	}
+	return lastErr
+}
+
+// roundTrip 发送一次请求,返回的 retry 表示失败是否可以重试
+func (c *Client) roundTrip(method, path string, body []byte, id string, out interface{}) (retry bool, err error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return false, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			retry = true
+		}
+		return retry, c.decodeError(resp, id)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return false, fmt.Errorf("failed to decode response of %s %s: %w", method, path, err)
+	}
+	return false, nil
+}
+
+// decodeError 把服务器的错误响应转换为 *Error
+func (c *Client) decodeError(resp *http.Response, id string) error {
+	var body server.ErrorResponse
+	data, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(data, &body); err != nil || body.Code == "" {
+		// 不是 jsondb-server 返回的错误,例如代理返回的错误页面
+		return &Error{StatusCode: resp.StatusCode, Message: fmt.Sprintf("unexpected response: %s", resp.Status)}
+	}
+	return newError(resp.StatusCode, body, c.collection, id)
+}
+
+// path 返回集合下的一个路径,每一段都会被转义
+func (c *Client) path(segments ...string) string {
+	var b strings.Builder
+	b.WriteString("/collections/")
+	b.WriteString(url.PathEscape(c.collection))
+	for _, segment := range segments {
+		b.WriteByte('/')
+		b.WriteString(url.PathEscape(segment))
+	}
+	return b.String()
+}
+
+// docsPath 返回集合中文档列表的路径
+func (c *Client) docsPath() string {
+	return c.path("docs")
+}
+
+// docPath 返回集合中一个文档的路径
+func (c *Client) docPath(id string) string {
+	return c.path("docs", id)
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AlexiaAshford/jsonDB"
+	"github.com/AlexiaAshford/jsonDB/server"
+)
+
+// newTestServer 启动一个服务于临时数据库的 jsondb-server
+func newTestServer(t *testing.T) (*jsonDB.Database, *httptest.Server) {
+	t.Helper()
+	db, err := jsonDB.NewDatabase("id", t.TempDir(), 2)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.LogLevelOff()
+	ts := httptest.NewServer(server.New(db))
+	t.Cleanup(func() {
+		ts.Close()
+		db.Close()
+	})
+	return db, ts
+}
+
+// exerciseStore 只通过 jsonDB.Store 接口操作数据库,嵌入式和远程模式的结果应当一致
+func exerciseStore(t *testing.T, store jsonDB.Store) {
+	store.CreateIndex("age")
+	store.CreateIndex("name")
+	for _, doc := range []map[string]interface{}{
+		{"id": "1", "name": "Alice", "age": 30},
+		{"id": "2", "name": "Bob", "age": 25},
+		{"id": "3", "name": "Anna", "age": 35},
+	} {
+		if _, err := store.Insert(doc); err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+	}
+	if _, err := store.Insert(map[string]interface{}{"id": "1"}); !errors.Is(err, jsonDB.ErrDocumentExists) {
+		t.Errorf("Expected ErrDocumentExists, got %v", err)
+	}
+	var notFound *jsonDB.DocumentNotFoundError
+	if err := store.Update("404", map[string]interface{}{"age": 1}); !errors.As(err, &notFound) || notFound.ID != "404" {
+		t.Errorf("Expected *DocumentNotFoundError, got %v", err)
+	}
+
+	if err := store.Update("1", map[string]interface{}{"age": 31}); err != nil {
+		t.Fatalf("Failed to update document: %v", err)
+	}
+	if doc, ok := store.Get("1"); !ok || doc["name"] != "Alice" {
+		t.Errorf("Unexpected document: %v", doc)
+	}
+	if _, ok := store.Get("404"); ok {
+		t.Error("Expected missing document")
+	}
+	if results := store.Query("age", 31); len(results) != 1 || results[0]["id"] != "1" {
+		t.Errorf("Unexpected query result: %v", results)
+	}
+	if results := store.RangeQuery("age", 30, 40); len(results) != 2 {
+		t.Errorf("Expected 2 documents in range, got %v", results)
+	}
+	if results := store.FuzzyQuery("name", "A*"); len(results) != 2 {
+		t.Errorf("Expected 2 documents matching A*, got %v", results)
+	}
+	if err := store.Delete("2"); err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+	if count := store.Count(); count != 2 {
+		t.Errorf("Expected 2 documents, got %d", count)
+	}
+	if docs := store.GetAll(); len(docs) != 2 {
+		t.Errorf("Expected 2 documents, got %v", docs)
+	}
+}
+
+func TestStore(t *testing.T) {
+	t.Run("embedded", func(t *testing.T) {
+		db, err := jsonDB.NewDatabase("id", t.TempDir(), 2)
+		if err != nil {
+			t.Fatalf("Failed to create database: %v", err)
+		}
+		defer db.Close()
+		db.LogLevelOff()
+		exerciseStore(t, db)
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		_, ts := newTestServer(t)
+		c, err := New(ts.URL, WithErrorHandler(func(op string, err error) {
+			t.Errorf("%s failed: %v", op, err)
+		}))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		defer c.Close()
+		exerciseStore(t, c)
+	})
+}
+
+func TestClientErrors(t *testing.T) {
+	db, ts := newTestServer(t)
+	schema, err := jsonDB.CompileSchema(`{"type": "object", "required": ["name"]}`)
+	if err != nil {
+		t.Fatalf("Failed to compile schema: %v", err)
+	}
+	if _, err := db.CreateCollection("people", "id", jsonDB.WithSchema(schema)); err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	_, err = c.Collection("people").Insert(map[string]interface{}{"id": "1"})
+	var validation *jsonDB.ValidationError
+	if !errors.As(err, &validation) || len(validation.Violations) == 0 {
+		t.Errorf("Expected *ValidationError with violations, got %v", err)
+	}
+	var clientErr *Error
+	if !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected *Error with status 422, got %v", err)
+	}
+	if _, err := c.Insert(map[string]interface{}{"name": "x"}); !errors.Is(err, jsonDB.ErrMissingPrimaryKey) {
+		t.Errorf("Expected ErrMissingPrimaryKey, got %v", err)
+	}
+	if err := c.Collection("missing").Delete("1"); !errors.Is(err, jsonDB.ErrCollectionNotFound) {
+		t.Errorf("Expected ErrCollectionNotFound, got %v", err)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	db, _ := newTestServer(t)
+	if _, err := db.Insert(map[string]interface{}{"id": "1"}); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+
+	// 代理在每个请求的前两次尝试时返回 503
+	var requests atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		server.New(db).ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	c, err := New(proxy.URL, WithRetries(3, time.Millisecond), WithErrorHandler(func(op string, err error) {}))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if _, ok := c.Get("1"); !ok {
+		t.Error("Expected Get to succeed after retries")
+	}
+	if requests.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", requests.Load())
+	}
+
+	// 插入不是幂等的,不会被重试
+	requests.Store(0)
+	if _, err := c.Insert(map[string]interface{}{"id": "2"}); err == nil {
+		t.Error("Expected Insert to fail without retry")
+	}
+	if requests.Load() != 1 {
+		t.Errorf("Expected a single attempt for Insert, got %d", requests.Load())
+	}
+}
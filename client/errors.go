@@ -0,0 +1,70 @@
+// errors.go
+
+// 介绍:
+// 本文件把 jsondb-server 返回的错误响应转换为可以与 jsonDB 包中的错误比较的 *Error。
+
+package client
+
+import (
+	"fmt"
+
+	"github.com/AlexiaAshford/jsonDB"
+	"github.com/AlexiaAshford/jsonDB/server"
+)
+
+// Error 是服务器返回的错误
+// Unwrap 返回对应的 jsonDB 错误,因此可以使用 errors.Is(err, jsonDB.ErrDocumentNotFound)
+// 或者 errors.As(err, &validationErr) 等方式判断错误类型
+type Error struct {
+	StatusCode int    // HTTP 状态码
+	Code       string // 服务器返回的错误类型,见 server.ErrorResponse
+	Message    string // 服务器返回的错误信息
+
+	err error // 对应的 jsonDB 错误,没有对应的错误时为 nil
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("jsondb-server: %s (status %d)", e.Message, e.StatusCode)
+	}
+	return fmt.Sprintf("jsondb-server: %s (status %d, code %s)", e.Message, e.StatusCode, e.Code)
+}
+
+// Unwrap 返回对应的 jsonDB 错误
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// newError 根据错误响应构造 *Error
+// collection 和 id 是请求操作的集合和文档,用于构造带有名称的 jsonDB 错误
+func newError(status int, resp server.ErrorResponse, collection, id string) *Error {
+	e := &Error{StatusCode: status, Code: resp.Code, Message: resp.Error}
+	if collection == server.DefaultCollection {
+		collection = ""
+	}
+
+	switch resp.Code {
+	case server.CodeDocumentNotFound:
+		e.err = jsonDB.ErrDocumentNotFound
+		if id != "" {
+			e.err = &jsonDB.DocumentNotFoundError{ID: id}
+		}
+	case server.CodeDocumentExists:
+		e.err = jsonDB.ErrDocumentExists
+	case server.CodeCollectionNotFound:
+		e.err = &jsonDB.CollectionNotFoundError{Name: collection}
+	case server.CodeCollectionExists:
+		e.err = jsonDB.ErrCollectionExists
+	case server.CodeConflict:
+		e.err = jsonDB.ErrConflict
+	case server.CodeMissingPrimaryKey:
+		e.err = jsonDB.ErrMissingPrimaryKey
+	case server.CodeIndexNotFound:
+		e.err = jsonDB.ErrIndexNotFound
+	case server.CodeReadOnly:
+		e.err = jsonDB.ErrReadOnly
+	case server.CodeValidationFailed:
+		e.err = &jsonDB.ValidationError{ID: id, Violations: resp.Violations}
+	}
+	return e
+}
@@ -0,0 +1,321 @@
+// main.go
+
+// 介绍:
+// jsondb-admin 是在数据库没有被打开时检查和修复数据库文件的离线工具。
+//
+// 用法:
+//
+//	jsondb-admin dump [-raw=false] [-o dump.jsonl] ./my_db   # 以 JSON Lines 格式输出每一条记录
+//	jsondb-admin verify ./my_db                               # 检查每一条记录能否读取和解码
+//	jsondb-admin stats [-json] ./my_db                        # 统计有效和无效的记录以及每个集合占用的空间
+//	jsondb-admin compact ./my_db                              # 只保留每个文档的最新版本并清空 WAL
+//	jsondb-admin restore [-i dump.jsonl] ./new_db             # 根据 dump 的输出重建数据库
+//	jsondb-admin reencrypt -keys keys.json ./my_db            # 使用密钥文件中的当前密钥重写数据文件和 WAL
+//
+// 加密的数据库需要通过 -keys 指定 JSON 格式的密钥文件(格式见 jsonDB.ReadKeyFile),
+// compact 和 restore 写入的新文件同样使用密钥文件中的当前密钥加密。
+// 所有命令都以流的方式处理文件,不会把数据库加载到内存中。
+// 运行期间不能有其他进程打开同一个数据库目录。
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/AlexiaAshford/jsonDB"
+)
+
+// command 是一个子命令
+type command struct {
+	name  string
+	usage string
+	run   func(flags *flag.FlagSet, args []string, stdin io.Reader, stdout io.Writer) error
+}
+
+var commands = []command{
+	{name: "dump", usage: "以 JSON Lines 格式输出元数据和每一条记录", run: runDump},
+	{name: "verify", usage: "检查每一条记录的长度前缀并解码记录内容", run: runVerify},
+	{name: "stats", usage: "统计有效和无效的记录、每个集合占用的空间和 WAL 的长度", run: runStats},
+	{name: "compact", usage: "离线压缩数据文件并清空 WAL", run: runCompact},
+	{name: "restore", usage: "根据 dump 的输出在新的目录中重建数据库", run: runRestore},
+	{name: "reencrypt", usage: "使用密钥文件中的当前密钥重写数据文件和 WAL", run: runReencrypt},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run 执行 args 指定的子命令并返回进程的退出码
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+		flags.SetOutput(stderr)
+		if err := cmd.run(flags, args[1:], stdin, stdout); err != nil {
+			if err != flag.ErrHelp {
+				fmt.Fprintf(stderr, "jsondb-admin %s: %v\n", cmd.name, err)
+			}
+			return 1
+		}
+		return 0
+	}
+	usage(stderr)
+	return 2
+}
+
+// usage 输出所有子命令的说明
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: jsondb-admin <command> [flags] <dir>")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-9s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintln(w, "\nRun 'jsondb-admin <command> -h' for the flags of a command.")
+}
+
+// parseDir 解析子命令的参数,返回唯一的位置参数数据库目录
+func parseDir(flags *flag.FlagSet, args []string) (string, error) {
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: jsondb-admin %s [flags] <dir>\n", flags.Name())
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return "", err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return "", fmt.Errorf("expected exactly one database directory")
+	}
+	return flags.Arg(0), nil
+}
+
+// keyFileFlag 注册 -keys 参数
+func keyFileFlag(flags *flag.FlagSet) *string {
+	return flags.String("keys", "", "JSON 格式的密钥文件,读写加密的数据库时需要")
+}
+
+// fileOptions 根据 -keys 参数返回读写数据库文件的配置项
+func fileOptions(keyFile string) ([]jsonDB.FileOption, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+	keys, err := jsonDB.ReadKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return []jsonDB.FileOption{jsonDB.FileKeys(keys)}, nil
+}
+
+// runDump 输出数据库文件中的每一条记录
+func runDump(flags *flag.FlagSet, args []string, _ io.Reader, stdout io.Writer) error {
+	raw := flags.Bool("raw", true, "输出记录的原始数据,restore 据此精确地还原记录")
+	output := flags.String("o", "", "输出文件,默认为标准输出")
+	keyFile := keyFileFlag(flags)
+	dir, err := parseDir(flags, args)
+	if err != nil {
+		return err
+	}
+	opts, err := fileOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	out := stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	writer := bufio.NewWriter(out)
+	if err := jsonDB.DumpFiles(dir, writer, *raw, opts...); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// runVerify 检查数据库文件,发现问题时返回错误
+func runVerify(flags *flag.FlagSet, args []string, _ io.Reader, stdout io.Writer) error {
+	keyFile := keyFileFlag(flags)
+	dir, err := parseDir(flags, args)
+	if err != nil {
+		return err
+	}
+	opts, err := fileOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+	report, err := jsonDB.VerifyFiles(dir, opts...)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "%s: %d records\n", jsonDB.DataFileName, report.DataRecords)
+	fmt.Fprintf(stdout, "%s: %d records\n", jsonDB.WALFileName, report.WALRecords)
+	for _, problem := range report.Problems {
+		switch {
+		case problem.Torn && problem.File == jsonDB.WALFileName:
+			fmt.Fprintf(stdout, "%v (discarded when the database is opened)\n", problem)
+		case problem.Torn:
+			fmt.Fprintf(stdout, "%v (run compact to discard it)\n", problem)
+		default:
+			fmt.Fprintln(stdout, problem)
+		}
+	}
+	if !report.OK() {
+		return fmt.Errorf("found %d problems", len(report.Problems))
+	}
+	fmt.Fprintln(stdout, "OK")
+	return nil
+}
+
+// runStats 输出数据库文件的统计信息
+func runStats(flags *flag.FlagSet, args []string, _ io.Reader, stdout io.Writer) error {
+	asJSON := flags.Bool("json", false, "以 JSON 格式输出")
+	keyFile := keyFileFlag(flags)
+	dir, err := parseDir(flags, args)
+	if err != nil {
+		return err
+	}
+	opts, err := fileOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+	stats, err := jsonDB.AnalyzeFiles(dir, opts...)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+
+	fmt.Fprintf(stdout, "%s: %d bytes, %d records (%d live, %d dead)\n",
+		jsonDB.DataFileName, stats.DataFileSize, stats.DataRecords, stats.LiveRecords, stats.DeadRecords)
+	fmt.Fprintf(stdout, "%s: %d bytes, %d records, %d operations",
+		jsonDB.WALFileName, stats.WALFileSize, stats.WALRecords, stats.WALOperations)
+	if stats.WALRecords > 0 {
+		fmt.Fprintf(stdout, ", LSN %d-%d", stats.FirstLSN, stats.LastLSN)
+	}
+	fmt.Fprintln(stdout)
+	if stats.TornBytes > 0 {
+		fmt.Fprintf(stdout, "torn records: %d bytes\n", stats.TornBytes)
+	}
+
+	fmt.Fprintln(stdout)
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTION\tID\tDOCUMENTS\tLIVE BYTES\tDEAD RECORDS\tDEAD BYTES\tWAL OPS\tWAL BYTES")
+	for _, cs := range stats.Collections {
+		name := cs.Name
+		switch {
+		case cs.Dropped:
+			name = "(dropped)"
+		case cs.ID == 0:
+			name = "_default"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n",
+			name, cs.ID, cs.Documents, cs.LiveBytes, cs.DeadRecords, cs.DeadBytes, cs.WALOperations, cs.WALBytes)
+	}
+	return tw.Flush()
+}
+
+// runCompact 离线压缩数据库
+func runCompact(flags *flag.FlagSet, args []string, _ io.Reader, stdout io.Writer) error {
+	keyFile := keyFileFlag(flags)
+	dir, err := parseDir(flags, args)
+	if err != nil {
+		return err
+	}
+	opts, err := fileOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+	result, err := jsonDB.CompactFiles(dir, opts...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "compacted %d documents: %s %d -> %d bytes, %s %d -> 0 bytes, dropped %d dead records\n",
+		result.Documents, jsonDB.DataFileName, result.DataSizeBefore, result.DataSizeAfter,
+		jsonDB.WALFileName, result.WALSizeBefore, result.DroppedRecords)
+	if result.DiscardedTorn > 0 {
+		fmt.Fprintf(stdout, "discarded %d bytes of torn records\n", result.DiscardedTorn)
+	}
+	return nil
+}
+
+// runRestore 根据转储重建数据库
+func runRestore(flags *flag.FlagSet, args []string, stdin io.Reader, stdout io.Writer) error {
+	input := flags.String("i", "", "dump 的输出文件,默认为标准输入")
+	keyFile := keyFileFlag(flags)
+	dir, err := parseDir(flags, args)
+	if err != nil {
+		return err
+	}
+	opts, err := fileOptions(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	in := stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	result, err := jsonDB.RestoreDump(bufio.NewReader(in), dir, opts...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "restored %d data records and %d WAL records into %s\n", result.DataRecords, result.WALRecords, dir)
+	if result.Skipped > 0 {
+		fmt.Fprintf(stdout, "skipped %d corrupt records\n", result.Skipped)
+	}
+	return nil
+}
+
+// runReencrypt 使用密钥文件中的当前密钥重写数据文件和 WAL
+func runReencrypt(flags *flag.FlagSet, args []string, _ io.Reader, stdout io.Writer) error {
+	keyFile := keyFileFlag(flags)
+	dir, err := parseDir(flags, args)
+	if err != nil {
+		return err
+	}
+	if *keyFile == "" {
+		return fmt.Errorf("-keys is required")
+	}
+	keys, err := jsonDB.ReadKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	result, err := jsonDB.ReencryptFiles(dir, keys)
+	if err != nil {
+		return err
+	}
+	target := fmt.Sprintf("key %q", result.KeyID)
+	if result.KeyID == "" {
+		target = "plaintext"
+	}
+	fmt.Fprintf(stdout, "rewrote %d data records and %d WAL records with %s\n", result.DataRecords, result.WALRecords, target)
+	if result.DiscardedTorn > 0 {
+		fmt.Fprintf(stdout, "discarded %d bytes of torn records\n", result.DiscardedTorn)
+	}
+	return nil
+}
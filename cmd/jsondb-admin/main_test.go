@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AlexiaAshford/jsonDB"
+)
+
+// runCommand 运行一个子命令并返回退出码和标准输出
+func runCommand(t *testing.T, stdin string, args ...string) (int, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	if code != 0 {
+		t.Logf("jsondb-admin %s: %s", strings.Join(args, " "), stderr.String())
+	}
+	return code, stdout.String()
+}
+
+func TestAdminCommands(t *testing.T) {
+	dir := t.TempDir()
+	db, err := jsonDB.NewDatabase("id", dir, 2, jsonDB.WithLogLevel(jsonDB.LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Insert(map[string]interface{}{"id": "1", "name": "Alice"})
+	db.Insert(map[string]interface{}{"id": "2", "name": "Bob"})
+	db.Update("1", map[string]interface{}{"name": "Alicia"})
+	db.Delete("2")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	if code, out := runCommand(t, "", "verify", dir); code != 0 || !strings.Contains(out, "OK") {
+		t.Errorf("Unexpected verify output: %d %s", code, out)
+	}
+	if code, out := runCommand(t, "", "stats", dir); code != 0 || !strings.Contains(out, "_default") || !strings.Contains(out, "4 operations") {
+		t.Errorf("Unexpected stats output: %d %s", code, out)
+	}
+
+	code, dump := runCommand(t, "", "dump", dir)
+	if code != 0 || !strings.Contains(dump, `"op":"DELETE"`) {
+		t.Fatalf("Unexpected dump output: %d %s", code, dump)
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	if code, out := runCommand(t, dump, "restore", restored); code != 0 || !strings.Contains(out, "4 WAL records") {
+		t.Errorf("Unexpected restore output: %d %s", code, out)
+	}
+
+	if code, out := runCommand(t, "", "compact", restored); code != 0 || !strings.Contains(out, "compacted 1 documents") {
+		t.Errorf("Unexpected compact output: %d %s", code, out)
+	}
+	db, err = jsonDB.NewDatabase("id", restored, 2, jsonDB.WithLogLevel(jsonDB.LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to open restored database: %v", err)
+	}
+	defer db.Close()
+	if doc, ok := db.Get("1"); !ok || doc["name"] != "Alicia" || db.Count() != 1 {
+		t.Errorf("Unexpected restored document: %v", doc)
+	}
+
+	if code, _ := runCommand(t, "", "verify"); code != 1 {
+		t.Errorf("Expected exit code 1 without a directory, got %d", code)
+	}
+	if code, _ := runCommand(t, "", "nope", dir); code != 2 {
+		t.Errorf("Expected exit code 2 for an unknown command, got %d", code)
+	}
+}
+
+func TestAdminReencrypt(t *testing.T) {
+	dir := t.TempDir()
+	k1, k2 := bytes.Repeat([]byte{1}, jsonDB.EncryptionKeySize), bytes.Repeat([]byte{2}, jsonDB.EncryptionKeySize)
+	db, err := jsonDB.NewDatabase("id", dir, 2, jsonDB.WithLogLevel(jsonDB.LogLevelOff),
+		jsonDB.WithEncryption(&jsonDB.StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": k1}}))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Insert(map[string]interface{}{"id": "1", "name": "Alice"})
+	db.Close()
+
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	data, _ := json.Marshal(jsonDB.StaticKeys{Current: "k2", Keys: map[string][]byte{"k1": k1, "k2": k2}})
+	if err := os.WriteFile(keyFile, data, 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	if code, _ := runCommand(t, "", "verify", dir); code != 1 {
+		t.Errorf("Expected verify to fail without keys, got %d", code)
+	}
+	if code, out := runCommand(t, "", "reencrypt", "-keys", keyFile, dir); code != 0 || !strings.Contains(out, `key "k2"`) {
+		t.Errorf("Unexpected reencrypt output: %d %s", code, out)
+	}
+	if code, out := runCommand(t, "", "verify", "-keys", keyFile, dir); code != 0 || !strings.Contains(out, "OK") {
+		t.Errorf("Unexpected verify output: %d %s", code, out)
+	}
+	if code, _ := runCommand(t, "", "reencrypt", dir); code != 1 {
+		t.Errorf("Expected reencrypt to require -keys, got %d", code)
+	}
+}
@@ -0,0 +1,124 @@
+// main.go
+
+// 介绍:
+// jsondb-server 把一个 jsonDB 数据库目录通过 HTTP/JSON 接口暴露给其他语言编写的服务。
+//
+// 用法:
+//
+//	jsondb-server -addr :8080 -path ./my_db -pk id
+//
+// 复制: leader 通过 -replication-addr 接受 follower 的连接,follower 通过 -follow 指定 leader 的复制地址,
+// 作为只读副本运行,POST /replication/promote 把它提升为可以写入的数据库:
+//
+//	jsondb-server -addr :8080 -path ./leader -replication-addr :7070
+//	jsondb-server -addr :8081 -path ./follower -follow localhost:7070
+//
+// 加密: -keys 指定 JSON 格式的密钥文件(格式见 jsonDB.ReadKeyFile),数据文件和 WAL 使用其中的当前密钥加密:
+//
+//	jsondb-server -addr :8080 -path ./my_db -keys /etc/jsondb/keys.json
+//
+// 收到 SIGINT 或 SIGTERM 后,服务器停止接受新的连接,等待正在处理的请求完成,然后关闭数据库。
+// 接口的说明见 server 包和 README。
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/AlexiaAshford/jsonDB"
+	"github.com/AlexiaAshford/jsonDB/server"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "HTTP 监听地址")
+	path := flag.String("path", "./my_db", "数据库目录")
+	primaryKey := flag.String("pk", "id", "默认集合的主键字段名")
+	workers := flag.Int("workers", runtime.NumCPU(), "写入数据文件的工作协程数量")
+	logLevel := flag.Int("log-level", int(jsonDB.LogLevelWarn), "数据库日志级别,0 关闭,4 为调试")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "关闭时等待正在处理的请求的最长时间")
+	replicationAddr := flag.String("replication-addr", "", "接受 follower 连接的地址,为空时不提供复制")
+	follow := flag.String("follow", "", "leader 的复制地址,设置时作为只读的 follower 运行")
+	keyFile := flag.String("keys", "", "JSON 格式的密钥文件,设置时加密数据文件和 WAL")
+	flag.Parse()
+
+	opts := []jsonDB.Option{jsonDB.WithLogLevel(jsonDB.LogLevel(*logLevel))}
+	if *keyFile != "" {
+		keys, err := jsonDB.ReadKeyFile(*keyFile)
+		if err != nil {
+			log.Fatalf("Failed to read key file: %v", err)
+		}
+		opts = append(opts, jsonDB.WithEncryption(keys))
+	}
+	db, err := jsonDB.NewDatabase(*primaryKey, *path, *workers, opts...)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+
+	if *follow != "" {
+		if err := db.Follow(*follow); err != nil {
+			log.Fatalf("Failed to follow %s: %v", *follow, err)
+		}
+		log.Printf("Following leader at %s", *follow)
+	}
+	var replicationLn net.Listener
+	if *replicationAddr != "" {
+		if replicationLn, err = net.Listen("tcp", *replicationAddr); err != nil {
+			log.Fatalf("Failed to listen for followers: %v", err)
+		}
+		go func() {
+			log.Printf("Serving replication on %s", *replicationAddr)
+			if err := db.ServeReplication(replicationLn); err != nil {
+				log.Printf("Replication error: %v", err)
+			}
+		}()
+	}
+
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           server.New(db),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("jsondb-server listening on %s, database: %s", *addr, *path)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	exitCode := 0
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Server error: %v", err)
+			exitCode = 1
+		}
+	case <-ctx.Done():
+		log.Printf("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down gracefully: %v", err)
+		}
+		cancel()
+	}
+
+	if replicationLn != nil {
+		replicationLn.Close()
+	}
+	if err := db.Close(); err != nil {
+		log.Fatalf("Failed to close database: %v", err)
+	}
+	os.Exit(exitCode)
+}
@@ -0,0 +1,217 @@
+// lineedit.go
+
+// 介绍:
+// 本文件实现了 jsondb shell 使用的一个简单的行编辑器,支持光标移动、历史记录和 Tab 补全。
+//
+// 行编辑器要求终端处于原始模式(见 makeRaw),从输入中逐个读取按键:
+// 左右方向键、Ctrl-A 和 Ctrl-E 移动光标,上下方向键浏览历史记录,Tab 补全当前单词,
+// Ctrl-U 和 Ctrl-K 删除光标之前和之后的内容,Ctrl-C 放弃当前行,空行上的 Ctrl-D 表示输入结束。
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// errInterrupted 表示用户按下 Ctrl-C 放弃了当前行
+var errInterrupted = errors.New("interrupted")
+
+// completer 返回 line 中光标之前最后一个单词的起始位置和所有候选补全
+type completer func(line string) (start int, candidates []string)
+
+// lineEditor 是一个带有历史记录和 Tab 补全的行编辑器
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	history  []string
+	complete completer
+}
+
+// newLineEditor 创建一个从 in 读取按键、向 out 输出的行编辑器
+func newLineEditor(in io.Reader, out io.Writer, complete completer) *lineEditor {
+	return &lineEditor{in: bufio.NewReader(in), out: out, complete: complete}
+}
+
+// addHistory 把一行添加到历史记录,与上一条相同的行不会被重复添加
+func (e *lineEditor) addHistory(line string) {
+	if line == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+}
+
+// readLine 显示 prompt 并读取一行
+// 用户按下 Ctrl-C 时返回 errInterrupted,在空行上按下 Ctrl-D 或者输入结束时返回 io.EOF
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	var buf []rune
+	pos := 0
+	histIdx := len(e.history)
+	var pending []rune // 浏览历史记录前正在编辑的内容
+
+	refresh := func() {
+		fmt.Fprintf(e.out, "\r\x1b[K%s%s", prompt, string(buf))
+		if back := len(buf) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	setLine := func(line []rune) {
+		buf = append([]rune(nil), line...)
+		pos = len(buf)
+	}
+	refresh()
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(buf) > 0 {
+				fmt.Fprint(e.out, "\n")
+				return string(buf), nil
+			}
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\n")
+			return string(buf), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				fmt.Fprint(e.out, "\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(buf)
+		case 11: // Ctrl-K
+			buf = buf[:pos]
+		case 21: // Ctrl-U
+			buf = append([]rune(nil), buf[pos:]...)
+			pos = 0
+		case '\t':
+			buf, pos = e.completeWord(buf, pos)
+		case 27: // 转义序列,例如方向键
+			switch e.readEscape() {
+			case 'A':
+				if histIdx > 0 {
+					if histIdx == len(e.history) {
+						pending = append([]rune(nil), buf...)
+					}
+					histIdx--
+					setLine([]rune(e.history[histIdx]))
+				}
+			case 'B':
+				if histIdx < len(e.history) {
+					histIdx++
+					if histIdx == len(e.history) {
+						setLine(pending)
+					} else {
+						setLine([]rune(e.history[histIdx]))
+					}
+				}
+			case 'C':
+				if pos < len(buf) {
+					pos++
+				}
+			case 'D':
+				if pos > 0 {
+					pos--
+				}
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(buf)
+			case '~': // Delete
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if r >= 32 {
+				buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+				pos++
+			}
+		}
+		refresh()
+	}
+}
+
+// readEscape 读取 ESC 之后的转义序列,返回序列的最后一个字符
+// 不认识的序列返回 0
+func (e *lineEditor) readEscape() rune {
+	r, _, err := e.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return 0
+	}
+	for {
+		r, _, err = e.in.ReadRune()
+		if err != nil {
+			return 0
+		}
+		// 参数字节是数字和分号,例如 Delete 键是 ESC [ 3 ~
+		if (r < '0' || r > '9') && r != ';' {
+			return r
+		}
+	}
+}
+
+// completeWord 补全光标之前的单词
+// 只有一个候选时直接补全并添加空格;有多个候选时补全到它们的公共前缀,
+// 无法继续补全时列出所有候选
+func (e *lineEditor) completeWord(buf []rune, pos int) ([]rune, int) {
+	if e.complete == nil {
+		return buf, pos
+	}
+	line := string(buf[:pos])
+	start, candidates := e.complete(line)
+	if len(candidates) == 0 {
+		return buf, pos
+	}
+	word := line[start:]
+
+	replacement := candidates[0] + " "
+	if len(candidates) > 1 {
+		replacement = commonPrefix(candidates)
+		if replacement == word {
+			sort.Strings(candidates)
+			fmt.Fprintf(e.out, "\n%s\n", strings.Join(candidates, "  "))
+			return buf, pos
+		}
+	}
+
+	newLine := []rune(line[:start] + replacement)
+	rest := buf[pos:]
+	return append(newLine, rest...), len(newLine)
+}
+
+// commonPrefix 返回所有字符串的最长公共前缀
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	// 按字节比较可能截断多字节字符
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix
+}
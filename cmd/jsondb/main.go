@@ -0,0 +1,212 @@
+// main.go
+
+// 介绍:
+// jsondb 是一个用于查看和编辑 jsonDB 数据库的交互式 shell。
+//
+// 用法:
+//
+//	jsondb ./my_db                          # 直接打开数据库目录
+//	jsondb -server http://localhost:8080    # 连接到 jsondb-server
+//
+// 在终端中运行时支持历史记录(保存在 -history 指定的文件中)和 Tab 补全;
+// 标准输入不是终端时逐行读取并执行命令,可以用于脚本。输入 help 查看所有命令。
+// 直接打开数据库目录时,同一时间不能有其他进程打开同一个目录。
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/AlexiaAshford/jsonDB"
+	"github.com/AlexiaAshford/jsonDB/client"
+)
+
+// maxHistory 是历史记录文件中保存的最大行数
+const maxHistory = 1000
+
+func main() {
+	path := flag.String("path", "", "数据库目录,也可以作为第一个参数传入")
+	serverURL := flag.String("server", "", "jsondb-server 的地址,设置后连接到服务器而不是打开数据库目录")
+	primaryKey := flag.String("pk", "id", "默认集合的主键字段名")
+	logLevel := flag.Int("log-level", int(jsonDB.LogLevelOff), "数据库日志级别,0 关闭,4 为调试")
+	historyFile := flag.String("history", defaultHistoryFile(), "历史记录文件,为空时不保存历史记录")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: jsondb [flags] [dir]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *path == "" {
+		*path = flag.Arg(0)
+	}
+	if (*path == "") == (*serverURL == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := openAndRun(*path, *serverURL, *primaryKey, jsonDB.LogLevel(*logLevel), *historyFile); err != nil {
+		fmt.Fprintf(os.Stderr, "jsondb: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// openAndRun 打开数据库目录或者连接到服务器,然后运行 shell 直到退出
+func openAndRun(path, serverURL, primaryKey string, logLevel jsonDB.LogLevel, historyFile string) error {
+	var open func(name string) (backend, error)
+	if serverURL != "" {
+		c, err := client.New(serverURL, client.WithErrorHandler(func(op string, err error) {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", op, err)
+		}))
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		open = remoteCollection(c)
+	} else {
+		db, err := jsonDB.NewDatabase(primaryKey, path, runtime.NumCPU(), jsonDB.WithLogLevel(logLevel))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		open = func(name string) (backend, error) {
+			return db.Collection(name)
+		}
+	}
+
+	sh, err := newShell(open, os.Stdout)
+	if err != nil {
+		return err
+	}
+	return run(sh, historyFile)
+}
+
+// remoteCollection 返回打开服务器上集合的函数,集合不存在时返回 *jsonDB.CollectionNotFoundError
+func remoteCollection(c *client.Client) func(name string) (backend, error) {
+	return func(name string) (backend, error) {
+		if name == "" {
+			return c, nil
+		}
+		for _, existing := range c.ListCollections() {
+			if existing == name {
+				return c.Collection(name), nil
+			}
+		}
+		return nil, &jsonDB.CollectionNotFoundError{Name: name}
+	}
+}
+
+// run 读取并执行命令,直到输入结束或者执行 exit
+func run(sh *shell, historyFile string) error {
+	fd := int(os.Stdin.Fd())
+	if !isTerminal(fd) {
+		// 标准输入不是终端,逐行执行命令
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(make([]byte, 64*1024), 16<<20)
+		for scanner.Scan() {
+			if !sh.executeAndReport(scanner.Text()) {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+
+	restore, err := makeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if restore != nil {
+			restore()
+		}
+	}()
+
+	editor := newLineEditor(os.Stdin, os.Stdout, sh.complete)
+	editor.history = loadHistory(historyFile)
+	defer saveHistory(historyFile, editor)
+
+	fmt.Fprintln(os.Stdout, "jsonDB shell, type help for a list of commands")
+	for {
+		line, err := editor.readLine(sh.prompt())
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		editor.addHistory(strings.TrimSpace(line))
+
+		// 命令的输出使用普通的终端模式,保证换行和 Ctrl-C 的行为正常
+		restore()
+		ok := sh.executeAndReport(line)
+		if restore, err = makeRaw(fd); err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	}
+}
+
+// executeAndReport 执行一行命令并输出错误,返回 false 表示应当退出
+func (sh *shell) executeAndReport(line string) bool {
+	switch strings.TrimSpace(line) {
+	case "exit", "quit":
+		return false
+	}
+	if err := sh.execute(line); err != nil {
+		fmt.Fprintf(sh.out, "error: %v\n", err)
+	}
+	return true
+}
+
+// defaultHistoryFile 返回默认的历史记录文件路径
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".jsondb_history")
+}
+
+// loadHistory 从文件中读取历史记录
+func loadHistory(path string) []string {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var history []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			history = append(history, line)
+		}
+	}
+	return history
+}
+
+// saveHistory 把最近的 maxHistory 条历史记录写入文件
+func saveHistory(path string, editor *lineEditor) {
+	if path == "" {
+		return
+	}
+	history := editor.history
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(history, "\n")+"\n"), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save history: %v\n", err)
+	}
+}
@@ -0,0 +1,476 @@
+// shell.go
+
+// 介绍:
+// 本文件实现了 jsondb shell 的命令。shell 通过 backend 接口操作嵌入式数据库或者远程的 jsondb-server,
+// 两种模式下的命令和输出完全相同。
+//
+// 文档和查询结果以缩进的 JSON 输出。shell 会记住输出过的文档中出现的字段名(嵌套字段使用 a.b 的形式),
+// 用于 Tab 补全查询和索引命令中的字段参数;切换集合时会从集合中最多 fieldSampleSize 个文档学习字段名。
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AlexiaAshford/jsonDB"
+)
+
+// fieldSampleSize 是切换集合时用于学习字段名的最大文档数量
+const fieldSampleSize = 1000
+
+// defaultCollectionName 是 shell 中表示默认集合的名称
+const defaultCollectionName = "_default"
+
+// backend 是 shell 操作的集合,*jsonDB.Database 和 *client.Client 都实现了它
+type backend interface {
+	jsonDB.Store
+	Find(filter jsonDB.Filter) []map[string]interface{}
+	CreateCompositeIndex(fields []string)
+	Indexes() []string
+	DropIndex(name string) error
+	ListCollections() []string
+}
+
+// argKind 描述命令参数的补全方式
+type argKind int
+
+const (
+	argNone       argKind = iota // 不补全
+	argField                     // 字段名
+	argCollection                // 集合名
+)
+
+// command 描述一个 shell 命令
+type command struct {
+	name  string
+	usage string
+	help  string
+	// maxArgs 是参数的最大数量,最后一个参数包含行的剩余部分,因此可以包含空格(例如 JSON)
+	maxArgs int
+	args    []argKind
+	run     func(sh *shell, args []string) error
+}
+
+// shell 保存一个交互式会话的状态
+type shell struct {
+	store      backend
+	collection string
+	open       func(name string) (backend, error)
+	out        io.Writer
+	fields     map[string]struct{}
+	commands   []*command
+}
+
+// newShell 创建一个操作默认集合的 shell
+// open 根据集合名称打开一个集合,空字符串表示默认集合
+func newShell(open func(name string) (backend, error), out io.Writer) (*shell, error) {
+	sh := &shell{open: open, out: out, fields: make(map[string]struct{})}
+	sh.commands = shellCommands()
+	if err := sh.use(""); err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
+
+// shellCommands 返回所有 shell 命令
+func shellCommands() []*command {
+	return []*command{
+		{name: "get", usage: "get <id>", help: "读取一个文档", maxArgs: 1, run: (*shell).cmdGet},
+		{name: "insert", usage: "insert <json>", help: "插入一个文档", maxArgs: 1, run: (*shell).cmdInsert},
+		{name: "update", usage: "update <id> <json>", help: "用 JSON 对象中的字段更新文档", maxArgs: 2, run: (*shell).cmdUpdate},
+		{name: "delete", usage: "delete <id>", help: "删除一个文档", maxArgs: 1, run: (*shell).cmdDelete},
+		{name: "all", usage: "all", help: "列出所有文档", run: (*shell).cmdAll},
+		{name: "query", usage: "query <field> <value>", help: "查询字段等于 value 的文档", maxArgs: 2, args: []argKind{argField}, run: (*shell).cmdQuery},
+		{name: "range", usage: "range <field> <min> <max>", help: "查询字段在 [min, max] 范围内的文档", maxArgs: 3, args: []argKind{argField}, run: (*shell).cmdRange},
+		{name: "fuzzy", usage: "fuzzy <field> <pattern>", help: "模糊查询,例如 fuzzy name A*", maxArgs: 2, args: []argKind{argField}, run: (*shell).cmdFuzzy},
+		{name: "find", usage: "find <filter>", help: "使用 Filter 查询,例如 find {\"age\": {\"$gte\": 18}}", maxArgs: 1, run: (*shell).cmdFind},
+		{name: "count", usage: "count", help: "显示文档数量", run: (*shell).cmdCount},
+		{name: "index", usage: "index create <field> [ttl] | index create <f1,f2,...> | index list | index drop <name>", help: "创建、列出和删除索引,ttl 是 TTL 索引的过期时长,例如 1h", maxArgs: 3, run: (*shell).cmdIndex},
+		{name: "collections", usage: "collections", help: "列出所有集合", run: (*shell).cmdCollections},
+		{name: "use", usage: "use <collection>", help: "切换到另一个集合", maxArgs: 1, args: []argKind{argCollection}, run: (*shell).cmdUse},
+		{name: "stats", usage: "stats", help: "显示所有集合的文档数量和索引", run: (*shell).cmdStats},
+		{name: "help", usage: "help", help: "显示帮助", run: (*shell).cmdHelp},
+	}
+}
+
+// prompt 返回当前集合的提示符
+func (sh *shell) prompt() string {
+	return sh.collectionName() + "> "
+}
+
+// collectionName 返回当前集合在 shell 中显示的名称
+func (sh *shell) collectionName() string {
+	if sh.collection == "" {
+		return defaultCollectionName
+	}
+	return sh.collection
+}
+
+// execute 执行一行命令
+func (sh *shell) execute(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	name, rest, _ := strings.Cut(line, " ")
+	cmd := sh.lookup(name)
+	if cmd == nil {
+		return fmt.Errorf("unknown command '%s', type help for a list of commands", name)
+	}
+	args := splitArgs(rest, cmd.maxArgs)
+	if len(args) > cmd.maxArgs {
+		return fmt.Errorf("usage: %s", cmd.usage)
+	}
+	return cmd.run(sh, args)
+}
+
+// lookup 返回指定名称的命令
+func (sh *shell) lookup(name string) *command {
+	for _, cmd := range sh.commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// use 切换到指定的集合,并从集合中学习字段名
+func (sh *shell) use(name string) error {
+	if name == defaultCollectionName {
+		name = ""
+	}
+	store, err := sh.open(name)
+	if err != nil {
+		return err
+	}
+	sh.store = store
+	sh.collection = name
+	sh.fields = make(map[string]struct{})
+	for i, doc := range store.GetAll() {
+		if i >= fieldSampleSize {
+			break
+		}
+		sh.learnFields(doc, "")
+	}
+	return nil
+}
+
+func (sh *shell) cmdGet(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: get <id>")
+	}
+	doc, ok := sh.store.Get(args[0])
+	if !ok {
+		return &jsonDB.DocumentNotFoundError{ID: args[0]}
+	}
+	return sh.printDocument(doc)
+}
+
+func (sh *shell) cmdInsert(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: insert <json>")
+	}
+	doc, err := parseObject(args[0])
+	if err != nil {
+		return err
+	}
+	id, err := sh.store.Insert(doc)
+	if err != nil {
+		return err
+	}
+	sh.learnFields(doc, "")
+	fmt.Fprintf(sh.out, "inserted %s\n", id)
+	return nil
+}
+
+func (sh *shell) cmdUpdate(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: update <id> <json>")
+	}
+	updates, err := parseObject(args[1])
+	if err != nil {
+		return err
+	}
+	if err := sh.store.Update(args[0], updates); err != nil {
+		return err
+	}
+	sh.learnFields(updates, "")
+	fmt.Fprintf(sh.out, "updated %s\n", args[0])
+	return nil
+}
+
+func (sh *shell) cmdDelete(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: delete <id>")
+	}
+	if err := sh.store.Delete(args[0]); err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.out, "deleted %s\n", args[0])
+	return nil
+}
+
+func (sh *shell) cmdAll(args []string) error {
+	return sh.printDocuments(sh.store.GetAll())
+}
+
+func (sh *shell) cmdQuery(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: query <field> <value>")
+	}
+	return sh.printDocuments(sh.store.Query(args[0], parseValue(args[1])))
+}
+
+func (sh *shell) cmdRange(args []string) error {
+	if len(args) != 3 {
+		return errors.New("usage: range <field> <min> <max>")
+	}
+	return sh.printDocuments(sh.store.RangeQuery(args[0], parseValue(args[1]), parseValue(args[2])))
+}
+
+func (sh *shell) cmdFuzzy(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: fuzzy <field> <pattern>")
+	}
+	return sh.printDocuments(sh.store.FuzzyQuery(args[0], args[1]))
+}
+
+func (sh *shell) cmdFind(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: find <filter>")
+	}
+	filter, err := parseObject(args[0])
+	if err != nil {
+		return err
+	}
+	return sh.printDocuments(sh.store.Find(filter))
+}
+
+func (sh *shell) cmdCount(args []string) error {
+	fmt.Fprintln(sh.out, sh.store.Count())
+	return nil
+}
+
+func (sh *shell) cmdIndex(args []string) error {
+	usage := errors.New("usage: " + sh.lookup("index").usage)
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 2 {
+			return usage
+		}
+		if fields := strings.Split(args[1], ","); len(fields) > 1 {
+			if len(args) > 2 {
+				return errors.New("composite indexes do not support ttl")
+			}
+			sh.store.CreateCompositeIndex(fields)
+		} else {
+			var opts []jsonDB.IndexOption
+			if len(args) > 2 {
+				ttl, err := time.ParseDuration(args[2])
+				if err != nil {
+					return fmt.Errorf("invalid ttl: %w", err)
+				}
+				opts = append(opts, jsonDB.IndexTTL(ttl))
+			}
+			sh.store.CreateIndex(args[1], opts...)
+		}
+		fmt.Fprintf(sh.out, "created index %s\n", args[1])
+		return nil
+	case "list":
+		for _, name := range sh.store.Indexes() {
+			fmt.Fprintln(sh.out, name)
+		}
+		return nil
+	case "drop":
+		if len(args) != 2 {
+			return usage
+		}
+		if err := sh.store.DropIndex(args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "dropped index %s\n", args[1])
+		return nil
+	}
+	return usage
+}
+
+func (sh *shell) cmdCollections(args []string) error {
+	fmt.Fprintln(sh.out, defaultCollectionName)
+	for _, name := range sh.store.ListCollections() {
+		fmt.Fprintln(sh.out, name)
+	}
+	return nil
+}
+
+func (sh *shell) cmdUse(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: use <collection>")
+	}
+	return sh.use(args[0])
+}
+
+func (sh *shell) cmdStats(args []string) error {
+	names := append([]string{defaultCollectionName}, sh.store.ListCollections()...)
+	for _, name := range names {
+		store := sh.store
+		if name != sh.collectionName() {
+			open := name
+			if open == defaultCollectionName {
+				open = ""
+			}
+			var err error
+			if store, err = sh.open(open); err != nil {
+				// 集合可能在列出之后被删除
+				continue
+			}
+		}
+		indexes := store.Indexes()
+		if len(indexes) == 0 {
+			indexes = []string{"-"}
+		}
+		fmt.Fprintf(sh.out, "%-20s documents: %-10d indexes: %s\n", name, store.Count(), strings.Join(indexes, ", "))
+	}
+	return nil
+}
+
+func (sh *shell) cmdHelp(args []string) error {
+	for _, cmd := range sh.commands {
+		fmt.Fprintf(sh.out, "  %-40s %s\n", cmd.usage, cmd.help)
+	}
+	fmt.Fprintf(sh.out, "  %-40s %s\n", "exit", "退出")
+	return nil
+}
+
+// complete 补全 line 中的最后一个单词,实现 completer
+func (sh *shell) complete(line string) (int, []string) {
+	words := strings.Fields(line)
+	start := len(line)
+	word := ""
+	if len(words) > 0 && !strings.HasSuffix(line, " ") {
+		word = words[len(words)-1]
+		start = len(line) - len(word)
+		words = words[:len(words)-1]
+	}
+
+	var options []string
+	switch {
+	case len(words) == 0:
+		for _, cmd := range sh.commands {
+			options = append(options, cmd.name)
+		}
+		options = append(options, "exit")
+	case words[0] == "index":
+		switch {
+		case len(words) == 1:
+			options = []string{"create", "list", "drop"}
+		case len(words) == 2 && words[1] == "create":
+			options = sh.fieldNames()
+		case len(words) == 2 && words[1] == "drop":
+			options = sh.store.Indexes()
+		}
+	default:
+		if cmd := sh.lookup(words[0]); cmd != nil && len(words)-1 < len(cmd.args) {
+			switch cmd.args[len(words)-1] {
+			case argField:
+				options = sh.fieldNames()
+			case argCollection:
+				options = append([]string{defaultCollectionName}, sh.store.ListCollections()...)
+			}
+		}
+	}
+
+	var candidates []string
+	for _, option := range options {
+		if strings.HasPrefix(option, word) {
+			candidates = append(candidates, option)
+		}
+	}
+	return start, candidates
+}
+
+// fieldNames 返回学习到的所有字段名,按字母顺序排列
+func (sh *shell) fieldNames() []string {
+	names := make([]string, 0, len(sh.fields))
+	for name := range sh.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// learnFields 记住文档中出现的字段名,嵌套的字段使用 a.b 的形式
+func (sh *shell) learnFields(doc map[string]interface{}, prefix string) {
+	for key, value := range doc {
+		name := prefix + key
+		sh.fields[name] = struct{}{}
+		if nested, ok := value.(map[string]interface{}); ok {
+			sh.learnFields(nested, name+".")
+		}
+	}
+}
+
+// printDocument 以缩进的 JSON 输出一个文档
+func (sh *shell) printDocument(doc map[string]interface{}) error {
+	sh.learnFields(doc, "")
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode document: %w", err)
+	}
+	fmt.Fprintln(sh.out, string(data))
+	return nil
+}
+
+// printDocuments 输出一组文档和文档数量
+func (sh *shell) printDocuments(docs []map[string]interface{}) error {
+	for _, doc := range docs {
+		if err := sh.printDocument(doc); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(sh.out, "(%d documents)\n", len(docs))
+	return nil
+}
+
+// splitArgs 按空白拆分参数,最多拆分为 n 个,最后一个参数包含行的剩余部分
+// n 为 0 时按空白拆分所有参数
+func splitArgs(s string, n int) []string {
+	var args []string
+	s = strings.TrimSpace(s)
+	for s != "" {
+		if n > 0 && len(args) == n-1 {
+			return append(args, s)
+		}
+		arg, rest, _ := strings.Cut(s, " ")
+		args = append(args, arg)
+		s = strings.TrimSpace(rest)
+	}
+	return args
+}
+
+// parseValue 把参数解析为 JSON 值,不是合法的 JSON 时作为字符串
+func parseValue(s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	return v
+}
+
+// parseObject 把参数解析为 JSON 对象
+func parseObject(s string) (map[string]interface{}, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &obj); err != nil {
+		return nil, fmt.Errorf("invalid JSON object: %w", err)
+	}
+	return obj, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AlexiaAshford/jsonDB"
+)
+
+// newTestShell 创建一个操作临时数据库的 shell
+func newTestShell(t *testing.T) (*shell, *bytes.Buffer) {
+	t.Helper()
+	db, err := jsonDB.NewDatabase("id", t.TempDir(), 2)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.LogLevelOff()
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.CreateCollection("orders", "orderId"); err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+
+	var out bytes.Buffer
+	sh, err := newShell(func(name string) (backend, error) {
+		return db.Collection(name)
+	}, &out)
+	if err != nil {
+		t.Fatalf("Failed to create shell: %v", err)
+	}
+	return sh, &out
+}
+
+// mustExecute 执行一条命令并返回它的输出
+func mustExecute(t *testing.T, sh *shell, out *bytes.Buffer, line string) string {
+	t.Helper()
+	out.Reset()
+	if err := sh.execute(line); err != nil {
+		t.Fatalf("%s: %v", line, err)
+	}
+	return out.String()
+}
+
+func TestShellCommands(t *testing.T) {
+	sh, out := newTestShell(t)
+
+	mustExecute(t, sh, out, `insert {"id": "1", "name": "Alice", "age": 30, "info": {"email": "a@example.com"}}`)
+	mustExecute(t, sh, out, `insert {"id": "2", "name": "Bob", "age": 25}`)
+	mustExecute(t, sh, out, "index create age")
+
+	if output := mustExecute(t, sh, out, "get 1"); !strings.Contains(output, `"name": "Alice"`) {
+		t.Errorf("Expected pretty-printed document, got %s", output)
+	}
+	if output := mustExecute(t, sh, out, "query age 30"); !strings.Contains(output, "(1 documents)") {
+		t.Errorf("Unexpected query output: %s", output)
+	}
+	if output := mustExecute(t, sh, out, "range age 20 40"); !strings.Contains(output, "(2 documents)") {
+		t.Errorf("Unexpected range output: %s", output)
+	}
+	if output := mustExecute(t, sh, out, `find {"info.email": "a@example.com"}`); !strings.Contains(output, "(1 documents)") {
+		t.Errorf("Unexpected find output: %s", output)
+	}
+	mustExecute(t, sh, out, `update 2 {"name": "Bobby"}`)
+	if output := mustExecute(t, sh, out, "fuzzy name Bob*"); !strings.Contains(output, "Bobby") {
+		t.Errorf("Unexpected fuzzy output: %s", output)
+	}
+	mustExecute(t, sh, out, "delete 1")
+	if output := mustExecute(t, sh, out, "count"); strings.TrimSpace(output) != "1" {
+		t.Errorf("Expected count 1, got %s", output)
+	}
+
+	if output := mustExecute(t, sh, out, "index list"); strings.TrimSpace(output) != "age" {
+		t.Errorf("Unexpected index list: %s", output)
+	}
+	mustExecute(t, sh, out, "index drop age")
+	if err := sh.execute("index drop age"); err == nil {
+		t.Error("Expected error when dropping a missing index")
+	}
+
+	// 切换集合
+	mustExecute(t, sh, out, "use orders")
+	if sh.prompt() != "orders> " {
+		t.Errorf("Unexpected prompt: %q", sh.prompt())
+	}
+	mustExecute(t, sh, out, `insert {"orderId": "o1", "total": 10}`)
+	if output := mustExecute(t, sh, out, "stats"); !strings.Contains(output, "_default") || !strings.Contains(output, "orders") {
+		t.Errorf("Unexpected stats output: %s", output)
+	}
+	if err := sh.execute("use missing"); err == nil {
+		t.Error("Expected error when switching to a missing collection")
+	}
+	if err := sh.execute("nope"); err == nil {
+		t.Error("Expected error for unknown command")
+	}
+}
+
+func TestShellCompletion(t *testing.T) {
+	sh, out := newTestShell(t)
+	mustExecute(t, sh, out, `insert {"id": "1", "name": "Alice", "nick": "Al", "info": {"email": "a@example.com"}}`)
+
+	tests := []struct {
+		line       string
+		start      int
+		candidates []string
+	}{
+		{"ind", 0, []string{"index"}},
+		{"query n", 6, []string{"name", "nick"}},
+		{"query info.", 6, []string{"info.email"}},
+		{"index create i", 13, []string{"id", "info", "info.email"}},
+		{"use o", 4, []string{"orders"}},
+		{"get ", 4, nil},
+	}
+	for _, tt := range tests {
+		start, candidates := sh.complete(tt.line)
+		if start != tt.start || !reflect.DeepEqual(candidates, tt.candidates) {
+			t.Errorf("complete(%q) = %d %v, want %d %v", tt.line, start, candidates, tt.start, tt.candidates)
+		}
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	sh, _ := newTestShell(t)
+	var out bytes.Buffer
+
+	// Tab 补全命令名,退格删除字符,方向键移动光标
+	editor := newLineEditor(strings.NewReader("cou\t\rget 12\x7f3\x1b[D\x1b[D\x1b[Cx\r"), &out, sh.complete)
+	if line, err := editor.readLine("> "); err != nil || line != "count " {
+		t.Errorf("Expected completed command, got %q %v", line, err)
+	}
+	if line, err := editor.readLine("> "); err != nil || line != "get 1x3" {
+		t.Errorf("Expected edited line, got %q %v", line, err)
+	}
+
+	// 上方向键浏览历史记录
+	editor = newLineEditor(strings.NewReader("\x1b[A\x1b[A\r\x1b[A\x1b[B\r"), &out, nil)
+	editor.addHistory("first")
+	editor.addHistory("second")
+	if line, _ := editor.readLine("> "); line != "first" {
+		t.Errorf("Expected first history entry, got %q", line)
+	}
+	if line, _ := editor.readLine("> "); line != "" {
+		t.Errorf("Expected empty line after browsing back down, got %q", line)
+	}
+
+	// Ctrl-C 放弃当前行,空行上的 Ctrl-D 结束输入
+	editor = newLineEditor(strings.NewReader("abc\x03\x04"), &out, nil)
+	if _, err := editor.readLine("> "); err != errInterrupted {
+		t.Errorf("Expected errInterrupted, got %v", err)
+	}
+	if _, err := editor.readLine("> "); err == nil {
+		t.Error("Expected EOF after Ctrl-D")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// isTerminal 在不支持的平台上总是返回 false,shell 退回到逐行读取
+func isTerminal(fd int) bool {
+	return false
+}
+
+// makeRaw 在不支持的平台上返回错误
+func makeRaw(fd int) (restore func(), err error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
@@ -0,0 +1,232 @@
+// collection.go
+
+// 介绍:
+// 本文件实现了泛型的类型化集合 Collection[T],用于在 Go 结构体和数据库文档之间自动转换。
+//
+// 数据库中的文档都是 map[string]interface{},数值在经过 msgpack 持久化和重启后类型会发生变化
+// (例如 int 变成 int8 或 int64),直接对文档做类型断言很容易出错。Collection[T] 把结构体编码为文档写入,
+// 读取时再把文档解码回结构体,由解码器负责把数值转换成结构体字段声明的类型。
+//
+// 字段名优先使用 msgpack 标签,没有 msgpack 标签时使用 json 标签,两者都没有时使用字段名本身。
+// 主键字段通过 `jsondb:"pk"` 标签指定,没有该标签时使用字段名与数据库主键相同的字段。
+
+package jsonDB
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"math"
+	"reflect"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Collection 是数据库上的类型化视图,T 必须是结构体类型
+type Collection[T any] struct {
+	db      *Database
+	pkIndex []int // 主键字段在结构体中的索引路径
+}
+
+// NewCollection 函数为数据库创建一个类型化集合
+//
+// 介绍:
+// NewCollection 会检查 T 是否为结构体,并找到与数据库主键对应的字段。
+// 主键字段可以是任意类型,文档ID是它的字符串形式(与 Database.Insert 相同)。
+// 如果数据库设置了主键生成策略,插入主键字段为零值的结构体时会自动生成主键。
+//
+// 参数:
+// - db: 集合所在的数据库
+//
+// 返回值:
+// - *Collection[T]: 新的类型化集合
+// - error: T 不是结构体,或者找不到主键字段时返回错误
+func NewCollection[T any](db *Database) (*Collection[T], error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("collection type must be a struct, got %v", t)
+	}
+
+	var pkIndex []int
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := documentFieldName(field)
+		tagged := hasTagOption(field.Tag.Get("jsondb"), "pk")
+		if tagged && name != db.primaryKey {
+			return nil, fmt.Errorf("primary key field %s of %v is stored as '%s', expected '%s'", field.Name, t, name, db.primaryKey)
+		}
+		if tagged || (pkIndex == nil && name == db.primaryKey) {
+			pkIndex = field.Index
+		}
+	}
+	if pkIndex == nil {
+		return nil, fmt.Errorf("type %v has no field for primary key '%s'", t, db.primaryKey)
+	}
+
+	db.log(LogLevelDebug, "Created typed collection", slog.Any("type", t))
+	return &Collection[T]{db: db, pkIndex: pkIndex}, nil
+}
+
+// Insert 方法插入一个结构体,返回文档主键的字符串形式
+func (c *Collection[T]) Insert(value T) (string, error) {
+	doc, err := c.encode(value)
+	if err != nil {
+		return "", err
+	}
+	return c.db.Insert(doc)
+}
+
+// Get 方法获取指定ID的文档并解码为 T
+// 文档不存在或者无法解码为 T 时,第二个返回值为 false
+func (c *Collection[T]) Get(id string) (T, bool) {
+	doc, ok := c.db.Get(id)
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	value, err := c.decode(doc)
+	if err != nil {
+		c.db.log(LogLevelWarn, "Failed to decode document", slog.String("id", id), slog.Any("error", err))
+		return value, false
+	}
+	return value, true
+}
+
+// Find 方法返回所有满足 filter 的文档,filter 中使用的是文档中的字段名
+// 无法解码为 T 的文档会被跳过并记录警告
+func (c *Collection[T]) Find(filter Filter) []T {
+	return c.decodeAll(c.db.Find(filter))
+}
+
+// GetAll 方法返回所有文档
+func (c *Collection[T]) GetAll() []T {
+	return c.decodeAll(c.db.GetAll())
+}
+
+// Update 方法用 value 中的字段覆盖指定ID的文档,更新语义与 Database.Update 相同
+// value 的主键字段为零值时不修改主键;不为零值时必须与 id 相同,否则返回错误
+func (c *Collection[T]) Update(id string, value T) error {
+	doc, err := c.encode(value)
+	if err != nil {
+		return err
+	}
+	if reflect.ValueOf(value).FieldByIndex(c.pkIndex).IsZero() {
+		delete(doc, c.db.primaryKey)
+	} else if pk := fmt.Sprintf("%v", doc[c.db.primaryKey]); pk != id {
+		return fmt.Errorf("update must not change primary key '%s' of document '%s' to '%s'", c.db.primaryKey, id, pk)
+	}
+	return c.db.Update(id, doc)
+}
+
+// Delete 方法删除指定ID的文档
+func (c *Collection[T]) Delete(id string) error {
+	return c.db.Delete(id)
+}
+
+// encode 将结构体编码为文档
+// 主键字段为零值并且数据库设置了主键生成策略时,文档中不包含主键,由 Insert 生成
+func (c *Collection[T]) encode(value T) (map[string]interface{}, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(value); err != nil {
+		return nil, fmt.Errorf("failed to encode %T: %w", value, err)
+	}
+
+	var doc map[string]interface{}
+	dec := msgpack.NewDecoder(&buf)
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to encode %T: %w", value, err)
+	}
+
+	if c.db.keyPolicy != KeyPolicyNone && reflect.ValueOf(value).FieldByIndex(c.pkIndex).IsZero() {
+		delete(doc, c.db.primaryKey)
+	}
+	return doc, nil
+}
+
+// decode 将文档解码为结构体,文档中多余的字段(如 _rev)会被忽略
+func (c *Collection[T]) decode(doc map[string]interface{}) (T, error) {
+	var value T
+	data, err := msgpack.Marshal(integralFloats(doc))
+	if err != nil {
+		return value, fmt.Errorf("failed to decode document: %w", err)
+	}
+
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(&value); err != nil {
+		return value, fmt.Errorf("failed to decode document into %T: %w", value, err)
+	}
+	return value, nil
+}
+
+// decodeAll 将一组文档解码为结构体,跳过无法解码的文档
+func (c *Collection[T]) decodeAll(docs []map[string]interface{}) []T {
+	values := make([]T, 0, len(docs))
+	for _, doc := range docs {
+		value, err := c.decode(doc)
+		if err != nil {
+			c.db.log(LogLevelWarn, "Skipping document that cannot be decoded", slog.Any("id", doc[c.db.primaryKey]), slog.Any("error", err))
+			continue
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// integralFloats 返回 v 的副本,其中值为整数的浮点数被转换为 int64
+// 通过 JSON 插入的数值都是 float64,而 msgpack 不能把浮点数解码到整数字段;整数可以解码到浮点数字段
+func integralFloats(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			converted[k] = integralFloats(item)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(val))
+		for i, item := range val {
+			converted[i] = integralFloats(item)
+		}
+		return converted
+	case float64:
+		if val == math.Trunc(val) && math.Abs(val) < 1<<63 {
+			return int64(val)
+		}
+	case float32:
+		if f := float64(val); f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return int64(f)
+		}
+	}
+	return v
+}
+
+// documentFieldName 返回结构体字段在文档中的字段名,优先使用 msgpack 标签,其次是 json 标签
+func documentFieldName(field reflect.StructField) string {
+	for _, key := range []string{"msgpack", "json"} {
+		tag, ok := field.Tag.Lookup(key)
+		if !ok {
+			continue
+		}
+		if name, _, _ := strings.Cut(tag, ","); name != "" {
+			return name
+		}
+	}
+	return field.Name
+}
+
+// hasTagOption 判断逗号分隔的标签中是否包含指定的选项
+func hasTagOption(tag, option string) bool {
+	for _, opt := range strings.Split(tag, ",") {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
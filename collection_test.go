@@ -0,0 +1,79 @@
+package jsonDB
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	ID       string    `json:"id" jsondb:"pk"`
+	Name     string    `json:"name"`
+	Age      int       `json:"age"`
+	Score    float64   `json:"score"`
+	Tags     []string  `json:"tags"`
+	JoinedAt time.Time `json:"joinedAt"`
+	Rev      uint64    `json:"_rev"`
+}
+
+func TestTypedCollection(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { cleanupTestDB(t, db) }()
+
+	users, err := NewCollection[testUser](db)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	joined := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, u := range []testUser{
+		{ID: "1", Name: "Alice", Age: 30, Score: 1.5, Tags: []string{"a"}, JoinedAt: joined},
+		{ID: "2", Name: "Bob", Age: 300, Score: 2, JoinedAt: joined},
+	} {
+		if _, err := users.Insert(u); err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+	}
+
+	// 重启后数值和时间的类型由结构体字段决定
+	db.writeWg.Wait()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db, err = NewDatabase("id", testDBPath, runtime.NumCPU())
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	users, _ = NewCollection[testUser](db)
+
+	alice, ok := users.Get("1")
+	if !ok || alice.Age != 30 || alice.Score != 1.5 || len(alice.Tags) != 1 || !alice.JoinedAt.Equal(joined) || alice.Rev != 1 {
+		t.Errorf("Unexpected user after restart: %+v", alice)
+	}
+	if older := users.Find(Filter{"age": map[string]interface{}{"$gt": 100}}); len(older) != 1 || older[0].Name != "Bob" {
+		t.Errorf("Expected Find to return Bob, got %+v", older)
+	}
+
+	// 通过 JSON 字符串插入的数值是 float64,同样可以解码到 int 字段
+	if _, err := db.Insert(`{"id": "3", "name": "Carol", "age": 40}`); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	if carol, ok := users.Get("3"); !ok || carol.Age != 40 {
+		t.Errorf("Expected Carol aged 40, got %+v", carol)
+	}
+
+	// Update 不能修改主键,主键字段为零值时保留原来的主键
+	if err := users.Update("3", testUser{ID: "4", Name: "Carol", Age: 41}); err == nil {
+		t.Error("Expected Update to reject a different primary key")
+	}
+	if err := users.Update("3", testUser{Name: "Carol", Age: 41}); err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+	if carol, ok := users.Get("3"); !ok || carol.ID != "3" || carol.Age != 41 {
+		t.Errorf("Expected Carol to keep the primary key, got %+v", carol)
+	}
+
+	type noKey struct{ Name string }
+	if _, err := NewCollection[noKey](db); err == nil {
+		t.Error("Expected error for type without primary key field")
+	}
+}
@@ -0,0 +1,322 @@
+// collections.go
+
+// 介绍:
+// 本文件实现了同一个数据库目录中的多个命名集合。
+//
+// 所有集合共享同一个 engine: 数据文件、WAL、文件锁、提交锁、工作池和 LSN 都只有一份,
+// 因此所有集合的写入经过同一条持久化流水线,快照和事务的 LSN 在集合之间也是可比较的。
+// 每个集合拥有独立的文档、索引、主键、主键生成策略和模式。WAL 记录和数据文件记录中的
+// Collection 字段指明记录所属的集合,默认集合的ID为 0。
+//
+// 命名集合的注册信息保存在元数据文件中,创建、删除和重命名集合时立即写入。
+// 这些操作同时作为一条同步落盘的 WAL 记录写入,WAL 中因此包含了重建集合所需的全部信息,
+// 从备份重放 WAL(见 archive.go 中的按时间点恢复)时集合的创建和删除会被一起重放。
+// 集合ID不会被重复使用,被删除集合遗留在 WAL 和数据文件中的记录在重新打开数据库时会被丢弃,
+// 下一次检查点之后就从磁盘上消失了。
+
+package jsonDB
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+)
+
+// CreateCollection 方法在数据库目录中创建一个新的命名集合
+//
+// 介绍:
+// 新集合与默认集合共享数据文件、WAL 和工作池,但拥有自己的主键、索引和模式。
+// 返回的 *Database 可以像 NewDatabase 返回的数据库一样使用,opts 只作用于新集合。
+// 集合的主键、主键生成策略和模式会写入元数据文件,重新打开数据库后自动恢复;索引需要重新创建。
+//
+// 参数:
+// - name: 集合名称,不能为空
+// - primaryKey: 集合的主键字段名
+// - opts: 可选配置项,例如 WithKeyPolicy 和 WithSchema
+//
+// 返回值:
+// - *Database: 新创建的集合
+// - error: 名称为空、同名集合已经存在(ErrCollectionExists)或者写入 WAL 失败时返回错误
+func (db *Database) CreateCollection(name, primaryKey string, opts ...Option) (*Database, error) {
+	if name == "" {
+		return nil, errors.New("collection name must not be empty")
+	}
+
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	coll := newCollectionDatabase(db.engine, db.nextCollectionID, name, primaryKey)
+	for _, opt := range opts {
+		opt(coll)
+	}
+
+	db.collMu.RLock()
+	exists := db.lookupCollection(name) != nil
+	db.collMu.RUnlock()
+	if exists {
+		db.log(LogLevelWarn, "Collection already exists", slog.String("op", "create_collection"), slog.String("name", name))
+		return nil, fmt.Errorf("%w: '%s'", ErrCollectionExists, name)
+	}
+
+	definition := coll.collectionMeta()
+	entry := walEntry{Operation: OperationCreateCollection, ID: name, Collection: coll.id, Definition: &definition}
+	if err := db.logCollectionOperation(entry); err != nil {
+		return nil, fmt.Errorf("failed to create collection: %w", err)
+	}
+
+	db.collMu.Lock()
+	db.collections[coll.id] = coll
+	db.nextCollectionID++
+	db.collMu.Unlock()
+	db.saveCollectionMeta()
+
+	db.log(LogLevelInfo, "Created collection", slog.String("op", "create_collection"), slog.String("name", name), slog.String("primary_key", primaryKey), slog.String("policy", coll.keyPolicy.String()))
+	return coll, nil
+}
+
+// Collection 方法返回指定名称的集合,空字符串表示默认集合
+// 集合不存在时返回 *CollectionNotFoundError
+func (db *Database) Collection(name string) (*Database, error) {
+	db.collMu.RLock()
+	defer db.collMu.RUnlock()
+
+	if coll := db.lookupCollection(name); coll != nil {
+		return coll, nil
+	}
+	return nil, &CollectionNotFoundError{Name: name}
+}
+
+// DropCollection 方法删除指定名称的集合及其中的所有文档
+//
+// 介绍:
+// 删除需要等待正在进行的写操作完成。删除之后,之前获得的集合对象上的写操作会返回
+// *CollectionNotFoundError,读操作返回空结果。默认集合不能被删除。
+//
+// 参数:
+// - name: 要删除的集合名称
+//
+// 返回值:
+// - error: 集合不存在或者写入 WAL 失败时返回错误
+func (db *Database) DropCollection(name string) error {
+	if name == "" {
+		return errors.New("cannot drop the default collection")
+	}
+
+	// 持有提交锁的写锁,等待集合上正在进行的写操作完成
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.collMu.RLock()
+	coll := db.lookupCollection(name)
+	db.collMu.RUnlock()
+	if coll == nil {
+		return &CollectionNotFoundError{Name: name}
+	}
+
+	if err := db.logCollectionOperation(walEntry{Operation: OperationDropCollection, ID: name, Collection: coll.id}); err != nil {
+		return fmt.Errorf("failed to drop collection: %w", err)
+	}
+	db.collMu.Lock()
+	delete(db.collections, coll.id)
+	db.collMu.Unlock()
+	db.saveCollectionMeta()
+
+	// 持有 db.mu 设置删除标记,之后该集合的记录不会再写入 WAL
+	coll.dropped = true
+	coll.discard()
+
+	db.log(LogLevelInfo, "Dropped collection", slog.String("op", "drop_collection"), slog.String("name", name))
+	return nil
+}
+
+// RenameCollection 方法重命名一个集合,集合中的文档、索引和模式保持不变
+// 默认集合不能被重命名,newName 已经被其他集合使用时返回 ErrCollectionExists
+func (db *Database) RenameCollection(oldName, newName string) error {
+	if oldName == "" || newName == "" {
+		return errors.New("cannot rename the default collection")
+	}
+
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.collMu.RLock()
+	coll := db.lookupCollection(oldName)
+	taken := db.lookupCollection(newName) != nil
+	db.collMu.RUnlock()
+	if coll == nil {
+		return &CollectionNotFoundError{Name: oldName}
+	}
+	if oldName == newName {
+		return nil
+	}
+	if taken {
+		return fmt.Errorf("%w: '%s'", ErrCollectionExists, newName)
+	}
+
+	if err := db.logCollectionOperation(walEntry{Operation: OperationRenameCollection, ID: newName, Collection: coll.id}); err != nil {
+		return fmt.Errorf("failed to rename collection: %w", err)
+	}
+	db.collMu.Lock()
+	coll.name = newName
+	db.collMu.Unlock()
+	db.saveCollectionMeta()
+
+	db.log(LogLevelInfo, "Renamed collection", slog.String("op", "rename_collection"), slog.String("name", oldName), slog.String("new_name", newName))
+	return nil
+}
+
+// ListCollections 方法返回所有命名集合的名称,按名称排序,不包含默认集合
+func (db *Database) ListCollections() []string {
+	colls := db.namedCollections()
+	names := make([]string, len(colls))
+	for i, coll := range colls {
+		names[i] = coll.Name()
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Name 方法返回集合的名称,默认集合返回空字符串
+func (db *Database) Name() string {
+	db.collMu.RLock()
+	defer db.collMu.RUnlock()
+	return db.name
+}
+
+// PrimaryKey 方法返回集合的主键字段名
+func (db *Database) PrimaryKey() string {
+	return db.primaryKey
+}
+
+// lookupCollection 按名称查找集合,找不到时返回 nil
+// 调用方需要持有 collMu
+func (db *Database) lookupCollection(name string) *Database {
+	if name == "" {
+		return db.root
+	}
+	for _, coll := range db.collections {
+		if coll.name == name {
+			return coll
+		}
+	}
+	return nil
+}
+
+// collectionByID 按ID查找集合,集合已经被删除时返回 nil
+func (db *Database) collectionByID(id uint32) *Database {
+	if id == 0 {
+		return db.root
+	}
+	db.collMu.RLock()
+	defer db.collMu.RUnlock()
+	return db.collections[id]
+}
+
+// logCollectionOperation 把一条集合管理操作同步写入 WAL,记录落盘之后操作就已经生效
+// 调用方需要持有 commitMu 的写锁和 db.mu
+func (db *Database) logCollectionOperation(entry walEntry) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if err := db.appendWALLocked(&entry, true); err != nil {
+		db.logTo(LogSubsystemWAL, LogLevelError, "Failed to log collection operation", slog.String("op", entry.Operation), slog.String("name", entry.ID), slog.Any("error", err))
+		return err
+	}
+	return nil
+}
+
+// saveCollectionMeta 在集合管理操作修改注册表之后保存元数据
+// 操作的 WAL 记录已经落盘,因此保存失败时只记录警告: 重新打开数据库时会重放这条记录,
+// 检查点会重新写入元数据文件
+func (db *Database) saveCollectionMeta() {
+	if err := db.saveMeta(); err != nil {
+		db.log(LogLevelWarn, "Failed to save metadata, it will be rewritten at the next checkpoint", slog.Any("error", err))
+	}
+}
+
+// isCollectionOperation 返回操作是否为集合管理操作
+func isCollectionOperation(operation string) bool {
+	switch operation {
+	case OperationCreateCollection, OperationDropCollection, OperationRenameCollection:
+		return true
+	}
+	return false
+}
+
+// applyCollectionEntry 在恢复时重放一条集合管理操作的 WAL 记录
+// 元数据文件在操作时已经更新,加载的元数据可能已经包含这次操作的结果,因此重放是幂等的
+func (db *Database) applyCollectionEntry(entry walEntry) {
+	db.collMu.Lock()
+	coll := db.collections[entry.Collection]
+	switch entry.Operation {
+	case OperationCreateCollection:
+		if coll != nil || entry.Definition == nil {
+			break
+		}
+		definition := *entry.Definition
+		definition.ID = entry.Collection
+		created, err := db.newCollectionFromMeta(definition)
+		if err != nil {
+			db.logTo(LogSubsystemWAL, LogLevelWarn, "Skipping creation of collection", slog.String("name", definition.Name), slog.Any("error", err))
+			break
+		}
+		db.collections[created.id] = created
+		if created.id >= db.nextCollectionID {
+			db.nextCollectionID = created.id + 1
+		}
+	case OperationDropCollection:
+		if coll != nil {
+			delete(db.collections, entry.Collection)
+			coll.dropped = true
+		}
+	case OperationRenameCollection:
+		if coll != nil {
+			coll.name = entry.ID
+		}
+	}
+	db.collMu.Unlock()
+
+	if entry.Operation == OperationDropCollection && coll != nil {
+		coll.discard()
+	}
+}
+
+// discard 清空被删除集合的文档和索引,并结束集合上的变更流
+func (db *Database) discard() {
+	db.data.Range(func(key, _ interface{}) bool {
+		db.data.Delete(key)
+		return true
+	})
+	db.indexes.Range(func(key, _ interface{}) bool {
+		db.indexes.Delete(key)
+		return true
+	})
+	atomic.StoreInt64(&db.docCount, 0)
+	db.closeWatchers(db, &CollectionNotFoundError{Name: db.name})
+}
+
+// namedCollections 返回所有命名集合,按集合ID排序
+func (db *Database) namedCollections() []*Database {
+	db.collMu.RLock()
+	colls := make([]*Database, 0, len(db.collections))
+	for _, coll := range db.collections {
+		colls = append(colls, coll)
+	}
+	db.collMu.RUnlock()
+
+	sort.Slice(colls, func(i, j int) bool { return colls[i].id < colls[j].id })
+	return colls
+}
+
+// allCollections 返回默认集合和所有命名集合
+func (db *Database) allCollections() []*Database {
+	return append([]*Database{db.root}, db.namedCollections()...)
+}
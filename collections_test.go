@@ -0,0 +1,130 @@
+package jsonDB
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestNamedCollections(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { cleanupTestDB(t, db) }()
+
+	users, err := db.CreateCollection("users", "email")
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	orders, err := db.CreateCollection("orders", "orderId", WithKeyPolicy(KeyPolicySequence))
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	if _, err := db.CreateCollection("users", "id"); !errors.Is(err, ErrCollectionExists) {
+		t.Errorf("Expected ErrCollectionExists, got %v", err)
+	}
+
+	if _, err := db.Insert(map[string]interface{}{"id": "1", "name": "root"}); err != nil {
+		t.Fatalf("Failed to insert into default collection: %v", err)
+	}
+	if _, err := users.Insert(map[string]interface{}{"email": "a@example.com", "name": "Alice"}); err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	id, err := orders.Insert(map[string]interface{}{"item": "book"})
+	if err != nil || id != "1" {
+		t.Fatalf("Expected generated order id 1, got %q, %v", id, err)
+	}
+
+	// 每个集合只能看到自己的文档
+	if _, ok := db.Get("a@example.com"); ok {
+		t.Error("Default collection should not see documents of other collections")
+	}
+	if doc, ok := orders.Get("1"); !ok || doc["item"] != "book" {
+		t.Errorf("Expected order 1 in orders collection, got %v", doc)
+	}
+	if db.Count() != 1 || users.Count() != 1 || orders.Count() != 1 {
+		t.Errorf("Unexpected counts: default=%d users=%d orders=%d", db.Count(), users.Count(), orders.Count())
+	}
+
+	if err := db.RenameCollection("orders", "purchases"); err != nil {
+		t.Fatalf("Failed to rename collection: %v", err)
+	}
+	if names := db.ListCollections(); len(names) != 2 || names[0] != "purchases" || names[1] != "users" {
+		t.Errorf("Unexpected collection names: %v", names)
+	}
+
+	// 重新打开后集合、主键和主键序列都被恢复
+	db.writeWg.Wait()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db, err = NewDatabase("id", testDBPath, runtime.NumCPU())
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	purchases, err := db.Collection("purchases")
+	if err != nil {
+		t.Fatalf("Failed to get collection: %v", err)
+	}
+	if purchases.PrimaryKey() != "orderId" || purchases.Count() != 1 {
+		t.Errorf("Expected restored purchases collection, got primary key %s and %d documents", purchases.PrimaryKey(), purchases.Count())
+	}
+	if id, err := purchases.Insert(map[string]interface{}{"item": "pen"}); err != nil || id != "2" {
+		t.Errorf("Expected generated order id 2 after reopen, got %q, %v", id, err)
+	}
+	if db.Count() != 1 {
+		t.Errorf("Expected 1 document in default collection, got %d", db.Count())
+	}
+
+	users, err = db.Collection("users")
+	if err != nil {
+		t.Fatalf("Failed to get collection: %v", err)
+	}
+	if err := db.DropCollection("users"); err != nil {
+		t.Fatalf("Failed to drop collection: %v", err)
+	}
+	if _, err := db.Collection("users"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("Expected ErrCollectionNotFound, got %v", err)
+	}
+	if _, err := users.Insert(map[string]interface{}{"email": "b@example.com"}); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("Expected write to dropped collection to fail, got %v", err)
+	}
+	if users.Count() != 0 {
+		t.Errorf("Expected dropped collection to be empty, got %d documents", users.Count())
+	}
+
+	// 同名集合重新创建后不会看到被删除集合的文档
+	db.writeWg.Wait()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db, err = NewDatabase("id", testDBPath, runtime.NumCPU())
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	users, err = db.CreateCollection("users", "email")
+	if err != nil {
+		t.Fatalf("Failed to recreate collection: %v", err)
+	}
+	if users.Count() != 0 {
+		t.Errorf("Expected recreated collection to be empty, got %d documents", users.Count())
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	db, err := NewDatabase("id", t.TempDir(), runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	users, err := db.CreateCollection("users", "id")
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+
+	// 集合共享同一个数据库目录,关闭集合之后再关闭默认集合返回错误而不是 panic
+	if err := users.Close(); err != nil {
+		t.Fatalf("Failed to close collection: %v", err)
+	}
+	if err := db.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected os.ErrClosed when closing twice, got %v", err)
+	}
+}
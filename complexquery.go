@@ -2,9 +2,11 @@ package jsonDB
 
 import (
 	"fmt"
+	"log/slog"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 )
 
 // FuzzyQuery 执行模糊查询
@@ -12,7 +14,12 @@ import (
 // pattern: 查询模式,支持 '*' 作为通配符
 // 返回匹配的文档列表
 func (db *Database) FuzzyQuery(field, pattern string) []map[string]interface{} {
-	db.logger.Debug(fmt.Sprintf("Performing fuzzy query on field: %s with pattern: %s", field, pattern))
+	start := time.Now()
+	db.logTo(LogSubsystemQuery, LogLevelDebug, "Performing fuzzy query", slog.String("field", field), slog.String("pattern", pattern))
+
+	// 持有提交锁的读锁,避免读到事务提交的中间状态
+	db.commitMu.RLock()
+	defer db.commitMu.RUnlock()
 
 	var results []map[string]interface{}
 	indexValue, indexExists := db.indexes.Load(field)
@@ -27,33 +34,35 @@ func (db *Database) FuzzyQuery(field, pattern string) []map[string]interface{} {
 
 			// 收集匹配的文档
 			matchedDocs.Range(func(docID, _ interface{}) bool {
-				if doc, exists := db.Get(docID.(string)); exists {
+				if doc, exists := db.getDocument(docID.(string)); exists {
 					results = append(results, doc)
 				}
 				return true
 			})
 
-			db.logger.Info(fmt.Sprintf("Fuzzy query using trie index on field %s returned %d results", field, len(results)))
+			db.logTo(LogSubsystemQuery, LogLevelInfo, "Fuzzy query using trie index", slog.String("op", "fuzzy_query"), slog.String("field", field), slog.Int("count", len(results)), slog.Duration("duration", time.Since(start)))
 		}
 	} else {
 		// 如果没有索引,执行全表扫描
 		results = db.fullScanFuzzyQuery(field, pattern)
 	}
 
-	return results
+	return db.revealAll(results)
 }
 
 // fullScanFuzzyQuery 在没有索引时执行全表扫描的模糊查询
 func (db *Database) fullScanFuzzyQuery(field, pattern string) []map[string]interface{} {
-	db.logger.Debug(fmt.Sprintf("Performing full scan fuzzy query on field: %s with pattern: %s", field, pattern))
+	start := time.Now()
+	db.logTo(LogSubsystemQuery, LogLevelDebug, "Performing full scan fuzzy query", slog.String("field", field), slog.String("pattern", pattern))
 
 	var results []map[string]interface{}
 	regex := wildcardToRegexp(pattern)
 
+	now := time.Now()
 	db.data.Range(func(_, value interface{}) bool {
 		doc := value.(*Document)
 		doc.mu.RLock()
-		if fieldValue, ok := doc.data[field]; ok {
+		if fieldValue, ok := doc.data[field]; ok && !db.isExpired(doc.data, now) {
 			if regex.MatchString(fmt.Sprintf("%v", fieldValue)) {
 				results = append(results, doc.data)
 			}
@@ -62,7 +71,7 @@ func (db *Database) fullScanFuzzyQuery(field, pattern string) []map[string]inter
 		return true
 	})
 
-	db.logger.Info(fmt.Sprintf("Full scan fuzzy query on field %s returned %d results", field, len(results)))
+	db.logTo(LogSubsystemQuery, LogLevelInfo, "Full scan fuzzy query", slog.String("op", "fuzzy_query"), slog.String("field", field), slog.Int("count", len(results)), slog.Duration("duration", time.Since(start)))
 	return results
 }
 
@@ -131,7 +140,12 @@ func (t *Trie) fuzzySearchRecursive(node *TrieNode, pattern, currentStr string,
 // - []map[string]interface{}: 包含所有匹配文档的切片
 func (db *Database) RangeQuery(field string, min, max interface{}) []map[string]interface{} {
 	// 记录查询的起始日志，包括字段名和查询范围
-	db.logger.Debug(fmt.Sprintf("Performing range query on field: %s with range: [%v, %v]", field, min, max))
+	start := time.Now()
+	db.logTo(LogSubsystemQuery, LogLevelDebug, "Performing range query", slog.String("field", field), slog.Any("min", min), slog.Any("max", max))
+
+	// 持有提交锁的读锁,避免读到事务提交的中间状态
+	db.commitMu.RLock()
+	defer db.commitMu.RUnlock()
 
 	// 初始化结果切片
 	var results []map[string]interface{}
@@ -141,8 +155,9 @@ func (db *Database) RangeQuery(field string, min, max interface{}) []map[string]
 	maxValue := toComparableValue(max)
 
 	// 记录转换后的最小值和最大值，便于调试
-	db.logger.Debug(fmt.Sprintf("Converted min value: %v (%T)", minValue, minValue))
-	db.logger.Debug(fmt.Sprintf("Converted max value: %v (%T)", maxValue, maxValue))
+	db.logTo(LogSubsystemQuery, LogLevelDebug, "Converted range bounds", slog.String("field", field),
+		slog.Any("min", minValue), slog.Any("min_type", typeName{minValue}),
+		slog.Any("max", maxValue), slog.Any("max_type", typeName{maxValue}))
 
 	// 尝试从数据库的索引中加载指定字段的索引
 	indexValue, indexExists := db.indexes.Load(field)
@@ -160,7 +175,7 @@ func (db *Database) RangeQuery(field string, min, max interface{}) []map[string]
 				keyValue := toComparableValue(key)
 
 				// 记录当前比较的键值，便于调试
-				db.logger.Debug(fmt.Sprintf("Comparing index key: %v (%T)", keyValue, keyValue))
+				db.logTo(LogSubsystemQuery, LogLevelDebug, "Comparing index key", slog.String("field", field), slog.Any("key", keyValue), slog.Any("type", typeName{keyValue}))
 
 				// 检查键值是否在查询范围内
 				if compareValues(keyValue, minValue) >= 0 && compareValues(keyValue, maxValue) <= 0 {
@@ -169,7 +184,7 @@ func (db *Database) RangeQuery(field string, min, max interface{}) []map[string]
 						// 遍历文档ID集合
 						valueMap.Range(func(docID, _ interface{}) bool {
 							// 获取完整的文档
-							if doc, exists := db.Get(docID.(string)); exists {
+							if doc, exists := db.getDocument(docID.(string)); exists {
 								// 将匹配的文档添加到结果集
 								results = append(results, doc)
 							}
@@ -180,16 +195,17 @@ func (db *Database) RangeQuery(field string, min, max interface{}) []map[string]
 				return true // 继续遍历索引
 			})
 			// 记录使用索引查询的结果数量
-			db.logger.Info(fmt.Sprintf("Range query using index on field %s returned %d results", field, len(results)))
+			db.logTo(LogSubsystemQuery, LogLevelInfo, "Range query using index", slog.String("op", "range_query"), slog.String("field", field), slog.Int("count", len(results)), slog.Duration("duration", time.Since(start)))
 		}
 	} else {
 		// 如果索引不存在，执行全表扫描
+		now := time.Now()
 		db.data.Range(func(_, value interface{}) bool {
 			doc := value.(*Document)
 			// 对文档加读锁，确保并发安全
 			doc.mu.RLock()
-			// 检查文档是否包含查询字段
-			if fieldValue, ok := doc.data[field]; ok {
+			// 检查文档是否包含查询字段,跳过已经过期的文档
+			if fieldValue, ok := doc.data[field]; ok && !db.isExpired(doc.data, now) {
 				// 将字段值转换为可比较的类型
 				docValue := toComparableValue(fieldValue)
 				// 检查字段值是否在查询范围内
@@ -208,9 +224,9 @@ func (db *Database) RangeQuery(field string, min, max interface{}) []map[string]
 			return true // 继续遍历下一个文档
 		})
 		// 记录全表扫描的结果数量
-		db.logger.Info(fmt.Sprintf("Full scan range query on field %s returned %d results", field, len(results)))
+		db.logTo(LogSubsystemQuery, LogLevelInfo, "Full scan range query", slog.String("op", "range_query"), slog.String("field", field), slog.Int("count", len(results)), slog.Duration("duration", time.Since(start)))
 	}
 
 	// 返回查询结果
-	return results
+	return db.revealAll(results)
 }
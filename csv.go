@@ -0,0 +1,367 @@
+// csv.go
+
+// 介绍:
+// 本文件实现了 CSV 格式的导入导出。
+//
+// 导入时第一行是表头,每一列通过 ImportColumns 映射到文档中的字段,字段名可以使用点号表示嵌套字段,
+// 例如表头为 info.email 的列会被写入 {"info": {"email": ...}}。没有指定类型的列按照单元格的内容推断类型:
+// 整数、浮点数(不包括 NaN 和无穷大)、布尔值、RFC 3339 格式的时间,其他内容保持为字符串。空单元格不会写入文档。
+//
+// 导出时嵌套的 map 被展开为以点号连接的表头,与导入的规则对应,因此导出的 CSV 可以原样导入。
+// Export 使用 FormatCSV 时导出文档中出现的所有字段;WriteCSV 把任意查询结果按照指定的列写成 CSV。
+
+package jsonDB
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldType 是 CSV 列的类型
+type FieldType int
+
+const (
+	// FieldTypeAuto 根据单元格的内容推断类型
+	FieldTypeAuto FieldType = iota
+	// FieldTypeString 保持为字符串,空单元格写入空字符串
+	FieldTypeString
+	// FieldTypeInt 解析为 int64
+	FieldTypeInt
+	// FieldTypeFloat 解析为 float64
+	FieldTypeFloat
+	// FieldTypeBool 解析为 bool,接受 strconv.ParseBool 支持的所有写法
+	FieldTypeBool
+	// FieldTypeTime 按照 CSVColumn.Layout 解析为 time.Time
+	FieldTypeTime
+)
+
+// CSVColumn 描述 CSV 中的一列如何映射到文档字段
+type CSVColumn struct {
+	Header string    // 表头中的列名
+	Field  string    // 文档中的字段,可以使用点号表示嵌套字段;为空时与 Header 相同,为 "-" 时忽略这一列
+	Type   FieldType // 列的类型,默认根据内容推断
+	Layout string    // FieldTypeTime 的时间格式,默认为 time.RFC3339
+}
+
+// ImportColumns 设置 CSV 列到文档字段的映射,没有列出的列使用表头作为字段名并推断类型
+func ImportColumns(columns ...CSVColumn) ImportOption {
+	return func(c *importConfig) {
+		c.columns = append(c.columns, columns...)
+	}
+}
+
+// ImportKeyColumn 指定 CSV 中作为主键的列,这一列的值写入数据库的主键字段
+// 主键列没有通过 ImportColumns 指定类型时保持为字符串,避免 "007" 之类的主键被解析为数字
+func ImportKeyColumn(header string) ImportOption {
+	return func(c *importConfig) {
+		c.keyColumn = header
+	}
+}
+
+// ImportComma 设置 CSV 的字段分隔符,默认为逗号
+func ImportComma(comma rune) ImportOption {
+	return func(c *importConfig) {
+		c.comma = comma
+	}
+}
+
+// csvField 是一列解析后的映射规则
+type csvField struct {
+	path   string // 文档中的字段,空字符串表示忽略这一列
+	typ    FieldType
+	layout string
+}
+
+// newCSVDecoder 返回一个从 CSV 中逐行读取文档的函数,输入结束时返回 io.EOF
+func (db *Database) newCSVDecoder(r io.Reader, cfg *importConfig) (func() (map[string]interface{}, error), error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	if cfg.comma != 0 {
+		reader.Comma = cfg.comma
+	}
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return func() (map[string]interface{}, error) { return nil, io.EOF }, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	// ReuseRecord 使之后的 Read 覆盖同一个切片
+	header = append([]string(nil), header...)
+	fields, err := db.csvFields(header, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (map[string]interface{}, error) {
+		record, err := reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		doc := make(map[string]interface{}, len(record))
+		for i, cell := range record {
+			f := fields[i]
+			if f.path == "" {
+				continue
+			}
+			value, ok, err := parseCSVValue(cell, f.typ, f.layout)
+			if err != nil {
+				return nil, fmt.Errorf("line %d, column %q: %w", line, header[i], err)
+			}
+			if ok {
+				setField(doc, f.path, value)
+			}
+		}
+		return doc, nil
+	}, nil
+}
+
+// csvFields 根据表头和导入配置确定每一列的映射规则
+func (db *Database) csvFields(header []string, cfg *importConfig) ([]csvField, error) {
+	configured := make(map[string]CSVColumn, len(cfg.columns))
+	for _, col := range cfg.columns {
+		configured[col.Header] = col
+	}
+
+	fields := make([]csvField, len(header))
+	foundKey := cfg.keyColumn == ""
+	for i, name := range header {
+		col, ok := configured[name]
+		delete(configured, name)
+		if !ok {
+			col = CSVColumn{Header: name}
+		}
+		f := csvField{path: col.Field, typ: col.Type, layout: col.Layout}
+		if f.path == "" {
+			f.path = name
+		}
+		if name == cfg.keyColumn {
+			foundKey = true
+			f.path = db.primaryKey
+			if f.typ == FieldTypeAuto {
+				f.typ = FieldTypeString
+			}
+		}
+		if f.path == "-" {
+			f.path = ""
+		}
+		fields[i] = f
+	}
+
+	if !foundKey {
+		return nil, fmt.Errorf("key column %q not found in CSV header", cfg.keyColumn)
+	}
+	for name := range configured {
+		return nil, fmt.Errorf("column %q not found in CSV header", name)
+	}
+	return fields, nil
+}
+
+// parseCSVValue 按照列的类型解析单元格,返回的 bool 表示是否应当写入文档
+func parseCSVValue(cell string, typ FieldType, layout string) (interface{}, bool, error) {
+	if typ == FieldTypeString {
+		return cell, true, nil
+	}
+	cell = strings.TrimSpace(cell)
+	if cell == "" {
+		return nil, false, nil
+	}
+	if layout == "" {
+		layout = time.RFC3339
+	}
+
+	switch typ {
+	case FieldTypeInt:
+		n, err := strconv.ParseInt(cell, 10, 64)
+		return n, err == nil, err
+	case FieldTypeFloat:
+		f, err := strconv.ParseFloat(cell, 64)
+		return f, err == nil, err
+	case FieldTypeBool:
+		b, err := strconv.ParseBool(cell)
+		return b, err == nil, err
+	case FieldTypeTime:
+		t, err := time.Parse(layout, cell)
+		return t, err == nil, err
+	case FieldTypeAuto:
+		if n, err := strconv.ParseInt(cell, 10, 64); err == nil {
+			return n, true, nil
+		}
+		// ParseFloat 同样接受 "NaN"、"Inf" 和 "infinity",这些单元格(例如姓氏 "Nan")按字符串处理,
+		// 非有限的浮点数也无法编码为 JSON
+		if f, err := strconv.ParseFloat(cell, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f, true, nil
+		}
+		switch strings.ToLower(cell) {
+		case "true":
+			return true, true, nil
+		case "false":
+			return false, true, nil
+		}
+		if t, err := time.Parse(layout, cell); err == nil {
+			return t, true, nil
+		}
+		return cell, true, nil
+	}
+	return nil, false, fmt.Errorf("unknown field type %d", typ)
+}
+
+// setField 按照点号路径写入字段,中间缺少的层级会被创建
+func setField(doc map[string]interface{}, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	node := doc
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := node[part].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			node[part] = child
+		}
+		node = child
+	}
+	node[parts[len(parts)-1]] = value
+}
+
+// WriteCSV 把文档以 CSV 格式写入 w,可以用于任意查询的结果
+//
+// 介绍:
+// 第一行是表头,之后每个文档一行。嵌套的 map 被展开为以点号连接的列名,例如 info.email;
+// 数组等其他复合值写成 JSON,时间写成 RFC 3339 格式,文档中不存在的字段为空单元格。
+//
+// 参数:
+// - w: 输出
+// - docs: 要写入的文档,例如 Find 或 Query 的结果
+// - columns: 要写入的列,可以使用点号选择嵌套字段;为空时使用文档中出现的所有字段,按字母顺序排列
+//
+// 返回值:
+// - error: 写入 w 时的错误
+func WriteCSV(w io.Writer, docs []map[string]interface{}, columns []string) error {
+	if len(columns) == 0 {
+		seen := make(map[string]struct{})
+		for _, doc := range docs {
+			collectColumns(doc, "", seen)
+		}
+		columns = sortedColumns(seen, "")
+	}
+
+	writer := newCSVWriter(w, columns)
+	for _, doc := range docs {
+		writer.write(doc)
+	}
+	return writer.flush()
+}
+
+// csvWriter 按照固定的列写入文档
+type csvWriter struct {
+	writer  *csv.Writer
+	columns []string
+	record  []string
+}
+
+// newCSVWriter 创建一个 csvWriter 并写入表头
+func newCSVWriter(w io.Writer, columns []string) *csvWriter {
+	cw := &csvWriter{writer: csv.NewWriter(w), columns: columns, record: make([]string, len(columns))}
+	cw.writer.Write(columns)
+	return cw
+}
+
+// write 写入一个文档,错误在 flush 时返回
+func (cw *csvWriter) write(doc map[string]interface{}) {
+	for i, column := range cw.columns {
+		value, _ := lookupField(doc, column)
+		cw.record[i] = formatCSVValue(value)
+	}
+	cw.writer.Write(cw.record)
+}
+
+// flush 把缓冲的内容写入底层的 io.Writer,并返回写入过程中的第一个错误
+func (cw *csvWriter) flush() error {
+	cw.writer.Flush()
+	return cw.writer.Error()
+}
+
+// collectColumns 把文档中所有叶子字段的点号路径加入 seen
+func collectColumns(doc map[string]interface{}, prefix string, seen map[string]struct{}) {
+	for key, value := range doc {
+		if nested, ok := value.(map[string]interface{}); ok && len(nested) > 0 {
+			collectColumns(nested, prefix+key+".", seen)
+			continue
+		}
+		seen[prefix+key] = struct{}{}
+	}
+}
+
+// sortedColumns 返回按字母顺序排列的列名,first 不为空时排在最前面
+func sortedColumns(seen map[string]struct{}, first string) []string {
+	columns := make([]string, 0, len(seen))
+	for column := range seen {
+		if column != first {
+			columns = append(columns, column)
+		}
+	}
+	sort.Strings(columns)
+	if _, ok := seen[first]; ok && first != "" {
+		columns = append([]string{first}, columns...)
+	}
+	return columns
+}
+
+// formatCSVValue 把字段值格式化为单元格的内容
+func formatCSVValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return string(data)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// exportCSV 把快照中满足 filter 的文档以 CSV 格式写入 w,返回导出的文档数量
+func (db *Database) exportCSV(snap *Snapshot, w io.Writer, filter Filter) (int, error) {
+	seen := make(map[string]struct{})
+	snap.forEach(func(_ string, data map[string]interface{}) bool {
+		if matchFilter(data, filter) {
+			collectColumns(data, "", seen)
+		}
+		return true
+	})
+
+	writer := newCSVWriter(w, sortedColumns(seen, db.primaryKey))
+	count := 0
+	snap.forEach(func(_ string, data map[string]interface{}) bool {
+		if matchFilter(data, filter) {
+			writer.write(data)
+			count++
+		}
+		return true
+	})
+	if err := writer.flush(); err != nil {
+		db.logTo(LogSubsystemQuery, LogLevelError, "Export failed", slog.String("op", "export"), slog.Int("count", count), slog.Any("error", err))
+		return count, fmt.Errorf("failed to export documents: %w", err)
+	}
+
+	db.logTo(LogSubsystemQuery, LogLevelInfo, "Exported documents", slog.String("op", "export"), slog.Int("count", count))
+	return count, nil
+}
@@ -0,0 +1,116 @@
+package jsonDB
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportCSV(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	input := `user_id,name,age,score,active,joined,info.email,notes
+007,Alice,30,9.5,true,2024-01-02,a@example.com,
+008,Bob,25,7,false,2024-02-03,b@example.com,hello
+`
+	result, err := db.Import(strings.NewReader(input),
+		ImportFormat(FormatCSV),
+		ImportKeyColumn("user_id"),
+		ImportColumns(
+			CSVColumn{Header: "score", Type: FieldTypeFloat},
+			CSVColumn{Header: "joined", Type: FieldTypeTime, Layout: "2006-01-02"},
+			CSVColumn{Header: "notes", Field: "-"},
+		))
+	if err != nil || result.Inserted != 2 {
+		t.Fatalf("Expected 2 imported documents, got %+v %v", result, err)
+	}
+
+	doc, ok := db.Get("007")
+	if !ok {
+		t.Fatal("Expected document 007")
+	}
+	want := map[string]interface{}{
+		"id":     "007",
+		"name":   "Alice",
+		"age":    int64(30),
+		"score":  9.5,
+		"active": true,
+		"joined": time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		"info":   map[string]interface{}{"email": "a@example.com"},
+	}
+	for field, value := range want {
+		if !jsonEqual(doc[field], value) {
+			t.Errorf("Field %s: expected %v (%T), got %v (%T)", field, value, value, doc[field], doc[field])
+		}
+	}
+	if _, ok := doc["notes"]; ok {
+		t.Error("Ignored column must not be imported")
+	}
+	if bob, _ := db.Get("008"); bob["score"] != float64(7) || bob["active"] != false {
+		t.Errorf("Unexpected document: %v", bob)
+	}
+
+	// 类型错误时报告行号和列名
+	_, err = db.Import(strings.NewReader("id,age\n1,x\n"), ImportFormat(FormatCSV),
+		ImportColumns(CSVColumn{Header: "age", Type: FieldTypeInt}))
+	if err == nil || !strings.Contains(err.Error(), `line 2, column "age"`) {
+		t.Errorf("Expected a parse error with position, got %v", err)
+	}
+	if _, err := db.Import(strings.NewReader("name\nx\n"), ImportFormat(FormatCSV), ImportKeyColumn("user_id")); err == nil {
+		t.Error("Expected error for a missing key column")
+	}
+
+	// 自动推断的类型不会是 NaN 或者无穷大,这些单元格保留为字符串,导出时仍然是合法的 JSON
+	if _, err := db.Import(strings.NewReader("id,name,rank\nn1,Nan,inf\nn2,NaN,-Infinity\n"), ImportFormat(FormatCSV)); err != nil {
+		t.Fatalf("Failed to import CSV: %v", err)
+	}
+	if doc, _ := db.Get("n1"); doc["name"] != "Nan" || doc["rank"] != "inf" {
+		t.Errorf("Expected non-finite cells to stay strings, got %v", doc)
+	}
+	var buf bytes.Buffer
+	if _, err := db.Export(&buf, Filter{"id": "n2"}, FormatJSONLines); err != nil || !strings.Contains(buf.String(), `"rank":"-Infinity"`) {
+		t.Errorf("Expected the document to be exported as JSON, got %q, %v", buf.String(), err)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	db.Insert(map[string]interface{}{"id": "1", "name": "Alice, A.", "age": 30, "info": map[string]interface{}{"email": "a@example.com"}, "tags": []interface{}{"x"}})
+	db.Insert(map[string]interface{}{"id": "2", "name": "Bob", "age": 25.5})
+
+	var buf bytes.Buffer
+	docs := db.Find(Filter{"id": "1"})
+	if err := WriteCSV(&buf, docs, []string{"id", "info.email", "tags", "missing"}); err != nil {
+		t.Fatalf("WriteCSV failed: %v", err)
+	}
+	if want := "id,info.email,tags,missing\n1,a@example.com,\"[\"\"x\"\"]\",\n"; buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+
+	// 导出的 CSV 可以原样导入
+	buf.Reset()
+	count, err := db.Export(&buf, nil, FormatCSV)
+	if err != nil || count != 2 {
+		t.Fatalf("Expected 2 exported documents, got %d %v", count, err)
+	}
+	if header := strings.SplitN(buf.String(), "\n", 2)[0]; header != "id,_rev,_updatedAt,age,info.email,name,tags" {
+		t.Errorf("Unexpected header: %s", header)
+	}
+	target, err := db.CreateCollection("copy", "id")
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	if _, err := target.Import(&buf, ImportFormat(FormatCSV), ImportKeyColumn("id")); err != nil {
+		t.Fatalf("Failed to import exported CSV: %v", err)
+	}
+	if doc, _ := target.Get("1"); doc["name"] != "Alice, A." || doc["age"] != int64(30) || !jsonEqual(doc["info"], map[string]interface{}{"email": "a@example.com"}) {
+		t.Errorf("Unexpected round-tripped document: %v", doc)
+	}
+	if doc, _ := target.Get("2"); doc["age"] != 25.5 {
+		t.Errorf("Unexpected round-tripped document: %v", doc)
+	}
+}
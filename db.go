@@ -3,112 +3,238 @@ package jsonDB
 import (
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Database 结构体定义了数据库的核心结构
+//
+// 一个数据库目录中可以包含多个集合,它们共享同一个 engine(数据文件、WAL、锁和工作池),
+// 各自拥有独立的文档、索引、主键和模式。NewDatabase 返回的是默认集合,
+// 命名集合通过 CreateCollection 和 Collection 获得,它们同样是 *Database。
 type Database struct {
-	data       *sync.Map      // 存储文档的主要数据结构,使用 sync.Map 保证并发安全
-	indexes    *sync.Map      // 存储索引的数据结构,也使用 sync.Map 保证并发安全
-	primaryKey string         // 主键的字段名
-	dbPath     string         // 数据库文件的存储路径
-	dataFile   *os.File       // 数据文件的文件句柄
-	walFile    *os.File       // Write-Ahead Log (WAL) 文件的文件句柄
-	mu         sync.RWMutex   // 用于保护文件操作的读写锁
-	workerPool chan struct{}  // 用于限制并发写操作的工作池
-	docCount   int64          // 文档总数,使用原子操作保证并发安全
-	writeWg    sync.WaitGroup // 用于等待所有写操作完成的等待组
-	logger     Logger         // 日志器
+	*engine // 同一数据库目录中的所有集合共享的存储引擎
+
+	name       string    // 集合名称,默认集合为空字符串
+	id         uint32    // 集合ID,写入 WAL 和数据文件,默认集合为 0
+	dropped    bool      // 集合是否已经被删除,由 engine.mu 保护
+	data       *sync.Map // 存储文档的主要数据结构,使用 sync.Map 保证并发安全
+	indexes    *sync.Map // 存储索引的数据结构,也使用 sync.Map 保证并发安全
+	primaryKey string    // 主键的字段名
+	docCount   int64     // 文档总数,使用原子操作保证并发安全
+	tombstones *sync.Map // 为快照保留的已删除文档,key 是文档ID,value 是 *tombstone
+
+	keyPolicy KeyPolicy        // 文档缺少主键时的主键生成策略
+	keySeq    uint64           // 整数主键序列的当前值,使用原子操作访问
+	timeKeys  timeKeyGenerator // UUIDv7 和 ULID 主键的生成器
+
+	schema atomic.Pointer[Schema] // 写入时用于校验文档的 JSON Schema,为 nil 时不校验
+
+	hookMu sync.Mutex              // 保护钩子的注册
+	hooks  atomic.Pointer[hookSet] // 写操作的钩子,为 nil 时没有注册任何钩子
+
+	ttlRules atomic.Pointer[[]ttlRule] // 集合上的 TTL 索引,为 nil 时文档永不过期
+
+	fieldCrypt atomic.Pointer[fieldEncryption] // 字段加密规则,为 nil 时不加密任何字段
+}
+
+// engine 是同一数据库目录中所有集合共享的存储引擎
+type engine struct {
+	dbPath     string                          // 数据库文件的存储路径
+	dataFile   *os.File                        // 数据文件的文件句柄
+	walFile    *os.File                        // Write-Ahead Log (WAL) 文件的文件句柄
+	mu         sync.RWMutex                    // 用于保护文件操作的读写锁
+	workerPool chan struct{}                   // 用于限制并发写操作的工作池
+	writeWg    sync.WaitGroup                  // 用于等待所有写操作完成的等待组
+	logger     Logger                          // 日志器
+	redaction  atomic.Pointer[RedactionPolicy] // 日志的脱敏策略,为 nil 时只脱敏字段级加密的字段
+	commitMu   sync.RWMutex                    // 提交锁:单文档写操作和读操作持有读锁,事务提交、创建快照和集合管理持有写锁
+	lsn        uint64                          // 最后一条 WAL 记录的日志序列号(LSN),使用原子操作读取
+	closed     atomic.Bool                     // 数据库是否已经关闭,保证关闭只执行一次
+
+	snapshotMu       sync.Mutex             // 保护快照注册表
+	snapshots        map[*Snapshot]struct{} // 当前活跃的快照
+	activeSnapshots  int32                  // 活跃快照数量,写操作据此决定是否保留旧版本
+	retainedVersions int64                  // 为快照保留的旧版本数量,为 0 时释放快照无需回收
+
+	collMu           sync.RWMutex         // 保护集合注册表
+	root             *Database            // 默认集合
+	collections      map[uint32]*Database // 命名集合,key 是集合ID
+	nextCollectionID uint32               // 下一个命名集合的ID,集合ID不会被重复使用,由 mu 保护
+
+	walStartLSN uint64                     // 最近一次检查点时的 LSN,WAL 中只有在它之后的记录,由 mu 保护
+	watchMu     sync.Mutex                 // 保护变更流注册表
+	watchers    map[*ChangeStream]struct{} // 所有集合上活跃的变更流
+
+	reapInterval time.Duration  // 后台清理过期文档的间隔
+	reaperOnce   sync.Once      // 保证清理器只启动一次
+	reaperStop   chan struct{}  // 关闭数据库时关闭,通知清理器退出
+	reaperWg     sync.WaitGroup // 用于等待清理器退出
+	reaperMu     sync.Mutex     // 保护 reaperStats
+	reaperStats  ReaperStats    // 清理器的统计信息
+
+	walSize        int64          // WAL 文件当前的大小,由 mu 保护
+	walSegmentSize int64          // WAL 达到这个大小时轮转,为 0 时只在打开数据库时检查点
+	walArchiveDir  string         // 保存轮转下来的 WAL 段的目录,为空时不归档
+	walReaders     sync.RWMutex   // 读取 WAL 文件的操作(例如增量备份)持有读锁,轮转只在没有读者时进行
+	walRotate      chan struct{}  // 通知轮转器 WAL 已经达到段大小
+	rotatorStop    chan struct{}  // 关闭数据库时关闭,通知轮转器退出
+	rotatorWg      sync.WaitGroup // 用于等待轮转器退出
+
+	readOnly atomic.Bool               // 数据库是否只读,作为 follower 时只接受 leader 复制过来的写入
+	replMu   sync.Mutex                // 保护 replicas 和 follower
+	replicas map[*replicaFeed]struct{} // 连接到本数据库的 follower
+	follower *follower                 // 作为 follower 时的复制状态,为 nil 时不是 follower
+
+	keys       KeyProvider   // 加密数据文件和 WAL 的密钥,为 nil 时不加密
+	dataWriter *recordWriter // 向数据文件追加记录,每次检查点时重新创建,由 mu 保护
+	walWriter  *recordWriter // 向 WAL 追加记录,每次检查点时重新创建,由 mu 保护
+
+	loggerMu         sync.Mutex                        // 保护子系统日志器的设置
+	subsystemLoggers atomic.Pointer[map[string]Logger] // 单独设置了日志器的子系统,为 nil 时都使用 logger
+}
+
+// newCollectionDatabase 创建属于 engine 的一个空集合
+func newCollectionDatabase(e *engine, id uint32, name, primaryKey string) *Database {
+	return &Database{
+		engine:     e,
+		id:         id,
+		name:       name,
+		data:       &sync.Map{}, // 初始化文档存储
+		indexes:    &sync.Map{}, // 初始化索引存储
+		primaryKey: primaryKey,  // 设置主键
+		tombstones: &sync.Map{}, // 初始化已删除文档的版本存储
+	}
 }
 
 // NewDatabase 创建一个新的数据库实例
-func NewDatabase(primaryKey, dbPath string, numWorkers int) (*Database, error) {
-	db := &Database{
-		data:       &sync.Map{},                     // 初始化文档存储
-		indexes:    &sync.Map{},                     // 初始化索引存储
-		primaryKey: primaryKey,                      // 设置主键
-		dbPath:     dbPath,                          // 设置数据库路径
-		workerPool: make(chan struct{}, numWorkers), // 创建工作池通道
-		logger:     NewDefaultLogger(),              // 创建默认日志器
+// opts 为可选配置项,例如 WithKeyPolicy
+func NewDatabase(primaryKey, dbPath string, numWorkers int, opts ...Option) (*Database, error) {
+	e := &engine{
+		dbPath:           dbPath,                           // 设置数据库路径
+		workerPool:       make(chan struct{}, numWorkers),  // 创建工作池通道
+		logger:           NewDefaultLogger(),               // 创建默认日志器
+		snapshots:        make(map[*Snapshot]struct{}),     // 初始化快照注册表
+		collections:      make(map[uint32]*Database),       // 初始化集合注册表
+		watchers:         make(map[*ChangeStream]struct{}), // 初始化变更流注册表
+		reapInterval:     DefaultTTLInterval,               // 设置默认的过期文档清理间隔
+		reaperStop:       make(chan struct{}),
+		walRotate:        make(chan struct{}, 1),
+		rotatorStop:      make(chan struct{}),
+		replicas:         make(map[*replicaFeed]struct{}),
+		nextCollectionID: 1,
+	}
+	db := newCollectionDatabase(e, 0, "", primaryKey)
+	e.root = db
+	for _, opt := range opts {
+		opt(db)
 	}
 
-	db.logger.Info(fmt.Sprintf("Initializing database with primary key: %s, path: %s, workers: %d", primaryKey, dbPath, numWorkers))
+	start := time.Now()
+	db.log(LogLevelInfo, "Initializing database", slog.String("primary_key", primaryKey), slog.String("path", dbPath), slog.Int("workers", numWorkers), slog.String("policy", db.keyPolicy.String()))
 
 	if err := os.MkdirAll(dbPath, DBDirPerm); err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to create database directory: %v", err))
+		db.log(LogLevelError, "Failed to create database directory", slog.Any("error", err))
 		return nil, fmt.Errorf("failed to create database directory: %w", err)
 	}
 
 	var err error
 	db.dataFile, err = os.OpenFile(filepath.Join(dbPath, DataFileName), FileOpenModeRW, DBFilePerm)
 	if err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to open data file: %v", err))
+		db.log(LogLevelError, "Failed to open data file", slog.Any("error", err))
 		return nil, fmt.Errorf("failed to open data file: %w", err)
 	}
 
 	db.walFile, err = os.OpenFile(filepath.Join(dbPath, WALFileName), FileOpenModeWAL, DBFilePerm)
 	if err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to open WAL file: %v", err))
+		db.logTo(LogSubsystemWAL, LogLevelError, "Failed to open WAL file", slog.Any("error", err))
 		return nil, fmt.Errorf("failed to open WAL file: %w", err)
 	}
 
+	if err = db.loadMeta(); err != nil {
+		db.log(LogLevelError, "Failed to load metadata", slog.Any("error", err))
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
 	if err = db.loadData(); err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to load data: %v", err))
+		db.log(LogLevelError, "Failed to load data", slog.Any("error", err))
 		return nil, fmt.Errorf("failed to load data: %w", err)
 	}
 
 	if err = db.recoverFromWAL(); err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to recover from WAL: %v", err))
+		db.logTo(LogSubsystemWAL, LogLevelError, "Failed to recover from WAL", slog.Any("error", err))
 		return nil, fmt.Errorf("failed to recover from WAL: %w", err)
 	}
 
-	db.logger.Info("Database initialized successfully")
+	// 将恢复后的数据写回数据文件并清空 WAL
+	if err = db.checkpoint(); err != nil {
+		db.logTo(LogSubsystemWAL, LogLevelError, "Failed to checkpoint database", slog.Any("error", err))
+		return nil, fmt.Errorf("failed to checkpoint database: %w", err)
+	}
+
+	db.startWALRotator()
+	db.log(LogLevelInfo, "Database initialized", slog.Int64("count", atomic.LoadInt64(&db.docCount)), slog.Duration("duration", time.Since(start)))
 	return db, nil
 }
 
 // SetLogLevel 设置日志级别
+// 只作用于数据库的日志器,通过 SetSubsystemLogger 单独设置的子系统日志器保持自己的级别
 func (db *Database) SetLogLevel(level LogLevel) {
 	db.logger.SetLevel(level)
-	db.logger.Info(fmt.Sprintf("Log level set to: %v", level))
+	db.log(LogLevelInfo, "Log level changed", slog.Int("level", int(level)))
 }
 
 // LogLevelOff 关闭日志
 func (db *Database) LogLevelOff() {
 	db.SetLogLevel(LogLevelOff)
-	db.logger.Info("Logging turned off")
+	db.log(LogLevelInfo, "Logging turned off")
 }
 
 // SetLogOutput 设置日志输出
+// 只作用于数据库的日志器;SlogLogger 的输出由它的 slog.Handler 决定,不受影响
 func (db *Database) SetLogOutput(output io.Writer) {
 	db.logger.SetOutput(output)
-	db.logger.Info("Log output changed")
+	db.log(LogLevelInfo, "Log output changed")
 }
 
 // Close 关闭数据库,确保所有写操作完成并关闭文件句柄
+// 所有集合共享同一组文件,关闭任意一个集合都会关闭整个数据库目录,之后再次关闭返回错误
 func (db *Database) Close() error {
-	db.logger.Info("Closing database")
+	if !db.closed.CompareAndSwap(false, true) {
+		db.log(LogLevelWarn, "Database already closed")
+		return fmt.Errorf("failed to close database: %w", os.ErrClosed)
+	}
+	db.log(LogLevelInfo, "Closing database")
+	db.stopFollowing()   // 停止应用 leader 的记录
+	close(db.reaperStop) // 通知过期文档清理器退出
+	db.reaperWg.Wait()
+	close(db.rotatorStop) // 通知 WAL 轮转器退出
+	db.rotatorWg.Wait()
 	db.writeWg.Wait() // 等待所有写操作完成
+	db.closeWatchers(nil, nil)
+	db.closeReplicas()
 
 	// 关闭数据文件
 	if err := db.dataFile.Close(); err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to close data file: %v", err))
+		db.log(LogLevelError, "Failed to close data file", slog.Any("error", err))
 		return fmt.Errorf("failed to close data file: %w", err)
 	}
 	// 关闭WAL文件
 	if err := db.walFile.Close(); err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to close WAL file: %v", err))
+		db.logTo(LogSubsystemWAL, LogLevelError, "Failed to close WAL file", slog.Any("error", err))
 		return fmt.Errorf("failed to close WAL file: %w", err)
 	}
-	db.logger.Info("Database closed successfully")
+	db.log(LogLevelInfo, "Database closed")
 	return nil
 }
 
 // Count 返回数据库中的文档总数
 func (db *Database) Count() int64 {
 	count := atomic.LoadInt64(&db.docCount) // 原子操作读取文档数量
-	db.logger.Debug(fmt.Sprintf("Current document count: %d", count))
+	db.log(LogLevelDebug, "Current document count", slog.Int64("count", count))
 	return count
 }
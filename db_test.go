@@ -59,7 +59,7 @@ func TestDatabaseStressInsert(t *testing.T) {
 		go func(id int) {
 			defer wg.Done()
 			doc := generateTestDocument(id)
-			if err := db.Insert(doc); err != nil {
+			if _, err := db.Insert(doc); err != nil {
 				t.Errorf("Failed to insert document %d: %v", id, err)
 			}
 		}(i)
@@ -82,7 +82,7 @@ func TestDatabaseStressQuery(t *testing.T) {
 	// Insert test data
 	for i := 0; i < numDocuments; i++ {
 		doc := generateTestDocument(i)
-		if err := db.Insert(doc); err != nil {
+		if _, err := db.Insert(doc); err != nil {
 			t.Fatalf("Failed to insert document %d: %v", i, err)
 		}
 	}
@@ -118,7 +118,7 @@ func TestDatabaseStressMixedOperations(t *testing.T) {
 	// Insert initial test data
 	for i := 0; i < numDocuments; i++ {
 		doc := generateTestDocument(i)
-		if err := db.Insert(doc); err != nil {
+		if _, err := db.Insert(doc); err != nil {
 			t.Fatalf("Failed to insert document %d: %v", i, err)
 		}
 	}
@@ -142,7 +142,7 @@ func TestDatabaseStressMixedOperations(t *testing.T) {
 			switch rand.Intn(4) {
 			case 0: // Insert
 				doc := generateTestDocument(numDocuments + opID)
-				if err := db.Insert(doc); err != nil {
+				if _, err := db.Insert(doc); err != nil {
 					select {
 					case errorsChan <- fmt.Errorf("Insert error: %v", err):
 					default:
@@ -212,7 +212,7 @@ func TestDatabaseStressWithTempConcurrentReads(t *testing.T) {
 	// Insert test data
 	for i := 0; i < numDocuments; i++ {
 		doc := generateTestDocument(i)
-		if err := db.Insert(doc); err != nil {
+		if _, err := db.Insert(doc); err != nil {
 			t.Fatalf("Failed to insert document %d: %v", i, err)
 		}
 	}
@@ -253,7 +253,7 @@ func TestDatabaseStressWithTempConcurrentWrites(t *testing.T) {
 			defer wg.Done()
 			for j := 0; j < numOperations/numWorkers; j++ {
 				doc := generateTestDocument(workerID*numOperations/numWorkers + j)
-				if err := db.Insert(doc); err != nil {
+				if _, err := db.Insert(doc); err != nil {
 					t.Errorf("Failed to insert document: %v", err)
 				}
 			}
@@ -277,7 +277,7 @@ func TestDatabaseStressWithTempDiskUsage(t *testing.T) {
 	// Insert test data
 	for i := 0; i < numDocuments; i++ {
 		doc := generateTestDocument(i)
-		if err := db.Insert(doc); err != nil {
+		if _, err := db.Insert(doc); err != nil {
 			t.Fatalf("Failed to insert document %d: %v", i, err)
 		}
 	}
@@ -314,7 +314,7 @@ func TestFuzzyQuery(t *testing.T) {
 	}
 
 	for _, doc := range testData {
-		if err := db.Insert(doc); err != nil {
+		if _, err := db.Insert(doc); err != nil {
 			t.Fatalf("Failed to insert document: %v", err)
 		}
 	}
@@ -355,7 +355,7 @@ func TestRangeQuery(t *testing.T) {
 	}
 
 	for _, doc := range testData {
-		if err := db.Insert(doc); err != nil {
+		if _, err := db.Insert(doc); err != nil {
 			t.Fatalf("Failed to insert document: %v", err)
 		}
 	}
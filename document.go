@@ -2,15 +2,20 @@ package jsonDB
 
 import (
 	"encoding/json"
-	"fmt"         // 导入格式化包
+	"errors"
+	"fmt" // 导入格式化包
+	"log/slog"
 	"sync"        // 导入同步包
 	"sync/atomic" // 导入原子操作包
+	"time"
 )
 
 // Document 结构体表示数据库中的一个文档
 type Document struct {
-	data map[string]interface{} // 存储文档数据的map
-	mu   sync.RWMutex           // 用于保护文档数据的读写锁
+	data map[string]interface{}   // 存储文档数据的map
+	mu   sync.RWMutex             // 用于保护文档数据的读写锁
+	seq  uint64                   // 写入这个版本的 WAL 记录的 LSN
+	prev atomic.Pointer[Document] // 同一文档的上一个版本,只在有活跃快照时保留
 }
 
 // Insert 方法用于向数据库中插入新文档
@@ -31,119 +36,180 @@ type Document struct {
 // Insert 方法在整个过程中都采取了必要的并发控制措施，确保了数据的一致性和完整性。
 // 同时，该方法还实现了详细的日志记录，有助于监控和调试。
 //
+// 如果文档缺少主键字段，并且数据库通过 WithKeyPolicy 设置了主键生成策略，
+// Insert 会生成一个主键写入文档；否则返回 ErrMissingPrimaryKey。
+//
 // 参数:
 // - docData: 要插入的文档数据，可以是 map[string]interface{} 或 JSON 字符串
 //
 // 返回值:
+// - string: 文档主键的字符串形式（调用方指定的或自动生成的）
 // - error: 如果插入过程中发生错误，将返回相应的错误信息；如果插入成功，则返回 nil
-func (db *Database) Insert(docData interface{}) error {
+func (db *Database) Insert(docData interface{}) (string, error) {
 	// 记录 Insert 操作的开始
-	db.logger.Debug("Starting Insert operation")
+	db.log(LogLevelDebug, "Starting insert")
 
-	var doc map[string]interface{}
+	// 解析输入并提取主键
+	doc, idStr, err := db.parseDocument(docData)
+	if err != nil {
+		return "", err
+	}
+	db.log(LogLevelDebug, "Parsed document", slog.String("id", idStr))
 
-	// 使用 switch 语句处理不同类型的输入
-	switch v := docData.(type) {
-	case map[string]interface{}:
-		// 如果输入已经是 map[string]interface{}，直接使用
-		doc = v
-		db.logger.Debug("Input is a map[string]interface{}")
-	case string:
-		// 如果输入是字符串，尝试解析为 JSON
-		db.logger.Debug("Input is a JSON string, attempting to parse")
-		if err := json.Unmarshal([]byte(v), &doc); err != nil {
-			// JSON 解析失败，记录错误并返回
-			db.logger.Error(fmt.Sprintf("Failed to parse JSON string: %v", err))
-			return fmt.Errorf("failed to parse JSON string: %w", err)
-		}
-		db.logger.Debug("Successfully parsed JSON string")
-	default:
-		// 不支持的输入类型，记录错误并返回
-		db.logger.Error(fmt.Sprintf("Unsupported input type: %T", docData))
-		return fmt.Errorf("unsupported input type: %T", docData)
+	// 调用 BeforeInsert 钩子,钩子可以修改文档或者拒绝插入
+	if doc, err = db.runBeforeInsert(idStr, doc); err != nil {
+		return "", err
 	}
 
-	// 检查文档中是否包含主键
-	id, ok := doc[db.primaryKey]
-	if !ok {
-		// 主键不存在，记录错误并返回
-		db.logger.Error(fmt.Sprintf("Primary key '%s' not found in document", db.primaryKey))
-		return fmt.Errorf("primary key '%s' not found in document", db.primaryKey)
+	// 使用数据库的模式校验文档
+	if err := db.validateDocument(idStr, doc); err != nil {
+		return "", err
 	}
 
-	// 将主键转换为字符串
-	idStr := fmt.Sprintf("%v", id)
-	db.logger.Debug(fmt.Sprintf("Document ID: %s", idStr))
+	// 校验之后加密字段,之后的 WAL 和内存中都只有密文
+	if doc, err = db.encryptFields(doc); err != nil {
+		return "", err
+	}
+
+	// AfterInsert 钩子在插入成功并释放所有锁之后调用
+	inserted := false
+	defer func() {
+		if inserted {
+			db.runAfterHooks(walEntry{Operation: OperationInsert, ID: idStr, Document: doc})
+		}
+	}()
+
+	// 持有提交锁的读锁,保证事务提交期间不会有单文档写入交错
+	db.commitMu.RLock()
+	defer db.commitMu.RUnlock()
 
 	// 检查具有相同 ID 的文档是否已存在
-	if _, exists := db.Get(idStr); exists {
+	if _, exists := db.data.Load(idStr); exists {
 		// 文档已存在，记录警告并返回错误
-		db.logger.Warn(fmt.Sprintf("Document with id '%s' already exists", idStr))
-		return fmt.Errorf("document with id '%s' already exists", idStr)
+		db.log(LogLevelWarn, "Document already exists", slog.String("op", "insert"), slog.String("id", idStr))
+		return "", &DocumentExistsError{ID: idStr}
 	}
 
-	// 创建新的 Document 对象
-	newDoc := &Document{
-		data: doc,
-	}
+	// 复制文档数据并写入修订号等元数据,避免修改调用方传入的 map
+	doc = copyDocumentData(doc)
+	stampRevision(doc, db.insertRevision())
 
 	// 将插入操作写入 WAL
-	db.logger.Debug("Writing to WAL")
-	if err := db.writeWAL(OperationInsert, idStr, doc); err != nil {
+	db.log(LogLevelDebug, "Writing to WAL", slog.String("id", idStr))
+	lsn, err := db.writeWAL(OperationInsert, idStr, doc, nil)
+	if err != nil {
 		// WAL 写入失败，记录错误并返回
-		db.logger.Error(fmt.Sprintf("Failed to write to WAL: %v", err))
-		return fmt.Errorf("failed to write to WAL: %w", err)
+		db.log(LogLevelError, "Failed to write to WAL", slog.String("id", idStr), slog.Any("error", err))
+		return "", fmt.Errorf("failed to write to WAL: %w", err)
 	}
 
+	// 创建新的 Document 对象
+	newDoc := db.newVersion(doc, lsn, nil)
+
 	// 获取写锁
-	db.logger.Debug("Acquiring write lock")
+	db.log(LogLevelDebug, "Acquiring write lock")
 	db.writeWg.Add(1)
 	db.workerPool <- struct{}{}
 	defer func() {
 		<-db.workerPool
 		db.writeWg.Done()
-		db.logger.Debug("Released write lock")
+		db.log(LogLevelDebug, "Released write lock")
 	}()
 
 	// 将文档存储在内存中
-	db.logger.Debug("Storing document in memory")
+	db.log(LogLevelDebug, "Storing document in memory")
 	db.data.Store(idStr, newDoc)
 
 	// 更新所有索引
-	db.logger.Debug("Updating indexes")
+	db.logTo(LogSubsystemIndex, LogLevelDebug, "Updating indexes", slog.String("id", idStr))
 	db.indexes.Range(func(_, indexValue interface{}) bool {
 		switch idx := indexValue.(type) {
 		case *Index:
 			// 更新单字段索引
-			db.logger.Debug(fmt.Sprintf("Updating single field index for field: %s", idx.field))
+			db.logTo(LogSubsystemIndex, LogLevelDebug, "Updating single field index", slog.String("field", idx.field))
 			db.indexDocument(newDoc, idStr, idx)
 		case *CompositeIndex:
 			// 更新复合索引
-			db.logger.Debug(fmt.Sprintf("Updating composite index for fields: %v", idx.fields))
+			db.logTo(LogSubsystemIndex, LogLevelDebug, "Updating composite index", slog.Any("fields", idx.fields))
 			db.indexDocumentComposite(newDoc, idStr, idx)
 		}
 		return true
 	})
 
 	// 增加文档计数
-	db.logger.Debug("Incrementing document count")
+	db.log(LogLevelDebug, "Incrementing document count")
 	atomic.AddInt64(&db.docCount, 1)
 
 	// 异步将文档写入数据文件
-	db.logger.Debug("Starting asynchronous write to data file")
+	db.log(LogLevelDebug, "Starting asynchronous write to data file")
+	db.writeWg.Add(1)
 	go func() {
+		defer db.writeWg.Done()
 		if err := db.writeToDataFile(idStr, doc); err != nil {
 			// 数据文件写入失败，记录错误
-			db.logger.Error(fmt.Sprintf("Failed to write document to data file: %v", err))
+			db.log(LogLevelError, "Failed to write document to data file", slog.String("id", idStr), slog.Any("error", err))
 		} else {
 			// 数据文件写入成功
-			db.logger.Debug("Successfully wrote document to data file")
+			db.log(LogLevelDebug, "Successfully wrote document to data file", slog.String("id", idStr))
 		}
 	}()
 
 	// 记录插入操作成功
-	db.logger.Info(fmt.Sprintf("Successfully inserted document with id: %s", idStr))
-	return nil
+	db.log(LogLevelInfo, "Inserted document", slog.String("op", "insert"), slog.String("id", idStr))
+	inserted = true
+	return idStr, nil
+}
+
+// parseDocument 将 Insert 的输入解析为文档数据,并返回字符串形式的主键
+func (db *Database) parseDocument(docData interface{}) (map[string]interface{}, string, error) {
+	var doc map[string]interface{}
+
+	// 使用 switch 语句处理不同类型的输入
+	switch v := docData.(type) {
+	case map[string]interface{}:
+		// 如果输入已经是 map[string]interface{}，直接使用
+		doc = v
+		db.log(LogLevelDebug, "Input is a map[string]interface{}")
+	case string:
+		// 如果输入是字符串，尝试解析为 JSON
+		db.log(LogLevelDebug, "Input is a JSON string, attempting to parse")
+		if err := json.Unmarshal([]byte(v), &doc); err != nil {
+			// JSON 解析失败，记录错误并返回
+			db.log(LogLevelError, "Failed to parse JSON string", slog.Any("error", err))
+			return nil, "", fmt.Errorf("failed to parse JSON string: %w", err)
+		}
+		db.log(LogLevelDebug, "Successfully parsed JSON string")
+	default:
+		// 不支持的输入类型，记录错误并返回
+		db.log(LogLevelError, "Unsupported input type", slog.Any("type", typeName{docData}))
+		return nil, "", fmt.Errorf("unsupported input type: %T", docData)
+	}
+
+	// 检查文档中是否包含主键
+	id, ok := doc[db.primaryKey]
+	if !ok {
+		if db.keyPolicy == KeyPolicyNone {
+			// 主键不存在且没有设置生成策略，记录错误并返回
+			db.log(LogLevelError, "Primary key not found in document", slog.String("field", db.primaryKey))
+			return nil, "", fmt.Errorf("%w: primary key '%s'", ErrMissingPrimaryKey, db.primaryKey)
+		}
+
+		// 按照生成策略生成主键,写入文档副本,不修改调用方传入的 map
+		key, idStr, err := db.generateKey()
+		if err != nil {
+			db.log(LogLevelError, "Failed to generate primary key", slog.Any("error", err))
+			return nil, "", fmt.Errorf("failed to generate primary key: %w", err)
+		}
+		doc = copyDocumentData(doc)
+		doc[db.primaryKey] = key
+		db.log(LogLevelDebug, "Generated primary key", slog.String("id", idStr), slog.String("policy", db.keyPolicy.String()))
+		return doc, idStr, nil
+	}
+
+	// 将主键转换为字符串,调用方指定的整数主键同样会推进主键序列
+	idStr := fmt.Sprintf("%v", id)
+	db.observeKey(idStr)
+	return doc, idStr, nil
 }
 
 // Update 方法用于更新数据库中指定ID的文档
@@ -154,8 +220,8 @@ func (db *Database) Insert(docData interface{}) error {
 // 它不仅更新内存中的文档，还会更新相关的索引，并记录更新操作到WAL(Write-Ahead Log)中。
 //
 // 实现细节:
-// 1. 使用乐观锁策略（Compare-and-Swap）来处理并发更新。
-// 2. 创建文档的新版本，而不是直接修改原文档，以支持原子性更新。
+// 1. 持有文档写锁后确认文档未被并发替换,否则重试,以此处理并发更新。
+// 2. 创建文档的新版本，而不是直接修改原文档，以支持原子性更新和快照读。
 // 3. 更新所有相关索引以保持数据一致性。
 // 4. 使用WAL记录更新操作，确保数据持久性和可恢复性。
 // 5. 异步写入数据文件，提高性能。
@@ -168,77 +234,145 @@ func (db *Database) Insert(docData interface{}) error {
 // - error: 如果更新过程中发生错误，返回相应的错误信息；如果更新成功，返回nil
 func (db *Database) Update(id string, updates map[string]interface{}) error {
 	// 记录更新尝试的日志
-	db.logger.Debug(fmt.Sprintf("Attempting to update document with ID: %s, Updates: %v", id, updates))
+	db.log(LogLevelDebug, "Attempting to update document", slog.String("id", id), slog.Any("updates", updates))
+
+	return db.modifyDocument(id, func(current map[string]interface{}) (map[string]interface{}, error) {
+		return mergeUpdates(current, updates), nil
+	})
+}
+
+// mergeUpdates 复制当前文档数据并将 updates 中的字段覆盖到副本上
+func mergeUpdates(current, updates map[string]interface{}) map[string]interface{} {
+	// 创建新的文档数据，首先复制原有数据
+	newData := make(map[string]interface{}, len(current)+len(updates))
+	for k, v := range current {
+		newData[k] = v
+	}
+
+	// 应用更新
+	for k, v := range updates {
+		newData[k] = v
+	}
+	return newData
+}
+
+// modifyDocument 是 Update 系列方法共用的原子更新流程
+//
+// mutate 在持有文档写锁的情况下被调用,根据当前文档数据生成完整的新文档数据。
+// mutate 不得修改传入的 current,如果返回错误,则整个更新被放弃,存储的文档保持不变;
+// 返回 errDocumentUnchanged 表示文档无需修改,此时不会写入 WAL。
+// 新文档生成后先写入 WAL,再替换内存中的旧文档、更新索引并异步写入数据文件。
+func (db *Database) modifyDocument(id string, mutate func(current map[string]interface{}) (map[string]interface{}, error)) error {
+	// AfterUpdate 钩子在更新成功并释放所有锁之后调用
+	var updated *walEntry
+	defer func() {
+		if updated != nil {
+			db.runAfterHooks(*updated)
+		}
+	}()
+
+	db.commitMu.RLock()
+	defer db.commitMu.RUnlock()
 
 	// 使用无限循环来处理并发更新冲突
 	for {
 		// 尝试从数据库中加载文档
-		if value, ok := db.data.Load(id); ok {
-			oldDoc := value.(*Document)
-			oldDoc.mu.Lock() // 锁定文档，防止其他goroutine同时修改
-
-			// 创建新的文档数据，首先复制原有数据
-			newData := make(map[string]interface{})
-			for k, v := range oldDoc.data {
-				newData[k] = v
-			}
+		value, ok := db.data.Load(id)
+		if !ok {
+			// 如果文档不存在，记录警告并返回错误
+			db.log(LogLevelWarn, "Document not found", slog.String("op", "update"), slog.String("id", id))
+			return &DocumentNotFoundError{ID: id}
+		}
+		oldDoc := value.(*Document)
+		oldDoc.mu.Lock() // 锁定文档，防止其他goroutine同时修改
 
-			// 应用更新
-			for k, v := range updates {
-				newData[k] = v
-			}
+		// 加锁后确认文档没有被并发替换,否则重试整个过程
+		if current, _ := db.data.Load(id); current != value {
+			oldDoc.mu.Unlock()
+			continue
+		}
+
+		// 已经过期但尚未被清理的文档视为不存在
+		if db.isExpired(oldDoc.data, time.Now()) {
+			oldDoc.mu.Unlock()
+			db.log(LogLevelWarn, "Document has expired", slog.String("op", "update"), slog.String("id", id))
+			return &DocumentNotFoundError{ID: id}
+		}
 
-			// 创建新的Document对象
-			newDoc := &Document{data: newData}
-
-			// 尝试原子性地替换旧文档
-			if db.data.CompareAndSwap(id, value, newDoc) {
-				// 更新成功，执行后续操作
-
-				// 将更新操作记录到WAL(Write-Ahead Log)
-				if err := db.writeWAL(OperationUpdate, id, newData); err != nil {
-					oldDoc.mu.Unlock() // 确保在返回错误前解锁
-					db.logger.Error(fmt.Sprintf("Failed to write to WAL: %v", err))
-					return fmt.Errorf("failed to write to WAL: %w", err)
-				}
-
-				// 更新所有相关索引
-				db.indexes.Range(func(key, value interface{}) bool {
-					switch idx := value.(type) {
-					case *Index:
-						db.updateIndex(id, oldDoc, newDoc, idx)
-					case *CompositeIndex:
-						db.updateCompositeIndex(id, oldDoc, newDoc, idx)
-					}
-					return true
-				})
-
-				// 异步写入数据文件
-				db.writeWg.Add(1)
-				go func() {
-					db.workerPool <- struct{}{} // 获取工作池令牌，限制并发写入数量
-					defer func() {
-						<-db.workerPool   // 释放工作池令牌
-						db.writeWg.Done() // 标记写入完成
-					}()
-					if err := db.writeToDataFile(id, newData); err != nil {
-						db.logger.Error(fmt.Sprintf("Error writing to data file: %v", err))
-					}
-				}()
-
-				oldDoc.mu.Unlock() // 解锁文档
-				db.logger.Info(fmt.Sprintf("Document updated successfully with ID: %s", id))
-				return nil
+		// 根据当前数据生成新的文档数据,mutate 和钩子看到的是解密之后的字段
+		current := db.revealFields(oldDoc.data)
+		newData, err := mutate(current)
+		if err != nil {
+			oldDoc.mu.Unlock()
+			if errors.Is(err, errDocumentUnchanged) {
+				db.log(LogLevelDebug, "Document unchanged, skipping write", slog.String("id", id))
+			} else {
+				db.log(LogLevelWarn, "Update rejected", slog.String("op", "update"), slog.String("id", id), slog.Any("error", err))
 			}
+			return err
+		}
 
-			oldDoc.mu.Unlock() // 解锁文档
-			// 如果 CompareAndSwap 失败，说明有并发更新，重试整个过程
-			continue
+		// 调用 BeforeUpdate 钩子,钩子可以修改新文档或者拒绝更新
+		if newData, err = db.runBeforeUpdate(id, current, newData); err != nil {
+			oldDoc.mu.Unlock()
+			return err
+		}
+
+		// 使用数据库的模式校验更新后的文档
+		if err := db.validateDocument(id, newData); err != nil {
+			oldDoc.mu.Unlock()
+			return err
+		}
+
+		// 递增修订号并记录更新时间,元数据字段不受 mutate 的影响
+		stampRevision(newData, documentRevision(oldDoc.data)+1)
+
+		// 校验之后加密字段,WAL 和内存中只保存密文
+		if newData, err = db.encryptFields(newData); err != nil {
+			oldDoc.mu.Unlock()
+			return err
+		}
+
+		// 将更新操作记录到WAL(Write-Ahead Log)
+		lsn, err := db.writeWAL(OperationUpdate, id, newData, oldDoc.data)
+		if err != nil {
+			oldDoc.mu.Unlock() // 确保在返回错误前解锁
+			db.log(LogLevelError, "Failed to write to WAL", slog.String("id", id), slog.Any("error", err))
+			return fmt.Errorf("failed to write to WAL: %w", err)
 		}
 
-		// 如果文档不存在，记录警告并返回错误
-		db.logger.Warn(fmt.Sprintf("Document with id '%s' not found", id))
-		return fmt.Errorf("document with id '%s' not found", id)
+		// 创建新版本的Document对象并替换旧文档,持有旧文档的写锁保证不会有其他写操作同时替换
+		newDoc := db.newVersion(newData, lsn, oldDoc)
+		db.data.Store(id, newDoc)
+
+		// 更新所有相关索引
+		db.indexes.Range(func(key, value interface{}) bool {
+			switch idx := value.(type) {
+			case *Index:
+				db.updateIndex(id, oldDoc, newDoc, idx)
+			case *CompositeIndex:
+				db.updateCompositeIndex(id, oldDoc, newDoc, idx)
+			}
+			return true
+		})
+
+		// 异步写入数据文件
+		db.writeWg.Add(1)
+		go func() {
+			db.workerPool <- struct{}{} // 获取工作池令牌，限制并发写入数量
+			defer func() {
+				<-db.workerPool   // 释放工作池令牌
+				db.writeWg.Done() // 标记写入完成
+			}()
+			if err := db.writeToDataFile(id, newData); err != nil {
+				db.log(LogLevelError, "Failed to write document to data file", slog.String("id", id), slog.Any("error", err))
+			}
+		}()
+
+		oldDoc.mu.Unlock() // 解锁文档
+		db.log(LogLevelInfo, "Updated document", slog.String("op", "update"), slog.String("id", id))
+		updated = &walEntry{Operation: OperationUpdate, ID: id, Document: newData, before: oldDoc.data}
+		return nil
 	}
 }
 
@@ -249,7 +383,7 @@ func (db *Database) Update(id string, updates map[string]interface{}) error {
 // 这个方法不仅从内存中删除文档,还会更新相关的索引,并记录删除操作到WAL(Write-Ahead Log)中。
 //
 // 实现细节:
-// 1. 使用 sync.Map 的 LoadAndDelete 方法原子性地删除文档。
+// 1. 持有文档写锁并确认文档未被并发替换后再删除文档。
 // 2. 更新所有相关索引以保持数据一致性。
 // 3. 使用 WAL 记录删除操作,确保数据持久性和可恢复性。
 // 4. 使用原子操作更新文档计数,保证并发安全。
@@ -261,20 +395,72 @@ func (db *Database) Update(id string, updates map[string]interface{}) error {
 // - error: 如果删除过程中发生错误,返回相应的错误信息；如果删除成功或文档不存在,返回 nil
 func (db *Database) Delete(id string) error {
 	// 记录删除尝试的日志
-	db.logger.Debug(fmt.Sprintf("Attempting to delete document with ID: %s", id))
+	db.log(LogLevelDebug, "Attempting to delete document", slog.String("id", id))
+
+	if _, deleted, err := db.deleteDocument(id, nil); err != nil || deleted {
+		return err
+	}
+
+	// 如果文档不存在,记录警告日志并静默返回
+	db.log(LogLevelWarn, "Document not found", slog.String("op", "delete"), slog.String("id", id))
+	return nil
+}
 
-	// 尝试从数据库中删除文档,LoadAndDelete 方法确保了操作的原子性
-	if value, ok := db.data.LoadAndDelete(id); ok {
+// deleteDocument 是 Delete 系列方法共用的删除流程
+//
+// 如果 check 不为 nil,会在持有文档写锁的情况下调用 check,只有 check 返回 nil 时才会删除文档,
+// 这保证了"检查条件"和"删除"之间不会有其他写操作插入;check 返回的错误会原样返回给调用方。
+// 返回被删除的文档数据(加密的字段已经解密)以及文档是否被删除。
+func (db *Database) deleteDocument(id string, check func(current map[string]interface{}) error) (map[string]interface{}, bool, error) {
+	// AfterDelete 钩子在删除成功并释放所有锁之后调用
+	var deleted *walEntry
+	defer func() {
+		if deleted != nil {
+			db.runAfterHooks(*deleted)
+		}
+	}()
+
+	db.commitMu.RLock()
+	defer db.commitMu.RUnlock()
+
+	for {
+		value, ok := db.data.Load(id)
+		if !ok {
+			return nil, false, nil
+		}
 		doc := value.(*Document)
 		// 对文档加写锁,确保在处理过程中不会被其他goroutine访问
 		doc.mu.Lock()
-		defer doc.mu.Unlock()
+
+		// 加锁后确认删除的正是检查过的版本,如果文档已被并发更新则重试
+		if current, _ := db.data.Load(id); current != value {
+			doc.mu.Unlock()
+			continue
+		}
+
+		current := db.revealFields(doc.data)
+		if check != nil {
+			if err := check(current); err != nil {
+				doc.mu.Unlock()
+				return nil, false, err
+			}
+		}
+
+		// 调用 BeforeDelete 钩子,钩子可以拒绝删除
+		if err := db.runBeforeDelete(id, current); err != nil {
+			doc.mu.Unlock()
+			return nil, false, err
+		}
 
 		// 将删除操作记录到WAL(Write-Ahead Log)
-		if err := db.writeWAL(OperationDelete, id, nil); err != nil {
-			db.logger.Error(fmt.Sprintf("Failed to write to WAL: %v", err))
-			return fmt.Errorf("failed to write to WAL: %w", err)
+		lsn, err := db.writeWAL(OperationDelete, id, nil, doc.data)
+		if err != nil {
+			doc.mu.Unlock()
+			db.log(LogLevelError, "Failed to write to WAL", slog.String("id", id), slog.Any("error", err))
+			return nil, false, fmt.Errorf("failed to write to WAL: %w", err)
 		}
+		db.data.Delete(id)
+		db.recordTombstone(id, doc, lsn)
 
 		// 更新所有相关索引
 		db.indexes.Range(func(key, value interface{}) bool {
@@ -289,15 +475,13 @@ func (db *Database) Delete(id string) error {
 
 		// 使用原子操作减少文档计数,确保并发安全
 		atomic.AddInt64(&db.docCount, -1)
+		doc.mu.Unlock()
 
 		// 记录删除成功的日志
-		db.logger.Info(fmt.Sprintf("Document deleted successfully with ID: %s", id))
-		return nil
+		db.log(LogLevelInfo, "Deleted document", slog.String("op", "delete"), slog.String("id", id))
+		deleted = &walEntry{Operation: OperationDelete, ID: id, before: doc.data}
+		return current, true, nil
 	}
-
-	// 如果文档不存在,记录警告日志并静默返回
-	db.logger.Warn(fmt.Sprintf("Document with id '%s' not found for deletion", id))
-	return nil
 }
 
 // Get 方法用于从数据库中获取指定ID的文档
@@ -319,29 +503,51 @@ func (db *Database) Delete(id string) error {
 // - bool: 表示文档是否存在
 func (db *Database) Get(id string) (map[string]interface{}, bool) {
 	// 记录获取尝试的日志
-	db.logger.Debug(fmt.Sprintf("Attempting to get document with ID: %s", id))
+	db.log(LogLevelDebug, "Attempting to get document", slog.String("id", id))
 
-	// 尝试从数据库中加载文档
-	if value, ok := db.data.Load(id); ok {
-		doc := value.(*Document)
-		// 对文档加读锁,确保在读取过程中数据不会被修改
-		doc.mu.RLock()
-		defer doc.mu.RUnlock() // 使用 defer 确保在函数返回时解锁
+	// 持有提交锁的读锁,避免读到事务提交的中间状态
+	db.commitMu.RLock()
+	defer db.commitMu.RUnlock()
 
+	// 尝试从数据库中加载文档
+	if data, ok := db.getDocument(id); ok {
 		// 记录成功获取文档的日志
-		db.logger.Debug(fmt.Sprintf("Document retrieved successfully with ID: %s", id))
+		db.log(LogLevelDebug, "Retrieved document", slog.String("op", "get"), slog.String("id", id))
 
-		// 返回文档数据和true表示成功
-		return doc.data, true
+		// 返回文档数据和true表示成功,加密的字段只对得到密钥的调用方解密
+		return db.revealFields(data), true
 	}
 
 	// 如果文档不存在,记录警告日志
-	db.logger.Warn(fmt.Sprintf("Document with id '%s' not found", id))
+	db.log(LogLevelWarn, "Document not found", slog.String("op", "get"), slog.String("id", id))
 
 	// 返回nil和false表示文档不存在
 	return nil, false
 }
 
+// getDocument 是 Get 的内部版本,不获取提交锁也不记录日志,供已经持有提交锁的方法使用
+// 已经过期但尚未被清理的文档视为不存在
+func (db *Database) getDocument(id string) (map[string]interface{}, bool) {
+	data, _, ok := db.getDocumentVersion(id)
+	return data, ok
+}
+
+// getDocumentVersion 与 getDocument 相同,同时返回写入这个版本的 WAL 记录的 LSN
+// 从数据文件加载的文档 LSN 为 0,之后的每次写入(包括删除后重新插入)都会得到更大的 LSN
+func (db *Database) getDocumentVersion(id string) (map[string]interface{}, uint64, bool) {
+	if value, ok := db.data.Load(id); ok {
+		doc := value.(*Document)
+		// 对文档加读锁,确保在读取过程中数据不会被修改
+		doc.mu.RLock()
+		defer doc.mu.RUnlock()
+		if db.isExpired(doc.data, time.Now()) {
+			return nil, 0, false
+		}
+		return doc.data, doc.seq, true
+	}
+	return nil, 0, false
+}
+
 // GetAll 方法用于获取数据库中的所有文档
 //
 // 介绍:
@@ -349,9 +555,9 @@ func (db *Database) Get(id string) (map[string]interface{}, bool) {
 // 这个方法对于需要处理或分析整个数据集的场景非常有用,比如数据导出、全局统计或批量操作。
 //
 // 实现细节:
-// 1. 该方法使用 sync.Map 的 Range 方法遍历所有存储的文档。
-// 2. 为了保证并发安全,在访问每个文档时都会使用读锁。
-// 3. 方法会创建每个文档的深拷贝,以防止在返回后对原始数据的意外修改。
+// 1. 该方法在一个内部快照上遍历所有文档,结果对应同一个时间点,不会混入遍历期间发生的写入。
+// 2. 遍历期间不持有提交锁,并发的写操作不会被长时间阻塞。
+// 3. 方法会创建每个文档的拷贝,以防止在返回后对原始数据的意外修改。
 // 4. 使用日志记录操作的开始和结束,包括获取的文档总数,有助于监控和调试。
 //
 // 性能考虑:
@@ -362,39 +568,15 @@ func (db *Database) Get(id string) (map[string]interface{}, bool) {
 // - []map[string]interface{}: 包含所有文档的切片,每个文档表示为一个 map
 func (db *Database) GetAll() []map[string]interface{} {
 	// 记录方法调用,用于调试
-	db.logger.Debug("Attempting to get all documents")
+	db.log(LogLevelDebug, "Attempting to get all documents")
 
-	// 初始化结果切片,用于存储所有文档
-	var allDocs []map[string]interface{}
-
-	// 使用 sync.Map 的 Range 方法遍历所有文档
-	db.data.Range(func(key, value interface{}) bool {
-		// 将 value 转换为 Document 类型
-		doc := value.(*Document)
-
-		// 对文档加读锁,确保并发安全
-		doc.mu.RLock()
-
-		// 创建文档数据的深拷贝
-		docCopy := make(map[string]interface{})
-		for k, v := range doc.data {
-			// 注意:这里假设文档中的值不包含需要深拷贝的复杂类型
-			// 如果有嵌套的 map 或 slice,可能需要递归复制
-			docCopy[k] = v
-		}
-
-		// 将文档副本添加到结果切片中
-		allDocs = append(allDocs, docCopy)
-
-		// 释放文档的读锁
-		doc.mu.RUnlock()
-
-		// 返回 true 以继续遍历
-		return true
-	})
+	// 在内部快照上遍历,返回的是某个时间点上一致的全部文档,遍历期间不阻塞写操作
+	snap := db.Snapshot()
+	defer snap.Release()
+	allDocs := snap.GetAll()
 
 	// 记录操作完成的信息,包括获取的文档总数
-	db.logger.Info(fmt.Sprintf("Retrieved all documents, total count: %d", len(allDocs)))
+	db.log(LogLevelInfo, "Retrieved all documents", slog.String("op", "get_all"), slog.Int("count", len(allDocs)))
 
 	// 返回包含所有文档的切片
 	return allDocs
@@ -0,0 +1,327 @@
+// encryption.go
+
+// 介绍:
+// 本文件实现了数据文件和 WAL 的静态加密(encryption at rest)。
+//
+// 使用 WithEncryption 打开数据库之后,写入 data.db 和 wal.log 的每一条记录都使用 AES-256-GCM 单独加密,
+// 每条记录有自己的随机 nonce,文件的类型作为附加数据参与认证,记录不能在两种文件之间调换。
+// 密钥由 KeyProvider 提供,数据库只通过密钥ID引用密钥,不会把密钥写入磁盘。
+//
+// 文件格式: 加密的文件以一个密钥帧开头,长度前缀为 keyFrameMarker,之后是 2 字节的密钥ID长度和密钥ID,
+// 后面的记录都使用这个密钥加密,直到下一个密钥帧;ID 为空的密钥帧表示之后的记录是明文。
+// 没有密钥帧的文件与未加密的旧版本完全相同。合并多个 WAL 的恢复操作直接复制记录,
+// 只在密钥变化时插入新的密钥帧,因此不需要密钥也能恢复备份和归档。
+// WAL 记录的 LSN 和时间戳以明文保存在密文之前(同样参与认证),用于在没有密钥时按时间点恢复。
+//
+// 密钥轮换: 每次检查点(打开数据库和 WAL 轮转)都使用 KeyProvider 当前的密钥重写数据文件并开始新的 WAL,
+// 旧的密钥只用于读取之前写入的文件。归档的 WAL 段和备份保留写入时的密钥,
+// 离线工具 ReencryptFiles 可以在数据库关闭时立即用当前密钥重写数据库目录中的文件。
+//
+// 元数据文件(meta.db)只包含 LSN、集合名称和模式,不会被加密;索引只保存在内存中,没有索引文件。
+
+package jsonDB
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	// EncryptionKeySize 是 AES-256 密钥的长度
+	EncryptionKeySize = 32
+
+	// keyFrameMarker 是密钥帧的长度前缀,记录的长度不可能达到这个值
+	keyFrameMarker = math.MaxUint32
+	// maxKeyIDLength 是密钥ID的最大长度
+	maxKeyIDLength = math.MaxUint16
+	// walClearSize 是加密的 WAL 记录中明文保存的 LSN 和时间戳的长度
+	walClearSize = 16
+)
+
+// KeyProvider 提供加密数据库文件使用的密钥
+//
+// 介绍:
+// CurrentKey 返回加密新写入的文件使用的密钥,每次检查点时调用,返回新的密钥即可完成轮换;
+// Key 返回读取文件时遇到的密钥ID对应的密钥,之前使用过的密钥需要一直保留,
+// 直到所有使用它的文件(包括归档的 WAL 段和备份)都被重写或删除。
+// 实现需要支持并发调用,可以从 KMS 或者环境变量中读取密钥。
+type KeyProvider interface {
+	// CurrentKey 返回当前密钥的ID和 32 字节的密钥,ID 为空时新写入的文件不加密
+	CurrentKey() (id string, key []byte, err error)
+	// Key 返回 id 对应的 32 字节密钥,密钥不存在时返回包装了 ErrKeyNotFound 的错误
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys 是保存在内存中的一组密钥,可以从 JSON 格式的密钥文件中读取
+type StaticKeys struct {
+	Current string            `json:"current"` // 当前密钥的ID,为空时新写入的文件不加密
+	Keys    map[string][]byte `json:"keys"`    // 所有密钥,key 是密钥ID,JSON 中为 base64
+}
+
+// CurrentKey 返回 Current 指定的密钥
+func (k *StaticKeys) CurrentKey() (string, []byte, error) {
+	if k.Current == "" {
+		return "", nil, nil
+	}
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+// Key 返回 id 对应的密钥
+func (k *StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, id)
+	}
+	return key, nil
+}
+
+// ReadKeyFile 读取 JSON 格式的密钥文件
+//
+// 介绍:
+// 文件的格式为 {"current": "2024-06", "keys": {"2024-05": "<base64>", "2024-06": "<base64>"}},
+// 每个密钥在 base64 解码之后必须是 32 字节。
+//
+// 参数:
+// - path: 密钥文件的路径
+//
+// 返回值:
+// - *StaticKeys: 文件中的密钥
+// - error: 读取失败、格式错误或者密钥长度不正确时的错误
+func ReadKeyFile(path string) (*StaticKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys StaticKeys
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to decode key file: %w", err)
+	}
+	for id, key := range keys.Keys {
+		if err := checkKey(id, key); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := keys.Keys[keys.Current]; keys.Current != "" && !ok {
+		return nil, fmt.Errorf("%w: current key %q is not in the key file", ErrKeyNotFound, keys.Current)
+	}
+	return &keys, nil
+}
+
+// WithEncryption 使用 keys 提供的密钥加密数据文件和 WAL
+// 已有的明文文件在打开时的检查点中被加密,打开加密的数据库时必须提供它使用过的所有密钥
+func WithEncryption(keys KeyProvider) Option {
+	return func(db *Database) {
+		db.keys = keys
+	}
+}
+
+// FileOption 是离线工具读写数据库文件时的可选配置项
+type FileOption func(*fileConfig)
+
+// fileConfig 是读写数据库文件的配置
+type fileConfig struct {
+	keys KeyProvider // 解密记录和加密新文件使用的密钥,为 nil 时只能读写明文记录
+	raw  bool        // 不解密记录,只读取记录的位置、密钥ID以及 WAL 记录的 LSN 和时间戳,用于原样复制记录
+}
+
+// FileKeys 设置读取加密文件和写入新文件使用的密钥
+// 写入新文件的工具(例如 CompactFiles 和 RestoreDump)使用 keys 的当前密钥加密
+func FileKeys(keys KeyProvider) FileOption {
+	return func(cfg *fileConfig) {
+		cfg.keys = keys
+	}
+}
+
+// newFileConfig 应用 opts 并返回配置
+func newFileConfig(opts []FileOption) fileConfig {
+	var cfg fileConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// checkKey 检查密钥ID和密钥的长度
+func checkKey(id string, key []byte) error {
+	if id == "" || len(id) > maxKeyIDLength {
+		return fmt.Errorf("invalid encryption key ID %q", id)
+	}
+	if len(key) != EncryptionKeySize {
+		return fmt.Errorf("encryption key %q must be %d bytes, got %d", id, EncryptionKeySize, len(key))
+	}
+	return nil
+}
+
+// recordCipher 使用一个密钥加密和解密记录
+type recordCipher struct {
+	id   string // 密钥ID
+	aead cipher.AEAD
+}
+
+// newRecordCipher 为密钥创建 AES-256-GCM 的加密器
+func newRecordCipher(id string, key []byte) (*recordCipher, error) {
+	if err := checkKey(id, key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &recordCipher{id: id, aead: aead}, nil
+}
+
+// currentCipher 返回 keys 的当前密钥对应的加密器,keys 为 nil 或者当前密钥ID为空时返回 nil
+func currentCipher(keys KeyProvider) (*recordCipher, error) {
+	if keys == nil {
+		return nil, nil
+	}
+	id, key, err := keys.CurrentKey()
+	if err != nil || id == "" {
+		return nil, err
+	}
+	return newRecordCipher(id, key)
+}
+
+// clearSize 返回 kind 类型的文件中加密的记录在密文之前明文保存的字节数
+func clearSize(kind string) int {
+	if kind == WALFileName {
+		return walClearSize
+	}
+	return 0
+}
+
+// seal 加密一条记录,返回 clear、nonce 和密文依次拼接的结果
+// 文件类型 kind 和 clear 作为附加数据参与认证
+func (c *recordCipher) seal(kind string, clear, plaintext []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	out := make([]byte, len(clear)+nonceSize, len(clear)+nonceSize+len(plaintext)+c.aead.Overhead())
+	copy(out, clear)
+	nonce := out[len(clear):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return c.aead.Seal(out, nonce, plaintext, c.additionalData(kind, clear)), nil
+}
+
+// open 解密 seal 的结果
+func (c *recordCipher) open(kind string, stored []byte) ([]byte, error) {
+	n := clearSize(kind)
+	nonceSize := c.aead.NonceSize()
+	if len(stored) < n+nonceSize+c.aead.Overhead() {
+		return nil, fmt.Errorf("encrypted record is too short: %d bytes", len(stored))
+	}
+	clear, nonce, ciphertext := stored[:n], stored[n:n+nonceSize], stored[n+nonceSize:]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, c.additionalData(kind, clear))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt record with key %q: %w", c.id, err)
+	}
+	return plaintext, nil
+}
+
+// additionalData 返回认证使用的附加数据
+func (c *recordCipher) additionalData(kind string, clear []byte) []byte {
+	return append([]byte(kind), clear...)
+}
+
+// walClear 返回加密的 WAL 记录中明文保存的 LSN 和时间戳
+func walClear(lsn uint64, timestamp int64) []byte {
+	clear := make([]byte, walClearSize)
+	binary.LittleEndian.PutUint64(clear, lsn)
+	binary.LittleEndian.PutUint64(clear[8:], uint64(timestamp))
+	return clear
+}
+
+// keyring 在读取文件时按密钥ID缓存加密器
+type keyring struct {
+	keys    KeyProvider
+	ciphers map[string]*recordCipher
+}
+
+// cipher 返回 id 对应的加密器
+func (k *keyring) cipher(id string) (*recordCipher, error) {
+	if c, ok := k.ciphers[id]; ok {
+		return c, nil
+	}
+	if k.keys == nil {
+		return nil, fmt.Errorf("%w: records are encrypted with key %q, but no key provider is configured", ErrKeyNotFound, id)
+	}
+	key, err := k.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newRecordCipher(id, key)
+	if err != nil {
+		return nil, err
+	}
+	if k.ciphers == nil {
+		k.ciphers = make(map[string]*recordCipher)
+	}
+	k.ciphers[id] = c
+	return c, nil
+}
+
+// recordWriter 向数据文件或 WAL 写入带有长度前缀的记录,使用 cipher 加密
+// 写入的记录与文件中最近的密钥帧使用的密钥不同时,先写入一个新的密钥帧
+type recordWriter struct {
+	w      io.Writer
+	kind   string        // 文件类型,DataFileName 或 WALFileName
+	cipher *recordCipher // 加密新记录使用的密钥,为 nil 时写入明文
+	keyID  string        // 已经写入的最后一个密钥帧的密钥ID,新文件为空
+}
+
+// newRecordWriter 创建向一个新文件写入记录的写入器
+func newRecordWriter(w io.Writer, kind string, c *recordCipher) *recordWriter {
+	return &recordWriter{w: w, kind: kind, cipher: c}
+}
+
+// write 加密并写入一条记录,返回写入的字节数
+// lsn 和 timestamp 只对 WAL 记录有效,以明文保存在密文之前
+func (rw *recordWriter) write(data []byte, lsn uint64, timestamp int64) (int64, error) {
+	if rw.cipher == nil {
+		return rw.writeStored("", data)
+	}
+	var clear []byte
+	if rw.kind == WALFileName {
+		clear = walClear(lsn, timestamp)
+	}
+	stored, err := rw.cipher.seal(rw.kind, clear, data)
+	if err != nil {
+		return 0, err
+	}
+	return rw.writeStored(rw.cipher.id, stored)
+}
+
+// writeStored 原样写入一条使用 keyID 加密的记录,keyID 为空时是明文记录
+// 用于在文件之间复制记录而不需要解密
+func (rw *recordWriter) writeStored(keyID string, stored []byte) (int64, error) {
+	size := 4 + len(stored)
+	if keyID != rw.keyID {
+		size += 6 + len(keyID)
+	}
+	buf := make([]byte, 0, size)
+	if keyID != rw.keyID {
+		buf = binary.LittleEndian.AppendUint32(buf, keyFrameMarker)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(keyID)))
+		buf = append(buf, keyID...)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(stored)))
+	buf = append(buf, stored...)
+	// 密钥帧和记录在同一次写入中完成,减少崩溃时留下不完整记录的可能
+	if _, err := rw.w.Write(buf); err != nil {
+		return 0, err
+	}
+	rw.keyID = keyID
+	return int64(size), nil
+}
@@ -0,0 +1,222 @@
+package jsonDB
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// testKey 返回一个由 b 填充的测试密钥
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, EncryptionKeySize)
+}
+
+// fileKeyIDs 返回文件中记录使用的所有密钥ID,明文记录为空字符串
+func fileKeyIDs(t *testing.T, path string, keys KeyProvider) map[string]int {
+	t.Helper()
+	ids := make(map[string]int)
+	err := scanRecords(path, filepath.Base(path), fileConfig{keys: keys}, nil, func(rec *FileRecord) error {
+		if rec.Err != nil {
+			t.Errorf("Failed to read record at %s:%d: %v", rec.File, rec.Offset, rec.Err)
+		}
+		ids[rec.KeyID]++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to scan %s: %v", path, err)
+	}
+	return ids
+}
+
+// assertNoPlaintext 检查目录中的数据文件和 WAL 不包含 secret
+func assertNoPlaintext(t *testing.T, dir, secret string) {
+	t.Helper()
+	for _, name := range []string{DataFileName, WALFileName} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("Found plaintext in %s", name)
+		}
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	dir := t.TempDir()
+	k1 := &StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": testKey(1)}}
+	open := func(opts ...Option) (*Database, error) {
+		return NewDatabase("id", dir, runtime.NumCPU(), append(opts, WithLogLevel(LogLevelOff))...)
+	}
+
+	// 已有的明文数据库在打开时被加密
+	db, err := open()
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Insert(map[string]interface{}{"id": "1", "ssn": "plain-secret"})
+	db.Close()
+	db, err = open(WithEncryption(k1))
+	if err != nil {
+		t.Fatalf("Failed to open database with encryption: %v", err)
+	}
+	db.Insert(map[string]interface{}{"id": "2", "ssn": "wal-secret"})
+	orders, _ := db.CreateCollection("orders", "id")
+	orders.Insert(map[string]interface{}{"id": "o1", "card": "card-secret"})
+	db.Close()
+	for _, secret := range []string{"plain-secret", "wal-secret", "card-secret"} {
+		assertNoPlaintext(t, dir, secret)
+	}
+	if ids := fileKeyIDs(t, filepath.Join(dir, WALFileName), k1); len(ids) != 1 || ids["k1"] != 3 {
+		t.Errorf("Expected WAL records encrypted with k1, got %v", ids)
+	}
+
+	// 没有密钥或者密钥错误时不能打开数据库
+	if _, err := open(); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound without keys, got %v", err)
+	}
+	wrong := &StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": testKey(9)}}
+	if _, err := open(WithEncryption(wrong)); err == nil {
+		t.Error("Expected error with a wrong key")
+	}
+	if report, err := VerifyFiles(dir); err != nil || report.OK() {
+		t.Errorf("Expected VerifyFiles to report records it cannot decrypt, got %+v %v", report, err)
+	}
+	if report, err := VerifyFiles(dir, FileKeys(k1)); err != nil || !report.OK() || report.WALRecords != 3 {
+		t.Errorf("Expected encrypted files to verify with the key, got %+v %v", report, err)
+	}
+
+	// 轮换密钥: 打开时的检查点使用新的密钥重写数据文件
+	rotated := &StaticKeys{Current: "k2", Keys: map[string][]byte{"k1": testKey(1), "k2": testKey(2)}}
+	db, err = open(WithEncryption(rotated))
+	if err != nil {
+		t.Fatalf("Failed to open database with a rotated key: %v", err)
+	}
+	if doc, ok := db.Get("2"); !ok || doc["ssn"] != "wal-secret" {
+		t.Errorf("Unexpected document after rotation: %v", doc)
+	}
+	db.Insert(map[string]interface{}{"id": "3"})
+	db.Close()
+	k2 := &StaticKeys{Current: "k2", Keys: map[string][]byte{"k2": testKey(2)}}
+	if ids := fileKeyIDs(t, filepath.Join(dir, DataFileName), k2); len(ids) != 1 || ids["k2"] == 0 {
+		t.Errorf("Expected data file encrypted with k2, got %v", ids)
+	}
+	db, err = open(WithEncryption(k2))
+	if err != nil {
+		t.Fatalf("Expected the old key to be no longer needed, got %v", err)
+	}
+	defer db.Close()
+	if db.Count() != 3 {
+		t.Errorf("Expected 3 documents, got %d", db.Count())
+	}
+}
+
+func TestEncryptedBackupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	keys := &StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": testKey(1)}}
+	dbPath, archive := filepath.Join(dir, "db"), filepath.Join(dir, "archive")
+	db, err := NewDatabase("id", dbPath, runtime.NumCPU(), WithLogLevel(LogLevelOff), WithEncryption(keys), WithWALArchive(archive))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Insert(map[string]interface{}{"id": "1", "ssn": "base-secret"})
+	full, incr := filepath.Join(dir, "full"), filepath.Join(dir, "incr")
+	manifest, err := db.BackupToDir(context.Background(), full)
+	if err != nil {
+		t.Fatalf("Full backup failed: %v", err)
+	}
+	db.Insert(map[string]interface{}{"id": "2", "ssn": "incr-secret"})
+	if _, err := db.BackupToDir(context.Background(), incr, BackupSince(manifest.LSN)); err != nil {
+		t.Fatalf("Incremental backup failed: %v", err)
+	}
+	db.Insert(map[string]interface{}{"id": "3", "ssn": "archive-secret"})
+	db.Close()
+	// 重新打开时把 WAL 归档
+	db, err = NewDatabase("id", dbPath, runtime.NumCPU(), WithLogLevel(LogLevelOff), WithEncryption(keys), WithWALArchive(archive))
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	db.Close()
+
+	for _, backup := range []string{full, incr} {
+		for _, name := range []string{DataFileName, WALFileName} {
+			data, _ := os.ReadFile(filepath.Join(backup, name))
+			if bytes.Contains(data, []byte("secret")) {
+				t.Errorf("Found plaintext in %s of %s", name, backup)
+			}
+		}
+	}
+
+	// 恢复时不需要密钥,打开恢复的数据库时需要
+	restored := filepath.Join(dir, "restored")
+	if _, err := RestoreFromDir(restored, full, incr); err != nil {
+		t.Fatalf("RestoreFromDir failed: %v", err)
+	}
+	copyDB, err := NewDatabase("id", restored, runtime.NumCPU(), WithLogLevel(LogLevelOff), WithEncryption(keys))
+	if err != nil {
+		t.Fatalf("Failed to open restored database: %v", err)
+	}
+	if doc, ok := copyDB.Get("2"); !ok || doc["ssn"] != "incr-secret" || copyDB.Count() != 2 {
+		t.Errorf("Unexpected restored document: %v", doc)
+	}
+	copyDB.Close()
+
+	result, err := RestoreToPoint(restored, archive, RecoveryTarget{}, full)
+	if err != nil || result.WALRecords != 2 {
+		t.Fatalf("RestoreToPoint failed: %+v %v", result, err)
+	}
+	assertNoPlaintext(t, restored, "secret")
+	copyDB, err = NewDatabase("id", restored, runtime.NumCPU(), WithLogLevel(LogLevelOff), WithEncryption(keys))
+	if err != nil {
+		t.Fatalf("Failed to open restored database: %v", err)
+	}
+	defer copyDB.Close()
+	if copyDB.Count() != 3 {
+		t.Errorf("Expected 3 documents after point-in-time recovery, got %d", copyDB.Count())
+	}
+}
+
+func TestReencryptFiles(t *testing.T) {
+	dir := t.TempDir()
+	k1 := &StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": testKey(1)}}
+	db, err := NewDatabase("id", dir, runtime.NumCPU(), WithLogLevel(LogLevelOff), WithEncryption(k1))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Insert(map[string]interface{}{"id": "1", "ssn": "secret"})
+	db.Insert(map[string]interface{}{"id": "2"})
+	db.Delete("2")
+	db.Close()
+
+	rotated := &StaticKeys{Current: "k2", Keys: map[string][]byte{"k1": testKey(1), "k2": testKey(2)}}
+	result, err := ReencryptFiles(dir, rotated)
+	if err != nil || result.KeyID != "k2" || result.WALRecords != 3 {
+		t.Fatalf("ReencryptFiles failed: %+v %v", result, err)
+	}
+	k2 := &StaticKeys{Current: "k2", Keys: map[string][]byte{"k2": testKey(2)}}
+	for _, name := range []string{DataFileName, WALFileName} {
+		if ids := fileKeyIDs(t, filepath.Join(dir, name), k2); ids["k1"] != 0 || ids[""] != 0 {
+			t.Errorf("Expected %s to use only k2, got %v", name, ids)
+		}
+	}
+	if _, err := ReencryptFiles(dir, k1); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound without the key of the files, got %v", err)
+	}
+
+	// 当前密钥为空时解密为明文
+	if _, err := ReencryptFiles(dir, &StaticKeys{Keys: k2.Keys}); err != nil {
+		t.Fatalf("Failed to decrypt files: %v", err)
+	}
+	db, err = NewDatabase("id", dir, runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to open decrypted database: %v", err)
+	}
+	defer db.Close()
+	if doc, ok := db.Get("1"); !ok || doc["ssn"] != "secret" || db.Count() != 1 {
+		t.Errorf("Unexpected document after decryption: %v", doc)
+	}
+}
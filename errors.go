@@ -0,0 +1,177 @@
+package jsonDB
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrDocumentNotFound 表示要操作的文档不存在
+	ErrDocumentNotFound = errors.New("document not found")
+	// ErrNoDocuments 表示没有文档满足给定的 Filter
+	ErrNoDocuments = errors.New("no document matches the filter")
+
+	// errDocumentUnchanged 由 modifyDocument 的 mutate 返回,表示文档无需修改
+	errDocumentUnchanged = errors.New("document unchanged")
+)
+
+// DocumentNotFoundError 表示指定ID的文档不存在
+// 可以通过 errors.Is(err, ErrDocumentNotFound) 判断
+type DocumentNotFoundError struct {
+	ID string // 文档ID
+}
+
+func (e *DocumentNotFoundError) Error() string {
+	return fmt.Sprintf("document with id '%s' not found", e.ID)
+}
+
+// Is 使 errors.Is(err, ErrDocumentNotFound) 返回 true
+func (e *DocumentNotFoundError) Is(target error) bool {
+	return target == ErrDocumentNotFound
+}
+
+// ErrDocumentExists 表示要插入的文档ID已经存在
+var ErrDocumentExists = errors.New("document already exists")
+
+// DocumentExistsError 表示指定ID的文档已经存在
+// 可以通过 errors.Is(err, ErrDocumentExists) 判断
+type DocumentExistsError struct {
+	ID string // 文档ID
+}
+
+func (e *DocumentExistsError) Error() string {
+	return fmt.Sprintf("document with id '%s' already exists", e.ID)
+}
+
+// Is 使 errors.Is(err, ErrDocumentExists) 返回 true
+func (e *DocumentExistsError) Is(target error) bool {
+	return target == ErrDocumentExists
+}
+
+// ErrConflict 表示条件写操作的期望修订号与文档当前修订号不一致
+var ErrConflict = errors.New("revision conflict")
+
+// ConflictError 描述一次修订号冲突
+// 可以通过 errors.Is(err, ErrConflict) 判断
+type ConflictError struct {
+	ID          string // 文档ID
+	ExpectedRev uint64 // 调用方期望的修订号
+	ActualRev   uint64 // 文档当前的修订号
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("document with id '%s' is at revision %d, expected %d", e.ID, e.ActualRev, e.ExpectedRev)
+}
+
+// Is 使 errors.Is(err, ErrConflict) 返回 true
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// ErrSchemaViolation 表示文档不满足数据库的 JSON Schema
+var ErrSchemaViolation = errors.New("document does not match schema")
+
+// SchemaViolation 描述文档中一处不满足模式的地方
+type SchemaViolation struct {
+	Path    string // 不满足模式的值在文档中的位置(JSON Pointer),空字符串表示整个文档
+	Message string // 具体原因
+}
+
+func (v SchemaViolation) String() string {
+	if v.Path == "" {
+		return v.Message
+	}
+	return v.Path + ": " + v.Message
+}
+
+// ValidationError 描述一个文档的所有模式校验错误
+// 可以通过 errors.Is(err, ErrSchemaViolation) 判断
+type ValidationError struct {
+	ID         string            // 文档ID
+	Violations []SchemaViolation // 所有不满足模式的地方
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.String()
+	}
+	return fmt.Sprintf("document with id '%s' does not match schema: %s", e.ID, strings.Join(messages, "; "))
+}
+
+// Is 使 errors.Is(err, ErrSchemaViolation) 返回 true
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrSchemaViolation
+}
+
+var (
+	// ErrCollectionNotFound 表示要操作的集合不存在或者已经被删除
+	ErrCollectionNotFound = errors.New("collection not found")
+	// ErrCollectionExists 表示同名的集合已经存在
+	ErrCollectionExists = errors.New("collection already exists")
+)
+
+// CollectionNotFoundError 表示指定名称的集合不存在
+// 可以通过 errors.Is(err, ErrCollectionNotFound) 判断
+type CollectionNotFoundError struct {
+	Name string // 集合名称
+}
+
+func (e *CollectionNotFoundError) Error() string {
+	return fmt.Sprintf("collection '%s' not found", e.Name)
+}
+
+// Is 使 errors.Is(err, ErrCollectionNotFound) 返回 true
+func (e *CollectionNotFoundError) Is(target error) bool {
+	return target == ErrCollectionNotFound
+}
+
+// ErrIndexNotFound 表示要删除的索引不存在
+var ErrIndexNotFound = errors.New("index not found")
+
+// ErrCorruptRecord 表示数据文件或 WAL 文件中的记录无法读取或解码
+var ErrCorruptRecord = errors.New("corrupt record")
+
+// CorruptRecordError 描述文件中一条损坏的记录
+// 可以通过 errors.Is(err, ErrCorruptRecord) 判断
+type CorruptRecordError struct {
+	File   string // 文件名,例如 data.db
+	Offset int64  // 记录(包括长度前缀)在文件中的起始位置
+	Torn   bool   // 记录在文件末尾被截断,通常是写入过程中进程崩溃导致的
+	Err    error  // 具体原因
+}
+
+func (e *CorruptRecordError) Error() string {
+	if e.Torn {
+		return fmt.Sprintf("%s: torn record at offset %d: %v", e.File, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("%s: corrupt record at offset %d: %v", e.File, e.Offset, e.Err)
+}
+
+// Is 使 errors.Is(err, ErrCorruptRecord) 返回 true
+func (e *CorruptRecordError) Is(target error) bool {
+	return target == ErrCorruptRecord
+}
+
+func (e *CorruptRecordError) Unwrap() error {
+	return e.Err
+}
+
+// ErrInvalidBackup 表示备份不完整、校验和不匹配或者多份备份不能组成连续的备份链
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// ErrBackupBaseUnavailable 表示增量备份的基准 LSN 之后的记录已经不在 WAL 中,需要重新创建全量备份
+var ErrBackupBaseUnavailable = errors.New("incremental backup base is no longer in the WAL")
+
+// ErrIncompleteWAL 表示归档的 WAL 中缺少记录,无法恢复到要求的时间点
+var ErrIncompleteWAL = errors.New("WAL archive is incomplete")
+
+// ErrReadOnly 表示数据库是只读的 follower,只接受从 leader 复制过来的写入
+var ErrReadOnly = errors.New("database is a read-only follower")
+
+// ErrNotFollower 表示数据库不是 follower
+var ErrNotFollower = errors.New("database is not a follower")
+
+// ErrKeyNotFound 表示读取加密的文件时找不到记录使用的密钥
+var ErrKeyNotFound = errors.New("encryption key not found")
@@ -0,0 +1,426 @@
+// fieldcrypt.go
+
+// 介绍:
+// 本文件实现了字段级加密,指定的字段(例如 info.phone)在写入时被加密,
+// 在内存、WAL、数据文件、备份、复制、变更流和 Export 的结果中都只出现密文,索引的调试日志中也只有密文。
+//
+// 加密的字段值被替换为字符串 "$enc:<密钥ID>:<base64>",base64 部分是 AES-256-GCM 的 nonce 和密文,
+// 明文是字段值的 JSON 编码,字段路径作为附加数据参与认证,密文不能被移动到其他字段。
+// 字段密钥由 KeyProvider 提供,与 WithEncryption 使用同一个接口,但是从提供的密钥派生出独立的子密钥,
+// 两者可以使用同一个 KeyProvider。
+//
+// 两种模式:
+// 1. 随机模式(默认): 每次加密使用随机的 nonce,相同的值得到不同的密文,只能在读取时解密。
+// 2. 确定性模式: nonce 由字段路径和明文的 HMAC 派生,相同的值总是得到相同的密文,
+// Query、QueryComposite、Find、Watch 和 Export 的相等条件($eq/$ne/$in/$nin)以及 CreateIndex、CreateCompositeIndex
+// 都可以直接作用于密文,代价是泄露了哪些文档的值相等。
+//
+// 授权: Get、GetAll、Find 和各种查询返回的文档中,加密的字段使用 KeyProvider.Key 返回的密钥解密;
+// KeyProvider 拒绝提供密钥(返回 ErrKeyNotFound)的调用方看到的是密文,例如只写入数据的服务
+// 可以使用只有 CurrentKey 的 KeyProvider。
+
+package jsonDB
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// encryptedFieldPrefix 是加密的字段值的前缀
+const encryptedFieldPrefix = "$enc:"
+
+// FieldRule 是一条字段加密规则
+type FieldRule struct {
+	Path          string // 点号分隔的字段路径,例如 "info.phone"
+	Deterministic bool   // 是否使用确定性加密,相同的值得到相同的密文,支持相等查询和索引
+}
+
+// fieldEncryption 是一个集合的字段加密配置
+type fieldEncryption struct {
+	keys  KeyProvider
+	rules map[string]FieldRule // key 是字段路径
+	err   error                // 规则无效时的错误,写入时返回给调用方
+
+	mu      sync.Mutex
+	ciphers map[string]*fieldCipher // 按密钥ID缓存的加密器
+}
+
+// fieldCipher 使用一个密钥派生的子密钥加密和解密字段
+type fieldCipher struct {
+	id       string // 密钥ID
+	aead     cipher.AEAD
+	nonceKey []byte // 确定性模式下派生 nonce 的 HMAC 密钥
+}
+
+// WithFieldEncryption 使用 keys 提供的密钥加密 rules 指定的字段
+// 规则无效时(例如加密主键)写入操作会返回错误;重新打开数据库之后,命名集合需要通过 SetFieldEncryption 重新设置
+func WithFieldEncryption(keys KeyProvider, rules ...FieldRule) Option {
+	return func(db *Database) {
+		db.fieldCrypt.Store(newFieldEncryption(db.primaryKey, keys, rules))
+	}
+}
+
+// SetFieldEncryption 方法设置集合的字段加密规则
+//
+// 介绍:
+// 新的规则对之后的写入生效,已经存储的文档不会被重写:之前写入的明文字段在文档下一次更新时被加密,
+// 不再加密的字段在下一次更新时被解密后以明文写入(需要密钥)。
+// 确定性字段的相等查询使用当前密钥加密查询值,轮换密钥之后,使用旧密钥写入的文档需要重新写入才能被查询到。
+// 不传入任何规则时关闭字段加密,已经加密的字段仍然会在读取时解密。
+//
+// 参数:
+// - keys: 字段密钥的提供者,有规则时不能为 nil
+// - rules: 字段加密规则,路径不能为空、重复或者是主键
+//
+// 返回值:
+// - error: 规则无效时的错误
+func (db *Database) SetFieldEncryption(keys KeyProvider, rules ...FieldRule) error {
+	fe := newFieldEncryption(db.primaryKey, keys, rules)
+	if fe.err != nil {
+		return fe.err
+	}
+	db.fieldCrypt.Store(fe)
+	db.log(LogLevelInfo, "Field encryption set", slog.Int("count", len(rules)))
+	return nil
+}
+
+// newFieldEncryption 检查规则并创建字段加密配置,规则无效时错误记录在返回值的 err 中
+func newFieldEncryption(primaryKey string, keys KeyProvider, rules []FieldRule) *fieldEncryption {
+	fe := &fieldEncryption{keys: keys, rules: make(map[string]FieldRule, len(rules))}
+	for _, rule := range rules {
+		switch _, dup := fe.rules[rule.Path]; {
+		case rule.Path == "" || strings.HasPrefix(rule.Path, ".") || strings.HasSuffix(rule.Path, "."):
+			fe.err = fmt.Errorf("invalid field encryption path %q", rule.Path)
+		case rule.Path == primaryKey:
+			fe.err = fmt.Errorf("primary key field %q cannot be encrypted", rule.Path)
+		case dup:
+			fe.err = fmt.Errorf("duplicate field encryption rule for %q", rule.Path)
+		}
+		if fe.err != nil {
+			return fe
+		}
+		fe.rules[rule.Path] = rule
+	}
+	if len(rules) > 0 && keys == nil {
+		fe.err = errors.New("field encryption requires a key provider")
+	}
+	return fe
+}
+
+// deriveFieldKey 从密钥派生用途为 label 的子密钥
+func deriveFieldKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// cipher 返回密钥对应的加密器,派生的子密钥按密钥ID缓存
+func (fe *fieldEncryption) cipher(id string, key []byte) (*fieldCipher, error) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	if c, ok := fe.ciphers[id]; ok {
+		return c, nil
+	}
+	if err := checkKey(id, key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(deriveFieldKey(key, "jsonDB field encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c := &fieldCipher{id: id, aead: aead, nonceKey: deriveFieldKey(key, "jsonDB field nonce")}
+	if fe.ciphers == nil {
+		fe.ciphers = make(map[string]*fieldCipher)
+	}
+	fe.ciphers[id] = c
+	return c, nil
+}
+
+// current 返回加密新写入的字段使用的加密器
+// 字段加密不允许退回明文,KeyProvider 没有当前密钥时返回错误
+func (fe *fieldEncryption) current() (*fieldCipher, error) {
+	id, key, err := fe.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("%w: field encryption requires a current key", ErrKeyNotFound)
+	}
+	return fe.cipher(id, key)
+}
+
+// encrypt 加密 path 字段的值 value,已经加密的值原样返回
+// 返回的第二个值表示 value 是否被加密
+func (fe *fieldEncryption) encrypt(path string, value interface{}) (interface{}, bool, error) {
+	if isEncryptedField(value) {
+		return value, false, nil
+	}
+	c, err := fe.current()
+	if err != nil {
+		return nil, false, err
+	}
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode field %s: %w", path, err)
+	}
+
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if fe.rules[path].Deterministic {
+		mac := hmac.New(sha256.New, c.nonceKey)
+		mac.Write([]byte(path))
+		mac.Write([]byte{0})
+		mac.Write(plaintext)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return nil, false, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, plaintext, []byte(path))
+	return encryptedFieldPrefix + c.id + ":" + base64.RawURLEncoding.EncodeToString(sealed), true, nil
+}
+
+// decrypt 解密 path 字段的值 value,未加密的值原样返回
+// 返回的第二个值表示 value 是否被解密
+func (fe *fieldEncryption) decrypt(path string, value interface{}) (interface{}, bool, error) {
+	s, _ := value.(string)
+	if !isEncryptedField(s) {
+		return value, false, nil
+	}
+	// 密钥ID中可能包含 ':',base64 中不会
+	sep := strings.LastIndex(s, ":")
+	id := s[len(encryptedFieldPrefix):sep]
+	sealed, err := base64.RawURLEncoding.DecodeString(s[sep+1:])
+	if err != nil {
+		return nil, false, fmt.Errorf("malformed encrypted field %s: %w", path, err)
+	}
+	if fe.keys == nil {
+		return nil, false, fmt.Errorf("%w: field %s is encrypted with key %q, but no key provider is configured", ErrKeyNotFound, path, id)
+	}
+	key, err := fe.keys.Key(id)
+	if err != nil {
+		return nil, false, err
+	}
+	c, err := fe.cipher(id, key)
+	if err != nil {
+		return nil, false, err
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize+c.aead.Overhead() {
+		return nil, false, fmt.Errorf("encrypted field %s is too short", path)
+	}
+	plaintext, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(path))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decrypt field %s with key %q: %w", path, id, err)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(plaintext, &decoded); err != nil {
+		return nil, false, fmt.Errorf("failed to decode field %s: %w", path, err)
+	}
+	return decoded, true, nil
+}
+
+// isEncryptedField 判断字段值是否是加密的字段值
+func isEncryptedField(value interface{}) bool {
+	s, ok := value.(string)
+	if !ok || !strings.HasPrefix(s, encryptedFieldPrefix) {
+		return false
+	}
+	sep := strings.LastIndex(s, ":")
+	return sep > len(encryptedFieldPrefix) && sep < len(s)-1
+}
+
+// updateField 对 doc 中 parts 路径上的值调用 fn,返回修改后的文档以及文档是否被修改
+// 路径上的 map 都会被复制,doc 本身不会被修改;路径不存在或者 fn 没有修改值时原样返回 doc
+func updateField(doc map[string]interface{}, parts []string, fn func(value interface{}) (interface{}, bool, error)) (map[string]interface{}, bool, error) {
+	value, ok := doc[parts[0]]
+	if !ok {
+		return doc, false, nil
+	}
+	if len(parts) > 1 {
+		child, isMap := value.(map[string]interface{})
+		if !isMap {
+			return doc, false, nil
+		}
+		newChild, changed, err := updateField(child, parts[1:], fn)
+		if err != nil || !changed {
+			return doc, false, err
+		}
+		value = newChild
+	} else {
+		newValue, changed, err := fn(value)
+		if err != nil || !changed {
+			return doc, false, err
+		}
+		value = newValue
+	}
+	updated := copyDocumentData(doc)
+	updated[parts[0]] = value
+	return updated, true, nil
+}
+
+// encryptFields 加密文档中所有有规则的字段,返回加密后的副本,doc 本身不会被修改
+// 没有设置字段加密时原样返回 doc
+func (db *Database) encryptFields(doc map[string]interface{}) (map[string]interface{}, error) {
+	fe := db.fieldCrypt.Load()
+	if fe == nil {
+		return doc, nil
+	}
+	if fe.err != nil {
+		return nil, fmt.Errorf("invalid field encryption rules: %w", fe.err)
+	}
+	for path := range fe.rules {
+		var err error
+		doc, _, err = updateField(doc, strings.Split(path, "."), func(value interface{}) (interface{}, bool, error) {
+			return fe.encrypt(path, value)
+		})
+		if err != nil {
+			db.log(LogLevelError, "Failed to encrypt field", slog.String("field", path), slog.Any("error", err))
+			return nil, fmt.Errorf("failed to encrypt field %s: %w", path, err)
+		}
+	}
+	return doc, nil
+}
+
+// revealFields 解密文档中加密的字段,返回解密后的副本,doc 本身不会被修改
+// 包括已经不在规则中的字段;没有得到密钥的字段保留密文,没有设置字段加密或者没有加密的字段时原样返回 doc
+func (db *Database) revealFields(doc map[string]interface{}) map[string]interface{} {
+	fe := db.fieldCrypt.Load()
+	if fe == nil || doc == nil {
+		return doc
+	}
+	for _, path := range encryptedPaths(doc, "", nil) {
+		revealed, _, err := updateField(doc, strings.Split(path, "."), func(value interface{}) (interface{}, bool, error) {
+			return fe.decrypt(path, value)
+		})
+		if err != nil {
+			// 没有权限的调用方看到密文,其他错误(例如密文被篡改)需要记录下来
+			if !errors.Is(err, ErrKeyNotFound) {
+				db.log(LogLevelWarn, "Failed to decrypt field", slog.String("field", path), slog.Any("error", err))
+			}
+			continue
+		}
+		doc = revealed
+	}
+	return doc
+}
+
+// encryptedPaths 返回文档中所有加密的字段值的路径
+func encryptedPaths(doc map[string]interface{}, prefix string, paths []string) []string {
+	for k, v := range doc {
+		switch value := v.(type) {
+		case string:
+			if isEncryptedField(value) {
+				paths = append(paths, prefix+k)
+			}
+		case map[string]interface{}:
+			paths = encryptedPaths(value, prefix+k+".", paths)
+		}
+	}
+	return paths
+}
+
+// revealAll 对 docs 中的每个文档调用 revealFields
+func (db *Database) revealAll(docs []map[string]interface{}) []map[string]interface{} {
+	if db.fieldCrypt.Load() == nil {
+		return docs
+	}
+	for i, doc := range docs {
+		docs[i] = db.revealFields(doc)
+	}
+	return docs
+}
+
+// encryptQueryValue 把确定性加密的字段的查询值转换为密文,使其可以与存储的值比较
+// 字段没有确定性加密规则时原样返回 value,返回的第二个值表示 value 是否被转换
+func (db *Database) encryptQueryValue(field string, value interface{}) (interface{}, bool) {
+	fe := db.fieldCrypt.Load()
+	if fe == nil || fe.err != nil || !fe.rules[field].Deterministic {
+		return value, false
+	}
+	encrypted, _, err := fe.encrypt(field, value)
+	if err != nil {
+		// 无法加密的查询值不会匹配任何密文
+		db.logTo(LogSubsystemQuery, LogLevelError, "Failed to encrypt query value", slog.String("field", field), slog.Any("error", err))
+		return value, false
+	}
+	return encrypted, true
+}
+
+// queryMatcher 返回判断字段值是否等于 value 的函数,匹配规则与 Query 相同
+// 确定性加密的字段比较密文,其他字段转换为 float64 比较
+func (db *Database) queryMatcher(field string, value interface{}) func(fieldValue interface{}) bool {
+	if encrypted, ok := db.encryptQueryValue(field, value); ok {
+		return func(fieldValue interface{}) bool {
+			return fieldValue == encrypted
+		}
+	}
+	queryValue := toFloat64(value)
+	return func(fieldValue interface{}) bool {
+		return toFloat64(fieldValue) == queryValue
+	}
+}
+
+// encryptFilter 把 filter 中确定性加密的字段的相等条件($eq/$ne/$in/$nin)转换为密文
+// 没有需要转换的条件时原样返回 filter
+func (db *Database) encryptFilter(filter Filter) Filter {
+	fe := db.fieldCrypt.Load()
+	if fe == nil {
+		return filter
+	}
+	var converted Filter
+	for field, cond := range filter {
+		if !fe.rules[field].Deterministic {
+			continue
+		}
+		if converted == nil {
+			converted = make(Filter, len(filter))
+			for k, v := range filter {
+				converted[k] = v
+			}
+		}
+		converted[field] = db.encryptCondition(field, cond)
+	}
+	if converted == nil {
+		return filter
+	}
+	return converted
+}
+
+// encryptCondition 转换单个字段条件中的相等比较的值,其他操作符保持不变
+func (db *Database) encryptCondition(field string, cond interface{}) interface{} {
+	ops, isOps := operatorMap(cond)
+	if !isOps {
+		value, _ := db.encryptQueryValue(field, cond)
+		return value
+	}
+	converted := make(map[string]interface{}, len(ops))
+	for op, operand := range ops {
+		switch op {
+		case FilterOpEq, FilterOpNe:
+			operand, _ = db.encryptQueryValue(field, operand)
+		case FilterOpIn, FilterOpNin:
+			if items, ok := toInterfaceSlice(operand); ok {
+				values := make([]interface{}, len(items))
+				for i, item := range items {
+					values[i], _ = db.encryptQueryValue(field, item)
+				}
+				operand = values
+			}
+		}
+		converted[op] = operand
+	}
+	return converted
+}
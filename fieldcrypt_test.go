@@ -0,0 +1,215 @@
+package jsonDB
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeOnlyKeys 只提供加密新字段的当前密钥,不提供解密使用的密钥
+type writeOnlyKeys struct {
+	*StaticKeys
+}
+
+func (k writeOnlyKeys) Key(id string) ([]byte, error) {
+	return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, id)
+}
+
+func TestFieldEncryption(t *testing.T) {
+	dir := t.TempDir()
+	keys := &StaticKeys{Current: "f1", Keys: map[string][]byte{"f1": testKey(1)}}
+	rules := []FieldRule{{Path: "info.phone", Deterministic: true}, {Path: "ssn"}}
+	db, err := NewDatabase("id", dir, runtime.NumCPU(), WithLogLevel(LogLevelOff), WithFieldEncryption(keys, rules...))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	input := map[string]interface{}{"id": "1", "ssn": "123-45-6789", "info": map[string]interface{}{"phone": "555-0100", "city": "Paris"}}
+	db.Insert(input)
+	db.Insert(map[string]interface{}{"id": "2", "ssn": "123-45-6789", "info": map[string]interface{}{"phone": "555-0199"}})
+	if input["info"].(map[string]interface{})["phone"] != "555-0100" {
+		t.Error("Expected Insert not to modify the caller's document")
+	}
+
+	doc, ok := db.Get("1")
+	if !ok || doc["ssn"] != "123-45-6789" || doc["info"].(map[string]interface{})["phone"] != "555-0100" {
+		t.Errorf("Expected decrypted fields, got %v", doc)
+	}
+
+	// 导出的结果中只有密文,随机模式下相同的值得到不同的密文
+	var buf bytes.Buffer
+	if _, err := db.Export(&buf, nil, FormatJSONLines); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if strings.Contains(buf.String(), "555-01") || strings.Contains(buf.String(), "123-45") {
+		t.Errorf("Found plaintext in export: %s", buf.String())
+	}
+	snap := db.Snapshot()
+	var ssns []interface{}
+	snap.forEach(func(_ string, data map[string]interface{}) bool {
+		ssns = append(ssns, data["ssn"])
+		return true
+	})
+	snap.Release()
+	if len(ssns) != 2 || ssns[0] == ssns[1] || !isEncryptedField(ssns[0]) {
+		t.Errorf("Expected distinct ciphertexts for randomized fields, got %v", ssns)
+	}
+
+	// 确定性字段支持相等查询,有没有索引结果都一样
+	check := func(stage string) {
+		t.Helper()
+		if docs := db.Query("info.phone", "555-0100"); len(docs) != 1 || docs[0]["id"] != "1" || docs[0]["ssn"] != "123-45-6789" {
+			t.Errorf("%s: unexpected Query result: %v", stage, docs)
+		}
+		if docs := db.Find(Filter{"info.phone": map[string]interface{}{"$in": []interface{}{"555-0100", "555-0199"}}}); len(docs) != 2 {
+			t.Errorf("%s: expected 2 documents from Find, got %v", stage, docs)
+		}
+		if docs := db.Find(Filter{"ssn": "123-45-6789"}); len(docs) != 0 {
+			t.Errorf("%s: expected randomized fields not to be queryable, got %v", stage, docs)
+		}
+	}
+	check("full scan")
+	db.CreateIndex("info.phone")
+	check("index")
+
+	// 更新其他字段时加密的字段保持不变,更新加密的字段时索引随之更新
+	if err := db.Update("1", map[string]interface{}{"name": "Alice"}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	check("after update")
+	if err := db.Update("2", map[string]interface{}{"info": map[string]interface{}{"phone": "555-0100"}}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if docs := db.Query("info.phone", "555-0100"); len(docs) != 2 {
+		t.Errorf("Expected 2 documents after updating the phone, got %v", docs)
+	}
+
+	// 事务中的写入同样被加密
+	tx := db.Begin()
+	tx.Insert(map[string]interface{}{"id": "3", "info": map[string]interface{}{"phone": "555-0123"}})
+	if docs := tx.Query("info.phone", "555-0123"); len(docs) != 1 || docs[0]["info"].(map[string]interface{})["phone"] != "555-0123" {
+		t.Errorf("Unexpected documents in the transaction view: %v", docs)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	db.Close()
+
+	data, err := os.ReadFile(filepath.Join(dir, WALFileName))
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+	if bytes.Contains(data, []byte("555-01")) || bytes.Contains(data, []byte("123-45")) {
+		t.Error("Found plaintext in the WAL")
+	}
+
+	// 没有设置字段加密时看到的是密文
+	db, err = NewDatabase("id", dir, runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if doc, _ := db.Get("1"); !isEncryptedField(doc["ssn"]) {
+		t.Errorf("Expected ciphertext without field encryption, got %v", doc)
+	}
+
+	// 只能写入的调用方不能解密,但是仍然可以查询确定性字段
+	if err := db.SetFieldEncryption(writeOnlyKeys{keys}, rules...); err != nil {
+		t.Fatalf("SetFieldEncryption failed: %v", err)
+	}
+	if docs := db.Query("info.phone", "555-0123"); len(docs) != 1 || !isEncryptedField(docs[0]["info"].(map[string]interface{})["phone"]) {
+		t.Errorf("Expected ciphertext for a write-only caller, got %v", docs)
+	}
+	db.Close()
+}
+
+func TestFieldEncryptionRules(t *testing.T) {
+	keys := &StaticKeys{Current: "f1", Keys: map[string][]byte{"f1": testKey(1)}}
+	db, err := NewDatabase("id", t.TempDir(), runtime.NumCPU(), WithLogLevel(LogLevelOff), WithFieldEncryption(keys, FieldRule{Path: "id"}))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Insert(map[string]interface{}{"id": "1"}); err == nil {
+		t.Error("Expected Insert to fail with an invalid rule")
+	}
+
+	for _, rules := range [][]FieldRule{{{Path: ""}}, {{Path: "a"}, {Path: "a"}}, {{Path: "info."}}} {
+		if err := db.SetFieldEncryption(keys, rules...); err == nil {
+			t.Errorf("Expected error for rules %v", rules)
+		}
+	}
+	if err := db.SetFieldEncryption(nil, FieldRule{Path: "a"}); err == nil {
+		t.Error("Expected error without a key provider")
+	}
+
+	// 没有当前密钥时拒绝写入明文
+	if err := db.SetFieldEncryption(&StaticKeys{Keys: keys.Keys}, FieldRule{Path: "a"}); err != nil {
+		t.Fatalf("SetFieldEncryption failed: %v", err)
+	}
+	if _, err := db.Insert(map[string]interface{}{"id": "1", "a": "secret"}); err == nil {
+		t.Error("Expected Insert to fail without a current key")
+	}
+	if _, ok := db.Get("1"); ok {
+		t.Error("Expected the document not to be inserted")
+	}
+}
+
+func TestFieldEncryptionFilters(t *testing.T) {
+	keys := &StaticKeys{Current: "f1", Keys: map[string][]byte{"f1": testKey(1)}}
+	db, err := NewDatabase("id", t.TempDir(), runtime.NumCPU(), WithLogLevel(LogLevelOff),
+		WithFieldEncryption(keys, FieldRule{Path: "phone", Deterministic: true}, FieldRule{Path: "age"}))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	db.CreateCompositeIndex([]string{"phone", "name"})
+	db.Insert(map[string]interface{}{"id": "1", "phone": "555-0100", "name": "Alice", "age": 30})
+	db.Insert(map[string]interface{}{"id": "2", "phone": "555-0199", "name": "Bob", "age": 40})
+
+	// Validate 与写操作一样校验解密后的文档
+	schema, err := CompileSchema(`{"type": "object", "properties": {"age": {"type": "integer"}}}`)
+	if err != nil {
+		t.Fatalf("CompileSchema failed: %v", err)
+	}
+	if err := db.SetSchema(schema); err != nil {
+		t.Fatalf("SetSchema failed: %v", err)
+	}
+	if invalid := db.Validate(); len(invalid) != 0 {
+		t.Errorf("Expected no violations for encrypted fields, got %v", invalid)
+	}
+
+	// 复合索引查询、变更流和导出的条件与 Query 一样先加密
+	if docs := db.QueryComposite([]string{"phone", "name"}, []interface{}{"555-0100", "Alice"}); len(docs) != 1 || docs[0]["id"] != "1" {
+		t.Errorf("Expected QueryComposite to find document 1, got %v", docs)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs, err := db.Watch(ctx, Filter{"phone": "555-0199"})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	db.Update("1", map[string]interface{}{"name": "Alicia"})
+	db.Update("2", map[string]interface{}{"name": "Robert"})
+	select {
+	case event := <-cs.Events():
+		if event.ID != "2" {
+			t.Errorf("Expected a change event for document 2, got %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected a change event for the encrypted filter")
+	}
+
+	for _, format := range []Format{FormatJSONLines, FormatCSV} {
+		var buf bytes.Buffer
+		if n, err := db.Export(&buf, Filter{"phone": "555-0100"}, format); err != nil || n != 1 {
+			t.Errorf("Expected %v export to match one document, got %d, %v", format, n, err)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+// filter.go
+
+// 介绍:
+// 本文件定义了 Filter 查询条件以及基于条件的 Find 查询。
+// Filter 支持多字段的"与"条件、点号表示的嵌套字段和 $eq/$ne/$gt/$gte/$lt/$lte/$in/$nin/$exists
+// 等操作符。如果条件中的某个字段已经建立了单字段索引,会先利用索引缩小候选文档范围,
+// 然后再对每个候选文档完整地检查所有条件。
+
+package jsonDB
+
+import (
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Filter 描述文档的匹配条件
+//
+// key 为字段名,支持使用点号访问嵌套字段(如 "info.email");value 为要匹配的值,
+// 或者由操作符组成的 map,例如 Filter{"age": map[string]interface{}{"$gte": 18, "$lt": 65}}。
+// 多个条件之间是"与"的关系,空 Filter 匹配所有文档。
+type Filter map[string]interface{}
+
+// Filter 支持的操作符
+const (
+	FilterOpEq     = "$eq"
+	FilterOpNe     = "$ne"
+	FilterOpGt     = "$gt"
+	FilterOpGte    = "$gte"
+	FilterOpLt     = "$lt"
+	FilterOpLte    = "$lte"
+	FilterOpIn     = "$in"
+	FilterOpNin    = "$nin"
+	FilterOpExists = "$exists"
+)
+
+// Find 方法返回所有满足 filter 的文档
+//
+// 介绍:
+// Find 是基于 Filter 的通用查询方法。如果 filter 中的某个字段存在单字段索引,
+// 并且该字段的条件只包含 $eq/$gt/$gte/$lt/$lte/$in,则使用索引获取候选文档;
+// 否则遍历所有文档。每个候选文档都会在读锁保护下完整检查 filter,返回的是文档副本。
+//
+// 参数:
+// - filter: 查询条件,nil 或空 Filter 匹配所有文档
+//
+// 返回值:
+// - []map[string]interface{}: 包含所有匹配文档的切片
+func (db *Database) Find(filter Filter) []map[string]interface{} {
+	start := time.Now()
+	db.logTo(LogSubsystemQuery, LogLevelDebug, "Finding documents", slog.Any("filter", filter))
+
+	// 持有提交锁的读锁,避免读到事务提交的中间状态
+	db.commitMu.RLock()
+	defer db.commitMu.RUnlock()
+
+	var results []map[string]interface{}
+	db.forEachMatch(filter, func(id string, doc *Document) bool {
+		results = append(results, copyDocumentData(doc.data))
+		return true
+	})
+
+	db.logTo(LogSubsystemQuery, LogLevelInfo, "Find with filter", slog.String("op", "find"), slog.Int("count", len(results)), slog.Duration("duration", time.Since(start)))
+	return db.revealAll(results)
+}
+
+// forEachMatch 对每个满足 filter 的文档调用 fn,调用期间持有文档的读锁
+// fn 返回 false 时停止遍历,已经过期的文档会被跳过
+// 确定性加密的字段上的相等条件会先转换为密文,再与存储的文档比较
+func (db *Database) forEachMatch(filter Filter, fn func(id string, doc *Document) bool) {
+	filter = db.encryptFilter(filter)
+	now := time.Now()
+	visit := func(id string, value interface{}) bool {
+		doc := value.(*Document)
+		doc.mu.RLock()
+		defer doc.mu.RUnlock()
+		if !matchFilter(doc.data, filter) || db.isExpired(doc.data, now) {
+			return true
+		}
+		return fn(id, doc)
+	}
+
+	if ids, ok := db.filterCandidates(filter); ok {
+		for _, id := range ids {
+			if value, exists := db.data.Load(id); exists {
+				if !visit(id, value) {
+					return
+				}
+			}
+		}
+		return
+	}
+
+	db.data.Range(func(key, value interface{}) bool {
+		return visit(key.(string), value)
+	})
+}
+
+// filterCandidates 尝试使用单字段索引获取候选文档ID
+// 返回的第二个值表示是否使用了索引;未使用索引时调用方需要进行全表扫描
+func (db *Database) filterCandidates(filter Filter) ([]string, bool) {
+	fields := make([]string, 0, len(filter))
+	for field := range filter {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		indexValue, ok := db.indexes.Load(field)
+		if !ok {
+			continue
+		}
+		idx, ok := indexValue.(*Index)
+		if !ok {
+			continue
+		}
+		cond, ok := indexCondition(filter[field])
+		if !ok {
+			continue
+		}
+
+		seen := make(map[string]struct{})
+		var ids []string
+		idx.mu.RLock()
+		idx.values.Range(func(key, valueMap interface{}) bool {
+			if matchCondition(key, true, cond) {
+				valueMap.(*sync.Map).Range(func(docID, _ interface{}) bool {
+					id := docID.(string)
+					if _, dup := seen[id]; !dup {
+						seen[id] = struct{}{}
+						ids = append(ids, id)
+					}
+					return true
+				})
+			}
+			return true
+		})
+		idx.mu.RUnlock()
+
+		db.logTo(LogSubsystemQuery, LogLevelDebug, "Using index for filter", slog.String("field", field), slog.Int("count", len(ids)))
+		return ids, true
+	}
+	return nil, false
+}
+
+// indexCondition 将条件中的值转换为索引键的形式
+// 如果条件包含无法通过索引回答的操作符(如 $ne、$exists),返回 false
+func indexCondition(cond interface{}) (interface{}, bool) {
+	ops, isOps := operatorMap(cond)
+	if !isOps {
+		return indexKeyOf(cond), true
+	}
+
+	converted := make(map[string]interface{}, len(ops))
+	for op, operand := range ops {
+		switch op {
+		case FilterOpEq, FilterOpGt, FilterOpGte, FilterOpLt, FilterOpLte:
+			converted[op] = indexKeyOf(operand)
+		case FilterOpIn:
+			items, ok := toInterfaceSlice(operand)
+			if !ok {
+				return nil, false
+			}
+			keys := make([]interface{}, len(items))
+			for i, item := range items {
+				keys[i] = indexKeyOf(item)
+			}
+			converted[op] = keys
+		default:
+			return nil, false
+		}
+	}
+	return converted, true
+}
+
+// matchFilter 检查文档是否满足 filter 中的所有条件
+func matchFilter(doc map[string]interface{}, filter Filter) bool {
+	for field, cond := range filter {
+		value, present := lookupField(doc, field)
+		if !matchCondition(value, present, cond) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchCondition 检查单个字段的值是否满足条件
+func matchCondition(value interface{}, present bool, cond interface{}) bool {
+	ops, isOps := operatorMap(cond)
+	if !isOps {
+		return present && filterEqual(value, cond)
+	}
+
+	for op, operand := range ops {
+		switch op {
+		case FilterOpEq:
+			if !present || !filterEqual(value, operand) {
+				return false
+			}
+		case FilterOpNe:
+			if present && filterEqual(value, operand) {
+				return false
+			}
+		case FilterOpGt, FilterOpGte, FilterOpLt, FilterOpLte:
+			if !present {
+				return false
+			}
+			c, ok := filterCompare(value, operand)
+			if !ok {
+				return false
+			}
+			switch {
+			case op == FilterOpGt && c <= 0, op == FilterOpGte && c < 0,
+				op == FilterOpLt && c >= 0, op == FilterOpLte && c > 0:
+				return false
+			}
+		case FilterOpIn, FilterOpNin:
+			items, ok := toInterfaceSlice(operand)
+			if !ok {
+				return false
+			}
+			found := false
+			if present {
+				for _, item := range items {
+					if filterEqual(value, item) {
+						found = true
+						break
+					}
+				}
+			}
+			if found != (op == FilterOpIn) {
+				return false
+			}
+		case FilterOpExists:
+			want, _ := operand.(bool)
+			if present != want {
+				return false
+			}
+		default:
+			// 未知操作符不匹配任何文档
+			return false
+		}
+	}
+	return true
+}
+
+// operatorMap 判断条件是否为操作符对象(所有 key 都以 '$' 开头)
+func operatorMap(cond interface{}) (map[string]interface{}, bool) {
+	var ops map[string]interface{}
+	switch v := cond.(type) {
+	case map[string]interface{}:
+		ops = v
+	case Filter:
+		ops = v
+	default:
+		return nil, false
+	}
+	if len(ops) == 0 {
+		return nil, false
+	}
+	for op := range ops {
+		if !strings.HasPrefix(op, "$") {
+			return nil, false
+		}
+	}
+	return ops, true
+}
+
+// lookupField 按照点号路径查找文档中的字段值
+func lookupField(doc map[string]interface{}, path string) (interface{}, bool) {
+	if value, ok := doc[path]; ok {
+		return value, true
+	}
+
+	var node interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if node, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// filterEqual 比较两个值是否相等,数值和时间按照数值比较,其他类型按照 JSON 语义比较
+func filterEqual(a, b interface{}) bool {
+	if c, ok := filterCompare(a, b); ok {
+		return c == 0
+	}
+	return jsonEqual(a, b)
+}
+
+// filterCompare 比较两个值的大小,只有两个值同为数值、时间或字符串时才可比较
+func filterCompare(a, b interface{}) (int, bool) {
+	if at, ok := a.(time.Time); ok {
+		a = at.Unix()
+	}
+	if bt, ok := b.(time.Time); ok {
+		b = bt.Unix()
+	}
+
+	if an, ok := asNumber(a); ok {
+		bn, ok := asNumber(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case an < bn:
+			return -1, true
+		case an > bn:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	if as, ok := a.(string); ok {
+		if bs, ok := b.(string); ok {
+			return strings.Compare(as, bs), true
+		}
+	}
+	return 0, false
+}
+
+// asNumber 将任意整数或浮点数类型转换为 float64
+func asNumber(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// toInterfaceSlice 将任意切片转换为 []interface{}
+func toInterfaceSlice(v interface{}) ([]interface{}, bool) {
+	if items, ok := v.([]interface{}); ok {
+		return items, true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	items := make([]interface{}, rv.Len())
+	for i := range items {
+		items[i] = rv.Index(i).Interface()
+	}
+	return items, true
+}
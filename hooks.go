@@ -0,0 +1,196 @@
+// hooks.go
+
+// 介绍:
+// 本文件实现了写操作的钩子(触发器),用于统一处理审计字段、派生字段和跨文档的副作用。
+//
+// before 钩子在写操作内部、写入 WAL 之前被调用,可以修改即将写入的文档,
+// 返回错误时整个操作被放弃,错误会被包装后返回给调用方。
+// after 钩子只在操作的 WAL 记录写入并 fsync 成功之后被调用: 集合上注册了某种操作的 after 钩子时,
+// 这种操作的 WAL 记录会同步落盘,因此 after 钩子看到的操作在崩溃后一定能够被恢复。
+//
+// 同一种钩子按照注册的顺序依次调用,前一个 before 钩子对文档的修改对后一个钩子可见,
+// 任何一个 before 钩子返回错误时,后面的钩子不会被调用。
+//
+// before 钩子在持有文档写锁和提交锁的情况下被调用,不能读写同一个数据库目录中的文档,
+// 否则可能死锁;跨文档的副作用应当放在 after 钩子中,after 钩子被调用时已经释放了所有锁。
+// 钩子对事务同样生效: before 钩子在事务中执行写操作时被调用,after 钩子在事务提交之后被调用。
+//
+// 所有钩子看到的都是解密后的文档。after 钩子得到的是文档的深拷贝,修改它不会影响数据库中的文档。
+
+package jsonDB
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// hookSet 保存集合上注册的所有钩子,注册时整体替换,调用时无需加锁
+type hookSet struct {
+	beforeInsert []func(id string, doc map[string]interface{}) error
+	afterInsert  []func(id string, doc map[string]interface{})
+	beforeUpdate []func(id string, oldDoc, newDoc map[string]interface{}) error
+	afterUpdate  []func(id string, oldDoc, newDoc map[string]interface{})
+	beforeDelete []func(id string, doc map[string]interface{}) error
+	afterDelete  []func(id string, doc map[string]interface{})
+}
+
+// BeforeInsert 方法注册一个在插入文档之前调用的钩子
+// 钩子可以修改 doc(主键除外),返回错误时插入被放弃
+func (db *Database) BeforeInsert(fn func(id string, doc map[string]interface{}) error) {
+	db.registerHook(func(h *hookSet) { h.beforeInsert = append(h.beforeInsert, fn) })
+}
+
+// AfterInsert 方法注册一个在插入文档并持久化 WAL 记录之后调用的钩子,doc 是插入的文档的副本
+func (db *Database) AfterInsert(fn func(id string, doc map[string]interface{})) {
+	db.registerHook(func(h *hookSet) { h.afterInsert = append(h.afterInsert, fn) })
+}
+
+// BeforeUpdate 方法注册一个在更新文档之前调用的钩子
+// oldDoc 是文档当前的数据,不能被修改;钩子可以修改 newDoc(主键除外),返回错误时更新被放弃
+func (db *Database) BeforeUpdate(fn func(id string, oldDoc, newDoc map[string]interface{}) error) {
+	db.registerHook(func(h *hookSet) { h.beforeUpdate = append(h.beforeUpdate, fn) })
+}
+
+// AfterUpdate 方法注册一个在更新文档并持久化 WAL 记录之后调用的钩子,oldDoc 和 newDoc 是更新前后的文档的副本
+func (db *Database) AfterUpdate(fn func(id string, oldDoc, newDoc map[string]interface{})) {
+	db.registerHook(func(h *hookSet) { h.afterUpdate = append(h.afterUpdate, fn) })
+}
+
+// BeforeDelete 方法注册一个在删除文档之前调用的钩子,doc 不能被修改,返回错误时删除被放弃
+func (db *Database) BeforeDelete(fn func(id string, doc map[string]interface{}) error) {
+	db.registerHook(func(h *hookSet) { h.beforeDelete = append(h.beforeDelete, fn) })
+}
+
+// AfterDelete 方法注册一个在删除文档并持久化 WAL 记录之后调用的钩子,doc 是被删除的文档的副本
+func (db *Database) AfterDelete(fn func(id string, doc map[string]interface{})) {
+	db.registerHook(func(h *hookSet) { h.afterDelete = append(h.afterDelete, fn) })
+}
+
+// registerHook 复制当前的钩子集合,应用 add 后整体替换
+func (db *Database) registerHook(add func(h *hookSet)) {
+	db.hookMu.Lock()
+	defer db.hookMu.Unlock()
+
+	hooks := &hookSet{}
+	if current := db.hooks.Load(); current != nil {
+		*hooks = *current
+	}
+	// 切片可能与旧的钩子集合共享底层数组,截断容量保证 append 总是复制
+	hooks.beforeInsert = slices.Clip(hooks.beforeInsert)
+	hooks.afterInsert = slices.Clip(hooks.afterInsert)
+	hooks.beforeUpdate = slices.Clip(hooks.beforeUpdate)
+	hooks.afterUpdate = slices.Clip(hooks.afterUpdate)
+	hooks.beforeDelete = slices.Clip(hooks.beforeDelete)
+	hooks.afterDelete = slices.Clip(hooks.afterDelete)
+	add(hooks)
+	db.hooks.Store(hooks)
+}
+
+// hasAfterHooks 判断集合上是否注册了指定操作的 after 钩子
+func (db *Database) hasAfterHooks(operation string) bool {
+	hooks := db.hooks.Load()
+	if hooks == nil {
+		return false
+	}
+	switch operation {
+	case OperationInsert:
+		return len(hooks.afterInsert) > 0
+	case OperationUpdate:
+		return len(hooks.afterUpdate) > 0
+	case OperationDelete:
+		return len(hooks.afterDelete) > 0
+	}
+	return false
+}
+
+// runBeforeInsert 依次调用 BeforeInsert 钩子,返回可能被钩子修改过的文档
+// 有钩子时 doc 会先被深拷贝,不会修改调用方传入的 map
+func (db *Database) runBeforeInsert(id string, doc map[string]interface{}) (map[string]interface{}, error) {
+	hooks := db.hooks.Load()
+	if hooks == nil || len(hooks.beforeInsert) == 0 {
+		return doc, nil
+	}
+	doc = deepCopyDocument(doc)
+	for _, fn := range hooks.beforeInsert {
+		if err := fn(id, doc); err != nil {
+			db.log(LogLevelWarn, "Rejected by hook", slog.String("op", "insert"), slog.String("id", id), slog.Any("error", err))
+			return nil, fmt.Errorf("insert of document '%s' rejected by hook: %w", id, err)
+		}
+	}
+	return doc, db.checkHookPrimaryKey(id, doc)
+}
+
+// runBeforeUpdate 依次调用 BeforeUpdate 钩子,返回可能被钩子修改过的新文档
+// 新文档与旧文档可能共享嵌套的值,有钩子时 newDoc 会先被深拷贝
+func (db *Database) runBeforeUpdate(id string, oldDoc, newDoc map[string]interface{}) (map[string]interface{}, error) {
+	hooks := db.hooks.Load()
+	if hooks == nil || len(hooks.beforeUpdate) == 0 {
+		return newDoc, nil
+	}
+	newDoc = deepCopyDocument(newDoc)
+	for _, fn := range hooks.beforeUpdate {
+		if err := fn(id, oldDoc, newDoc); err != nil {
+			db.log(LogLevelWarn, "Rejected by hook", slog.String("op", "update"), slog.String("id", id), slog.Any("error", err))
+			return nil, fmt.Errorf("update of document '%s' rejected by hook: %w", id, err)
+		}
+	}
+	return newDoc, db.checkHookPrimaryKey(id, newDoc)
+}
+
+// runBeforeDelete 依次调用 BeforeDelete 钩子
+func (db *Database) runBeforeDelete(id string, doc map[string]interface{}) error {
+	hooks := db.hooks.Load()
+	if hooks == nil {
+		return nil
+	}
+	for _, fn := range hooks.beforeDelete {
+		if err := fn(id, doc); err != nil {
+			db.log(LogLevelWarn, "Rejected by hook", slog.String("op", "delete"), slog.String("id", id), slog.Any("error", err))
+			return fmt.Errorf("delete of document '%s' rejected by hook: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// runAfterHooks 为一个已经持久化的操作依次调用对应的 after 钩子
+// op.before 是写入前的文档,插入时为 nil
+// op 中的文档与内存中的文档是同一个 map,并且加密的字段是密文,钩子得到的是解密后的深拷贝
+func (db *Database) runAfterHooks(op walEntry) {
+	hooks := db.hooks.Load()
+	if hooks == nil {
+		return
+	}
+	switch op.Operation {
+	case OperationInsert:
+		for _, fn := range hooks.afterInsert {
+			fn(op.ID, db.hookCopy(op.Document))
+		}
+	case OperationUpdate:
+		for _, fn := range hooks.afterUpdate {
+			fn(op.ID, db.hookCopy(op.before), db.hookCopy(op.Document))
+		}
+	case OperationDelete:
+		// 事务中插入后又删除的文档没有写入前的数据,对外视为没有发生
+		if op.before == nil {
+			return
+		}
+		for _, fn := range hooks.afterDelete {
+			fn(op.ID, db.hookCopy(op.before))
+		}
+	}
+}
+
+// hookCopy 返回交给 after 钩子的文档: 解密后的深拷贝,每个钩子得到各自的副本
+func (db *Database) hookCopy(doc map[string]interface{}) map[string]interface{} {
+	return deepCopyDocument(db.revealFields(doc))
+}
+
+// checkHookPrimaryKey 检查钩子是否修改或删除了主键
+func (db *Database) checkHookPrimaryKey(id string, doc map[string]interface{}) error {
+	pk, ok := doc[db.primaryKey]
+	if !ok || fmt.Sprintf("%v", pk) != id {
+		return fmt.Errorf("hook must not change primary key '%s' of document '%s'", db.primaryKey, id)
+	}
+	return nil
+}
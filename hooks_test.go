@@ -0,0 +1,165 @@
+package jsonDB
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestWriteHooks(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var calls []string
+	errReadOnly := errors.New("document is read-only")
+
+	db.BeforeInsert(func(id string, doc map[string]interface{}) error {
+		calls = append(calls, "beforeInsert1:"+id)
+		doc["createdBy"] = "system"
+		return nil
+	})
+	db.BeforeInsert(func(id string, doc map[string]interface{}) error {
+		// 后注册的钩子能看到前一个钩子的修改
+		calls = append(calls, "beforeInsert2:"+doc["createdBy"].(string))
+		return nil
+	})
+	db.AfterInsert(func(id string, doc map[string]interface{}) {
+		calls = append(calls, "afterInsert:"+id)
+		// after 钩子中可以写入其他文档
+		if id == "1" {
+			if _, err := db.Insert(map[string]interface{}{"id": "audit", "last": id}); err != nil {
+				t.Errorf("Failed to insert from after hook: %v", err)
+			}
+		}
+	})
+	db.BeforeUpdate(func(id string, oldDoc, newDoc map[string]interface{}) error {
+		if oldDoc["locked"] == true {
+			return errReadOnly
+		}
+		newDoc["previousName"] = oldDoc["name"]
+		return nil
+	})
+	db.AfterUpdate(func(id string, oldDoc, newDoc map[string]interface{}) {
+		calls = append(calls, "afterUpdate:"+id)
+	})
+	db.BeforeDelete(func(id string, doc map[string]interface{}) error {
+		if doc["locked"] == true {
+			return errReadOnly
+		}
+		return nil
+	})
+	db.AfterDelete(func(id string, doc map[string]interface{}) {
+		calls = append(calls, "afterDelete:"+id)
+	})
+
+	input := map[string]interface{}{"id": "1", "name": "Alice"}
+	if _, err := db.Insert(input); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	if _, ok := input["createdBy"]; ok {
+		t.Error("Hooks should not modify the caller's map")
+	}
+	if doc, _ := db.Get("1"); doc["createdBy"] != "system" {
+		t.Errorf("Expected createdBy to be set by hook, got %v", doc)
+	}
+	if _, ok := db.Get("audit"); !ok {
+		t.Error("Expected audit document written by after hook")
+	}
+
+	if err := db.Update("1", map[string]interface{}{"name": "Alicia"}); err != nil {
+		t.Fatalf("Failed to update document: %v", err)
+	}
+	if doc, _ := db.Get("1"); doc["previousName"] != "Alice" {
+		t.Errorf("Expected previousName to be set by hook, got %v", doc)
+	}
+
+	// before 钩子拒绝操作时不会写入,也不会调用 after 钩子
+	if _, err := db.Insert(map[string]interface{}{"id": "2", "locked": true}); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	calls = nil
+	if err := db.Update("2", map[string]interface{}{"name": "x"}); !errors.Is(err, errReadOnly) {
+		t.Errorf("Expected update to be vetoed, got %v", err)
+	}
+	if err := db.Delete("2"); !errors.Is(err, errReadOnly) {
+		t.Errorf("Expected delete to be vetoed, got %v", err)
+	}
+	if _, ok := db.Get("2"); !ok {
+		t.Error("Vetoed delete should keep the document")
+	}
+	if len(calls) != 0 {
+		t.Errorf("After hooks should not fire for vetoed operations, got %v", calls)
+	}
+
+	// 钩子不能修改主键
+	db.BeforeInsert(func(id string, doc map[string]interface{}) error {
+		if id == "3" {
+			doc["id"] = "other"
+		}
+		return nil
+	})
+	if _, err := db.Insert(map[string]interface{}{"id": "3"}); err == nil {
+		t.Error("Expected error when a hook changes the primary key")
+	}
+
+	// 钩子对事务同样生效,after 钩子在提交之后调用
+	calls = nil
+	tx := db.Begin()
+	if err := tx.Update("1", map[string]interface{}{"name": "Al"}); err != nil {
+		t.Fatalf("Failed to update in transaction: %v", err)
+	}
+	if err := tx.Delete("2"); !errors.Is(err, errReadOnly) {
+		t.Errorf("Expected delete in transaction to be vetoed, got %v", err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("After hooks should not fire before commit, got %v", calls)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit transaction: %v", err)
+	}
+	if len(calls) != 1 || calls[0] != "afterUpdate:1" {
+		t.Errorf("Expected after update hook after commit, got %v", calls)
+	}
+	if doc, _ := db.Get("1"); doc["previousName"] != "Alicia" {
+		t.Errorf("Expected previousName to be set by hook in transaction, got %v", doc)
+	}
+}
+
+func TestAfterHooksReceiveCopies(t *testing.T) {
+	keys := &StaticKeys{Current: "f1", Keys: map[string][]byte{"f1": testKey(1)}}
+	db, err := NewDatabase("id", t.TempDir(), runtime.NumCPU(), WithLogLevel(LogLevelOff), WithFieldEncryption(keys, FieldRule{Path: "ssn"}))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	// after 钩子看到的是解密后的文档,修改它不会影响数据库中的文档
+	var seen []interface{}
+	db.AfterInsert(func(id string, doc map[string]interface{}) {
+		seen = append(seen, doc["ssn"])
+		doc["name"] = "MUTATED"
+		doc["tags"].([]interface{})[0] = "MUTATED"
+	})
+	db.AfterUpdate(func(id string, oldDoc, newDoc map[string]interface{}) {
+		seen = append(seen, oldDoc["ssn"], newDoc["ssn"])
+		oldDoc["name"] = "MUTATED"
+		newDoc["name"] = "MUTATED"
+	})
+	db.AfterDelete(func(id string, doc map[string]interface{}) {
+		seen = append(seen, doc["ssn"])
+	})
+
+	db.Insert(map[string]interface{}{"id": "1", "name": "Alice", "ssn": "123", "tags": []interface{}{"a"}})
+	if doc, _ := db.Get("1"); doc["name"] != "Alice" || doc["tags"].([]interface{})[0] != "a" {
+		t.Errorf("AfterInsert hook changed the stored document: %v", doc)
+	}
+	db.Update("1", map[string]interface{}{"ssn": "456"})
+	if doc, _ := db.Get("1"); doc["name"] != "Alice" {
+		t.Errorf("AfterUpdate hook changed the stored document: %v", doc)
+	}
+	db.Delete("1")
+	if fmt.Sprint(seen) != "[123 123 456 456]" {
+		t.Errorf("Expected after hooks to see decrypted values, got %v", seen)
+	}
+}
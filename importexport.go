@@ -0,0 +1,341 @@
+// importexport.go
+
+// 介绍:
+// 本文件实现了 JSON Lines 和 JSON 数组格式的导入导出,用于初始化数据和在数据库之间迁移数据。
+// CSV 格式的解析和生成见 csv.go。
+//
+// 导入和导出都以流的方式进行: Export 在快照上逐个编码文档并写入 io.Writer,
+// 导出期间不阻塞写操作,导出的结果是一个时间点一致的视图;Import 使用 json.Decoder 逐个解码文档,
+// 每 BatchSize 个文档在一个事务中提交,事务写入一条批量 WAL 记录,比逐个 Insert 少了大量的 fsync。
+
+package jsonDB
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// Format 是导入导出使用的文件格式
+type Format int
+
+const (
+	// FormatJSONLines 每行一个 JSON 文档
+	FormatJSONLines Format = iota
+	// FormatJSONArray 一个包含所有文档的 JSON 数组
+	FormatJSONArray
+	// FormatCSV 第一行是表头的 CSV,见 ImportColumns 和 WriteCSV
+	FormatCSV
+)
+
+// String 返回格式的名称
+func (f Format) String() string {
+	switch f {
+	case FormatJSONLines:
+		return "jsonl"
+	case FormatJSONArray:
+		return "json"
+	case FormatCSV:
+		return "csv"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// DefaultImportBatchSize 是 Import 默认每个事务中写入的文档数量
+const DefaultImportBatchSize = 1000
+
+// importConflictRetries 是一个批次因为并发写入冲突而重试的最大次数
+const importConflictRetries = 3
+
+// ImportResult 描述导入的结果
+type ImportResult struct {
+	Inserted int64 // 新插入的文档数量
+	Updated  int64 // 在 upsert 模式下被替换的已有文档数量
+}
+
+// ImportOption 是 Import 的可选配置项
+type ImportOption func(*importConfig)
+
+type importConfig struct {
+	format    Format
+	upsert    bool
+	batchSize int
+	progress  func(ImportResult)
+	columns   []CSVColumn // CSV 列到文档字段的映射
+	keyColumn string      // CSV 中作为主键的列
+	comma     rune        // CSV 的字段分隔符
+}
+
+// ImportFormat 设置输入的格式,默认为 FormatJSONLines
+func ImportFormat(format Format) ImportOption {
+	return func(c *importConfig) {
+		c.format = format
+	}
+}
+
+// ImportUpsert 让已经存在的文档被输入中的文档整体替换,默认遇到已经存在的文档时返回 *DocumentExistsError
+func ImportUpsert() ImportOption {
+	return func(c *importConfig) {
+		c.upsert = true
+	}
+}
+
+// ImportBatchSize 设置每个事务中写入的文档数量,默认为 DefaultImportBatchSize
+func ImportBatchSize(size int) ImportOption {
+	return func(c *importConfig) {
+		if size > 0 {
+			c.batchSize = size
+		}
+	}
+}
+
+// ImportProgress 设置每个批次提交后调用的函数,参数是到目前为止的导入结果
+func ImportProgress(fn func(ImportResult)) ImportOption {
+	return func(c *importConfig) {
+		c.progress = fn
+	}
+}
+
+// Export 方法把所有满足 filter 的文档以 format 格式写入 w
+//
+// 介绍:
+// Export 在一个快照上遍历文档,逐个编码后写入 w,不会把所有文档收集到内存中,
+// 导出期间的写操作不会被阻塞,也不会出现在导出的结果中。导出的文档包含 _rev 等元数据字段,
+// 导入时这些字段会被重新生成。
+// 使用 FormatCSV 时先遍历一遍快照收集所有字段作为表头,主键列排在最前面;
+// 只需要部分列时可以使用 WriteCSV。
+//
+// 参数:
+// - w: 输出
+// - filter: 要导出的文档需要满足的条件,nil 表示导出所有文档
+// - format: 输出的格式
+//
+// 返回值:
+// - int: 导出的文档数量
+// - error: 编码或者写入 w 时的错误
+func (db *Database) Export(w io.Writer, filter Filter, format Format) (int, error) {
+	if format != FormatJSONLines && format != FormatJSONArray && format != FormatCSV {
+		return 0, fmt.Errorf("unsupported export format: %v", format)
+	}
+	db.logTo(LogSubsystemQuery, LogLevelDebug, "Exporting documents", slog.Any("filter", filter), slog.String("format", format.String()))
+
+	// 快照中的文档保存的是密文,确定性加密的字段与加密之后的条件比较
+	filter = db.encryptFilter(filter)
+	snap := db.Snapshot()
+	defer snap.Release()
+	if format == FormatCSV {
+		return db.exportCSV(snap, w, filter)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	count := 0
+	var err error
+	write := func(s string) {
+		if err == nil {
+			_, err = io.WriteString(w, s)
+		}
+	}
+
+	if format == FormatJSONArray {
+		write("[\n")
+	}
+	snap.forEach(func(_ string, data map[string]interface{}) bool {
+		if !matchFilter(data, filter) {
+			return true
+		}
+		if format == FormatJSONArray && count > 0 {
+			write(",\n")
+		}
+		if err == nil {
+			// Encode 会在每个文档之后写入换行
+			err = encoder.Encode(data)
+		}
+		count++
+		return err == nil
+	})
+	if format == FormatJSONArray {
+		write("]\n")
+	}
+	if err != nil {
+		db.logTo(LogSubsystemQuery, LogLevelError, "Export failed", slog.String("op", "export"), slog.Int("count", count), slog.Any("error", err))
+		return count, fmt.Errorf("failed to export documents: %w", err)
+	}
+
+	db.logTo(LogSubsystemQuery, LogLevelInfo, "Exported documents", slog.String("op", "export"), slog.Int("count", count))
+	return count, nil
+}
+
+// Import 方法从 r 中读取文档并写入数据库
+//
+// 介绍:
+// Import 使用 json.Decoder 逐个解码文档(CSV 使用 csv.Reader 逐行读取),输入可以任意大。每 BatchSize 个文档在一个事务中提交,
+// 文档的主键、钩子和模式校验规则与 Insert 相同。默认遇到已经存在的文档时返回 *DocumentExistsError,
+// 使用 ImportUpsert 时已经存在的文档被整体替换。批次因为并发写入而冲突时会自动重试。
+//
+// 参数:
+// - r: 输入
+// - opts: 可选配置项,例如 ImportFormat、ImportUpsert、ImportBatchSize 和 ImportProgress,
+// CSV 输入还可以使用 ImportColumns、ImportKeyColumn 和 ImportComma
+//
+// 返回值:
+// - ImportResult: 插入和替换的文档数量
+// - error: 输入格式错误或者写入失败时的错误,出错的批次不会生效,之前已经提交的批次不会回滚
+func (db *Database) Import(r io.Reader, opts ...ImportOption) (ImportResult, error) {
+	cfg := importConfig{batchSize: DefaultImportBatchSize}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	start := time.Now()
+	db.log(LogLevelDebug, "Importing documents", slog.String("format", cfg.format.String()), slog.Bool("upsert", cfg.upsert), slog.Int("batch_size", cfg.batchSize))
+
+	var result ImportResult
+	next, err := db.newDocumentDecoder(r, &cfg)
+	if err != nil {
+		return result, err
+	}
+
+	batch := make([]map[string]interface{}, 0, cfg.batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		inserted, updated, err := db.importBatch(batch, cfg.upsert)
+		if err != nil {
+			return err
+		}
+		result.Inserted += inserted
+		result.Updated += updated
+		batch = batch[:0]
+		if cfg.progress != nil {
+			cfg.progress(result)
+		}
+		return nil
+	}
+
+	for n := 1; ; n++ {
+		doc, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			db.log(LogLevelError, "Failed to decode document", slog.String("op", "import"), slog.Int("index", n), slog.Any("error", err))
+			return result, fmt.Errorf("failed to decode document %d: %w", n, err)
+		}
+		batch = append(batch, doc)
+		if len(batch) >= cfg.batchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+
+	db.log(LogLevelInfo, "Imported documents", slog.String("op", "import"), slog.Int64("count", result.Inserted), slog.Int64("replaced", result.Updated), slog.Duration("duration", time.Since(start)))
+	return result, nil
+}
+
+// importBatch 在一个事务中写入一批文档,冲突时重试,返回插入和替换的文档数量
+func (db *Database) importBatch(docs []map[string]interface{}, upsert bool) (int64, int64, error) {
+	for attempt := 0; ; attempt++ {
+		var inserted, updated int64
+		err := db.RunInTx(func(tx *Tx) error {
+			for _, doc := range docs {
+				if !upsert {
+					if _, err := tx.Insert(doc); err != nil {
+						return err
+					}
+					inserted++
+					continue
+				}
+				parsed, id, err := db.parseDocument(doc)
+				if err != nil {
+					return err
+				}
+				isNew, err := tx.replace(id, parsed)
+				if err != nil {
+					return err
+				}
+				if isNew {
+					inserted++
+				} else {
+					updated++
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, ErrConflict) && attempt < importConflictRetries {
+			db.log(LogLevelWarn, "Import batch conflicted with a concurrent write, retrying", slog.Int("attempt", attempt), slog.Any("error", err))
+			continue
+		}
+		if err != nil {
+			db.log(LogLevelError, "Failed to import batch", slog.String("op", "import"), slog.Int("count", len(docs)), slog.Any("error", err))
+			return 0, 0, err
+		}
+		return inserted, updated, nil
+	}
+}
+
+// newDocumentDecoder 返回一个从 r 中逐个读取文档的函数,输入结束时返回 io.EOF
+func (db *Database) newDocumentDecoder(r io.Reader, cfg *importConfig) (func() (map[string]interface{}, error), error) {
+	if cfg.format == FormatCSV {
+		return db.newCSVDecoder(r, cfg)
+	}
+
+	decoder := json.NewDecoder(r)
+	decode := func() (map[string]interface{}, error) {
+		var doc map[string]interface{}
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			return nil, errors.New("document is null")
+		}
+		return doc, nil
+	}
+
+	switch cfg.format {
+	case FormatJSONLines:
+		// json.Decoder 接受以空白分隔的多个值,因此同样可以读取每行一个文档的输入
+		return decode, nil
+	case FormatJSONArray:
+		if err := expectDelim(decoder, '['); err != nil {
+			return nil, err
+		}
+		done := false
+		return func() (map[string]interface{}, error) {
+			if done {
+				return nil, io.EOF
+			}
+			if decoder.More() {
+				return decode()
+			}
+			done = true
+			if err := expectDelim(decoder, ']'); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported import format: %v", cfg.format)
+}
+
+// expectDelim 读取下一个 JSON 标记并检查它是 delim
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err == io.EOF {
+		return fmt.Errorf("expected %v, got end of input", delim)
+	}
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %v, got %v", delim, token)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package jsonDB
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExportAndImport(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	for i, name := range []string{"Alice", "Bob", "Carol", "Dave", "Eve"} {
+		if _, err := db.Insert(map[string]interface{}{"id": name, "age": 20 + i*10, "info": map[string]interface{}{"city": "Paris"}}); err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+	}
+
+	for _, format := range []Format{FormatJSONLines, FormatJSONArray} {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			count, err := db.Export(&buf, Filter{"age": map[string]interface{}{"$gte": 30}}, format)
+			if err != nil || count != 4 {
+				t.Fatalf("Expected 4 exported documents, got %d %v", count, err)
+			}
+			if format == FormatJSONArray && !strings.HasPrefix(buf.String(), "[") {
+				t.Errorf("Expected a JSON array, got %s", buf.String())
+			}
+
+			target, err := db.CreateCollection("import_"+format.String(), "id")
+			if err != nil {
+				t.Fatalf("Failed to create collection: %v", err)
+			}
+			var progress []ImportResult
+			result, err := target.Import(bytes.NewReader(buf.Bytes()), ImportFormat(format), ImportBatchSize(3),
+				ImportProgress(func(r ImportResult) { progress = append(progress, r) }))
+			if err != nil || result.Inserted != 4 {
+				t.Fatalf("Expected 4 imported documents, got %+v %v", result, err)
+			}
+			if len(progress) != 2 || progress[0].Inserted != 3 {
+				t.Errorf("Expected progress after each batch, got %+v", progress)
+			}
+			if doc, ok := target.Get("Bob"); !ok || doc["age"] != float64(30) || DocumentRevision(doc) == 0 {
+				t.Errorf("Unexpected imported document: %v", doc)
+			}
+
+			// 重复导入默认失败,出错的批次不会生效
+			_, err = target.Import(bytes.NewReader(buf.Bytes()), ImportFormat(format))
+			if !errors.Is(err, ErrDocumentExists) {
+				t.Errorf("Expected ErrDocumentExists, got %v", err)
+			}
+		})
+	}
+}
+
+func TestImportUpsert(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	if _, err := db.Insert(map[string]interface{}{"id": "1", "name": "old", "extra": true}); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	input := `{"id": "1", "name": "new"}
+{"id": "2", "name": "two"}
+{"id": "2", "name": "two again"}`
+	result, err := db.Import(strings.NewReader(input), ImportUpsert())
+	if err != nil || result.Inserted != 1 || result.Updated != 2 {
+		t.Fatalf("Unexpected upsert result: %+v %v", result, err)
+	}
+	if doc, _ := db.Get("1"); doc["name"] != "new" || doc["extra"] != nil || doc[RevisionField] != uint64(2) {
+		t.Errorf("Expected document to be replaced, got %v", doc)
+	}
+	if doc, _ := db.Get("2"); doc["name"] != "two again" {
+		t.Errorf("Expected the last duplicate to win, got %v", doc)
+	}
+
+	for _, input := range []string{`{"id": "3"} [1]`, `{"id": "3"}`, `[{"id": "3"} {"id": "4"}]`} {
+		if _, err := db.Import(strings.NewReader(input), ImportFormat(FormatJSONArray)); err == nil {
+			t.Errorf("Expected error for malformed input %q", input)
+		}
+	}
+	if _, ok := db.Get("3"); ok {
+		t.Error("Malformed input must not import any document")
+	}
+}
@@ -2,6 +2,8 @@ package jsonDB
 
 import (
 	"fmt"
+	"log/slog"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -13,8 +15,14 @@ type Index struct {
 	values *sync.Map    // 存储索引的数据结构,key是字段值,value是文档ID的集合
 	trie   *Trie        // 用于支持模糊查询的 trie 结构
 	mu     sync.RWMutex // 保护索引操作的读写锁
+
+	ttl         bool          // 是否为 TTL 索引
+	expireAfter time.Duration // TTL 索引中文档在字段时间之后多久过期
 }
 
+// IndexOption 是 CreateIndex 的可选配置项
+type IndexOption func(*Index)
+
 // CompositeIndex 结构体定义了复合索引
 type CompositeIndex struct {
 	fields []string     // 复合索引的字段名列表
@@ -37,13 +45,17 @@ type CompositeIndex struct {
 // 需要注意的是,虽然索引可以显著提升读取性能,但会略微降低写入性能,因为每次插入或更新操作都
 // 需要维护索引。因此,应该只为经常在查询中使用的字段创建索引。
 //
+// 使用 IndexTTL 选项可以创建 TTL 索引,文档在字段记录的时间之后自动过期,详见 ttl.go。
+//
 // 参数:
-// - field: 要创建索引的字段名
+// - field: 要创建索引的字段名,可以是点号分隔的嵌套字段路径
+// - opts: 可选配置项,例如 IndexTTL
 //
 // 注意: 这个方法没有返回值,但会在日志中记录索引创建的结果
-func (db *Database) CreateIndex(field string) {
+func (db *Database) CreateIndex(field string, opts ...IndexOption) {
 	// 记录开始创建索引的日志
-	db.logger.Info(fmt.Sprintf("Creating index for field: %s", field))
+	start := time.Now()
+	db.logTo(LogSubsystemIndex, LogLevelInfo, "Creating index", slog.String("field", field))
 
 	// 获取数据库的写锁,确保在创建索引时数据不被修改
 	db.mu.Lock()
@@ -57,9 +69,18 @@ func (db *Database) CreateIndex(field string) {
 			values: &sync.Map{}, // 初始化存储索引数据的 sync.Map
 			trie:   NewTrie(),   // 初始化用于支持模糊查询的 Trie
 		}
+		for _, opt := range opts {
+			opt(index)
+		}
 		// 将新创建的索引存储到数据库的索引集合中
 		db.indexes.Store(field, index)
 
+		// TTL 索引从现在开始隐藏过期的文档,并由后台清理器删除它们
+		if index.ttl {
+			db.addTTLRule(ttlRule{field: field, expireAfter: index.expireAfter})
+			db.logTo(LogSubsystemIndex, LogLevelInfo, "Documents expire after field", slog.String("field", field), slog.Duration("expire_after", index.expireAfter))
+		}
+
 		// 为现有文档创建索引
 		indexedCount := 0 // 用于记录已索引的文档数量
 		db.data.Range(func(key, value interface{}) bool {
@@ -71,10 +92,10 @@ func (db *Database) CreateIndex(field string) {
 		})
 
 		// 记录索引创建完成的日志,包括索引的文档数量
-		db.logger.Info(fmt.Sprintf("Index created for field %s, indexed %d documents", field, indexedCount))
+		db.logTo(LogSubsystemIndex, LogLevelInfo, "Index created", slog.String("op", "create_index"), slog.String("field", field), slog.Int("count", indexedCount), slog.Duration("duration", time.Since(start)))
 	} else {
 		// 如果索引已存在,记录警告日志
-		db.logger.Warn(fmt.Sprintf("Index already exists for field: %s", field))
+		db.logTo(LogSubsystemIndex, LogLevelWarn, "Index already exists", slog.String("op", "create_index"), slog.String("field", field))
 	}
 }
 
@@ -101,7 +122,8 @@ func (db *Database) CreateCompositeIndex(fields []string) {
 	indexKey := strings.Join(fields, "-")
 
 	// 记录开始创建复合索引的日志
-	db.logger.Info(fmt.Sprintf("Creating composite index for fields: %v", fields))
+	start := time.Now()
+	db.logTo(LogSubsystemIndex, LogLevelInfo, "Creating composite index", slog.Any("fields", fields))
 
 	// 获取数据库的写锁,确保在创建索引时数据不被修改
 	db.mu.Lock()
@@ -128,13 +150,53 @@ func (db *Database) CreateCompositeIndex(fields []string) {
 		})
 
 		// 记录复合索引创建完成的日志,包括索引的文档数量
-		db.logger.Info(fmt.Sprintf("Composite index created for fields %v, indexed %d documents", fields, indexedCount))
+		db.logTo(LogSubsystemIndex, LogLevelInfo, "Composite index created", slog.String("op", "create_index"), slog.Any("fields", fields), slog.Int("count", indexedCount), slog.Duration("duration", time.Since(start)))
 	} else {
 		// 如果复合索引已存在,记录警告日志
-		db.logger.Warn(fmt.Sprintf("Composite index already exists for fields: %v", fields))
+		db.logTo(LogSubsystemIndex, LogLevelWarn, "Composite index already exists", slog.String("op", "create_index"), slog.Any("fields", fields))
 	}
 }
 
+// Indexes 方法返回集合上所有索引的名称,按字母顺序排列
+// 单字段索引的名称是字段名,复合索引的名称是用'-'连接的字段名
+func (db *Database) Indexes() []string {
+	var names []string
+	db.indexes.Range(func(key, _ interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+// DropIndex 方法删除指定名称的索引
+//
+// 介绍:
+// 删除索引之后,对该字段的查询退回到全表扫描。删除 TTL 索引时同时删除对应的过期规则,
+// 文档不再因为该字段而过期。
+//
+// 参数:
+// - name: 索引名称,与 Indexes 返回的名称相同
+//
+// 返回值:
+// - error: 索引不存在时返回 ErrIndexNotFound
+func (db *Database) DropIndex(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	value, ok := db.indexes.LoadAndDelete(name)
+	if !ok {
+		db.logTo(LogSubsystemIndex, LogLevelWarn, "Index not found", slog.String("op", "drop_index"), slog.String("index", name))
+		return fmt.Errorf("%w: '%s'", ErrIndexNotFound, name)
+	}
+	if idx, ok := value.(*Index); ok && idx.ttl {
+		db.removeTTLRule(idx.field)
+	}
+
+	db.logTo(LogSubsystemIndex, LogLevelInfo, "Dropped index", slog.String("op", "drop_index"), slog.String("index", name))
+	return nil
+}
+
 // indexDocument 方法用于为单个文档创建单字段索引
 //
 // 介绍:
@@ -158,20 +220,9 @@ func (db *Database) indexDocument(doc *Document, id string, index *Index) {
 	defer doc.mu.RUnlock()
 
 	// 检查文档是否包含要索引的字段
-	if fieldValue, ok := doc.data[index.field]; ok {
-		var indexValue interface{}
-		// 根据字段值的类型进行相应的转换
-		switch v := fieldValue.(type) {
-		case int, int64, float32, float64:
-			// 数值类型统一转换为 float64
-			indexValue = toFloat64(v)
-		case time.Time:
-			// 时间类型转换为 Unix 时间戳
-			indexValue = v.Unix()
-		default:
-			// 其他类型(如字符串)直接使用原值
-			indexValue = v
-		}
+	if fieldValue, ok := lookupField(doc.data, index.field); ok {
+		// 根据字段值的类型转换为索引键
+		indexValue := indexKeyOf(fieldValue)
 
 		// 将索引值转换为字符串,用于 Trie 索引
 		strValue := fmt.Sprintf("%v", indexValue)
@@ -186,10 +237,26 @@ func (db *Database) indexDocument(doc *Document, id string, index *Index) {
 		index.mu.Unlock()
 
 		// 记录索引操作的日志
-		db.logger.Debug(fmt.Sprintf("Indexed document %s for field %s with value %v (type: %T, indexValue: %v)", id, index.field, fieldValue, fieldValue, indexValue))
+		db.logTo(LogSubsystemIndex, LogLevelDebug, "Indexed document", slog.String("id", id), slog.String("field", index.field),
+			slog.Any("value", fieldValue), slog.Any("type", typeName{fieldValue}), slog.Any("index_key", indexValue))
 	} else {
 		// 如果文档不包含要索引的字段,记录警告日志
-		db.logger.Warn(fmt.Sprintf("Document %s does not contain field %s for indexing", id, index.field))
+		db.logTo(LogSubsystemIndex, LogLevelWarn, "Document does not contain the indexed field", slog.String("id", id), slog.String("field", index.field))
+	}
+}
+
+// indexKeyOf 将字段值转换为单字段索引中使用的键
+func indexKeyOf(fieldValue interface{}) interface{} {
+	switch v := fieldValue.(type) {
+	case int, int64, float32, float64:
+		// 数值类型统一转换为 float64
+		return toFloat64(v)
+	case time.Time:
+		// 时间类型转换为 Unix 时间戳
+		return v.Unix()
+	default:
+		// 其他类型(如字符串)直接使用原值
+		return v
 	}
 }
 
@@ -214,7 +281,7 @@ func (db *Database) indexDocumentComposite(doc *Document, id string, index *Comp
 	valueMap, _ := index.values.LoadOrStore(compositeKey, &sync.Map{})
 	valueMap.(*sync.Map).Store(id, struct{}{})
 	index.mu.Unlock()
-	db.logger.Debug(fmt.Sprintf("Indexed document %s for composite fields %v with key %s", id, index.fields, compositeKey))
+	db.logTo(LogSubsystemIndex, LogLevelDebug, "Indexed document in composite index", slog.String("id", id), slog.Any("fields", index.fields), slog.String("key", compositeKey))
 }
 
 // updateIndex 方法用于更新单字段索引
@@ -234,32 +301,37 @@ func (db *Database) indexDocumentComposite(doc *Document, id string, index *Comp
 //
 // 注意: 这个方法在内部使用,不应该直接从外部调用
 func (db *Database) updateIndex(id string, oldDoc, newDoc *Document, index *Index) {
-	// 获取旧文档和新文档中索引字段的值
-	oldValue, _ := oldDoc.data[index.field]
-	newValue, _ := newDoc.data[index.field]
+	// 获取旧文档和新文档中索引字段的值,转换为与 indexDocument 相同的索引键
+	oldValue, oldOk := lookupField(oldDoc.data, index.field)
+	newValue, newOk := lookupField(newDoc.data, index.field)
+	oldKey, newKey := indexKeyOf(oldValue), indexKeyOf(newValue)
 
 	// 如果索引字段的值发生变化
-	if oldValue != newValue {
+	if oldOk != newOk || oldKey != newKey {
 		// 获取索引的写锁
 		index.mu.Lock()
 		defer index.mu.Unlock()
 
 		// 从旧值的索引中移除文档ID
-		if oldMap, ok := index.values.Load(oldValue); ok {
-			oldMap.(*sync.Map).Delete(id)
-			db.logger.Debug(fmt.Sprintf("Removed document %s from index %s for old value %v", id, index.field, oldValue))
+		if oldOk {
+			if oldMap, ok := index.values.Load(oldKey); ok {
+				oldMap.(*sync.Map).Delete(id)
+				db.logTo(LogSubsystemIndex, LogLevelDebug, "Removed document from index", slog.String("id", id), slog.String("field", index.field), slog.Any("old_value", oldValue))
+			}
+			// 从 Trie 中移除旧值
+			index.trie.Remove(strings.ToLower(fmt.Sprintf("%v", oldKey)), id)
 		}
-		// 从 Trie 中移除旧值
-		index.trie.Remove(strings.ToLower(fmt.Sprintf("%v", oldValue)), id)
 
 		// 将文档ID添加到新值的索引中
-		newMap, _ := index.values.LoadOrStore(newValue, &sync.Map{})
-		newMap.(*sync.Map).Store(id, struct{}{})
-		// 将新值添加到 Trie 中
-		index.trie.Insert(strings.ToLower(fmt.Sprintf("%v", newValue)), id)
-
-		// 记录索引更新的日志
-		db.logger.Debug(fmt.Sprintf("Added document %s to index %s for new value %v", id, index.field, newValue))
+		if newOk {
+			newMap, _ := index.values.LoadOrStore(newKey, &sync.Map{})
+			newMap.(*sync.Map).Store(id, struct{}{})
+			// 将新值添加到 Trie 中
+			index.trie.Insert(strings.ToLower(fmt.Sprintf("%v", newKey)), id)
+
+			// 记录索引更新的日志
+			db.logTo(LogSubsystemIndex, LogLevelDebug, "Added document to index", slog.String("id", id), slog.String("field", index.field), slog.Any("new_value", newValue))
+		}
 	}
 }
 
@@ -280,30 +352,32 @@ func (db *Database) updateCompositeIndex(id string, oldDoc, newDoc *Document, in
 		// 从旧复合键的集合中移除文档ID
 		if oldMap, ok := index.values.Load(oldCompositeKey); ok {
 			oldMap.(*sync.Map).Delete(id)
-			db.logger.Debug(fmt.Sprintf("Removed document %s from composite index for old key %s", id, oldCompositeKey))
+			db.logTo(LogSubsystemIndex, LogLevelDebug, "Removed document from composite index", slog.String("id", id), slog.Any("fields", index.fields), slog.String("key", oldCompositeKey))
 		}
 		// 将文档ID添加到新复合键的集合中
 		newMap, _ := index.values.LoadOrStore(newCompositeKey, &sync.Map{})
 		newMap.(*sync.Map).Store(id, struct{}{})
 		index.mu.Unlock()
-		db.logger.Debug(fmt.Sprintf("Added document %s to composite index for new key %s", id, newCompositeKey))
+		db.logTo(LogSubsystemIndex, LogLevelDebug, "Added document to composite index", slog.String("id", id), slog.Any("fields", index.fields), slog.String("key", newCompositeKey))
 	}
 }
 
 // removeFromIndex 从单字段索引中移除文档
 func (db *Database) removeFromIndex(id string, doc *Document, index *Index) {
-	if fieldValue, ok := doc.data[index.field]; ok {
+	if fieldValue, ok := lookupField(doc.data, index.field); ok {
+		// 与 indexDocument 使用相同的索引键,例如整数在索引中是 float64
+		indexValue := indexKeyOf(fieldValue)
 		index.mu.Lock()
 		// 从对应字段值的集合中移除文档ID
-		if valueMap, ok := index.values.Load(fieldValue); ok {
+		if valueMap, ok := index.values.Load(indexValue); ok {
 			valueMap.(*sync.Map).Delete(id)
-			db.logger.Debug(fmt.Sprintf("Removed document %s from index %s for value %v", id, index.field, fieldValue))
+			db.logTo(LogSubsystemIndex, LogLevelDebug, "Removed document from index", slog.String("id", id), slog.String("field", index.field), slog.Any("value", fieldValue))
 		}
 		// 从 trie 中移除文档ID
-		index.trie.Remove(strings.ToLower(fmt.Sprintf("%v", fieldValue)), id)
+		index.trie.Remove(strings.ToLower(fmt.Sprintf("%v", indexValue)), id)
 		index.mu.Unlock()
 	} else {
-		db.logger.Warn(fmt.Sprintf("Document %s does not contain field %s for index removal", id, index.field))
+		db.logTo(LogSubsystemIndex, LogLevelWarn, "Document does not contain the indexed field for removal", slog.String("id", id), slog.String("field", index.field))
 	}
 }
 
@@ -324,7 +398,7 @@ func (db *Database) removeFromCompositeIndex(id string, doc *Document, index *Co
 	// 从对应复合索引键的集合中移除文档ID
 	if valueMap, ok := index.values.Load(compositeKey); ok {
 		valueMap.(*sync.Map).Delete(id)
-		db.logger.Debug(fmt.Sprintf("Removed document %s from composite index for key %s", id, compositeKey))
+		db.logTo(LogSubsystemIndex, LogLevelDebug, "Removed document from composite index", slog.String("id", id), slog.Any("fields", index.fields), slog.String("key", compositeKey))
 	}
 	index.mu.Unlock()
 }
@@ -347,7 +421,7 @@ func (db *Database) removeFromCompositeIndex(id string, doc *Document, index *Co
 // 注意: 这个方法没有返回值,所有的输出都通过日志系统记录
 func (db *Database) PrintIndexContent(field string) {
 	// 记录开始打印索引内容的日志
-	db.logger.Debug(fmt.Sprintf("Printing index content for field: %s", field))
+	db.logTo(LogSubsystemIndex, LogLevelDebug, "Printing index content", slog.String("field", field))
 
 	// 尝试从数据库的索引集合中获取指定字段的索引
 	if indexValue, ok := db.indexes.Load(field); ok {
@@ -360,14 +434,14 @@ func (db *Database) PrintIndexContent(field string) {
 			// 遍历索引中的所有键值对
 			idx.values.Range(func(key, value interface{}) bool {
 				// 打印索引键
-				db.logger.Debug(fmt.Sprintf("Index key: %v", key))
+				db.logTo(LogSubsystemIndex, LogLevelDebug, "Index key", slog.String("field", field), slog.Any("key", key))
 
 				// 检查值是否为预期的 sync.Map 类型
 				if valueMap, ok := value.(*sync.Map); ok {
 					// 遍历与该索引键关联的所有文档ID
 					valueMap.Range(func(docID, _ interface{}) bool {
 						// 打印文档ID
-						db.logger.Debug(fmt.Sprintf("  Document ID: %v", docID))
+						db.logTo(LogSubsystemIndex, LogLevelDebug, "Index entry", slog.String("field", field), slog.Any("key", key), slog.Any("id", docID))
 						return true // 继续遍历
 					})
 				}
@@ -376,6 +450,6 @@ func (db *Database) PrintIndexContent(field string) {
 		}
 	} else {
 		// 如果未找到指定字段的索引,记录相应的日志
-		db.logger.Debug(fmt.Sprintf("No index found for field: %s", field))
+		db.logTo(LogSubsystemIndex, LogLevelDebug, "No index found", slog.String("field", field))
 	}
 }
@@ -0,0 +1,200 @@
+// keygen.go
+
+// 介绍:
+// 本文件实现了主键的自动生成。
+//
+// 通过 WithKeyPolicy 选项可以为数据库设置主键生成策略,插入的文档缺少主键字段时,
+// 数据库按照策略生成一个主键写入文档,并由 Insert 返回。支持的策略有:
+// - KeyPolicyUUIDv4: 随机 UUID
+// - KeyPolicyUUIDv7: 以毫秒时间戳开头的 UUID,按生成顺序递增
+// - KeyPolicyULID: 26 个字符的 ULID,按生成顺序递增
+// - KeyPolicySequence: 从 1 开始单调递增的整数
+//
+// 整数序列的当前值在检查点时保存到元数据文件中。打开数据库时,序列从元数据中的值、
+// 数据文件和 WAL 中出现过的最大整数主键三者中的最大值继续,因此崩溃后不会重复分配
+// 已经写入 WAL 的主键,即使对应的文档之后被删除。
+
+package jsonDB
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyPolicy 定义文档缺少主键时的主键生成策略
+type KeyPolicy int
+
+const (
+	// KeyPolicyNone 不生成主键,文档缺少主键时 Insert 返回错误
+	KeyPolicyNone KeyPolicy = iota
+	// KeyPolicyUUIDv4 生成随机的 UUID(RFC 9562 第 4 版)
+	KeyPolicyUUIDv4
+	// KeyPolicyUUIDv7 生成基于时间的 UUID(RFC 9562 第 7 版),同一数据库生成的主键按字符串排序即为生成顺序
+	KeyPolicyUUIDv7
+	// KeyPolicyULID 生成 ULID,同一数据库生成的主键按字符串排序即为生成顺序
+	KeyPolicyULID
+	// KeyPolicySequence 生成单调递增的整数主键,序列值会被持久化
+	KeyPolicySequence
+)
+
+// String 返回主键生成策略的名称
+func (p KeyPolicy) String() string {
+	switch p {
+	case KeyPolicyNone:
+		return "none"
+	case KeyPolicyUUIDv4:
+		return "uuidv4"
+	case KeyPolicyUUIDv7:
+		return "uuidv7"
+	case KeyPolicyULID:
+		return "ulid"
+	case KeyPolicySequence:
+		return "sequence"
+	}
+	return fmt.Sprintf("KeyPolicy(%d)", int(p))
+}
+
+// ErrMissingPrimaryKey 表示文档缺少主键,并且数据库没有设置主键生成策略
+var ErrMissingPrimaryKey = errors.New("primary key not found in document")
+
+// crockford 是 ULID 使用的 Crockford Base32 字母表
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// timeKeyGenerator 生成以毫秒时间戳开头的主键(UUIDv7 和 ULID)
+// 同一毫秒内生成的主键在上一个主键的随机部分上加 1,以保证严格递增
+type timeKeyGenerator struct {
+	mu     sync.Mutex
+	lastMS int64
+	last   [10]byte
+}
+
+// next 返回下一个主键的时间戳和 10 字节的随机部分
+// 同一毫秒内只对 rnd[from:] 递增,递增溢出时时间戳前进 1 毫秒
+func (g *timeKeyGenerator) next(from int) (int64, [10]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := time.Now().UnixMilli()
+	if ms > g.lastMS {
+		if _, err := rand.Read(g.last[:]); err != nil {
+			return 0, g.last, fmt.Errorf("failed to read random bytes: %w", err)
+		}
+		g.lastMS = ms
+		return g.lastMS, g.last, nil
+	}
+
+	// 时钟没有前进(或者回拨),沿用上一个时间戳并递增随机部分
+	for i := len(g.last) - 1; i >= from; i-- {
+		g.last[i]++
+		if g.last[i] != 0 {
+			return g.lastMS, g.last, nil
+		}
+	}
+	g.lastMS++
+	return g.lastMS, g.last, nil
+}
+
+// generateKey 按照数据库的主键生成策略生成一个新主键
+// 返回的第一个值是写入文档的主键值,第二个值是它的字符串形式
+func (db *Database) generateKey() (interface{}, string, error) {
+	switch db.keyPolicy {
+	case KeyPolicyUUIDv4:
+		var u [16]byte
+		if _, err := rand.Read(u[:]); err != nil {
+			return nil, "", fmt.Errorf("failed to read random bytes: %w", err)
+		}
+		u[6] = u[6]&0x0f | 0x40
+		u[8] = u[8]&0x3f | 0x80
+		id := formatUUID(u)
+		return id, id, nil
+
+	case KeyPolicyUUIDv7:
+		// 随机部分的前 3 个字节包含版本号和变体位,同一毫秒内只递增后 7 个字节
+		ms, rnd, err := db.timeKeys.next(3)
+		if err != nil {
+			return nil, "", err
+		}
+		var u [16]byte
+		binary.BigEndian.PutUint16(u[0:2], uint16(ms>>32))
+		binary.BigEndian.PutUint32(u[2:6], uint32(ms))
+		copy(u[6:], rnd[:])
+		u[6] = u[6]&0x0f | 0x70
+		u[8] = u[8]&0x3f | 0x80
+		id := formatUUID(u)
+		return id, id, nil
+
+	case KeyPolicyULID:
+		ms, rnd, err := db.timeKeys.next(0)
+		if err != nil {
+			return nil, "", err
+		}
+		id := formatULID(ms, rnd)
+		return id, id, nil
+
+	case KeyPolicySequence:
+		seq := atomic.AddUint64(&db.keySeq, 1)
+		return seq, strconv.FormatUint(seq, 10), nil
+	}
+	return nil, "", fmt.Errorf("%w: primary key '%s'", ErrMissingPrimaryKey, db.primaryKey)
+}
+
+// observeKey 记录一个已经使用的主键,如果它是大于当前序列值的整数,则推进序列
+// 这样无论主键是生成的还是调用方指定的,整数序列都不会分配重复的主键
+func (db *Database) observeKey(id string) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return
+	}
+	db.observeKeySequence(n)
+}
+
+// observeKeySequence 把整数主键序列推进到至少 n
+func (db *Database) observeKeySequence(n uint64) {
+	for {
+		current := atomic.LoadUint64(&db.keySeq)
+		if n <= current || atomic.CompareAndSwapUint64(&db.keySeq, current, n) {
+			return
+		}
+	}
+}
+
+// formatUUID 将 16 字节的 UUID 格式化为标准的 8-4-4-4-12 形式
+func formatUUID(u [16]byte) string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
+
+// formatULID 将 48 位毫秒时间戳和 80 位随机数编码为 26 个字符的 ULID
+func formatULID(ms int64, rnd [10]byte) string {
+	var b [16]byte
+	binary.BigEndian.PutUint16(b[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:6], uint32(ms))
+	copy(b[6:], rnd[:])
+
+	// 128 位数据按 5 位一组编码,最高位补 2 个 0 位,共 26 个字符
+	var out [26]byte
+	hi := binary.BigEndian.Uint64(b[0:8])
+	lo := binary.BigEndian.Uint64(b[8:16])
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -0,0 +1,96 @@
+package jsonDB
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"runtime"
+	"testing"
+)
+
+func TestGeneratedKeys(t *testing.T) {
+	os.RemoveAll(testDBPath)
+	db, err := NewDatabase("id", testDBPath, runtime.NumCPU(), WithKeyPolicy(KeyPolicySequence))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer func() { cleanupTestDB(t, db) }()
+
+	for want := 1; want <= 3; want++ {
+		id, err := db.Insert(map[string]interface{}{"name": "doc"})
+		if err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+		if doc, ok := db.Get(id); !ok || !filterEqual(doc["id"], want) {
+			t.Fatalf("Expected generated id %d, got %q (%v)", want, id, doc)
+		}
+	}
+	if err := db.Delete("3"); err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+
+	// 重新打开时从 WAL 恢复序列(第一次)和从元数据恢复序列(第二次),被删除的主键也不会被重新分配
+	for i := 0; i < 2; i++ {
+		db.writeWg.Wait()
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase("id", testDBPath, runtime.NumCPU(), WithKeyPolicy(KeyPolicySequence))
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+		id, err := db.Insert(map[string]interface{}{"name": "after restart"})
+		if err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+		if want := []string{"4", "5"}[i]; id != want {
+			t.Errorf("Expected id %s after restart, got %s", want, id)
+		}
+	}
+
+	// 调用方指定的整数主键会推进序列
+	if _, err := db.Insert(map[string]interface{}{"id": 10}); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	if id, _ := db.Insert(map[string]interface{}{}); id != "11" {
+		t.Errorf("Expected id 11 after explicit key 10, got %s", id)
+	}
+
+	// 没有生成策略时缺少主键返回 ErrMissingPrimaryKey
+	db.keyPolicy = KeyPolicyNone
+	if _, err := db.Insert(map[string]interface{}{"name": "no key"}); !errors.Is(err, ErrMissingPrimaryKey) {
+		t.Errorf("Expected ErrMissingPrimaryKey, got %v", err)
+	}
+}
+
+func TestTimeOrderedKeyFormats(t *testing.T) {
+	formats := map[KeyPolicy]*regexp.Regexp{
+		KeyPolicyUUIDv4: regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		KeyPolicyUUIDv7: regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		KeyPolicyULID:   regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`),
+	}
+
+	for policy, format := range formats {
+		db := &Database{keyPolicy: policy}
+		ids := make([]string, 1000)
+		for i := range ids {
+			_, id, err := db.generateKey()
+			if err != nil {
+				t.Fatalf("%v: failed to generate key: %v", policy, err)
+			}
+			if !format.MatchString(id) {
+				t.Fatalf("%v: malformed key %q", policy, id)
+			}
+			ids[i] = id
+		}
+		// 基于时间的主键按生成顺序严格递增
+		if policy == KeyPolicyUUIDv4 {
+			continue
+		}
+		for i := 1; i < len(ids); i++ {
+			if ids[i-1] >= ids[i] {
+				t.Fatalf("%v: key %q generated after %q", policy, ids[i], ids[i-1])
+			}
+		}
+	}
+}
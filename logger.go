@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
+	"strings"
+	"sync/atomic"
 )
 
 // LogLevel 定义日志级别的枚举类型
@@ -25,6 +28,8 @@ const (
 
 // Logger 接口定义了日志系统应该实现的方法
 // 这个接口允许我们在将来轻松地替换日志实现,而不影响其他代码
+// 只实现了 Logger 的日志器收到的是格式化之后的一行文本,并且无法在格式化之前跳过被关闭的级别,
+// 自定义的日志器应该同时实现 StructuredLogger,或者使用基于 log/slog 的 SlogLogger(见 slog.go)
 type Logger interface {
 	// Info 记录一般信息日志
 	Info(v ...interface{})
@@ -40,20 +45,30 @@ type Logger interface {
 	SetOutput(output io.Writer)
 }
 
+// StructuredLogger 是支持结构化属性的日志器
+// 数据库的日志都把操作名、文档ID、字段、值、耗时和结果数量作为属性传入,
+// 属性在交给日志器之前已经按照脱敏策略处理过(见 redact.go)
+type StructuredLogger interface {
+	Logger
+	// Enabled 判断 level 级别的日志是否会被记录,用于在准备属性之前跳过被关闭的日志
+	Enabled(level LogLevel) bool
+	// Log 记录一条带有属性的日志
+	Log(level LogLevel, msg string, attrs ...slog.Attr)
+}
+
 // DefaultLogger 是默认的日志实现
 // 它封装了标准库的 log.Logger,并添加了日志级别控制
 type DefaultLogger struct {
-	level  LogLevel    // 当前的日志级别
-	logger *log.Logger // 标准库的日志器
+	level  atomic.Int32 // 当前的日志级别,日志可能在后台写入的协程中记录,因此原子地读写
+	logger *log.Logger  // 标准库的日志器
 }
 
 // NewDefaultLogger 创建一个新的默认日志器
 // 它初始化日志级别为 Info,并将输出设置为标准输出
 func NewDefaultLogger() *DefaultLogger {
-	return &DefaultLogger{
-		level:  LogLevelInfo,
-		logger: log.New(os.Stdout, "", log.Ldate|log.Ltime),
-	}
+	l := &DefaultLogger{logger: log.New(os.Stdout, "", log.Ldate|log.Ltime)}
+	l.SetLevel(LogLevelInfo)
+	return l
 }
 
 // Info 记录信息级别的日志
@@ -68,10 +83,137 @@ func (l *DefaultLogger) Error(v ...interface{}) { l.log(LogLevelError, "ERROR: "
 // Debug 记录调试级别的日志
 func (l *DefaultLogger) Debug(v ...interface{}) { l.log(LogLevelDebug, "DEBUG: ", v...) }
 
+// Enabled 判断 level 级别的日志是否会被记录
+func (l *DefaultLogger) Enabled(level LogLevel) bool {
+	return level != LogLevelOff && level <= LogLevel(l.level.Load())
+}
+
+// Log 记录一条带有属性的日志,属性以 key=value 的形式追加在消息之后
+func (l *DefaultLogger) Log(level LogLevel, msg string, attrs ...slog.Attr) {
+	if l.Enabled(level) {
+		l.logger.Print(levelPrefix(level), formatLogRecord(msg, attrs))
+	}
+}
+
+// levelPrefix 返回日志级别在输出中的前缀
+func levelPrefix(level LogLevel) string {
+	switch level {
+	case LogLevelError:
+		return "ERROR: "
+	case LogLevelWarn:
+		return "WARN: "
+	case LogLevelInfo:
+		return "INFO: "
+	default:
+		return "DEBUG: "
+	}
+}
+
+// formatLogRecord 把消息和属性格式化为一行文本
+func formatLogRecord(msg string, attrs []slog.Attr) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, a := range attrs {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value.Resolve())
+	}
+	return b.String()
+}
+
+// 日志子系统的名称,每条日志都带有 subsystem 属性
+// 通过 WithSubsystemLogger 可以为子系统设置单独的日志器,例如只打开 WAL 的调试日志
+const (
+	LogSubsystemDB    = "db"    // 数据库的打开和关闭、文档读写、集合、事务、备份等
+	LogSubsystemWAL   = "wal"   // WAL 的写入、恢复、检查点、轮转和复制
+	LogSubsystemIndex = "index" // 索引的创建、维护和删除
+	LogSubsystemQuery = "query" // 查询、过滤和导出
+)
+
+// loggerFor 返回子系统使用的日志器,没有单独设置时返回数据库的日志器
+func (db *Database) loggerFor(subsystem string) Logger {
+	if loggers := db.subsystemLoggers.Load(); loggers != nil {
+		if logger, ok := (*loggers)[subsystem]; ok {
+			return logger
+		}
+	}
+	return db.logger
+}
+
+// SetSubsystemLogger 方法为子系统设置单独的日志器,logger 为 nil 时恢复使用数据库的日志器
+// 子系统的日志器由所有集合共享,它的级别和输出不受 SetLogLevel 和 SetLogOutput 影响
+func (db *Database) SetSubsystemLogger(subsystem string, logger Logger) {
+	db.loggerMu.Lock()
+	defer db.loggerMu.Unlock()
+	loggers := make(map[string]Logger)
+	if old := db.subsystemLoggers.Load(); old != nil {
+		for name, l := range *old {
+			loggers[name] = l
+		}
+	}
+	if logger == nil {
+		delete(loggers, subsystem)
+	} else {
+		loggers[subsystem] = logger
+	}
+	db.subsystemLoggers.Store(&loggers)
+}
+
+// log 记录一条属于 db 子系统的结构化日志,见 logTo
+func (db *Database) log(level LogLevel, msg string, attrs ...slog.Attr) {
+	db.logTo(LogSubsystemDB, level, msg, attrs...)
+}
+
+// logTo 记录一条结构化日志
+//
+// 介绍:
+// 所有日志都通过这个方法记录: msg 是固定的消息,操作名、文档ID、字段名、字段值、耗时、结果数量和错误
+// 都作为属性传入,调用方不需要预先格式化字符串。日志器实现了 StructuredLogger 并且 level 被关闭时直接返回,
+// 不会处理属性;否则属性先按照脱敏策略处理(见 redact.go),再加上 subsystem 属性和命名集合的 collection 属性,
+// 交给子系统的日志器。不支持结构化属性的日志器收到的是格式化之后的一行文本。
+//
+// 参数:
+// - subsystem: 日志所属的子系统,例如 LogSubsystemWAL
+// - level: 日志级别
+// - msg: 日志消息,不应包含文档内容
+// - attrs: 日志属性
+func (db *Database) logTo(subsystem string, level LogLevel, msg string, attrs ...slog.Attr) {
+	logger := db.loggerFor(subsystem)
+	sl, structured := logger.(StructuredLogger)
+	if structured && !sl.Enabled(level) {
+		return
+	}
+	attrs = db.redactAttrs(attrs)
+	head := []slog.Attr{slog.String("subsystem", subsystem)}
+	if db.name != "" {
+		head = append(head, slog.String("collection", db.name))
+	}
+	attrs = append(head, attrs...)
+	if structured {
+		sl.Log(level, msg, attrs...)
+		return
+	}
+	line := formatLogRecord(msg, attrs)
+	switch level {
+	case LogLevelError:
+		logger.Error(line)
+	case LogLevelWarn:
+		logger.Warn(line)
+	case LogLevelInfo:
+		logger.Info(line)
+	case LogLevelDebug:
+		logger.Debug(line)
+	}
+}
+
+// typeName 是在日志中显示值的类型的属性值,只有日志真正被记录时才格式化
+type typeName struct{ v interface{} }
+
+// LogValue 实现 slog.LogValuer 接口
+func (t typeName) LogValue() slog.Value { return slog.StringValue(fmt.Sprintf("%T", t.v)) }
+
 // log 是内部方法,用于实际记录日志
 // 它会检查日志级别,只有当要记录的日志级别不高于当前设置的级别时,才会实际写入日志
 func (l *DefaultLogger) log(level LogLevel, prefix string, v ...interface{}) {
-	if level <= l.level {
+	if level <= LogLevel(l.level.Load()) {
 		l.logger.Print(prefix, fmt.Sprint(v...))
 	}
 }
@@ -79,7 +221,7 @@ func (l *DefaultLogger) log(level LogLevel, prefix string, v ...interface{}) {
 // SetLevel 设置日志记录的级别
 // 这允许在运行时动态调整日志的详细程度
 func (l *DefaultLogger) SetLevel(level LogLevel) {
-	l.level = level
+	l.level.Store(int32(level))
 }
 
 // SetOutput 设置日志输出的目标
@@ -35,7 +35,7 @@ func main() {
 			"phone": "123456",
 		},
 	}
-	err = db.Insert(doc1)
+	_, err = db.Insert(doc1)
 	if err != nil {
 		log.Printf("Insert error: %v", err)
 	}
@@ -51,7 +51,7 @@ func main() {
 			"phone": "654321",
 		},
 	}
-	err = db.Insert(doc2)
+	_, err = db.Insert(doc2)
 	if err != nil {
 		log.Printf("Insert error: %v", err)
 	}
@@ -67,7 +67,7 @@ func main() {
 			"phone": "987654",
 		},
 	}
-	err = db.Insert(doc3)
+	_, err = db.Insert(doc3)
 	if err != nil {
 		log.Printf("Insert error: %v", err)
 	}
@@ -0,0 +1,1221 @@
+// offline.go
+
+// 介绍:
+// 本文件实现了在数据库没有被打开时直接检查和修复数据库文件的离线工具,cmd/jsondb-admin 基于这些函数实现。
+//
+// 所有函数都以流的方式逐条读取 data.db 和 wal.log 中的记录,不会把文档全部加载到内存:
+// DumpFiles、VerifyFiles 和 RestoreDump 的内存占用只与单条记录的大小有关;
+// AnalyzeFiles 和 CompactFiles 需要知道每个文档的最新版本在哪里,只为每个文档保存它的位置和修订号,
+// 内存占用与文档数量成正比,与文档的大小无关。
+//
+// 这些函数不会检查数据库是否正在被使用,调用方需要保证操作期间没有进程打开了同一个数据库目录。
+
+package jsonDB
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// OperationData 是数据文件中的记录在 FileRecord 中的操作类型
+	OperationData = "DATA"
+	// OperationMeta 是转储中元数据文件对应的行的操作类型
+	OperationMeta = "META"
+)
+
+// FileRecord 是数据文件或 WAL 文件中的一条记录,也是 DumpFiles 输出的一行
+type FileRecord struct {
+	File       string                 `json:"file"`                 // 记录所在的文件,例如 DataFileName 或 WALFileName
+	Offset     int64                  `json:"offset"`               // 记录(包括 4 字节的长度前缀)在文件中的起始位置
+	Size       int                    `json:"size"`                 // 记录在文件中的长度,不包括长度前缀
+	Operation  string                 `json:"op"`                   // WAL 记录的操作类型,数据文件中的记录为 OperationData
+	Collection uint32                 `json:"collection"`           // 记录所属集合的ID,默认集合为 0
+	ID         string                 `json:"id,omitempty"`         // 文档ID
+	LSN        uint64                 `json:"lsn,omitempty"`        // WAL 记录的日志序列号
+	Timestamp  int64                  `json:"timestamp,omitempty"`  // 写入 WAL 记录的时间(Unix 纳秒)
+	Document   map[string]interface{} `json:"document,omitempty"`   // 文档内容
+	Batch      []FileRecord           `json:"batch,omitempty"`      // 批量记录中的操作,只有 Operation、Collection、ID 和 Document 有效
+	Definition *CollectionMetadata    `json:"definition,omitempty"` // 创建集合的记录中新集合的定义
+	Raw        []byte                 `json:"raw,omitempty"`        // 记录的原始数据(msgpack 编码,加密的记录为解密后的内容),JSON 中为 base64
+	KeyID      string                 `json:"keyId,omitempty"`      // 加密记录使用的密钥ID,明文记录为空
+	Err        error                  `json:"-"`                    // 记录完整但是无法解密或解码时的错误,此时只有 File、Offset、Size、KeyID 和 Raw 有效
+
+	stored []byte // 记录在文件中保存的内容,明文记录与 Raw 相同
+}
+
+// Metadata 是元数据文件的内容
+type Metadata struct {
+	LSN              uint64               `json:"lsn"`                        // 最近一次检查点时的 LSN
+	KeySequence      uint64               `json:"keySequence,omitempty"`      // 默认集合整数主键序列的值
+	Schema           json.RawMessage      `json:"schema,omitempty"`           // 默认集合的 JSON Schema
+	Collections      []CollectionMetadata `json:"collections,omitempty"`      // 所有命名集合
+	NextCollectionID uint32               `json:"nextCollectionId,omitempty"` // 下一个命名集合的ID
+}
+
+// CollectionMetadata 是元数据文件中保存的命名集合信息
+type CollectionMetadata struct {
+	ID          uint32          `json:"id"`
+	Name        string          `json:"name"`
+	PrimaryKey  string          `json:"primaryKey"`
+	KeyPolicy   KeyPolicy       `json:"keyPolicy,omitempty"`
+	KeySequence uint64          `json:"keySequence,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+}
+
+// ScanDataFile 按顺序读取数据文件中的每一条记录并调用 fn
+//
+// 介绍:
+// 记录的长度前缀完整但是内容无法解码时,fn 收到的 rec.Err 不为 nil,扫描继续进行;
+// 记录超出了文件末尾时扫描停止,返回 Torn 为 true 的 *CorruptRecordError。
+// fn 返回错误时扫描停止并返回这个错误。文件不存在时视为空文件。
+// 加密的记录使用 FileKeys 提供的密钥解密,找不到密钥时 rec.Err 包装了 ErrKeyNotFound。
+//
+// 参数:
+// - path: 数据文件的路径
+// - fn: 对每条记录调用的函数,可以保留 rec
+// - opts: 可选配置项,例如 FileKeys
+//
+// 返回值:
+// - error: 读取失败、记录被截断或者 fn 返回的错误
+func ScanDataFile(path string, fn func(rec *FileRecord) error, opts ...FileOption) error {
+	return scanRecords(path, DataFileName, newFileConfig(opts), decodeDataFileRecord, fn)
+}
+
+// ScanWALFile 按顺序读取 WAL 文件中的每一条记录并调用 fn
+// 错误处理与 ScanDataFile 相同。WAL 末尾被截断的记录在打开数据库时会被丢弃,不影响已有的数据。
+// 加密的记录即使无法解密,rec.LSN 和 rec.Timestamp 也是有效的。
+func ScanWALFile(path string, fn func(rec *FileRecord) error, opts ...FileOption) error {
+	return scanRecords(path, WALFileName, newFileConfig(opts), decodeWALFileRecord, fn)
+}
+
+// errStopScan 由扫描函数的 fn 返回,表示不需要继续读取之后的记录
+var errStopScan = errors.New("stop scan")
+
+// scanRecords 逐条读取带有长度前缀的记录,解密并用 decode 解码后调用 fn
+// kind 是文件的类型,DataFileName 或 WALFileName,归档的 WAL 段同样是 WALFileName。
+// 密钥帧不会传给 fn,decode 为 nil 时只解密,由 fn 自己解码 rec.Raw
+func scanRecords(path, kind string, cfg fileConfig, decode func(rec *FileRecord) error, fn func(rec *FileRecord) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	name := filepath.Base(path)
+	reader := bufio.NewReader(file)
+	keys := &keyring{keys: cfg.keys}
+
+	var header [4]byte
+	var offset int64
+	var keyID string // 最近一个密钥帧的密钥ID
+	for offset < size {
+		remaining := size - offset - 4
+		if remaining < 0 {
+			return &CorruptRecordError{File: name, Offset: offset, Torn: true, Err: io.ErrUnexpectedEOF}
+		}
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return &CorruptRecordError{File: name, Offset: offset, Err: err}
+		}
+		n := binary.LittleEndian.Uint32(header[:])
+		if n == keyFrameMarker {
+			id, err := readKeyFrame(reader, remaining)
+			if err != nil {
+				return &CorruptRecordError{File: name, Offset: offset, Torn: err == io.ErrUnexpectedEOF, Err: err}
+			}
+			keyID = id
+			offset += 6 + int64(len(id))
+			continue
+		}
+		// 先检查长度,避免损坏的长度前缀导致分配过大的内存
+		if int64(n) > remaining {
+			return &CorruptRecordError{File: name, Offset: offset, Torn: true,
+				Err: fmt.Errorf("record length %d exceeds the remaining %d bytes", n, remaining)}
+		}
+		stored := make([]byte, n)
+		if _, err := io.ReadFull(reader, stored); err != nil {
+			return &CorruptRecordError{File: name, Offset: offset, Err: err}
+		}
+
+		rec := &FileRecord{File: name, Offset: offset, Size: int(n), KeyID: keyID, stored: stored}
+		if err := openRecord(rec, kind, keys, cfg.raw, decode); err != nil {
+			rec.Err = err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+		offset += 4 + int64(n)
+	}
+	return nil
+}
+
+// readKeyFrame 读取密钥帧中长度前缀之后的部分,remaining 是长度前缀之后剩余的字节数
+// 密钥帧超出文件末尾时返回 io.ErrUnexpectedEOF
+func readKeyFrame(reader io.Reader, remaining int64) (string, error) {
+	var length [2]byte
+	if remaining < 2 {
+		return "", io.ErrUnexpectedEOF
+	}
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return "", err
+	}
+	n := int64(binary.LittleEndian.Uint16(length[:]))
+	if n > remaining-2 {
+		return "", io.ErrUnexpectedEOF
+	}
+	id := make([]byte, n)
+	if _, err := io.ReadFull(reader, id); err != nil {
+		return "", err
+	}
+	return string(id), nil
+}
+
+// openRecord 解密 rec 并解码,raw 为 true 时加密的记录只读取明文保存的 LSN 和时间戳
+func openRecord(rec *FileRecord, kind string, keys *keyring, raw bool, decode func(rec *FileRecord) error) error {
+	if rec.KeyID == "" {
+		rec.Raw = rec.stored
+	} else {
+		if kind == WALFileName && len(rec.stored) >= walClearSize {
+			rec.LSN = binary.LittleEndian.Uint64(rec.stored)
+			rec.Timestamp = int64(binary.LittleEndian.Uint64(rec.stored[8:]))
+		}
+		if raw {
+			return nil
+		}
+		c, err := keys.cipher(rec.KeyID)
+		if err != nil {
+			return err
+		}
+		if rec.Raw, err = c.open(kind, rec.stored); err != nil {
+			return err
+		}
+	}
+	if decode == nil {
+		return nil
+	}
+	return decode(rec)
+}
+
+// decodeDataFileRecord 把 rec.Raw 解码为数据文件中的记录
+func decodeDataFileRecord(rec *FileRecord) error {
+	var entry dataRecord
+	if err := msgpack.Unmarshal(rec.Raw, &entry); err != nil {
+		return err
+	}
+	rec.Operation = OperationData
+	rec.Collection = entry.Collection
+	rec.ID = entry.ID
+	rec.Document = entry.Data
+	return nil
+}
+
+// decodeWALFileRecord 把 rec.Raw 解码为 WAL 记录
+func decodeWALFileRecord(rec *FileRecord) error {
+	var entry walEntry
+	if err := msgpack.Unmarshal(rec.Raw, &entry); err != nil {
+		return err
+	}
+	rec.Operation = entry.Operation
+	rec.Collection = entry.Collection
+	rec.ID = entry.ID
+	rec.LSN = entry.LSN
+	rec.Timestamp = entry.Time
+	rec.Document = entry.Document
+	if entry.Definition != nil {
+		definition := entry.Definition.export()
+		rec.Definition = &definition
+	}
+	for _, op := range entry.Batch {
+		rec.Batch = append(rec.Batch, FileRecord{
+			Operation:  op.Operation,
+			Collection: entry.Collection,
+			ID:         op.ID,
+			Document:   op.Document,
+		})
+	}
+	return nil
+}
+
+// encode 根据记录的字段重新编码记录,用于恢复没有原始数据的转储
+func (rec *FileRecord) encode() ([]byte, error) {
+	switch rec.File {
+	case DataFileName:
+		return encodeDataRecord(rec.Collection, rec.ID, rec.Document)
+	case WALFileName:
+		entry := walEntry{
+			Operation:  rec.Operation,
+			ID:         rec.ID,
+			Document:   rec.Document,
+			LSN:        rec.LSN,
+			Collection: rec.Collection,
+			Time:       rec.Timestamp,
+		}
+		if rec.Definition != nil {
+			definition := rec.Definition.internal()
+			entry.Definition = &definition
+		}
+		for _, op := range rec.Batch {
+			entry.Batch = append(entry.Batch, walEntry{Operation: op.Operation, ID: op.ID, Document: op.Document})
+		}
+		return msgpack.Marshal(entry)
+	}
+	return nil, fmt.Errorf("unknown file %q", rec.File)
+}
+
+// operations 返回记录中的所有操作和它们在批量记录中的位置,不是批量记录时位置为 -1
+func (rec *FileRecord) operations() ([]*FileRecord, []int) {
+	if rec.Operation != OperationBatch {
+		return []*FileRecord{rec}, []int{-1}
+	}
+	ops := make([]*FileRecord, len(rec.Batch))
+	positions := make([]int, len(rec.Batch))
+	for i := range rec.Batch {
+		ops[i] = &rec.Batch[i]
+		positions[i] = i
+	}
+	return ops, positions
+}
+
+// ReadMetadata 读取数据库目录中的元数据文件
+// 文件不存在时返回的错误满足 errors.Is(err, fs.ErrNotExist)
+func ReadMetadata(dir string) (*Metadata, error) {
+	meta, _, err := readMetaFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	return meta.export(), nil
+}
+
+// readMetaFile 读取并解码元数据文件,同时返回文件的原始内容
+func readMetaFile(dir string) (dbMeta, []byte, error) {
+	var meta dbMeta
+	data, err := os.ReadFile(filepath.Join(dir, MetaFileName))
+	if err != nil {
+		return meta, nil, err
+	}
+	if err := msgpack.Unmarshal(data, &meta); err != nil {
+		return meta, data, &CorruptRecordError{File: MetaFileName, Err: err}
+	}
+	return meta, data, nil
+}
+
+// export 把元数据转换为导出的 Metadata
+func (m dbMeta) export() *Metadata {
+	out := &Metadata{
+		LSN:              m.LSN,
+		KeySequence:      m.KeySequence,
+		Schema:           m.Schema,
+		NextCollectionID: m.NextCollectionID,
+	}
+	for _, cm := range m.Collections {
+		out.Collections = append(out.Collections, cm.export())
+	}
+	return out
+}
+
+// export 把命名集合的信息转换为导出的 CollectionMetadata
+func (cm collectionMeta) export() CollectionMetadata {
+	return CollectionMetadata{
+		ID:          cm.ID,
+		Name:        cm.Name,
+		PrimaryKey:  cm.PrimaryKey,
+		KeyPolicy:   cm.KeyPolicy,
+		KeySequence: cm.KeySequence,
+		Schema:      cm.Schema,
+	}
+}
+
+// internal 把导出的 Metadata 转换回元数据文件的内容
+func (m *Metadata) internal() dbMeta {
+	out := dbMeta{
+		LSN:              m.LSN,
+		KeySequence:      m.KeySequence,
+		Schema:           m.Schema,
+		NextCollectionID: m.NextCollectionID,
+	}
+	for _, cm := range m.Collections {
+		out.Collections = append(out.Collections, cm.internal())
+	}
+	return out
+}
+
+// internal 把导出的 CollectionMetadata 转换回元数据文件中的命名集合信息
+func (cm *CollectionMetadata) internal() collectionMeta {
+	return collectionMeta{
+		ID:          cm.ID,
+		Name:        cm.Name,
+		PrimaryKey:  cm.PrimaryKey,
+		KeyPolicy:   cm.KeyPolicy,
+		KeySequence: cm.KeySequence,
+		Schema:      cm.Schema,
+	}
+}
+
+// dumpLine 是转储中的一行
+type dumpLine struct {
+	FileRecord
+	Meta  *Metadata `json:"meta,omitempty"`  // 元数据文件的内容,只出现在 OperationMeta 行中
+	Error string    `json:"error,omitempty"` // 记录无法读取或解码时的错误
+}
+
+// DumpFiles 把数据库目录中的元数据、数据文件和 WAL 文件依次以 JSON Lines 格式写入 w
+//
+// 介绍:
+// 每一行是一个 FileRecord,包括记录所在的文件、偏移量、操作类型和文档内容,第一行是元数据文件。
+// 无法解码的记录和文件末尾被截断的记录同样输出一行,error 字段说明原因,然后继续处理下一个文件。
+// includeRaw 为 true 时每一行都包含记录的原始数据,RestoreDump 可以据此精确地还原文件,
+// 否则还原时根据 JSON 字段重新编码记录,数字会变成浮点数,时间会变成字符串。
+//
+// 参数:
+// - dir: 数据库目录
+// - w: 输出
+// - includeRaw: 是否输出记录的原始数据
+// - opts: 可选配置项,加密的数据库需要通过 FileKeys 提供密钥,转储中的记录是解密后的明文
+//
+// 返回值:
+// - error: 读取文件或者写入 w 时的错误,损坏的记录不会导致返回错误
+func DumpFiles(dir string, w io.Writer, includeRaw bool, opts ...FileOption) error {
+	if err := checkDir(dir); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	emit := func(line *dumpLine) error {
+		if !includeRaw {
+			line.Raw = nil
+		}
+		err := encoder.Encode(line)
+		var unsupported *json.UnsupportedValueError
+		if errors.As(err, &unsupported) {
+			// 文档中有 JSON 无法表示的值(例如 NaN),只输出原始数据
+			line.Document, line.Batch, line.Meta = nil, nil, nil
+			line.Error = fmt.Sprintf("cannot encode record as JSON: %v", err)
+			err = encoder.Encode(line)
+		}
+		return err
+	}
+
+	meta, raw, err := readMetaFile(dir)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil && raw == nil:
+		return err
+	default:
+		line := &dumpLine{FileRecord: FileRecord{File: MetaFileName, Operation: OperationMeta, Size: len(raw), Raw: raw}}
+		if err != nil {
+			line.Error = err.Error()
+		} else {
+			line.Meta = meta.export()
+		}
+		if err := emit(line); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range []struct {
+		name string
+		scan func(path string, fn func(rec *FileRecord) error, opts ...FileOption) error
+	}{
+		{DataFileName, ScanDataFile},
+		{WALFileName, ScanWALFile},
+	} {
+		err := file.scan(filepath.Join(dir, file.name), func(rec *FileRecord) error {
+			line := &dumpLine{FileRecord: *rec}
+			if rec.Err != nil {
+				line.Error = rec.Err.Error()
+			}
+			return emit(line)
+		}, opts...)
+		var corrupt *CorruptRecordError
+		if errors.As(err, &corrupt) {
+			err = emit(&dumpLine{FileRecord: FileRecord{File: corrupt.File, Offset: corrupt.Offset}, Error: corrupt.Error()})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreResult 是 RestoreDump 的结果
+type RestoreResult struct {
+	DataRecords int // 写入数据文件的记录数量
+	WALRecords  int // 写入 WAL 文件的记录数量
+	Skipped     int // 因为损坏而被跳过的行
+}
+
+// RestoreDump 根据 DumpFiles 输出的转储在 dir 中重建数据库文件
+//
+// 介绍:
+// 转储中的记录按原来的顺序写入新的数据文件和 WAL 文件,元数据行写入元数据文件,
+// 因此重建的数据库与转储时的数据库在打开后完全一致。行中有原始数据时直接使用原始数据,
+// 否则根据 JSON 字段重新编码,所以手工编辑转储时需要同时删除 raw 字段。
+// 无法解码的记录(带有 error 字段且没有可用的原始数据)会被跳过。
+// dir 中已经存在数据库文件时返回错误,不会覆盖已有的数据。
+//
+// 参数:
+// - r: DumpFiles 输出的转储
+// - dir: 新的数据库目录,不存在时会被创建
+// - opts: 可选配置项,通过 FileKeys 提供密钥时使用当前密钥加密重建的文件
+//
+// 返回值:
+// - *RestoreResult: 写入和跳过的记录数量
+// - error: 转储格式错误或者写入失败时的错误,此时已经写入的文件会被删除
+func RestoreDump(r io.Reader, dir string, opts ...FileOption) (*RestoreResult, error) {
+	if err := os.MkdirAll(dir, DBDirPerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	for _, name := range []string{DataFileName, WALFileName, MetaFileName} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return nil, fmt.Errorf("%s already exists in %s", name, dir)
+		}
+	}
+
+	c, err := currentCipher(newFileConfig(opts).keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the current encryption key: %w", err)
+	}
+	result := &RestoreResult{}
+	err = restoreDump(r, dir, c, result)
+	if err != nil {
+		for _, name := range []string{DataFileName, WALFileName, MetaFileName} {
+			os.Remove(filepath.Join(dir, name))
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// restoreDump 逐行读取转储并写入 dir 中的数据库文件
+func restoreDump(r io.Reader, dir string, c *recordCipher, result *RestoreResult) error {
+	writers := make(map[string]*bufio.Writer)
+	records := make(map[string]*recordWriter)
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, name := range []string{DataFileName, WALFileName} {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, DBFilePerm)
+		if err != nil {
+			return err
+		}
+		files[name] = file
+		writers[name] = bufio.NewWriter(file)
+		records[name] = newRecordWriter(writers[name], name, c)
+	}
+
+	decoder := json.NewDecoder(r)
+	for lineNo := 1; ; lineNo++ {
+		var line dumpLine
+		err := decoder.Decode(&line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		switch line.File {
+		case MetaFileName:
+			data := line.Raw
+			if data == nil && line.Meta != nil {
+				if data, err = msgpack.Marshal(line.Meta.internal()); err != nil {
+					return fmt.Errorf("line %d: %w", lineNo, err)
+				}
+			}
+			var meta dbMeta
+			if data == nil || msgpack.Unmarshal(data, &meta) != nil {
+				result.Skipped++
+				continue
+			}
+			if err := writeMetaFile(dir, data); err != nil {
+				return err
+			}
+		case DataFileName, WALFileName:
+			data, ok := line.restoreData()
+			if !ok {
+				result.Skipped++
+				continue
+			}
+			if _, err := records[line.File].write(data, line.LSN, line.Timestamp); err != nil {
+				return err
+			}
+			if line.File == DataFileName {
+				result.DataRecords++
+			} else {
+				result.WALRecords++
+			}
+		default:
+			return fmt.Errorf("line %d: unknown file %q", lineNo, line.File)
+		}
+	}
+
+	for name, writer := range writers {
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		if err := files[name].Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreData 返回转储中一行对应的记录数据,记录无法还原时返回 false
+func (line *dumpLine) restoreData() ([]byte, bool) {
+	decode := decodeDataFileRecord
+	if line.File == WALFileName {
+		decode = decodeWALFileRecord
+	}
+	if line.Raw != nil {
+		// 原始数据本身可能就是损坏的记录
+		if decode(&FileRecord{Raw: line.Raw}) != nil {
+			return nil, false
+		}
+		return line.Raw, true
+	}
+	if line.Error != "" || line.Operation == "" {
+		return nil, false
+	}
+	data, err := line.encode()
+	return data, err == nil
+}
+
+// VerifyReport 是 VerifyFiles 的检查结果
+type VerifyReport struct {
+	DataRecords int                   // 数据文件中能够解码的记录数量
+	WALRecords  int                   // WAL 文件中能够解码的记录数量
+	Problems    []*CorruptRecordError // 发现的所有问题
+}
+
+// OK 返回是否没有发现任何问题
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// VerifyFiles 检查数据库目录中每一条记录的长度前缀并解码记录内容
+//
+// 介绍:
+// 除了无法解码和被截断的记录,还会检查 WAL 记录的操作类型是否有效、LSN 是否单调递增,
+// 以及元数据文件能否解码。单条记录无法解码时继续检查后面的记录,
+// 长度前缀损坏时无法找到下一条记录的位置,停止检查这个文件。
+// WAL 末尾被截断的记录在打开数据库时会被自动丢弃,数据文件末尾被截断的记录可以通过 CompactFiles 修复。
+// 加密的记录需要通过 FileKeys 提供密钥,找不到密钥或者认证失败的记录同样作为问题报告。
+//
+// 返回值:
+// - *VerifyReport: 检查结果
+// - error: 无法读取文件时的错误
+func VerifyFiles(dir string, opts ...FileOption) (*VerifyReport, error) {
+	if err := checkDir(dir); err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{}
+	addProblem := func(err error) error {
+		var corrupt *CorruptRecordError
+		if errors.As(err, &corrupt) {
+			report.Problems = append(report.Problems, corrupt)
+			return nil
+		}
+		return err
+	}
+
+	if _, _, err := readMetaFile(dir); err != nil && !os.IsNotExist(err) {
+		if err := addProblem(err); err != nil {
+			return nil, err
+		}
+	}
+
+	err := ScanDataFile(filepath.Join(dir, DataFileName), func(rec *FileRecord) error {
+		if rec.Err != nil {
+			return addProblem(&CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: rec.Err})
+		}
+		report.DataRecords++
+		return nil
+	}, opts...)
+	if err := addProblem(err); err != nil {
+		return nil, err
+	}
+
+	var lastLSN uint64
+	err = ScanWALFile(filepath.Join(dir, WALFileName), func(rec *FileRecord) error {
+		if rec.Err != nil {
+			return addProblem(&CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: rec.Err})
+		}
+		report.WALRecords++
+		ops, _ := rec.operations()
+		for _, op := range ops {
+			switch op.Operation {
+			case OperationInsert, OperationUpdate, OperationDelete:
+			case OperationCreateCollection, OperationDropCollection, OperationRenameCollection:
+			default:
+				addProblem(&CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: fmt.Errorf("unknown operation %q", op.Operation)})
+			}
+		}
+		if rec.LSN != 0 {
+			if rec.LSN < lastLSN {
+				addProblem(&CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: fmt.Errorf("LSN %d is smaller than the previous LSN %d", rec.LSN, lastLSN)})
+			}
+			lastLSN = rec.LSN
+		}
+		return nil
+	}, opts...)
+	if err := addProblem(err); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// StorageStats 是 AnalyzeFiles 统计的数据库文件信息
+type StorageStats struct {
+	DataFileSize  int64                    // 数据文件的大小
+	DataRecords   int                      // 数据文件中的记录数量
+	LiveRecords   int                      // 数据文件中仍然是文档最新版本的记录数量
+	DeadRecords   int                      // 被新版本覆盖、被删除或者属于已删除集合的记录数量,可以通过 CompactFiles 回收
+	WALFileSize   int64                    // WAL 文件的大小
+	WALRecords    int                      // WAL 文件中的记录数量
+	WALOperations int                      // WAL 中的操作数量,批量记录中的每个操作单独计数
+	FirstLSN      uint64                   // WAL 中第一条记录的 LSN
+	LastLSN       uint64                   // WAL 中最后一条记录的 LSN
+	TornBytes     int64                    // 文件末尾被截断的记录占用的字节数
+	Collections   []CollectionStorageStats // 每个集合的统计信息,按集合ID排序
+}
+
+// CollectionStorageStats 是一个集合在数据库文件中的统计信息
+type CollectionStorageStats struct {
+	ID            uint32 // 集合ID,默认集合为 0
+	Name          string // 集合名称,默认集合为空字符串
+	Dropped       bool   // 集合已经被删除,它的记录都是无效的
+	Documents     int    // 打开数据库后集合中的文档数量
+	LiveBytes     int64  // 数据文件中有效记录占用的字节数,包括长度前缀
+	DeadRecords   int    // 数据文件中无效的记录数量
+	DeadBytes     int64  // 数据文件中无效记录占用的字节数
+	WALOperations int    // WAL 中属于这个集合的操作数量
+	WALBytes      int64  // WAL 中属于这个集合的记录占用的字节数
+}
+
+// AnalyzeFiles 统计数据库文件中有效和无效的记录、每个集合占用的空间以及 WAL 的长度
+//
+// 介绍:
+// 统计按照打开数据库时的规则进行: 数据文件中同一文档只有修订号最大的版本有效,
+// WAL 中的操作覆盖数据文件中的版本,已删除集合中的记录全部无效。
+// 文件中有无法解码的记录时返回错误,可以先用 VerifyFiles 找到它们。加密的数据库需要通过 FileKeys 提供密钥。
+//
+// 返回值:
+// - *StorageStats: 统计信息
+// - error: 读取失败或者记录损坏时的错误
+func AnalyzeFiles(dir string, opts ...FileOption) (*StorageStats, error) {
+	a, err := analyzeFiles(dir, newFileConfig(opts))
+	if err != nil {
+		return nil, err
+	}
+	return a.stats, nil
+}
+
+// docKey 标识一个集合中的文档
+type docKey struct {
+	collection uint32
+	id         string
+}
+
+// docLocation 记录文档最新版本在文件中的位置
+type docLocation struct {
+	inWAL  bool   // 最新版本在 WAL 中
+	offset int64  // 记录在文件中的起始位置
+	batch  int    // 操作在批量记录中的位置,不是批量记录时为 -1
+	size   int64  // 数据文件中记录占用的字节数,包括长度前缀
+	rev    uint64 // 数据文件中记录的修订号
+}
+
+// fileAnalysis 是 analyzeFiles 的结果
+type fileAnalysis struct {
+	cfg       fileConfig
+	meta      dbMeta
+	stats     *StorageStats
+	docs      map[docKey]*docLocation            // 每个文档最新版本的位置
+	colls     map[uint32]*CollectionStorageStats // 每个集合的统计信息
+	keySeqs   map[uint32]uint64                  // 每个集合中出现过的最大整数主键
+	lastLSN   uint64                             // WAL 中最大的 LSN
+	liveColls map[uint32]bool                    // 没有被删除的集合
+}
+
+// analyzeFiles 扫描数据文件和 WAL 文件,找到每个文档最新版本的位置
+func analyzeFiles(dir string, cfg fileConfig) (*fileAnalysis, error) {
+	if err := checkDir(dir); err != nil {
+		return nil, err
+	}
+	meta, _, err := readMetaFile(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	a := &fileAnalysis{
+		cfg:       cfg,
+		meta:      meta,
+		stats:     &StorageStats{},
+		docs:      make(map[docKey]*docLocation),
+		colls:     make(map[uint32]*CollectionStorageStats),
+		keySeqs:   make(map[uint32]uint64),
+		liveColls: map[uint32]bool{0: true},
+	}
+	a.colls[0] = &CollectionStorageStats{}
+	for _, cm := range meta.Collections {
+		a.liveColls[cm.ID] = true
+		a.colls[cm.ID] = &CollectionStorageStats{ID: cm.ID, Name: cm.Name}
+	}
+
+	dataPath := filepath.Join(dir, DataFileName)
+	walPath := filepath.Join(dir, WALFileName)
+	if a.stats.DataFileSize, err = fileSize(dataPath); err != nil {
+		return nil, err
+	}
+	if a.stats.WALFileSize, err = fileSize(walPath); err != nil {
+		return nil, err
+	}
+
+	err = scanRecords(dataPath, DataFileName, cfg, decodeDataFileRecord, func(rec *FileRecord) error {
+		if rec.Err != nil {
+			return &CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: rec.Err}
+		}
+		a.addDataRecord(rec)
+		return nil
+	})
+	if err := a.checkTorn(err); err != nil {
+		return nil, err
+	}
+
+	err = scanRecords(walPath, WALFileName, cfg, decodeWALFileRecord, func(rec *FileRecord) error {
+		if rec.Err != nil {
+			return &CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: rec.Err}
+		}
+		a.addWALRecord(rec)
+		return nil
+	})
+	if err := a.checkTorn(err); err != nil {
+		return nil, err
+	}
+
+	a.finish()
+	return a, nil
+}
+
+// isTorn 返回 err 是否表示文件末尾的记录被截断
+func isTorn(err error) bool {
+	var corrupt *CorruptRecordError
+	return errors.As(err, &corrupt) && corrupt.Torn
+}
+
+// checkTorn 记录文件末尾被截断的记录,截断以外的错误原样返回
+func (a *fileAnalysis) checkTorn(err error) error {
+	var corrupt *CorruptRecordError
+	if !errors.As(err, &corrupt) || !corrupt.Torn {
+		return err
+	}
+	size := a.stats.DataFileSize
+	if corrupt.File == WALFileName {
+		size = a.stats.WALFileSize
+	}
+	a.stats.TornBytes += size - corrupt.Offset
+	return nil
+}
+
+// collection 返回集合的统计信息,集合不在元数据中时视为已删除
+func (a *fileAnalysis) collection(id uint32) *CollectionStorageStats {
+	cs, ok := a.colls[id]
+	if !ok {
+		cs = &CollectionStorageStats{ID: id, Dropped: true}
+		a.colls[id] = cs
+	}
+	return cs
+}
+
+// observeKey 记录集合中出现过的整数主键,与 Database.observeKey 的规则相同
+func (a *fileAnalysis) observeKey(collection uint32, id string) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return
+	}
+	if n > a.keySeqs[collection] {
+		a.keySeqs[collection] = n
+	}
+}
+
+// markDead 把数据文件中的一条记录计为无效
+func (a *fileAnalysis) markDead(collection uint32, size int64) {
+	cs := a.collection(collection)
+	cs.DeadRecords++
+	cs.DeadBytes += size
+	a.stats.DeadRecords++
+}
+
+// addDataRecord 处理数据文件中的一条记录,同一文档只保留修订号最大的版本
+func (a *fileAnalysis) addDataRecord(rec *FileRecord) {
+	a.stats.DataRecords++
+	size := 4 + int64(rec.Size)
+	if !a.liveColls[rec.Collection] {
+		a.markDead(rec.Collection, size)
+		return
+	}
+	a.observeKey(rec.Collection, rec.ID)
+
+	key := docKey{rec.Collection, rec.ID}
+	rev := documentRevision(rec.Document)
+	if existing, ok := a.docs[key]; ok {
+		if existing.rev > rev {
+			a.markDead(rec.Collection, size)
+			return
+		}
+		a.markDead(rec.Collection, existing.size)
+	}
+	a.docs[key] = &docLocation{offset: rec.Offset, batch: -1, size: size, rev: rev}
+}
+
+// addWALRecord 按照恢复时的顺序应用一条 WAL 记录
+func (a *fileAnalysis) addWALRecord(rec *FileRecord) {
+	a.stats.WALRecords++
+	if a.stats.FirstLSN == 0 {
+		a.stats.FirstLSN = rec.LSN
+	}
+	if rec.LSN > a.lastLSN {
+		a.lastLSN = rec.LSN
+	}
+	a.stats.LastLSN = a.lastLSN
+
+	cs := a.collection(rec.Collection)
+	cs.WALBytes += 4 + int64(rec.Size)
+	ops, positions := rec.operations()
+	for i, op := range ops {
+		a.stats.WALOperations++
+		cs.WALOperations++
+		if !a.liveColls[rec.Collection] {
+			continue
+		}
+
+		key := docKey{rec.Collection, op.ID}
+		switch op.Operation {
+		case OperationInsert, OperationUpdate, OperationDelete:
+		default:
+			// 集合管理操作不涉及文档,恢复时同样会跳过未知的操作
+			continue
+		}
+		a.observeKey(rec.Collection, op.ID)
+		if existing, ok := a.docs[key]; ok && !existing.inWAL {
+			a.markDead(rec.Collection, existing.size)
+		}
+		if op.Operation == OperationDelete {
+			delete(a.docs, key)
+			continue
+		}
+		a.docs[key] = &docLocation{inWAL: true, offset: rec.Offset, batch: positions[i]}
+	}
+}
+
+// finish 根据每个文档最新版本的位置计算有效记录和文档数量
+func (a *fileAnalysis) finish() {
+	for key, loc := range a.docs {
+		cs := a.colls[key.collection]
+		cs.Documents++
+		if !loc.inWAL {
+			cs.LiveBytes += loc.size
+			a.stats.LiveRecords++
+		}
+	}
+	for _, cs := range a.colls {
+		a.stats.Collections = append(a.stats.Collections, *cs)
+	}
+	sort.Slice(a.stats.Collections, func(i, j int) bool {
+		return a.stats.Collections[i].ID < a.stats.Collections[j].ID
+	})
+}
+
+// isLatest 返回 rec 中的操作是否是文档的最新版本
+func (a *fileAnalysis) isLatest(rec *FileRecord, op *FileRecord, position int, inWAL bool) bool {
+	loc, ok := a.docs[docKey{rec.Collection, op.ID}]
+	return ok && loc.inWAL == inWAL && loc.offset == rec.Offset && loc.batch == position
+}
+
+// checkDir 检查 dir 是一个已经存在的目录,避免把拼错的路径当作空数据库
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// fileSize 返回文件的大小,文件不存在时返回 0
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// CompactResult 是 CompactFiles 的结果
+type CompactResult struct {
+	Documents       int   // 新数据文件中的文档数量
+	DataSizeBefore  int64 // 压缩前数据文件的大小
+	DataSizeAfter   int64 // 压缩后数据文件的大小
+	WALSizeBefore   int64 // 压缩前 WAL 文件的大小,压缩后 WAL 为空
+	DiscardedTorn   int64 // 丢弃的文件末尾被截断的记录占用的字节数
+	DroppedRecords  int   // 丢弃的无效记录数量
+	AppliedWALOps   int   // 合并到数据文件中的 WAL 操作数量
+	CheckpointedLSN uint64
+}
+
+// CompactFiles 离线压缩数据库目录,效果与打开数据库时的检查点相同
+//
+// 介绍:
+// 新的数据文件只包含每个文档的最新版本: 先扫描一遍数据文件和 WAL 找到每个文档最新版本的位置,
+// 然后再按顺序扫描一遍,只把这些记录写入临时文件。临时文件 fsync 之后通过重命名替换旧的数据文件,
+// 接着把 WAL 中的最大 LSN 和出现过的整数主键写入元数据文件,最后清空 WAL。
+// 在任何时刻崩溃,磁盘上都有一份完整的数据文件加上对应的 WAL,重新压缩或者打开数据库即可恢复。
+//
+// 文件末尾被截断的记录会被丢弃: WAL 中被截断的记录从未提交,数据文件中被截断的记录
+// 总是在最近一次检查点之后写入的,它的内容同样保存在 WAL 中。其他损坏的记录会导致压缩失败,文件保持不变。
+// 通过 FileKeys 提供密钥时新的数据文件使用当前密钥加密,否则写入明文。
+//
+// 返回值:
+// - *CompactResult: 压缩前后的文件信息
+// - error: 读写失败或者记录损坏时的错误
+func CompactFiles(dir string, opts ...FileOption) (*CompactResult, error) {
+	a, err := analyzeFiles(dir, newFileConfig(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpPath := filepath.Join(dir, DataFileName+".tmp")
+	size, err := a.writeCompacted(dir, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to write compacted data file: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, DataFileName)); err != nil {
+		return nil, fmt.Errorf("failed to replace data file: %w", err)
+	}
+
+	// 在清空 WAL 之前保存 LSN 和主键序列,保证重新打开后它们继续单调递增,
+	// 被删除文档的主键也不会被重新分配
+	meta := a.meta
+	if a.lastLSN > meta.LSN {
+		meta.LSN = a.lastLSN
+	}
+	if seq := a.keySeqs[0]; seq > meta.KeySequence {
+		meta.KeySequence = seq
+	}
+	for i := range meta.Collections {
+		if seq := a.keySeqs[meta.Collections[i].ID]; seq > meta.Collections[i].KeySequence {
+			meta.Collections[i].KeySequence = seq
+		}
+	}
+	data, err := msgpack.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeMetaFile(dir, data); err != nil {
+		return nil, fmt.Errorf("failed to save database metadata: %w", err)
+	}
+
+	walPath := filepath.Join(dir, WALFileName)
+	if err := os.Truncate(walPath, 0); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to truncate WAL file: %w", err)
+	}
+
+	stats := a.stats
+	return &CompactResult{
+		Documents:       len(a.docs),
+		DataSizeBefore:  stats.DataFileSize,
+		DataSizeAfter:   size,
+		WALSizeBefore:   stats.WALFileSize,
+		DiscardedTorn:   stats.TornBytes,
+		DroppedRecords:  stats.DeadRecords,
+		AppliedWALOps:   stats.WALOperations,
+		CheckpointedLSN: meta.LSN,
+	}, nil
+}
+
+// writeCompacted 把每个文档的最新版本写入 path,返回写入的字节数
+func (a *fileAnalysis) writeCompacted(dir, path string) (int64, error) {
+	c, err := currentCipher(a.cfg.keys)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the current encryption key: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, DBFilePerm)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	records := newRecordWriter(writer, DataFileName, c)
+	var written int64
+	write := func(data []byte) error {
+		n, err := records.write(data, 0, 0)
+		written += n
+		return err
+	}
+
+	err = scanRecords(filepath.Join(dir, DataFileName), DataFileName, a.cfg, decodeDataFileRecord, func(rec *FileRecord) error {
+		if !a.isLatest(rec, rec, -1, false) {
+			return nil
+		}
+		return write(rec.Raw)
+	})
+	if err != nil && !isTorn(err) {
+		return 0, err
+	}
+
+	err = scanRecords(filepath.Join(dir, WALFileName), WALFileName, a.cfg, decodeWALFileRecord, func(rec *FileRecord) error {
+		ops, positions := rec.operations()
+		for i, op := range ops {
+			if !a.isLatest(rec, op, positions[i], true) {
+				continue
+			}
+			data, err := encodeDataRecord(rec.Collection, op.ID, op.Document)
+			if err != nil {
+				return err
+			}
+			if err := write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && !isTorn(err) {
+		return 0, err
+	}
+
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	return written, file.Close()
+}
+
+// ReencryptResult 是 ReencryptFiles 的结果
+type ReencryptResult struct {
+	KeyID         string // 重写后的文件使用的密钥ID,为空时文件被解密为明文
+	DataRecords   int    // 重写的数据文件记录数量
+	WALRecords    int    // 重写的 WAL 记录数量
+	DiscardedTorn int64  // 丢弃的文件末尾被截断的记录占用的字节数
+}
+
+// ReencryptFiles 离线使用 keys 的当前密钥重写数据库目录中的数据文件和 WAL
+//
+// 介绍:
+// 每条记录使用它原来的密钥解密,再使用当前密钥加密后按原来的顺序写入临时文件,
+// 临时文件 fsync 之后通过重命名替换原来的文件,记录的内容和顺序都不会改变。
+// 用于在轮换密钥之后立即停止使用旧的密钥,keys 需要同时提供旧的密钥和当前密钥;
+// 当前密钥ID为空时文件被解密为明文,之后打开数据库不再需要 WithEncryption。
+// 元数据文件不加密,保持不变;归档的 WAL 段和备份仍然使用写入时的密钥。
+//
+// 文件末尾被截断的记录会被丢弃,规则与 CompactFiles 相同,其他损坏的记录会导致重写失败,文件保持不变。
+//
+// 参数:
+// - dir: 数据库目录
+// - keys: 读取旧文件和加密新文件使用的密钥
+//
+// 返回值:
+// - *ReencryptResult: 重写的记录数量
+// - error: 读写失败、找不到密钥或者记录损坏时的错误
+func ReencryptFiles(dir string, keys KeyProvider) (*ReencryptResult, error) {
+	if err := checkDir(dir); err != nil {
+		return nil, err
+	}
+	c, err := currentCipher(keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the current encryption key: %w", err)
+	}
+	result := &ReencryptResult{}
+	if c != nil {
+		result.KeyID = c.id
+	}
+	cfg := fileConfig{keys: keys}
+	if result.DataRecords, err = reencryptFile(dir, DataFileName, cfg, c, result); err != nil {
+		return nil, err
+	}
+	if result.WALRecords, err = reencryptFile(dir, WALFileName, cfg, c, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// reencryptFile 使用 c 重写 dir 中的一个文件,返回重写的记录数量,文件不存在时什么都不做
+func reencryptFile(dir, name string, cfg fileConfig, c *recordCipher, result *ReencryptResult) (int, error) {
+	path := filepath.Join(dir, name)
+	size, err := fileSize(path)
+	if err != nil || size == 0 {
+		return 0, err
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, DBFilePerm)
+	if err != nil {
+		return 0, err
+	}
+	writer := bufio.NewWriter(file)
+	records := newRecordWriter(writer, name, c)
+	decode := decodeDataFileRecord
+	if name == WALFileName {
+		// 加密 WAL 记录时需要 LSN 和时间戳
+		decode = decodeWALFileRecord
+	}
+	count := 0
+	err = scanRecords(path, name, cfg, decode, func(rec *FileRecord) error {
+		if rec.Err != nil {
+			return &CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: rec.Err}
+		}
+		count++
+		_, err := records.write(rec.Raw, rec.LSN, rec.Timestamp)
+		return err
+	})
+	var corrupt *CorruptRecordError
+	if errors.As(err, &corrupt) && corrupt.Torn {
+		result.DiscardedTorn += size - corrupt.Offset
+		err = nil
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to re-encrypt %s: %w", name, err)
+	}
+	return count, nil
+}
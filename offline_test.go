@@ -0,0 +1,207 @@
+package jsonDB
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// populateOfflineTestDB 写入一组覆盖各种记录类型的数据后关闭数据库,返回每个文档的最终内容
+func populateOfflineTestDB(t *testing.T) map[string]map[string]interface{} {
+	db := setupTestDB(t)
+	db.LogLevelOff()
+	for _, id := range []string{"1", "2", "3", "4"} {
+		if _, err := db.Insert(map[string]interface{}{"id": id, "n": id}); err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+	}
+	if err := db.Update("1", map[string]interface{}{"n": "updated"}); err != nil {
+		t.Fatalf("Failed to update document: %v", err)
+	}
+	if err := db.Delete("2"); err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+	err := db.RunInTx(func(tx *Tx) error {
+		if _, err := tx.Insert(map[string]interface{}{"id": "5"}); err != nil {
+			return err
+		}
+		return tx.Update("3", map[string]interface{}{"n": "tx"})
+	})
+	if err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+
+	orders, err := db.CreateCollection("orders", "orderId")
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	orders.Insert(map[string]interface{}{"orderId": "o1"})
+	tmp, err := db.CreateCollection("tmp", "id")
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	tmp.Insert(map[string]interface{}{"id": "t1"})
+	if err := db.DropCollection("tmp"); err != nil {
+		t.Fatalf("Failed to drop collection: %v", err)
+	}
+
+	expected := make(map[string]map[string]interface{})
+	for _, doc := range db.GetAll() {
+		expected[doc["id"].(string)] = doc
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	return expected
+}
+
+// checkReopenedDB 打开 dir 中的数据库并检查默认集合的文档与 expected 一致
+func checkReopenedDB(t *testing.T, dir string, expected map[string]map[string]interface{}) {
+	t.Helper()
+	db, err := NewDatabase("id", dir, runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if count := db.Count(); count != int64(len(expected)) {
+		t.Errorf("Expected %d documents, got %d", len(expected), count)
+	}
+	for id, want := range expected {
+		got, ok := db.Get(id)
+		if !ok || got["n"] != want["n"] || documentRevision(got) != documentRevision(want) {
+			t.Errorf("Document %s: expected %v, got %v", id, want, got)
+		}
+	}
+	orders, err := db.Collection("orders")
+	if err != nil || orders.Count() != 1 {
+		t.Errorf("Expected 1 document in orders, got %v", err)
+	}
+}
+
+func TestVerifyAndAnalyzeFiles(t *testing.T) {
+	expected := populateOfflineTestDB(t)
+	defer os.RemoveAll(testDBPath)
+
+	report, err := VerifyFiles(testDBPath)
+	if err != nil || !report.OK() || report.WALRecords == 0 || report.DataRecords == 0 {
+		t.Fatalf("Unexpected verify result: %+v %v", report, err)
+	}
+
+	stats, err := AnalyzeFiles(testDBPath)
+	if err != nil {
+		t.Fatalf("AnalyzeFiles failed: %v", err)
+	}
+	if stats.LiveRecords+stats.DeadRecords != stats.DataRecords || stats.DeadRecords == 0 {
+		t.Errorf("Unexpected record counts: %+v", stats)
+	}
+	if len(stats.Collections) != 3 {
+		t.Fatalf("Expected default, orders and dropped collections, got %+v", stats.Collections)
+	}
+	if def := stats.Collections[0]; def.Documents != len(expected) || def.WALOperations != 8 {
+		t.Errorf("Unexpected default collection stats: %+v", def)
+	}
+	if orders := stats.Collections[1]; orders.Name != "orders" || orders.Documents != 1 {
+		t.Errorf("Unexpected orders stats: %+v", orders)
+	}
+	if dropped := stats.Collections[2]; !dropped.Dropped || dropped.Documents != 0 || dropped.DeadRecords != 1 {
+		t.Errorf("Unexpected dropped collection stats: %+v", dropped)
+	}
+
+	// WAL 末尾写入一半的记录
+	wal, err := os.OpenFile(filepath.Join(testDBPath, WALFileName), os.O_WRONLY|os.O_APPEND, DBFilePerm)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	wal.Write([]byte{100, 0, 0, 0, 1, 2})
+	wal.Close()
+
+	report, err = VerifyFiles(testDBPath)
+	if err != nil || len(report.Problems) != 1 || !report.Problems[0].Torn || !errors.Is(report.Problems[0], ErrCorruptRecord) {
+		t.Errorf("Expected a torn WAL record, got %+v %v", report, err)
+	}
+	if stats, err := AnalyzeFiles(testDBPath); err != nil || stats.TornBytes != 6 {
+		t.Errorf("Expected 6 torn bytes, got %+v %v", stats, err)
+	}
+}
+
+func TestCompactFiles(t *testing.T) {
+	expected := populateOfflineTestDB(t)
+	defer os.RemoveAll(testDBPath)
+
+	// 数据文件末尾被截断的记录会导致数据库无法打开,压缩时会被丢弃
+	data, err := os.OpenFile(filepath.Join(testDBPath, DataFileName), os.O_WRONLY|os.O_APPEND, DBFilePerm)
+	if err != nil {
+		t.Fatalf("Failed to open data file: %v", err)
+	}
+	data.Write([]byte{50, 0, 0, 0})
+	data.Close()
+
+	result, err := CompactFiles(testDBPath)
+	if err != nil {
+		t.Fatalf("CompactFiles failed: %v", err)
+	}
+	if result.Documents != len(expected)+1 || result.DiscardedTorn != 4 || result.DataSizeAfter >= result.DataSizeBefore {
+		t.Errorf("Unexpected compact result: %+v", result)
+	}
+
+	stats, err := AnalyzeFiles(testDBPath)
+	if err != nil {
+		t.Fatalf("AnalyzeFiles failed: %v", err)
+	}
+	if stats.WALFileSize != 0 || stats.DeadRecords != 0 || stats.LiveRecords != result.Documents {
+		t.Errorf("Expected compacted files, got %+v", stats)
+	}
+	meta, err := ReadMetadata(testDBPath)
+	if err != nil || meta.LSN != result.CheckpointedLSN || meta.KeySequence < 4 {
+		t.Errorf("Unexpected metadata after compaction: %+v %v", meta, err)
+	}
+
+	checkReopenedDB(t, testDBPath, expected)
+}
+
+func TestDumpAndRestore(t *testing.T) {
+	expected := populateOfflineTestDB(t)
+	defer os.RemoveAll(testDBPath)
+
+	var dump bytes.Buffer
+	if err := DumpFiles(testDBPath, &dump, true); err != nil {
+		t.Fatalf("DumpFiles failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(dump.String()), "\n")
+	var first dumpLine
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil || first.Operation != OperationMeta || len(first.Meta.Collections) != 1 {
+		t.Errorf("Expected metadata on the first line, got %s", lines[0])
+	}
+	if !strings.Contains(dump.String(), `"op":"BATCH"`) || !strings.Contains(dump.String(), `"op":"DATA"`) {
+		t.Errorf("Expected data and batch records in dump")
+	}
+
+	dir := t.TempDir()
+	result, err := RestoreDump(bytes.NewReader(dump.Bytes()), dir)
+	if err != nil || result.Skipped != 0 || result.DataRecords+result.WALRecords != len(lines)-1 {
+		t.Fatalf("Unexpected restore result: %+v %v", result, err)
+	}
+	if _, err := RestoreDump(bytes.NewReader(dump.Bytes()), dir); err == nil {
+		t.Error("Expected error when restoring into an existing database")
+	}
+	checkReopenedDB(t, dir, expected)
+
+	// 没有原始数据的转储根据 JSON 字段重新编码
+	dump.Reset()
+	if err := DumpFiles(testDBPath, &dump, false); err != nil {
+		t.Fatalf("DumpFiles failed: %v", err)
+	}
+	if strings.Contains(dump.String(), `"raw"`) {
+		t.Error("Expected dump without raw data")
+	}
+	dir = t.TempDir()
+	if _, err := RestoreDump(&dump, dir); err != nil {
+		t.Fatalf("RestoreDump failed: %v", err)
+	}
+	checkReopenedDB(t, dir, expected)
+}
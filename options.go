@@ -0,0 +1,48 @@
+package jsonDB
+
+import "log/slog"
+
+// Option 是 NewDatabase 的可选配置项
+type Option func(*Database)
+
+// WithKeyPolicy 设置文档缺少主键时的主键生成策略,默认为 KeyPolicyNone
+func WithKeyPolicy(policy KeyPolicy) Option {
+	return func(db *Database) {
+		db.keyPolicy = policy
+	}
+}
+
+// WithSchema 设置数据库的 JSON Schema,优先于元数据文件中保存的模式
+func WithSchema(schema *Schema) Option {
+	return func(db *Database) {
+		db.schema.Store(schema)
+	}
+}
+
+// WithLogLevel 设置日志级别,使打开数据库过程中的日志也遵循这个级别
+// 日志器由所有集合共享,在 CreateCollection 中使用时同样作用于整个数据库
+func WithLogLevel(level LogLevel) Option {
+	return func(db *Database) {
+		db.logger.SetLevel(level)
+	}
+}
+
+// WithLogger 使用 logger 替换默认的日志器,使打开数据库过程中的日志也交给它记录
+// 日志器由所有集合共享,应该只在 NewDatabase 中使用;在它之后的 WithLogLevel 作用于新的日志器
+func WithLogger(logger Logger) Option {
+	return func(db *Database) {
+		db.logger = logger
+	}
+}
+
+// WithLogHandler 使用 handler 记录日志,等价于 WithLogger(NewSlogLogger(handler))
+func WithLogHandler(handler slog.Handler) Option {
+	return WithLogger(NewSlogLogger(handler))
+}
+
+// WithSubsystemLogger 为子系统设置单独的日志器,见 Database.SetSubsystemLogger
+func WithSubsystemLogger(subsystem string, logger Logger) Option {
+	return func(db *Database) {
+		db.SetSubsystemLogger(subsystem, logger)
+	}
+}
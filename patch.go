@@ -0,0 +1,434 @@
+// patch.go
+
+// 介绍:
+// 本文件实现了 RFC 7396 JSON Merge Patch 和 RFC 6902 JSON Patch 两种文档更新方式。
+// 与 Update 的浅层合并不同,这两种方式可以修改嵌套字段、删除字段以及操作数组,
+// 因此 HTTP 服务可以把客户端的 PATCH 请求体直接交给数据库处理。
+//
+// 补丁总是作用在文档的深拷贝上,只有在所有操作都成功后才会通过 modifyDocument
+// 原子地替换存储的文档。任意一个操作失败(包括 test 操作不匹配)都会放弃整个补丁。
+
+package jsonDB
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// JSON Patch 操作类型
+const (
+	PatchOpAdd     = "add"
+	PatchOpRemove  = "remove"
+	PatchOpReplace = "replace"
+	PatchOpMove    = "move"
+	PatchOpCopy    = "copy"
+	PatchOpTest    = "test"
+)
+
+// ErrPatchTestFailed 表示 JSON Patch 中的 test 操作未通过
+var ErrPatchTestFailed = errors.New("json patch test operation failed")
+
+// PatchOperation 表示 RFC 6902 JSON Patch 中的一个操作
+type PatchOperation struct {
+	Op    string      `json:"op"`             // 操作类型: add/remove/replace/move/copy/test
+	Path  string      `json:"path"`           // 目标位置的 JSON Pointer
+	From  string      `json:"from,omitempty"` // move 和 copy 操作的源位置
+	Value interface{} `json:"value"`          // add/replace/test 操作使用的值
+
+	hasValue bool // 是否提供了 value 成员,用于区分缺失与 null
+}
+
+// UpdateMergePatch 方法使用 RFC 7396 JSON Merge Patch 更新指定ID的文档
+//
+// 介绍:
+// Merge Patch 是一个 JSON 对象,其中的字段会递归地合并到文档中:
+// 值为 null 的字段会从文档中删除,对象会递归合并,其他值(包括数组)会直接替换原值。
+// 补丁不能修改或删除文档的主键。
+//
+// 参数:
+// - id: 要更新的文档的唯一标识符
+// - patch: Merge Patch 文档,可以是 map[string]interface{}、JSON 字符串或 []byte
+//
+// 返回值:
+// - error: 如果补丁无效或更新失败,返回相应的错误信息；如果更新成功,返回nil
+func (db *Database) UpdateMergePatch(id string, patch interface{}) error {
+	db.log(LogLevelDebug, "Attempting to merge patch document", slog.String("id", id))
+
+	var patchDoc interface{}
+	switch v := patch.(type) {
+	case map[string]interface{}:
+		patchDoc = v
+	case string:
+		if err := json.Unmarshal([]byte(v), &patchDoc); err != nil {
+			return fmt.Errorf("failed to parse merge patch: %w", err)
+		}
+	case []byte:
+		if err := json.Unmarshal(v, &patchDoc); err != nil {
+			return fmt.Errorf("failed to parse merge patch: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported merge patch type: %T", patch)
+	}
+
+	patchObj, ok := patchDoc.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("merge patch must be a JSON object, got %T", patchDoc)
+	}
+
+	return db.modifyDocument(id, func(current map[string]interface{}) (map[string]interface{}, error) {
+		newData := mergePatch(deepCopyDocument(current), patchObj).(map[string]interface{})
+		if err := db.checkPatchedPrimaryKey(id, newData); err != nil {
+			return nil, err
+		}
+		return newData, nil
+	})
+}
+
+// UpdateJSONPatch 方法使用 RFC 6902 JSON Patch 更新指定ID的文档
+//
+// 介绍:
+// JSON Patch 是一个有序的操作列表,支持 add、remove、replace、move、copy 和 test 六种操作,
+// 路径使用 RFC 6901 JSON Pointer 表示(如 "/info/email" 或 "/tags/0")。
+// 所有操作按顺序作用在文档的副本上,任何一个操作失败都会放弃整个补丁,
+// test 操作失败时返回的错误可以通过 errors.Is(err, ErrPatchTestFailed) 判断。
+//
+// 参数:
+// - id: 要更新的文档的唯一标识符
+// - patch: JSON Patch 文档,可以是 []PatchOperation、[]interface{}、JSON 字符串或 []byte
+//
+// 返回值:
+// - error: 如果补丁无效或任意操作失败,返回相应的错误信息；如果更新成功,返回nil
+func (db *Database) UpdateJSONPatch(id string, patch interface{}) error {
+	db.log(LogLevelDebug, "Attempting to apply JSON patch to document", slog.String("id", id))
+
+	ops, err := parsePatchOperations(patch)
+	if err != nil {
+		db.log(LogLevelError, "Failed to parse JSON patch", slog.String("id", id), slog.Any("error", err))
+		return err
+	}
+
+	return db.modifyDocument(id, func(current map[string]interface{}) (map[string]interface{}, error) {
+		var doc interface{} = deepCopyDocument(current)
+		for i, op := range ops {
+			doc, err = applyPatchOperation(doc, op)
+			if err != nil {
+				return nil, fmt.Errorf("json patch operation %d (%s %s) failed: %w", i, op.Op, op.Path, err)
+			}
+		}
+
+		newData, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("json patch must leave the document as a JSON object, got %T", doc)
+		}
+		if err := db.checkPatchedPrimaryKey(id, newData); err != nil {
+			return nil, err
+		}
+		return newData, nil
+	})
+}
+
+// checkPatchedPrimaryKey 检查补丁是否修改或删除了主键
+func (db *Database) checkPatchedPrimaryKey(id string, doc map[string]interface{}) error {
+	pk, ok := doc[db.primaryKey]
+	if !ok {
+		return fmt.Errorf("patch must not remove primary key '%s'", db.primaryKey)
+	}
+	if fmt.Sprintf("%v", pk) != id {
+		return fmt.Errorf("patch must not change primary key '%s'", db.primaryKey)
+	}
+	return nil
+}
+
+// mergePatch 按照 RFC 7396 将 patch 合并到 target 中并返回结果
+// target 会被原地修改,调用方需要传入副本
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return deepCopyValue(patch)
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = mergePatch(targetObj[k], v)
+		}
+	}
+	return targetObj
+}
+
+// parsePatchOperations 将各种形式的输入解析为 PatchOperation 列表
+func parsePatchOperations(patch interface{}) ([]PatchOperation, error) {
+	var raw []interface{}
+	switch v := patch.(type) {
+	case []PatchOperation:
+		ops := make([]PatchOperation, len(v))
+		for i, op := range v {
+			op.hasValue = true
+			ops[i] = op
+		}
+		return ops, validatePatchOperations(ops)
+	case []map[string]interface{}:
+		for _, item := range v {
+			raw = append(raw, item)
+		}
+	case []interface{}:
+		raw = v
+	case string:
+		if err := json.Unmarshal([]byte(v), &raw); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON patch: %w", err)
+		}
+	case []byte:
+		if err := json.Unmarshal(v, &raw); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON patch: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JSON patch type: %T", patch)
+	}
+
+	ops := make([]PatchOperation, 0, len(raw))
+	for i, item := range raw {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("json patch operation %d must be an object", i)
+		}
+		var op PatchOperation
+		op.Op, _ = m["op"].(string)
+		op.Path, ok = m["path"].(string)
+		if !ok {
+			return nil, fmt.Errorf("json patch operation %d is missing 'path'", i)
+		}
+		op.From, _ = m["from"].(string)
+		op.Value, op.hasValue = m["value"]
+		ops = append(ops, op)
+	}
+	return ops, validatePatchOperations(ops)
+}
+
+// validatePatchOperations 检查每个操作是否包含其所需的成员
+func validatePatchOperations(ops []PatchOperation) error {
+	for i, op := range ops {
+		switch op.Op {
+		case PatchOpAdd, PatchOpReplace, PatchOpTest:
+			if !op.hasValue {
+				return fmt.Errorf("json patch operation %d (%s) is missing 'value'", i, op.Op)
+			}
+		case PatchOpMove, PatchOpCopy:
+			if _, err := parseJSONPointer(op.From); err != nil {
+				return fmt.Errorf("json patch operation %d has invalid 'from': %w", i, err)
+			}
+		case PatchOpRemove:
+		default:
+			return fmt.Errorf("json patch operation %d has unknown op '%s'", i, op.Op)
+		}
+		if _, err := parseJSONPointer(op.Path); err != nil {
+			return fmt.Errorf("json patch operation %d has invalid 'path': %w", i, err)
+		}
+	}
+	return nil
+}
+
+// applyPatchOperation 将单个操作应用到文档上并返回新的文档根节点
+func applyPatchOperation(doc interface{}, op PatchOperation) (interface{}, error) {
+	path, _ := parseJSONPointer(op.Path)
+
+	switch op.Op {
+	case PatchOpAdd:
+		return pointerAdd(doc, path, deepCopyValue(op.Value))
+	case PatchOpRemove:
+		return pointerRemove(doc, path)
+	case PatchOpReplace:
+		if _, err := pointerGet(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return deepCopyValue(op.Value), nil
+		}
+		doc, err := pointerRemove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, deepCopyValue(op.Value))
+	case PatchOpMove:
+		from, _ := parseJSONPointer(op.From)
+		if op.From == op.Path {
+			return doc, nil
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("cannot move '%s' into one of its children", op.From)
+		}
+		value, err := pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if doc, err = pointerRemove(doc, from); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case PatchOpCopy:
+		from, _ := parseJSONPointer(op.From)
+		value, err := pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, deepCopyValue(value))
+	case PatchOpTest:
+		value, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrPatchTestFailed, err)
+		}
+		if !jsonEqual(value, op.Value) {
+			// 错误信息会被记录到日志中,不包含文档中的值
+			return nil, fmt.Errorf("%w: value at '%s' does not match", ErrPatchTestFailed, op.Path)
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op '%s'", op.Op)
+}
+
+// parseJSONPointer 按照 RFC 6901 解析 JSON Pointer
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("json pointer '%s' must start with '/'", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex 解析数组下标,allowEnd 为 true 时允许下标等于数组长度(用于插入)
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index '%s'", token)
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid array index '%s'", token)
+	}
+	if index > length || (index == length && !allowEnd) {
+		return 0, fmt.Errorf("array index %d out of bounds", index)
+	}
+	return index, nil
+}
+
+// pointerGet 返回 JSON Pointer 指向的值
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	node := doc
+	for _, token := range path {
+		switch container := node.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("path member '%s' not found", token)
+			}
+			node = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			node = container[index]
+		default:
+			return nil, fmt.Errorf("cannot traverse into %T at '%s'", node, token)
+		}
+	}
+	return node, nil
+}
+
+// updateParent 找到 JSON Pointer 的父容器,调用 fn 修改父容器,并把修改后的父容器写回文档
+// 切片在插入或删除元素后可能会变成新的切片,因此 fn 需要返回新的父容器
+func updateParent(doc interface{}, path []string, fn func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		child, ok := container[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("path member '%s' not found", path[0])
+		}
+		newChild, err := updateParent(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		container[path[0]] = newChild
+		return container, nil
+	case []interface{}:
+		index, err := arrayIndex(path[0], len(container), false)
+		if err != nil {
+			return nil, err
+		}
+		newChild, err := updateParent(container[index], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		container[index] = newChild
+		return container, nil
+	}
+	return nil, fmt.Errorf("cannot traverse into %T at '%s'", doc, path[0])
+}
+
+// pointerAdd 在 JSON Pointer 指定的位置添加值
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updateParent(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[key] = value
+			return container, nil
+		case []interface{}:
+			index, err := arrayIndex(key, len(container), true)
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		}
+		return nil, fmt.Errorf("cannot add member '%s' to %T", key, parent)
+	})
+}
+
+// pointerRemove 删除 JSON Pointer 指定位置的值
+func pointerRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the document root")
+	}
+	return updateParent(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := container[key]; !ok {
+				return nil, fmt.Errorf("path member '%s' not found", key)
+			}
+			delete(container, key)
+			return container, nil
+		case []interface{}:
+			index, err := arrayIndex(key, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(container[:index], container[index+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove member '%s' from %T", key, parent)
+	})
+}
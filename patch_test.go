@@ -0,0 +1,63 @@
+package jsonDB
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestJSONPatch(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	doc := `{"id": "1", "name": "Alice", "tags": ["a", "b"], "info": {"email": "alice@example.com", "phone": "123"}}`
+	if _, err := db.Insert(doc); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+
+	// Merge Patch: 删除 phone, 修改 email, 新增 age
+	if err := db.UpdateMergePatch("1", `{"age": 30, "info": {"email": "new@example.com", "phone": null}}`); err != nil {
+		t.Fatalf("Merge patch failed: %v", err)
+	}
+	got, _ := db.Get("1")
+	info := got["info"].(map[string]interface{})
+	if info["email"] != "new@example.com" || info["phone"] != nil || got["age"] != float64(30) {
+		t.Errorf("Unexpected document after merge patch: %v", got)
+	}
+
+	// JSON Patch: 所有操作成功
+	patch := `[
+		{"op": "test", "path": "/name", "value": "Alice"},
+		{"op": "add", "path": "/tags/-", "value": "c"},
+		{"op": "remove", "path": "/tags/0"},
+		{"op": "copy", "from": "/info/email", "path": "/email"},
+		{"op": "move", "from": "/age", "path": "/info/age"},
+		{"op": "replace", "path": "/name", "value": "Alicia"}
+	]`
+	if err := db.UpdateJSONPatch("1", patch); err != nil {
+		t.Fatalf("JSON patch failed: %v", err)
+	}
+	got, _ = db.Get("1")
+	got = copyDocumentData(got)
+	delete(got, RevisionField)
+	delete(got, UpdatedAtField)
+	if !jsonEqual(got, map[string]interface{}{
+		"id": "1", "name": "Alicia", "tags": []string{"b", "c"}, "email": "new@example.com",
+		"info": map[string]interface{}{"email": "new@example.com", "age": 30},
+	}) {
+		t.Errorf("Unexpected document after JSON patch: %v", got)
+	}
+
+	// test 操作失败时整个补丁都不生效
+	failing := `[{"op": "replace", "path": "/name", "value": "Bob"}, {"op": "test", "path": "/name", "value": "Alicia"}]`
+	if err := db.UpdateJSONPatch("1", failing); !errors.Is(err, ErrPatchTestFailed) {
+		t.Errorf("Expected ErrPatchTestFailed, got %v", err)
+	}
+	if got, _ = db.Get("1"); got["name"] != "Alicia" {
+		t.Errorf("Failed patch must not modify the document, got name %v", got["name"])
+	}
+
+	// 不允许修改主键
+	if err := db.UpdateJSONPatch("1", `[{"op": "replace", "path": "/id", "value": "2"}]`); err == nil {
+		t.Error("Expected error when patching the primary key")
+	}
+}
@@ -2,8 +2,10 @@ package jsonDB
 
 import (
 	"fmt"
+	"log/slog"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Query 方法用于在数据库中查询符合特定条件的文档
@@ -16,6 +18,7 @@ import (
 //
 // 该方法在查询过程中考虑了并发安全性,使用了适当的锁机制来保护数据访问。
 // 为了处理可能的类型不匹配问题(例如整数和浮点数的比较),该方法使用 toFloat64 函数将值转换为统一的浮点数类型进行比较。
+// 使用确定性加密的字段(见 fieldcrypt.go)比较的是查询值加密之后的密文,field 可以是点号分隔的路径。
 //
 // 参数:
 // - field: 要查询的字段名
@@ -25,11 +28,19 @@ import (
 // - []map[string]interface{}: 包含所有匹配文档的切片,每个文档表示为一个 map
 func (db *Database) Query(field string, value interface{}) []map[string]interface{} {
 	// 记录查询的字段、值和值的类型,用于调试
-	db.logger.Debug(fmt.Sprintf("Querying for field: %s, value: %v (type: %T)", field, value, value))
+	start := time.Now()
+	db.logTo(LogSubsystemQuery, LogLevelDebug, "Querying documents", slog.String("field", field), slog.Any("value", value), slog.Any("type", typeName{value}))
+
+	// 持有提交锁的读锁,避免读到事务提交的中间状态
+	db.commitMu.RLock()
+	defer db.commitMu.RUnlock()
 
 	// 初始化结果切片
 	var results []map[string]interface{}
 
+	// 将字段值和查询值转换为 float64 比较,确定性加密的字段比较密文
+	match := db.queryMatcher(field, value)
+
 	// 尝试从数据库的索引中加载指定字段的索引
 	indexValue, indexExists := db.indexes.Load(field)
 
@@ -40,20 +51,15 @@ func (db *Database) Query(field string, value interface{}) []map[string]interfac
 			idx.mu.RLock()
 			defer idx.mu.RUnlock() // 确保在函数返回时解锁
 
-			// 将查询值转换为浮点数,以统一比较
-			queryValue := toFloat64(value)
-
 			// 遍历索引中的所有键值对
 			idx.values.Range(func(key, valueMapInterface interface{}) bool {
-				// 将索引键转换为浮点数进行比较
-				indexKey := toFloat64(key)
 				// 如果索引键与查询值匹配
-				if indexKey == queryValue {
+				if match(key) {
 					if valueMap, ok := valueMapInterface.(*sync.Map); ok {
 						// 遍历匹配的文档ID
 						valueMap.Range(func(docID, _ interface{}) bool {
 							// 获取文档并添加到结果中
-							if doc, exists := db.Get(docID.(string)); exists {
+							if doc, exists := db.getDocument(docID.(string)); exists {
 								results = append(results, doc)
 							}
 							return true
@@ -64,21 +70,19 @@ func (db *Database) Query(field string, value interface{}) []map[string]interfac
 			})
 
 			// 记录使用索引查询的结果数量
-			db.logger.Info(fmt.Sprintf("Query using index on field %s returned %d results", field, len(results)))
+			db.logTo(LogSubsystemQuery, LogLevelInfo, "Query using index", slog.String("op", "query"), slog.String("field", field), slog.Int("count", len(results)), slog.Duration("duration", time.Since(start)))
 		}
 	} else {
 		// 如果索引不存在,进行全表扫描
+		now := time.Now()
 		db.data.Range(func(_, value interface{}) bool {
 			doc := value.(*Document)
 			// 对文档加读锁,确保并发安全
 			doc.mu.RLock()
-			// 检查文档是否包含查询字段
-			if fieldValue, ok := doc.data[field]; ok {
-				// 将文档中的字段值和查询值都转换为float64进行比较
-				docValue := toFloat64(fieldValue)
-				queryValue := toFloat64(value)
+			// 检查文档是否包含查询字段,跳过已经过期的文档
+			if fieldValue, ok := lookupField(doc.data, field); ok && !db.isExpired(doc.data, now) {
 				// 如果值匹配,则添加到结果中
-				if docValue == queryValue {
+				if match(fieldValue) {
 					// 创建文档的副本以避免并发问题
 					docCopy := make(map[string]interface{})
 					for k, v := range doc.data {
@@ -92,11 +96,11 @@ func (db *Database) Query(field string, value interface{}) []map[string]interfac
 			return true
 		})
 		// 记录全表扫描的结果数量
-		db.logger.Info(fmt.Sprintf("Full scan query on field %s returned %d results", field, len(results)))
+		db.logTo(LogSubsystemQuery, LogLevelInfo, "Full scan query", slog.String("op", "query"), slog.String("field", field), slog.Int("count", len(results)), slog.Duration("duration", time.Since(start)))
 	}
 
 	// 返回查询结果
-	return results
+	return db.revealAll(results)
 }
 
 // QueryComposite 方法用于根据复合索引查询文档
@@ -123,7 +127,12 @@ func (db *Database) QueryComposite(fields []string, values []interface{}) []map[
 	indexKey := strings.Join(fields, "-")
 
 	// 记录查询操作的日志,包括查询的字段和值
-	db.logger.Debug(fmt.Sprintf("Querying composite index for fields: %v, values: %v", fields, values))
+	start := time.Now()
+	db.logTo(LogSubsystemQuery, LogLevelDebug, "Querying composite index", slog.Any("fields", fields), slog.Any("values", values))
+
+	// 持有提交锁的读锁,避免读到事务提交的中间状态
+	db.commitMu.RLock()
+	defer db.commitMu.RUnlock()
 
 	// 初始化结果切片,用于存储匹配的文档
 	var results []map[string]interface{}
@@ -137,7 +146,11 @@ func (db *Database) QueryComposite(fields []string, values []interface{}) []map[
 		if idx, ok := indexValue.(*CompositeIndex); ok {
 			var fieldValues []string
 			// 将查询值转换为字符串切片,以便生成复合键
-			for _, v := range values {
+			for i, v := range values {
+				// 索引中确定性加密的字段保存的是密文,查询值需要先加密
+				if i < len(fields) {
+					v, _ = db.encryptQueryValue(fields[i], v)
+				}
 				fieldValues = append(fieldValues, fmt.Sprintf("%v", v))
 			}
 			// 生成复合查询键,使用'-'连接所有值
@@ -151,7 +164,7 @@ func (db *Database) QueryComposite(fields []string, values []interface{}) []map[
 					// 遍历复合索引中匹配的文档ID
 					valueMap.Range(func(key, _ interface{}) bool {
 						// 获取完整的文档并添加到结果集
-						if doc, exists := db.Get(key.(string)); exists {
+						if doc, exists := db.getDocument(key.(string)); exists {
 							results = append(results, doc)
 						}
 						return true // 继续遍历
@@ -162,13 +175,13 @@ func (db *Database) QueryComposite(fields []string, values []interface{}) []map[
 			idx.mu.RUnlock()
 
 			// 记录查询结果的日志
-			db.logger.Info(fmt.Sprintf("Composite query using index on fields %v returned %d results", fields, len(results)))
+			db.logTo(LogSubsystemQuery, LogLevelInfo, "Composite query using index", slog.String("op", "query_composite"), slog.Any("fields", fields), slog.Int("count", len(results)), slog.Duration("duration", time.Since(start)))
 		}
 	} else {
 		// 如果复合索引不存在,记录警告日志
-		db.logger.Warn(fmt.Sprintf("Composite index not found for fields: %v", fields))
+		db.logTo(LogSubsystemQuery, LogLevelWarn, "Composite index not found", slog.String("op", "query_composite"), slog.Any("fields", fields))
 	}
 
 	// 返回查询结果
-	return results
+	return db.revealAll(results)
 }
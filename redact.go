@@ -0,0 +1,216 @@
+// redact.go
+
+// 介绍:
+// 本文件实现了日志中文档内容的脱敏。
+//
+// 包含文档内容的日志通过 Database.log 和 Database.logTo 记录,文档、更新内容、过滤条件和字段值都作为属性传入,
+// 日志层在属性交给日志器之前按照下面的字段把它们替换为掩码:
+// 1. RedactionPolicy.Fields 中的字段,点号分隔的路径只匹配这个路径,不含点号的字段名匹配任意层级的同名字段;
+// 2. RedactionPolicy.UseSchema 为 true 时,集合的模式中标记为 "sensitive": true 的属性;
+// 3. 字段级加密的字段(见 fieldcrypt.go),无论是否设置了脱敏策略。
+//
+// 属性的处理规则:
+// - 值为文档、Filter 或者数组的属性,逐个字段检查路径,敏感字段的值被替换为掩码;
+// - 日志的 field 或 fields 属性包含敏感字段时,保存字段值的属性(value、values、min、max、pattern、key 等)整体被替换;
+// - 值为错误的属性,其中模式校验的违规(ValidationError)发生在敏感字段上时,违规的说明被替换为掩码。
+//
+// 错误信息不应包含文档中的值,例如 JSON Patch 的 test 操作失败时只报告路径。
+
+package jsonDB
+
+import (
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
+)
+
+// DefaultRedactionMask 是脱敏之后字段值的默认文本
+const DefaultRedactionMask = "[REDACTED]"
+
+// RedactionPolicy 是日志的脱敏策略
+type RedactionPolicy struct {
+	Fields    []string // 需要脱敏的字段,点号分隔的路径,或者匹配任意层级同名字段的字段名
+	UseSchema bool     // 同时脱敏模式中标记为 "sensitive": true 的字段
+	Mask      string   // 替换字段值的文本,为空时使用 DefaultRedactionMask
+}
+
+// logValueKeys 是保存字段值的日志属性,日志的 field 或 fields 属性是敏感字段时被整体替换
+var logValueKeys = map[string]bool{
+	"value": true, "values": true, "min": true, "max": true, "pattern": true,
+	"key": true, "index_key": true, "old_value": true, "new_value": true,
+}
+
+// WithRedaction 设置日志的脱敏策略
+// 脱敏策略作用于整个数据库,UseSchema 使用的是写日志的集合自己的模式
+func WithRedaction(policy RedactionPolicy) Option {
+	return func(db *Database) {
+		db.SetRedaction(policy)
+	}
+}
+
+// SetRedaction 方法设置整个数据库的日志脱敏策略,立即对之后的日志生效
+func (db *Database) SetRedaction(policy RedactionPolicy) {
+	policy.Fields = append([]string(nil), policy.Fields...)
+	db.redaction.Store(&policy)
+}
+
+// redactor 保存一条日志需要脱敏的字段
+type redactor struct {
+	paths map[string]bool // 完整路径
+	names map[string]bool // 匹配任意层级的字段名
+	mask  string
+}
+
+// newRedactor 收集集合当前需要脱敏的字段,没有任何需要脱敏的字段时返回 nil
+func (db *Database) newRedactor() *redactor {
+	r := &redactor{paths: make(map[string]bool), names: make(map[string]bool), mask: DefaultRedactionMask}
+	if policy := db.redaction.Load(); policy != nil {
+		for _, field := range policy.Fields {
+			if strings.Contains(field, ".") {
+				r.paths[field] = true
+			} else {
+				r.names[field] = true
+			}
+		}
+		if policy.UseSchema {
+			for _, path := range db.Schema().sensitivePaths() {
+				r.paths[path] = true
+			}
+		}
+		if policy.Mask != "" {
+			r.mask = policy.Mask
+		}
+	}
+	if fe := db.fieldCrypt.Load(); fe != nil {
+		for path := range fe.rules {
+			r.paths[path] = true
+		}
+	}
+	if len(r.paths) == 0 && len(r.names) == 0 {
+		return nil
+	}
+	return r
+}
+
+// sensitive 判断 path 是否是需要脱敏的字段
+func (r *redactor) sensitive(path string) bool {
+	if r.paths[path] {
+		return true
+	}
+	return r.names[path[strings.LastIndex(path, ".")+1:]]
+}
+
+// redactValue 返回 value 脱敏之后的副本,prefix 是 value 所在的路径,顶层为空字符串
+// 数组中的元素使用数组本身的路径。键为字符串的其他 map 类型(例如 DocumentData)和其他切片类型
+// 通过反射遍历,副本分别是 map[string]interface{} 和 []interface{}
+func (r *redactor) redactValue(prefix string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			path := k
+			if prefix != "" {
+				path = prefix + "." + k
+			}
+			if r.sensitive(path) {
+				out[k] = r.mask
+			} else {
+				out[k] = r.redactValue(path, item)
+			}
+		}
+		return out
+	case Filter:
+		return Filter(r.redactValue(prefix, map[string]interface{}(v)).(map[string]interface{}))
+	case DocumentData:
+		return r.redactValue(prefix, map[string]interface{}(v))
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = r.redactValue(prefix, item)
+		}
+		return out
+	case []byte, []string:
+		// 字符串数组中没有字段,不需要遍历
+		return value
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return value
+		}
+		out := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			out[iter.Key().String()] = iter.Value().Interface()
+		}
+		return r.redactValue(prefix, out)
+	case reflect.Slice, reflect.Array:
+		out := make([]interface{}, rv.Len())
+		for i := range out {
+			out[i] = rv.Index(i).Interface()
+		}
+		return r.redactValue(prefix, out)
+	}
+	return value
+}
+
+// redactError 返回 err 脱敏之后的错误信息
+// 模式校验的违规发生在敏感字段上时,违规的说明可能包含字段的值,被替换为掩码
+func (r *redactor) redactError(err error) string {
+	msg := err.Error()
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		return msg
+	}
+	redacted := &ValidationError{ID: ve.ID, Violations: make([]SchemaViolation, len(ve.Violations))}
+	for i, v := range ve.Violations {
+		if r.sensitive(violationFieldPath(v.Path)) {
+			v.Message = r.mask
+		}
+		redacted.Violations[i] = v
+	}
+	return strings.Replace(msg, ve.Error(), redacted.Error(), 1)
+}
+
+// redactAttrs 按照集合当前的脱敏字段处理一条日志的属性,返回处理之后的副本
+// 没有需要脱敏的字段时原样返回 attrs
+func (db *Database) redactAttrs(attrs []slog.Attr) []slog.Attr {
+	r := db.newRedactor()
+	if r == nil {
+		return attrs
+	}
+
+	// field 或 fields 属性是敏感字段时,这条日志中的字段值都需要脱敏
+	maskValues := false
+	for _, a := range attrs {
+		switch a.Key {
+		case "field":
+			maskValues = maskValues || r.sensitive(a.Value.String())
+		case "fields":
+			if fields, ok := a.Value.Any().([]string); ok {
+				for _, field := range fields {
+					maskValues = maskValues || r.sensitive(field)
+				}
+			}
+		}
+	}
+
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		err, isErr := a.Value.Any().(error)
+		switch {
+		case maskValues && logValueKeys[a.Key]:
+			out[i] = slog.String(a.Key, r.mask)
+		case isErr:
+			out[i] = slog.String(a.Key, r.redactError(err))
+		case a.Value.Kind() == slog.KindAny:
+			out[i] = slog.Any(a.Key, r.redactValue("", a.Value.Any()))
+		default:
+			out[i] = a
+		}
+	}
+	return out
+}
@@ -0,0 +1,127 @@
+package jsonDB
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLogRedaction(t *testing.T) {
+	schema, err := CompileSchema(`{"type": "object", "properties": {"info": {"type": "object", "properties": {"email": {"type": "string", "sensitive": true}}}}}`)
+	if err != nil {
+		t.Fatalf("CompileSchema failed: %v", err)
+	}
+	var buf bytes.Buffer
+	db, err := NewDatabase("id", t.TempDir(), runtime.NumCPU(), WithLogLevel(LogLevelDebug), WithSchema(schema),
+		WithRedaction(RedactionPolicy{Fields: []string{"phone", "card.number"}, UseSchema: true}))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.SetLogOutput(&buf)
+
+	db.Insert(map[string]interface{}{"id": "1", "phone": "555-0100", "info": map[string]interface{}{"email": "a@example.com", "phone": "555-0111"}})
+	db.CreateIndex("phone")
+	db.CreateIndex("info.phone")
+	db.CreateCompositeIndex([]string{"phone", "name"})
+	db.Update("1", map[string]interface{}{"name": "Alice", "card": map[string]interface{}{"number": "4111-1111", "brand": "visa"}})
+	db.Update("1", map[string]interface{}{"phone": "555-0122", "info": map[string]interface{}{"email": "b@example.com"}})
+	db.Query("phone", "555-0122")
+	db.QueryComposite([]string{"phone", "name"}, []interface{}{"555-0122", "Alice"})
+	db.Find(Filter{"info.phone": map[string]interface{}{"$in": []interface{}{"555-0111"}}})
+	db.UpdateMany(Filter{"phone": "555-0122"}, map[string]interface{}{"phone": "555-0133"})
+	db.RangeQuery("phone", "555-0000", "555-9999")
+	db.FuzzyQuery("phone", "555-01*")
+	if _, err := db.Insert(map[string]interface{}{"id": "2", "info": map[string]interface{}{"email": 5.5}}); err == nil {
+		t.Error("Expected a schema violation")
+	}
+	db.Close()
+
+	logs := buf.String()
+	for _, secret := range []string{"555-01", "a@example.com", "b@example.com", "4111-1111"} {
+		if strings.Contains(logs, secret) {
+			t.Errorf("Found %q in logs:\n%s", secret, logs)
+		}
+	}
+	for _, visible := range []string{DefaultRedactionMask, "Alice", "visa", "id=1"} {
+		if !strings.Contains(logs, visible) {
+			t.Errorf("Expected %q in logs:\n%s", visible, logs)
+		}
+	}
+}
+
+func TestLogRedactionOfEncryptedFields(t *testing.T) {
+	keys := &StaticKeys{Current: "f1", Keys: map[string][]byte{"f1": testKey(1)}}
+	var buf bytes.Buffer
+	db, err := NewDatabase("id", t.TempDir(), runtime.NumCPU(), WithLogLevel(LogLevelDebug),
+		WithFieldEncryption(keys, FieldRule{Path: "ssn", Deterministic: true}))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.SetLogOutput(&buf)
+	db.Insert(map[string]interface{}{"id": "1", "ssn": "123-45-6789"})
+	db.Update("1", map[string]interface{}{"ssn": "987-65-4321"})
+	db.Query("ssn", "987-65-4321")
+
+	// 自定义的掩码
+	db.SetRedaction(RedactionPolicy{Fields: []string{"name"}, Mask: "***"})
+	db.Update("1", map[string]interface{}{"name": "Bob"})
+	db.Close()
+
+	logs := buf.String()
+	if strings.Contains(logs, "123-45") || strings.Contains(logs, "987-65") || strings.Contains(logs, "Bob") {
+		t.Errorf("Found encrypted field values in logs:\n%s", logs)
+	}
+	if !strings.Contains(logs, "name:***") {
+		t.Errorf("Expected the custom mask in logs:\n%s", logs)
+	}
+}
+
+func TestLogRedactionOfErrors(t *testing.T) {
+	schema, err := CompileSchema(`{"type": "object", "properties": {"info": {"type": "object", "properties": {"phone": {"type": "string", "pattern": "^[0-9]+$"}}}}}`)
+	if err != nil {
+		t.Fatalf("CompileSchema failed: %v", err)
+	}
+	var buf bytes.Buffer
+	db, err := NewDatabase("id", t.TempDir(), runtime.NumCPU(), WithLogLevel(LogLevelDebug),
+		WithRedaction(RedactionPolicy{Fields: []string{"phone"}}))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.SetLogOutput(&buf)
+	db.Insert(map[string]interface{}{"id": "1", "info": map[string]interface{}{"phone": "555-SECRET"}})
+
+	// JSON Patch 的 test 操作失败时,错误信息中不包含文档中的值
+	err = db.UpdateJSONPatch("1", `[{"op": "test", "path": "/info/phone", "value": "555-OTHER"}]`)
+	if !errors.Is(err, ErrPatchTestFailed) {
+		t.Fatalf("Expected ErrPatchTestFailed, got %v", err)
+	}
+
+	// 敏感字段上的模式校验违规在错误属性中被替换
+	if err := db.SetSchema(schema); err != nil {
+		t.Fatalf("SetSchema failed: %v", err)
+	}
+	updates := map[string]interface{}{"info": map[string]interface{}{"phone": "555-NEWSECRET"}}
+	if _, err := db.UpdateMany(Filter{"id": "1"}, updates); !errors.Is(err, ErrSchemaViolation) {
+		t.Fatalf("Expected ErrSchemaViolation, got %v", err)
+	}
+
+	// 键为字符串的其他 map 类型和切片同样被遍历
+	db.log(LogLevelDebug, "Typed containers", slog.Any("doc", DocumentData{"phone": "555-SECRET"}),
+		slog.Any("list", []map[string]string{{"phone": "555-SECRET", "name": "Alice"}}))
+	db.Close()
+
+	logs := buf.String()
+	for _, secret := range []string{"SECRET", "555-OTHER"} {
+		if strings.Contains(logs, secret) {
+			t.Errorf("Found %q in logs:\n%s", secret, logs)
+		}
+	}
+	for _, visible := range []string{"value at '/info/phone' does not match", "/info/phone: " + DefaultRedactionMask, "name:Alice"} {
+		if !strings.Contains(logs, visible) {
+			t.Errorf("Expected %q in logs:\n%s", visible, logs)
+		}
+	}
+}
@@ -0,0 +1,794 @@
+// replication.go
+
+// 介绍:
+// 本文件实现了基于 WAL 的 leader-follower 复制,用于扩展读能力和故障切换。
+//
+// leader 通过 ServeReplication 在一个 TCP 监听器上接受 follower 的连接。follower 通过 Follow
+// 连接 leader,先发送自己最后一条记录的 LSN,leader 从 WAL 文件中发送这个 LSN 之后的记录,
+// 然后把新写入的记录在追加到 WAL 的同时推送给 follower。follower 把收到的记录原样(包括 LSN 和时间)
+// 写入自己的 WAL,再经过与恢复相同的 replayWALEntry 应用到内存和索引,因此 follower 的目录
+// 随时可以作为普通的数据库打开。follower 也可以调用 ServeReplication,把记录继续转发给下一级 follower。
+//
+// follower 需要的记录已经不在 leader 的 WAL 中时(leader 在这之间执行了检查点或者轮转了 WAL),
+// leader 改为发送一份快照: 与在线备份一样在提交锁内创建快照,然后发送元数据和所有文档。
+// follower 用快照替换本地数据并执行一次检查点,之后继续接收快照之后的记录。
+// follower 处理得太慢、leader 的发送队列积压超过 replicaFeedSize 条记录时连接会被断开,
+// follower 重新连接之后从自己的 LSN 继续。
+//
+// follower 是只读的: 写操作和集合管理操作返回 ErrReadOnly,后台清理器不会删除过期文档。
+// 索引、钩子和变更流只作用于本地,不会被复制。Promote 停止复制并让 follower 可以写入,
+// 用于 leader 故障时的手动切换;旧的 leader 恢复之后不能直接作为新 leader 的 follower,
+// 两者在切换之后的写入使用了相同的 LSN,需要用空目录重新开始复制。
+
+package jsonDB
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// RoleLeader 表示数据库可以写入
+	RoleLeader = "leader"
+	// RoleFollower 表示数据库是只读的 follower
+	RoleFollower = "follower"
+
+	// DefaultFollowRetryInterval 是 follower 与 leader 的连接断开之后重新连接的默认间隔
+	DefaultFollowRetryInterval = time.Second
+
+	// replicationHeartbeat 是 leader 发送心跳的间隔,心跳告知 follower leader 当前的 LSN
+	replicationHeartbeat = time.Second
+	// replicationTimeout 是连接、握手和发送的超时;follower 超过这个时间没有收到任何消息时重新连接
+	replicationTimeout = 10 * time.Second
+	// replicaFeedSize 是 leader 为每个 follower 积压的最大记录数量
+	replicaFeedSize = 4096
+	// maxReplicaMessageSize 是复制消息的最大长度
+	maxReplicaMessageSize = 1 << 30
+)
+
+// leader 发送给 follower 的消息类型
+const (
+	replicaMessageWAL         = "wal"          // 一条 WAL 记录
+	replicaMessageHeartbeat   = "heartbeat"    // leader 当前的 LSN 和时间
+	replicaMessageSnapshot    = "snapshot"     // 快照的开始,Record 是元数据
+	replicaMessageData        = "data"         // 快照中的一个文档,Record 是数据文件中的记录
+	replicaMessageSnapshotEnd = "snapshot-end" // 快照的结束
+)
+
+// errReplicaLagged 表示 follower 处理得太慢,leader 的发送队列已满
+var errReplicaLagged = errors.New("follower fell behind the replication feed")
+
+// replicaMessage 是 leader 发送给 follower 的消息
+type replicaMessage struct {
+	Type   string
+	LSN    uint64 `msgpack:",omitempty"`
+	Time   int64  `msgpack:",omitempty"` // 记录写入的时间或者心跳发送的时间(Unix 纳秒)
+	Record []byte `msgpack:",omitempty"` // 原始的 WAL 记录、元数据或者数据文件记录
+}
+
+// replicaAck 是 follower 发送给 leader 的消息: 连接后的第一条消息是起始位置,之后是已经应用的位置
+type replicaAck struct {
+	LSN uint64
+}
+
+// ReplicationStatus 描述数据库的复制状态
+type ReplicationStatus struct {
+	Role        string           `json:"role"`                // RoleLeader 或 RoleFollower
+	LSN         uint64           `json:"lsn"`                 // 本地最后一条 WAL 记录的 LSN
+	Leader      string           `json:"leader,omitempty"`    // follower 连接的 leader 地址
+	Connected   bool             `json:"connected,omitempty"` // follower 当前是否连接着 leader
+	LeaderLSN   uint64           `json:"leaderLsn,omitempty"` // leader 最近一次告知的 LSN
+	LagLSN      uint64           `json:"lagLsn,omitempty"`    // follower 落后 leader 的记录数量
+	Lag         time.Duration    `json:"lag,omitempty"`       // follower 最后应用的记录与 leader 最新的写入之间的时间差
+	LastContact time.Time        `json:"lastContact"`         // 最近一次收到 leader 消息的时间
+	Resyncs     int              `json:"resyncs,omitempty"`   // follower 从 leader 的快照追赶的次数
+	LastError   string           `json:"lastError,omitempty"` // follower 最近一次断开连接的原因
+	Followers   []FollowerStatus `json:"followers,omitempty"` // 连接到本数据库的 follower
+}
+
+// FollowerStatus 是 leader 看到的一个 follower
+type FollowerStatus struct {
+	Addr        string    `json:"addr"`        // follower 的网络地址
+	ConnectedAt time.Time `json:"connectedAt"` // 建立连接的时间
+	AckedLSN    uint64    `json:"ackedLsn"`    // follower 确认已经应用的 LSN
+	LagLSN      uint64    `json:"lagLsn"`      // follower 落后的记录数量
+}
+
+// replicaFeed 是 leader 向一个 follower 发送记录的队列
+type replicaFeed struct {
+	addr        string
+	connectedAt time.Time
+	records     chan replicaMessage // 新写入的 WAL 记录,由 feedReplicas 放入
+	acked       uint64              // follower 确认的 LSN,使用原子操作访问
+
+	closeOnce sync.Once
+	done      chan struct{} // 关闭时结束发送
+	err       error         // 关闭的原因,done 关闭之后才能读取
+}
+
+func newReplicaFeed(addr string) *replicaFeed {
+	return &replicaFeed{
+		addr:        addr,
+		connectedAt: time.Now(),
+		records:     make(chan replicaMessage, replicaFeedSize),
+		done:        make(chan struct{}),
+	}
+}
+
+// close 结束向 follower 发送记录,可以多次调用,只有第一次的 err 被保留
+func (f *replicaFeed) close(err error) {
+	f.closeOnce.Do(func() {
+		f.err = err
+		close(f.done)
+	})
+}
+
+// ServeReplication 方法在 ln 上接受 follower 的连接并向它们发送 WAL 记录
+//
+// 介绍:
+// ServeReplication 一直运行到 ln 被关闭,返回时断开它接受的所有 follower。
+// 关闭数据库时同样会断开所有 follower,调用方应该在关闭数据库之前关闭 ln。
+//
+// 参数:
+// - ln: 接受 follower 连接的监听器,例如 net.Listen("tcp", ":7070") 的返回值
+//
+// 返回值:
+// - error: ln 被关闭时返回 nil,否则返回 Accept 的错误
+func (db *Database) ServeReplication(ln net.Listener) error {
+	db.logTo(LogSubsystemWAL, LogLevelInfo, "Serving replication", slog.String("addr", ln.Addr().String()))
+
+	var mu sync.Mutex
+	feeds := make(map[*replicaFeed]struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		mu.Lock()
+		for feed := range feeds {
+			feed.close(net.ErrClosed)
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		feed := newReplicaFeed(conn.RemoteAddr().String())
+		mu.Lock()
+		feeds[feed] = struct{}{}
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.serveReplica(conn, feed)
+			db.logTo(LogSubsystemWAL, LogLevelInfo, "Follower disconnected", slog.String("addr", feed.addr), slog.Any("error", err))
+			mu.Lock()
+			delete(feeds, feed)
+			mu.Unlock()
+		}()
+	}
+}
+
+// serveReplica 向一个 follower 发送记录,直到连接断开或者 feed 被关闭
+func (db *Database) serveReplica(conn net.Conn, feed *replicaFeed) error {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	var hello replicaAck
+	conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+	if err := readReplicaMessage(reader, &hello); err != nil {
+		return fmt.Errorf("failed to read follower position: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	atomic.StoreUint64(&feed.acked, hello.LSN)
+	db.logTo(LogSubsystemWAL, LogLevelInfo, "Follower connected", slog.String("addr", feed.addr), slog.Uint64("lsn", hello.LSN))
+
+	// follower 定期确认已经应用的位置,读取失败说明连接已经断开
+	go func() {
+		for {
+			var ack replicaAck
+			if err := readReplicaMessage(reader, &ack); err != nil {
+				feed.close(err)
+				return
+			}
+			atomic.StoreUint64(&feed.acked, ack.LSN)
+		}
+	}()
+	go func() {
+		// feed 被关闭时断开连接,结束阻塞的读写
+		<-feed.done
+		conn.Close()
+	}()
+
+	// 在 db.mu 内注册 feed,之后追加的记录都会进入队列,之前的记录从 WAL 文件或者快照发送
+	db.walReaders.RLock()
+	db.mu.RLock()
+	until, walStart := atomic.LoadUint64(&db.lsn), db.walStartLSN
+	db.replMu.Lock()
+	db.replicas[feed] = struct{}{}
+	db.replMu.Unlock()
+	db.mu.RUnlock()
+	defer func() {
+		db.replMu.Lock()
+		delete(db.replicas, feed)
+		db.replMu.Unlock()
+		feed.close(nil)
+	}()
+
+	conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+	var err error
+	if hello.LSN >= walStart && hello.LSN <= until {
+		err = db.scanWALRange(hello.LSN, until, func(rec *FileRecord) error {
+			conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+			return writeReplicaMessage(writer, replicaMessage{Type: replicaMessageWAL, LSN: rec.LSN, Time: rec.Timestamp, Record: rec.Raw})
+		})
+		db.walReaders.RUnlock()
+	} else {
+		// follower 需要的记录已经不在 WAL 中,或者 follower 领先于 leader(例如 leader 从备份恢复过)
+		db.walReaders.RUnlock()
+		db.logTo(LogSubsystemWAL, LogLevelInfo, "Follower is outside the WAL, sending a snapshot", slog.String("addr", feed.addr), slog.Uint64("lsn", hello.LSN), slog.Uint64("wal_start", walStart), slog.Uint64("wal_end", until))
+		err = db.sendSnapshot(conn, writer)
+	}
+	if err != nil {
+		return err
+	}
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var msg replicaMessage
+		select {
+		case msg = <-feed.records:
+		case now := <-heartbeat.C:
+			msg = replicaMessage{Type: replicaMessageHeartbeat, LSN: atomic.LoadUint64(&db.lsn), Time: now.UnixNano()}
+		case <-feed.done:
+			return feed.err
+		}
+		conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		if err := writeReplicaMessage(writer, msg); err != nil {
+			return err
+		}
+		// 队列中没有更多记录时才刷新,连续的写入合并发送
+		if len(feed.records) == 0 {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendSnapshot 向 follower 发送一份快照: 元数据、所有集合的文档和结束标记
+func (db *Database) sendSnapshot(conn net.Conn, writer *bufio.Writer) error {
+	state := db.captureBackupState()
+	defer state.snap.Release()
+
+	meta, err := msgpack.Marshal(state.meta)
+	if err != nil {
+		return err
+	}
+	lsn := state.meta.LSN
+	if err := writeReplicaMessage(writer, replicaMessage{Type: replicaMessageSnapshot, LSN: lsn, Time: state.snap.created.UnixNano(), Record: meta}); err != nil {
+		return err
+	}
+	count, err := state.forEachRecord(context.Background(), func(record []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		return writeReplicaMessage(writer, replicaMessage{Type: replicaMessageData, Record: record})
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeReplicaMessage(writer, replicaMessage{Type: replicaMessageSnapshotEnd, LSN: lsn}); err != nil {
+		return err
+	}
+	db.logTo(LogSubsystemWAL, LogLevelInfo, "Sent snapshot", slog.Uint64("lsn", lsn), slog.Int64("count", count))
+	return writer.Flush()
+}
+
+// feedReplicas 把一条刚写入 WAL 的记录放入所有 follower 的发送队列
+// data 是记录序列化之后的数据,调用方需要持有 db.mu,因此记录按照 LSN 的顺序进入队列
+func (db *Database) feedReplicas(entry *walEntry, data []byte) {
+	db.replMu.Lock()
+	defer db.replMu.Unlock()
+
+	for feed := range db.replicas {
+		select {
+		case feed.records <- replicaMessage{Type: replicaMessageWAL, LSN: entry.LSN, Time: entry.Time, Record: data}:
+		default:
+			// 不能阻塞写操作,断开这个 follower,它重新连接之后从自己的位置继续
+			feed.close(errReplicaLagged)
+		}
+	}
+}
+
+// closeReplicas 断开所有 follower,在关闭数据库时调用
+func (db *Database) closeReplicas() {
+	db.replMu.Lock()
+	defer db.replMu.Unlock()
+	for feed := range db.replicas {
+		feed.close(errors.New("database closed"))
+	}
+}
+
+// FollowOption 是 Follow 的可选配置项
+type FollowOption func(*followConfig)
+
+type followConfig struct {
+	retryInterval time.Duration
+}
+
+// FollowRetryInterval 设置与 leader 的连接断开之后重新连接的间隔,默认为 DefaultFollowRetryInterval
+func FollowRetryInterval(interval time.Duration) FollowOption {
+	return func(c *followConfig) {
+		if interval > 0 {
+			c.retryInterval = interval
+		}
+	}
+}
+
+// follower 是数据库作为 follower 时的复制状态
+type follower struct {
+	db   *Database
+	addr string
+	cfg  followConfig
+	stop chan struct{} // 停止复制时关闭
+	done chan struct{} // 复制协程退出时关闭
+
+	mu          sync.Mutex // 保护以下字段
+	conn        net.Conn   // 当前与 leader 的连接
+	connected   bool
+	leaderLSN   uint64    // leader 最近一次告知的 LSN
+	leaderTime  time.Time // leader 最近一次告知的时间
+	appliedTime time.Time // leader 写入最后一条已应用记录的时间
+	lastContact time.Time
+	resyncs     int
+	lastErr     error
+}
+
+// Follow 方法让数据库成为 leader 的只读 follower
+//
+// 介绍:
+// Follow 在后台连接 addr 上的 leader(leader 通过 ServeReplication 提供复制),
+// 从本地最后一条记录之后开始接收并应用 leader 的记录,连接断开时自动重新连接。
+// 之后数据库只接受从 leader 复制过来的写入,本地的写操作返回 ErrReadOnly。
+// 复制的进度和延迟通过 ReplicationStatus 查看,Promote 停止复制。
+// 所有集合共享同一个复制状态,在任意一个集合上调用的效果相同。
+//
+// 参数:
+// - addr: leader 的复制地址,例如 "10.0.0.1:7070"
+// - opts: 可选配置项,例如 FollowRetryInterval
+//
+// 返回值:
+// - error: 数据库已经是 follower 时返回错误
+func (db *Database) Follow(addr string, opts ...FollowOption) error {
+	cfg := followConfig{retryInterval: DefaultFollowRetryInterval}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	db.replMu.Lock()
+	defer db.replMu.Unlock()
+	if db.follower != nil {
+		return fmt.Errorf("database is already following %s", db.follower.addr)
+	}
+	f := &follower{db: db.root, addr: addr, cfg: cfg, stop: make(chan struct{}), done: make(chan struct{})}
+	db.follower = f
+	db.readOnly.Store(true)
+	go f.run()
+
+	db.logTo(LogSubsystemWAL, LogLevelInfo, "Following leader", slog.String("addr", addr), slog.Uint64("lsn", atomic.LoadUint64(&db.lsn)))
+	return nil
+}
+
+// Promote 方法停止复制,让 follower 成为可以写入的数据库
+//
+// 介绍:
+// Promote 用于 leader 故障时的手动切换。它断开与 leader 的连接并等待正在应用的记录完成,
+// 之后的写入从 follower 最后应用的 LSN 继续。切换之前应该通过 ReplicationStatus 确认 follower
+// 已经追上 leader,没有复制过来的写入不会出现在新的 leader 上。
+//
+// 返回值:
+// - error: 数据库不是 follower 时返回 ErrNotFollower
+func (db *Database) Promote() error {
+	if db.stopFollowing() == nil {
+		return ErrNotFollower
+	}
+	db.readOnly.Store(false)
+	db.logTo(LogSubsystemWAL, LogLevelInfo, "Promoted to leader", slog.Uint64("lsn", atomic.LoadUint64(&db.lsn)))
+	return nil
+}
+
+// stopFollowing 停止复制并等待复制协程退出,返回之前的复制状态,不是 follower 时返回 nil
+func (db *Database) stopFollowing() *follower {
+	db.replMu.Lock()
+	f := db.follower
+	db.follower = nil
+	db.replMu.Unlock()
+	if f == nil {
+		return nil
+	}
+
+	close(f.stop)
+	f.mu.Lock()
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.mu.Unlock()
+	<-f.done
+	return f
+}
+
+// ReplicationStatus 方法返回数据库的复制状态
+// follower 的延迟根据 leader 告知的 LSN 和时间计算,与 leader 断开连接期间保持断开之前的值
+func (db *Database) ReplicationStatus() ReplicationStatus {
+	status := ReplicationStatus{Role: RoleLeader, LSN: atomic.LoadUint64(&db.lsn)}
+
+	db.replMu.Lock()
+	f := db.follower
+	for feed := range db.replicas {
+		acked := atomic.LoadUint64(&feed.acked)
+		follower := FollowerStatus{Addr: feed.addr, ConnectedAt: feed.connectedAt, AckedLSN: acked}
+		if acked < status.LSN {
+			follower.LagLSN = status.LSN - acked
+		}
+		status.Followers = append(status.Followers, follower)
+	}
+	db.replMu.Unlock()
+	sort.Slice(status.Followers, func(i, j int) bool { return status.Followers[i].Addr < status.Followers[j].Addr })
+
+	if f == nil {
+		return status
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status.Role = RoleFollower
+	status.Leader = f.addr
+	status.Connected = f.connected
+	status.LeaderLSN = f.leaderLSN
+	status.LastContact = f.lastContact
+	status.Resyncs = f.resyncs
+	if f.lastErr != nil {
+		status.LastError = f.lastErr.Error()
+	}
+	if status.LeaderLSN > status.LSN {
+		status.LagLSN = status.LeaderLSN - status.LSN
+		if !f.appliedTime.IsZero() && f.leaderTime.After(f.appliedTime) {
+			status.Lag = f.leaderTime.Sub(f.appliedTime)
+		}
+	}
+	return status
+}
+
+// run 连接 leader 并应用它的记录,连接断开之后等待一段时间重新连接,直到复制被停止
+func (f *follower) run() {
+	defer close(f.done)
+	for {
+		err := f.session()
+		f.mu.Lock()
+		f.conn = nil
+		f.connected = false
+		if err != nil {
+			f.lastErr = err
+		}
+		f.mu.Unlock()
+
+		select {
+		case <-f.stop:
+			return
+		default:
+		}
+		f.db.logTo(LogSubsystemWAL, LogLevelWarn, "Replication interrupted, retrying", slog.String("addr", f.addr), slog.Duration("retry_in", f.cfg.retryInterval), slog.Any("error", err))
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(f.cfg.retryInterval):
+		}
+	}
+}
+
+// session 与 leader 建立一次连接,接收并应用记录直到连接断开
+func (f *follower) session() error {
+	db := f.db
+	conn, err := net.DialTimeout("tcp", f.addr, replicationTimeout)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	select {
+	case <-f.stop:
+		f.mu.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	f.conn = conn
+	f.connected = true
+	f.lastContact = time.Now()
+	f.mu.Unlock()
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	ack := func() error {
+		conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		if err := writeReplicaMessage(writer, replicaAck{LSN: atomic.LoadUint64(&db.lsn)}); err != nil {
+			return err
+		}
+		return writer.Flush()
+	}
+	if err := ack(); err != nil {
+		return err
+	}
+
+	var snapshot *replicaSnapshot
+	for {
+		conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+		var msg replicaMessage
+		if err := readReplicaMessage(reader, &msg); err != nil {
+			return err
+		}
+
+		switch msg.Type {
+		case replicaMessageHeartbeat:
+		case replicaMessageWAL:
+			var entry walEntry
+			if err := msgpack.Unmarshal(msg.Record, &entry); err != nil {
+				return fmt.Errorf("failed to unmarshal replicated WAL entry: %w", err)
+			}
+			applied, err := db.applyReplicatedEntry(entry)
+			if err != nil {
+				return err
+			}
+			if applied {
+				f.mu.Lock()
+				f.appliedTime = time.Unix(0, entry.Time)
+				f.mu.Unlock()
+			}
+		case replicaMessageSnapshot:
+			snapshot = &replicaSnapshot{lsn: msg.LSN}
+			if err := msgpack.Unmarshal(msg.Record, &snapshot.meta); err != nil {
+				return fmt.Errorf("failed to unmarshal snapshot metadata: %w", err)
+			}
+		case replicaMessageData:
+			if snapshot == nil {
+				return errors.New("received snapshot data without a snapshot")
+			}
+			var record dataRecord
+			if err := msgpack.Unmarshal(msg.Record, &record); err != nil {
+				return fmt.Errorf("failed to unmarshal snapshot document: %w", err)
+			}
+			snapshot.records = append(snapshot.records, record)
+		case replicaMessageSnapshotEnd:
+			if snapshot == nil || snapshot.lsn != msg.LSN {
+				return errors.New("received an unexpected end of snapshot")
+			}
+			if err := db.installSnapshot(snapshot); err != nil {
+				return fmt.Errorf("failed to install snapshot: %w", err)
+			}
+			f.mu.Lock()
+			f.resyncs++
+			f.appliedTime = time.Time{}
+			f.mu.Unlock()
+			snapshot = nil
+		default:
+			return fmt.Errorf("unknown replication message type %q", msg.Type)
+		}
+		f.observe(msg)
+
+		// 收到的消息都已经处理完时确认位置
+		if reader.Buffered() == 0 {
+			if err := ack(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// observe 根据 leader 的消息更新 leader 的位置
+func (f *follower) observe(msg replicaMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastContact = time.Now()
+	if msg.LSN > f.leaderLSN {
+		f.leaderLSN = msg.LSN
+	}
+	if msg.Time != 0 {
+		if t := time.Unix(0, msg.Time); t.After(f.leaderTime) {
+			f.leaderTime = t
+		}
+	}
+}
+
+// applyReplicatedEntry 把从 leader 收到的一条 WAL 记录写入本地 WAL,并应用到内存数据和索引
+//
+// 记录保留 leader 分配的 LSN 和时间,因此本地 WAL 与 leader 的 WAL 一致。
+// LSN 不大于本地 LSN 的记录已经应用过(例如快照之前进入发送队列的记录),返回 false;
+// LSN 不连续时返回错误,重新连接之后从本地 LSN 继续。
+func (db *Database) applyReplicatedEntry(entry walEntry) (bool, error) {
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	current := atomic.LoadUint64(&db.lsn)
+	if entry.LSN <= current {
+		return false, nil
+	}
+	if entry.LSN != current+1 {
+		return false, fmt.Errorf("replication gap: expected LSN %d, received %d", current+1, entry.LSN)
+	}
+
+	// 变更流的写入前文档来自本地的当前版本
+	coll := db.collectionByID(entry.Collection)
+	if coll != nil {
+		if entry.Operation == OperationBatch {
+			for i := range entry.Batch {
+				entry.Batch[i].before, _ = coll.currentData(entry.Batch[i].ID)
+			}
+		} else {
+			entry.before, _ = coll.currentData(entry.ID)
+		}
+	}
+
+	if err := db.appendWALLocked(&entry, isCollectionOperation(entry.Operation)); err != nil {
+		return false, err
+	}
+	if coll != nil {
+		coll.publishChanges(entry)
+	}
+	db.replayWALEntry(entry, entry.LSN, (*Database).applyReplicated)
+	if isCollectionOperation(entry.Operation) {
+		db.saveCollectionMeta()
+	}
+	return true, nil
+}
+
+// applyReplicated 把 leader 的一个文档操作应用到集合的内存数据、索引和数据文件
+func (db *Database) applyReplicated(op walEntry, seq uint64) {
+	if op.Operation != OperationDelete {
+		db.observeKey(op.ID)
+	}
+	db.applyCommitted(op, seq)
+}
+
+// currentData 返回文档当前的数据,不检查是否过期
+func (db *Database) currentData(id string) (map[string]interface{}, bool) {
+	value, ok := db.data.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return value.(*Document).data, true
+}
+
+// replicaSnapshot 是 follower 从 leader 收到的快照
+type replicaSnapshot struct {
+	lsn     uint64
+	meta    dbMeta
+	records []dataRecord
+}
+
+// installSnapshot 用 leader 的快照替换本地的所有集合和文档,然后执行检查点
+//
+// 本地与快照相同的集合保留下来(连同它们的索引),快照中没有的集合被删除;
+// 文档通过与复制记录相同的方式应用,因此索引保持一致。完成之后本地 WAL 被清空,
+// 变更流的恢复位置不再有效,所有变更流以 ErrResumeTokenExpired 结束。
+func (db *Database) installSnapshot(snap *replicaSnapshot) error {
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+
+	db.mu.Lock()
+	db.reconcileCollections(snap.meta)
+	db.mu.Unlock()
+
+	seen := make(map[uint32]map[string]struct{})
+	for _, rec := range snap.records {
+		coll := db.collectionByID(rec.Collection)
+		if coll == nil {
+			continue
+		}
+		if seen[coll.id] == nil {
+			seen[coll.id] = make(map[string]struct{})
+		}
+		seen[coll.id][rec.ID] = struct{}{}
+		op := walEntry{Operation: OperationInsert, ID: rec.ID, Document: rec.Data}
+		if _, ok := coll.data.Load(rec.ID); ok {
+			op.Operation = OperationUpdate
+		}
+		coll.applyReplicated(op, snap.lsn)
+	}
+	for _, coll := range db.allCollections() {
+		var stale []string
+		coll.data.Range(func(key, _ interface{}) bool {
+			if _, ok := seen[coll.id][key.(string)]; !ok {
+				stale = append(stale, key.(string))
+			}
+			return true
+		})
+		for _, id := range stale {
+			coll.applyCommitted(walEntry{Operation: OperationDelete, ID: id}, snap.lsn)
+		}
+	}
+
+	// 等待异步写入数据文件的操作完成,然后把快照写入新的数据文件并清空 WAL
+	db.writeWg.Wait()
+	db.mu.Lock()
+	atomic.StoreUint64(&db.lsn, snap.lsn)
+	db.mu.Unlock()
+	if err := db.checkpoint(); err != nil {
+		return err
+	}
+	db.closeWatchers(nil, fmt.Errorf("%w: resynchronized from a snapshot of the leader", ErrResumeTokenExpired))
+	db.logTo(LogSubsystemWAL, LogLevelInfo, "Installed snapshot", slog.Uint64("lsn", snap.lsn), slog.Int("count", len(snap.records)))
+	return nil
+}
+
+// reconcileCollections 让本地的命名集合与 leader 的元数据一致
+// 调用方需要持有 commitMu 的写锁和 db.mu
+func (db *Database) reconcileCollections(meta dbMeta) {
+	wanted := make(map[uint32]collectionMeta, len(meta.Collections))
+	for _, cm := range meta.Collections {
+		wanted[cm.ID] = cm
+	}
+	for _, coll := range db.namedCollections() {
+		cm, ok := wanted[coll.id]
+		switch {
+		case !ok || cm.PrimaryKey != coll.primaryKey:
+			db.applyCollectionEntry(walEntry{Operation: OperationDropCollection, ID: coll.name, Collection: coll.id})
+		case cm.Name != coll.name:
+			db.applyCollectionEntry(walEntry{Operation: OperationRenameCollection, ID: cm.Name, Collection: coll.id})
+		}
+	}
+	for _, cm := range meta.Collections {
+		definition := cm
+		db.applyCollectionEntry(walEntry{Operation: OperationCreateCollection, ID: cm.Name, Collection: cm.ID, Definition: &definition})
+		if coll := db.collectionByID(cm.ID); coll != nil {
+			coll.observeKeySequence(cm.KeySequence)
+		}
+	}
+	db.root.observeKeySequence(meta.KeySequence)
+	if meta.NextCollectionID > db.nextCollectionID {
+		db.nextCollectionID = meta.NextCollectionID
+	}
+}
+
+// writeReplicaMessage 把一条复制消息序列化之后写入 w,带有 4 字节的长度前缀
+func writeReplicaMessage(w io.Writer, msg interface{}) error {
+	data, err := msgpack.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return writeFramedRecord(w, data)
+}
+
+// readReplicaMessage 从 r 中读取一条带有长度前缀的复制消息
+func readReplicaMessage(r io.Reader, msg interface{}) error {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if size > maxReplicaMessageSize {
+		return fmt.Errorf("replication message of %d bytes exceeds the limit", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return msgpack.Unmarshal(data, msg)
+}
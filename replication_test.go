@@ -0,0 +1,201 @@
+package jsonDB
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// startLeader 在本地的随机端口上为 db 提供复制,返回监听地址和停止函数
+func startLeader(t *testing.T, db *Database, addr string) (string, func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- db.ServeReplication(ln) }()
+	return ln.Addr().String(), func() {
+		ln.Close()
+		if err := <-done; err != nil {
+			t.Errorf("ServeReplication failed: %v", err)
+		}
+	}
+}
+
+// waitFor 等待 cond 成立,超时时报告 msg
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	dir := t.TempDir()
+	leader, err := NewDatabase("id", filepath.Join(dir, "leader"), runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to create leader: %v", err)
+	}
+	defer leader.Close()
+	leader.Insert(map[string]interface{}{"id": "1", "score": 1.5})
+	addr, stop := startLeader(t, leader, "127.0.0.1:0")
+	defer stop()
+
+	follower, err := NewDatabase("id", filepath.Join(dir, "follower"), runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to create follower: %v", err)
+	}
+	defer follower.Close()
+	follower.CreateIndex("score")
+	stream, err := follower.Watch(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Failed to watch follower: %v", err)
+	}
+	defer stream.Close()
+	if err := follower.Follow(addr, FollowRetryInterval(10*time.Millisecond)); err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	if err := follower.Follow(addr); err == nil {
+		t.Error("Expected error when following twice")
+	}
+
+	leader.Insert(map[string]interface{}{"id": "2", "score": 2.5})
+	leader.Update("1", map[string]interface{}{"score": 2.5})
+	orders, _ := leader.CreateCollection("orders", "id")
+	tx := orders.Begin()
+	tx.Insert(map[string]interface{}{"id": "o1"})
+	tx.Insert(map[string]interface{}{"id": "o2"})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	leader.Delete("2")
+
+	waitFor(t, "Follower did not catch up", func() bool {
+		return follower.ReplicationStatus().LSN == currentLSN(leader)
+	})
+	if docs := follower.Query("score", 2.5); len(docs) != 1 || docs[0]["id"] != "1" {
+		t.Errorf("Expected the follower index to be maintained, got %v", docs)
+	}
+	if copyOrders, err := follower.Collection("orders"); err != nil || copyOrders.Count() != 2 {
+		t.Errorf("Expected replicated collection, got %v", err)
+	}
+	if event := <-stream.Events(); event.ID != "1" || event.Operation != OperationInsert {
+		t.Errorf("Unexpected change event on the follower: %+v", event)
+	}
+
+	// follower 是只读的
+	if _, err := follower.Insert(map[string]interface{}{"id": "x"}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+	if _, err := follower.CreateCollection("local", "id"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly for a collection, got %v", err)
+	}
+
+	waitFor(t, "Leader did not see the follower acknowledgement", func() bool {
+		followers := leader.ReplicationStatus().Followers
+		return len(followers) == 1 && followers[0].LagLSN == 0
+	})
+	status := follower.ReplicationStatus()
+	if status.Role != RoleFollower || !status.Connected || status.Leader != addr || status.LagLSN != 0 || status.Lag != 0 {
+		t.Errorf("Unexpected follower status: %+v", status)
+	}
+
+	// 手动提升之后 follower 可以写入,LSN 从 leader 的位置继续
+	if err := follower.Promote(); err != nil {
+		t.Fatalf("Promote failed: %v", err)
+	}
+	if err := follower.Promote(); !errors.Is(err, ErrNotFollower) {
+		t.Errorf("Expected ErrNotFollower, got %v", err)
+	}
+	if _, err := follower.Insert(map[string]interface{}{"id": "3"}); err != nil {
+		t.Errorf("Expected the promoted follower to accept writes, got %v", err)
+	}
+	if status := follower.ReplicationStatus(); status.Role != RoleLeader || status.LSN != currentLSN(leader)+1 {
+		t.Errorf("Unexpected status after promotion: %+v", status)
+	}
+}
+
+func TestReplicationCatchUp(t *testing.T) {
+	dir := t.TempDir()
+	leaderPath := filepath.Join(dir, "leader")
+	leader, err := NewDatabase("id", leaderPath, runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to create leader: %v", err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		leader.Insert(map[string]interface{}{"id": id})
+	}
+	leader.CreateCollection("orders", "id")
+	leader.Close()
+	// 重新打开时执行检查点,follower 需要的记录已经不在 WAL 中
+	leader, err = NewDatabase("id", leaderPath, runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to reopen leader: %v", err)
+	}
+	defer func() { leader.Close() }()
+	addr, stop := startLeader(t, leader, "127.0.0.1:0")
+
+	followerPath := filepath.Join(dir, "follower")
+	follower, err := NewDatabase("id", followerPath, runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to create follower: %v", err)
+	}
+	follower.Insert(map[string]interface{}{"id": "stale", "n": 1.5})
+	follower.CreateCollection("local", "id")
+	follower.CreateIndex("n")
+	if err := follower.Follow(addr, FollowRetryInterval(10*time.Millisecond)); err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	leader.Insert(map[string]interface{}{"id": "4"})
+	waitFor(t, "Follower did not catch up from a snapshot", func() bool {
+		return follower.ReplicationStatus().LSN == currentLSN(leader)
+	})
+	if _, ok := follower.Get("stale"); ok || follower.Count() != 4 {
+		t.Errorf("Expected the follower to match the leader, got %d documents", follower.Count())
+	}
+	if names := follower.ListCollections(); len(names) != 1 || names[0] != "orders" {
+		t.Errorf("Expected the leader's collections, got %v", names)
+	}
+	if docs := follower.Query("n", 1.5); len(docs) != 0 {
+		t.Errorf("Expected the index to drop stale documents, got %v", docs)
+	}
+	if status := follower.ReplicationStatus(); status.Resyncs != 1 {
+		t.Errorf("Expected one resync, got %+v", status)
+	}
+
+	// leader 重启复制之后 follower 重新连接,从 WAL 继续而不是快照
+	stop()
+	waitFor(t, "Follower did not notice the disconnect", func() bool {
+		return !follower.ReplicationStatus().Connected
+	})
+	leader.Insert(map[string]interface{}{"id": "5"})
+	_, stop = startLeader(t, leader, addr)
+	defer stop()
+	waitFor(t, "Follower did not reconnect", func() bool {
+		return follower.ReplicationStatus().LSN == currentLSN(leader)
+	})
+	if status := follower.ReplicationStatus(); status.Resyncs != 1 || status.LastError == "" {
+		t.Errorf("Expected to resume from the WAL, got %+v", status)
+	}
+
+	// follower 的目录可以作为普通的数据库打开
+	lsn := currentLSN(leader)
+	follower.Close()
+	follower, err = NewDatabase("id", followerPath, runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to reopen follower: %v", err)
+	}
+	defer follower.Close()
+	if follower.Count() != 5 || currentLSN(follower) != lsn {
+		t.Errorf("Expected 5 documents at LSN %d, got %d at LSN %d", lsn, follower.Count(), currentLSN(follower))
+	}
+}
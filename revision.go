@@ -0,0 +1,122 @@
+// revision.go
+
+// 介绍:
+// 本文件实现了基于文档修订号的乐观并发控制。
+// 每个文档都带有两个由数据库维护的元数据字段: RevisionField(修订号)和 UpdatedAtField(最后写入时间)。
+// 插入时修订号从当前 LSN 加 1 开始,之后每次更新加 1。这两个字段随文档一起写入 WAL 和数据文件,
+// 因此重启后修订号保持不变,并且会出现在 Get 和各种查询返回的文档中。
+//
+// 文档的修订号不会大于写入它的 WAL 记录的 LSN,而 LSN 在重启后继续单调递增,
+// 因此文档被删除后重新插入时,新文档的修订号一定大于旧文档曾经有过的任何修订号,
+// 在旧文档上读取的修订号不会与新文档的修订号相同。
+//
+// UpdateIf 和 DeleteIf 允许调用方声明"只有在文档自我读取后没有被修改时才执行",
+// 如果修订号不一致,会返回 *ConflictError,可以通过 errors.Is(err, ErrConflict) 判断。
+
+package jsonDB
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// UpdateIf 方法在文档当前修订号等于 expectedRev 时更新文档
+//
+// 参数:
+// - id: 要更新的文档的唯一标识符
+// - expectedRev: 调用方读取文档时看到的修订号
+// - updates: 包含要更新的字段和其新值的映射
+//
+// 返回值:
+// - uint64: 更新后文档的修订号
+// - error: 修订号不一致时返回 *ConflictError,文档不存在时返回 *DocumentNotFoundError
+func (db *Database) UpdateIf(id string, expectedRev uint64, updates map[string]interface{}) (uint64, error) {
+	db.log(LogLevelDebug, "Attempting to update document at revision", slog.String("id", id), slog.Uint64("rev", expectedRev))
+
+	var newRev uint64
+	err := db.modifyDocument(id, func(current map[string]interface{}) (map[string]interface{}, error) {
+		if rev := documentRevision(current); rev != expectedRev {
+			return nil, &ConflictError{ID: id, ExpectedRev: expectedRev, ActualRev: rev}
+		}
+		newRev = expectedRev + 1
+		return mergeUpdates(current, updates), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newRev, nil
+}
+
+// DeleteIf 方法在文档当前修订号等于 expectedRev 时删除文档
+//
+// 与 Delete 不同,如果文档不存在,DeleteIf 会返回 *DocumentNotFoundError,
+// 因为调用方期望删除的是一个特定的修订版本。
+//
+// 参数:
+// - id: 要删除的文档的唯一标识符
+// - expectedRev: 调用方读取文档时看到的修订号
+//
+// 返回值:
+// - error: 修订号不一致时返回 *ConflictError,文档不存在时返回 *DocumentNotFoundError
+func (db *Database) DeleteIf(id string, expectedRev uint64) error {
+	db.log(LogLevelDebug, "Attempting to delete document at revision", slog.String("id", id), slog.Uint64("rev", expectedRev))
+
+	_, deleted, err := db.deleteDocument(id, func(current map[string]interface{}) error {
+		if rev := documentRevision(current); rev != expectedRev {
+			return &ConflictError{ID: id, ExpectedRev: expectedRev, ActualRev: rev}
+		}
+		return nil
+	})
+	if err != nil {
+		db.log(LogLevelWarn, "Conditional delete rejected", slog.String("op", "delete"), slog.String("id", id), slog.Any("error", err))
+		return err
+	}
+	if !deleted {
+		return &DocumentNotFoundError{ID: id}
+	}
+	return nil
+}
+
+// Revision 方法返回指定文档的当前修订号
+func (db *Database) Revision(id string) (uint64, bool) {
+	if value, ok := db.data.Load(id); ok {
+		doc := value.(*Document)
+		doc.mu.RLock()
+		defer doc.mu.RUnlock()
+		return documentRevision(doc.data), true
+	}
+	return 0, false
+}
+
+// DocumentRevision 从 Get 或查询返回的文档中读取修订号
+// 修订号经过 MessagePack 持久化后可能变成不同宽度的整数类型,这个函数会统一转换为 uint64
+func DocumentRevision(doc map[string]interface{}) uint64 {
+	return documentRevision(doc)
+}
+
+// DocumentUpdatedAt 从 Get 或查询返回的文档中读取最后写入时间
+func DocumentUpdatedAt(doc map[string]interface{}) (time.Time, bool) {
+	t, ok := doc[UpdatedAtField].(time.Time)
+	return t, ok
+}
+
+// documentRevision 读取文档的修订号,没有修订号的文档(如旧版本写入的数据)返回 0
+func documentRevision(doc map[string]interface{}) uint64 {
+	if n, ok := asNumber(doc[RevisionField]); ok && n > 0 {
+		return uint64(n)
+	}
+	return 0
+}
+
+// insertRevision 返回新插入的文档的修订号
+// 插入记录的 LSN 不会小于当前 LSN 加 1,因此修订号不会大于写入它的 WAL 记录的 LSN
+func (db *Database) insertRevision() uint64 {
+	return atomic.LoadUint64(&db.lsn) + 1
+}
+
+// stampRevision 写入文档的修订号和最后写入时间
+func stampRevision(doc map[string]interface{}, rev uint64) {
+	doc[RevisionField] = rev
+	doc[UpdatedAtField] = time.Now().UTC()
+}
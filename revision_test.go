@@ -0,0 +1,93 @@
+package jsonDB
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+)
+
+func TestRevisionConflicts(t *testing.T) {
+	db := setupTestDB(t)
+
+	if _, err := db.Insert(map[string]interface{}{"id": "1", "balance": 100}); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	doc, _ := db.Get("1")
+	if rev := DocumentRevision(doc); rev != 1 {
+		t.Fatalf("Expected revision 1 after insert, got %d", rev)
+	}
+
+	rev, err := db.UpdateIf("1", 1, map[string]interface{}{"balance": 50})
+	if err != nil || rev != 2 {
+		t.Fatalf("UpdateIf returned %d, %v; expected revision 2", rev, err)
+	}
+
+	// 使用过期的修订号更新和删除都会失败
+	var conflict *ConflictError
+	if _, err := db.UpdateIf("1", 1, map[string]interface{}{"balance": 0}); !errors.As(err, &conflict) || conflict.ActualRev != 2 {
+		t.Errorf("Expected ConflictError at revision 2, got %v", err)
+	}
+	if err := db.DeleteIf("1", 1); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+
+	// 修订号在重启后保持不变
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db, err = NewDatabase("id", testDBPath, runtime.NumCPU())
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer cleanupTestDB(t, db)
+
+	if rev, ok := db.Revision("1"); !ok || rev != 2 {
+		t.Errorf("Expected revision 2 after restart, got %d", rev)
+	}
+	if err := db.DeleteIf("1", 2); err != nil {
+		t.Errorf("DeleteIf with current revision failed: %v", err)
+	}
+}
+
+func TestRevisionAfterReinsert(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDatabase("id", dir, runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Insert(map[string]interface{}{"id": "1", "name": "old"})
+	db.Insert(map[string]interface{}{"id": "2"})
+	stale, _ := db.Revision("1")
+
+	// 删除后重新插入的文档的修订号大于旧文档的修订号,旧的修订号不能用来修改新文档
+	db.Delete("1")
+	db.Insert(map[string]interface{}{"id": "1", "name": "new"})
+	if rev, _ := db.Revision("1"); rev <= stale {
+		t.Fatalf("Expected revision after %d for the reinserted document, got %d", stale, rev)
+	}
+	if _, err := db.UpdateIf("1", stale, map[string]interface{}{"name": "overwritten"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict for a revision of the deleted document, got %v", err)
+	}
+	if err := db.DeleteIf("1", stale); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict for a revision of the deleted document, got %v", err)
+	}
+
+	// 重启之后 LSN 继续递增,修订号同样不会重复
+	stale, _ = db.Revision("1")
+	db.Delete("1")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db, err = NewDatabase("id", dir, runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	db.Insert(map[string]interface{}{"id": "1", "name": "newer"})
+	if _, err := db.UpdateIf("1", stale, map[string]interface{}{"name": "overwritten"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict after restart, got %v", err)
+	}
+	if doc, _ := db.Get("1"); doc["name"] != "newer" {
+		t.Errorf("Expected the reinserted document to be unchanged, got %v", doc)
+	}
+}
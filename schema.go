@@ -0,0 +1,551 @@
+// schema.go
+
+// 介绍:
+// 本文件实现了基于 JSON Schema 的文档校验。
+//
+// 支持 JSON Schema draft 2020-12 的一个子集:
+// - 类型: type(字符串或字符串数组,取值为 null/boolean/object/array/number/integer/string)
+// - 对象: properties、required、additionalProperties(布尔值或子模式)
+// - 数组: items、minItems、maxItems
+// - 数值: minimum、maximum、exclusiveMinimum、exclusiveMaximum
+// - 字符串: minLength、maxLength、pattern(Go RE2 语法)
+// - 通用: enum、const,以及 true/false 布尔模式
+// - 注解: sensitive(布尔值),标记包含个人信息的属性,使用 RedactionPolicy.UseSchema 时这些属性在日志中被脱敏
+// 不认识的关键字(如 $schema、title、description)会被忽略。
+//
+// 校验在文档按照 JSON 语义规范化之后进行,因此 int8、float64 等数值都按 number 处理,
+// time.Time 按 string 处理。数据库维护的元数据字段(_rev、_updatedAt)不参与校验。
+// 设置的模式保存在元数据文件中,重新打开数据库后仍然生效。
+
+package jsonDB
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema 是编译后的 JSON Schema
+type Schema struct {
+	source    []byte      // 模式的原始 JSON,用于持久化
+	root      *schemaNode // 编译后的根模式
+	sensitive []string    // 标记为 sensitive 的属性的路径(点号分隔)
+}
+
+// schemaNode 是编译后的单个(子)模式
+type schemaNode struct {
+	never     bool // 布尔模式 false,任何值都不匹配
+	sensitive bool // 属性包含个人信息,只影响日志脱敏,不参与校验
+
+	types      []string
+	enum       []interface{}
+	constValue interface{}
+	hasConst   bool
+
+	properties           map[string]*schemaNode
+	required             []string
+	additionalProperties *schemaNode // nil 表示允许任意额外属性
+
+	items    *schemaNode
+	minItems *int
+	maxItems *int
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+}
+
+// CompileSchema 函数解析并编译 JSON Schema
+//
+// 参数:
+// - source: JSON 格式的模式,可以是 []byte、string、json.RawMessage 或者已经解析的 map[string]interface{}
+//
+// 返回值:
+// - *Schema: 编译后的模式
+// - error: 模式不是合法的 JSON,或者关键字的值不合法时返回错误
+func CompileSchema(source interface{}) (*Schema, error) {
+	var data []byte
+	switch v := source.(type) {
+	case []byte:
+		data = v
+	case json.RawMessage:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			return nil, fmt.Errorf("failed to marshal schema: %w", err)
+		}
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse schema: %w", err)
+	}
+	root, err := compileSchemaNode(raw, "")
+	if err != nil {
+		return nil, err
+	}
+	return &Schema{source: append([]byte(nil), data...), root: root, sensitive: root.sensitivePaths("", nil)}, nil
+}
+
+// sensitivePaths 返回模式中标记为 sensitive 的属性的路径,模式为 nil 时返回 nil
+func (s *Schema) sensitivePaths() []string {
+	if s == nil {
+		return nil
+	}
+	return s.sensitive
+}
+
+// sensitivePaths 收集 properties 中标记为 sensitive 的属性,数组元素的属性使用数组本身的路径
+func (n *schemaNode) sensitivePaths(prefix string, paths []string) []string {
+	for name, prop := range n.properties {
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		if prop.sensitive {
+			paths = append(paths, path)
+		}
+		paths = prop.sensitivePaths(path, paths)
+	}
+	if n.items != nil {
+		paths = n.items.sensitivePaths(prefix, paths)
+	}
+	return paths
+}
+
+// sourceBytes 返回模式的原始 JSON,模式为 nil 时返回 nil
+func (s *Schema) sourceBytes() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.source
+}
+
+// MarshalJSON 返回模式的原始 JSON
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	return s.source, nil
+}
+
+// Validate 方法校验一个值是否满足模式,返回所有不满足的地方
+// 值为 map 时,顶层的元数据字段(_rev、_updatedAt)会被忽略
+func (s *Schema) Validate(value interface{}) []SchemaViolation {
+	if doc, ok := value.(map[string]interface{}); ok {
+		value = withoutMetaFields(doc)
+	}
+	normalized, err := normalizeJSON(value)
+	if err != nil {
+		return []SchemaViolation{{Path: "", Message: fmt.Sprintf("value is not representable as JSON: %v", err)}}
+	}
+
+	var violations []SchemaViolation
+	s.root.validate(normalized, "", &violations)
+	return violations
+}
+
+// SetSchema 方法为数据库设置 JSON Schema,schema 为 nil 时移除模式
+//
+// 介绍:
+// 设置模式之后,Insert、Update 以及所有基于它们的写操作(包括事务和补丁更新)都会校验写入后的文档,
+// 不满足模式时返回 *ValidationError。已经存储的文档不会被检查,可以使用 Validate 方法找出它们。
+// 模式会立即写入元数据文件。
+//
+// 参数:
+// - schema: 通过 CompileSchema 编译的模式
+//
+// 返回值:
+// - error: 保存元数据失败时返回错误
+func (db *Database) SetSchema(schema *Schema) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.schema.Store(schema)
+	if err := db.saveMeta(); err != nil {
+		db.log(LogLevelError, "Failed to save schema", slog.Any("error", err))
+		return fmt.Errorf("failed to save schema: %w", err)
+	}
+
+	if schema == nil {
+		db.log(LogLevelInfo, "Schema removed")
+	} else {
+		db.log(LogLevelInfo, "Schema attached")
+	}
+	return nil
+}
+
+// Schema 方法返回数据库当前的模式,没有设置模式时返回 nil
+func (db *Database) Schema() *Schema {
+	return db.schema.Load()
+}
+
+// Validate 方法使用当前的模式检查所有已经存储的文档
+//
+// 介绍:
+// Validate 在一个快照上遍历所有文档,返回每个不满足模式的文档的校验错误,结果按照文档ID排序。
+// 通常在为已有数据的数据库设置新模式之后调用,用来找出需要修复的文档。
+//
+// 返回值:
+// - []*ValidationError: 所有不满足模式的文档,没有设置模式或者所有文档都满足模式时返回空切片
+func (db *Database) Validate() []*ValidationError {
+	schema := db.Schema()
+	if schema == nil {
+		return nil
+	}
+
+	snap := db.Snapshot()
+	defer snap.Release()
+
+	var invalid []*ValidationError
+	snap.forEach(func(id string, data map[string]interface{}) bool {
+		// 与写操作相同,校验的是解密后的文档
+		if violations := schema.Validate(db.revealFields(data)); len(violations) > 0 {
+			invalid = append(invalid, &ValidationError{ID: id, Violations: violations})
+		}
+		return true
+	})
+	sort.Slice(invalid, func(i, j int) bool { return invalid[i].ID < invalid[j].ID })
+
+	db.log(LogLevelInfo, "Validated documents against schema", slog.Int("invalid", len(invalid)))
+	return invalid
+}
+
+// validateDocument 使用当前的模式校验即将写入的文档
+func (db *Database) validateDocument(id string, doc map[string]interface{}) error {
+	schema := db.Schema()
+	if schema == nil {
+		return nil
+	}
+	if violations := schema.Validate(doc); len(violations) > 0 {
+		// 原因中可能包含字段的值,按照字段路径记录,使敏感字段可以被脱敏
+		reasons := make(map[string]interface{}, len(violations))
+		for _, v := range violations {
+			path := violationFieldPath(v.Path)
+			if previous, ok := reasons[path]; ok {
+				reasons[path] = previous.(string) + "; " + v.Message
+			} else {
+				reasons[path] = v.Message
+			}
+		}
+		db.log(LogLevelWarn, "Document does not match schema", slog.String("id", id), slog.Any("violations", reasons))
+		return &ValidationError{ID: id, Violations: violations}
+	}
+	return nil
+}
+
+// violationFieldPath 把 JSON Pointer 转换为点号分隔的字段路径,数组下标被省略,与脱敏使用的路径一致
+func violationFieldPath(pointer string) string {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return pointer
+	}
+	parts := tokens[:0]
+	for _, token := range tokens {
+		if _, err := strconv.Atoi(token); err != nil {
+			parts = append(parts, token)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// withoutMetaFields 返回去掉元数据字段的文档副本,文档不包含元数据字段时直接返回原文档
+func withoutMetaFields(doc map[string]interface{}) map[string]interface{} {
+	_, hasRev := doc[RevisionField]
+	_, hasUpdatedAt := doc[UpdatedAtField]
+	if !hasRev && !hasUpdatedAt {
+		return doc
+	}
+	stripped := copyDocumentData(doc)
+	delete(stripped, RevisionField)
+	delete(stripped, UpdatedAtField)
+	return stripped
+}
+
+// compileSchemaNode 编译一个(子)模式,path 是它在模式中的位置,用于错误信息
+func compileSchemaNode(raw interface{}, path string) (*schemaNode, error) {
+	if b, ok := raw.(bool); ok {
+		return &schemaNode{never: !b}, nil
+	}
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid schema at '%s': expected object or boolean", path)
+	}
+
+	node := &schemaNode{}
+	var err error
+	for keyword, value := range obj {
+		keywordPath := path + "/" + keyword
+		switch keyword {
+		case "type":
+			node.types, err = schemaTypes(value, keywordPath)
+		case "enum":
+			items, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid schema at '%s': expected array", keywordPath)
+			}
+			node.enum = items
+		case "const":
+			node.constValue, node.hasConst = value, true
+		case "sensitive":
+			if node.sensitive, ok = value.(bool); !ok {
+				return nil, fmt.Errorf("invalid schema at '%s': expected boolean", keywordPath)
+			}
+		case "properties":
+			props, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid schema at '%s': expected object", keywordPath)
+			}
+			node.properties = make(map[string]*schemaNode, len(props))
+			for name, sub := range props {
+				if node.properties[name], err = compileSchemaNode(sub, keywordPath+"/"+escapeJSONPointer(name)); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			items, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid schema at '%s': expected array of strings", keywordPath)
+			}
+			for _, item := range items {
+				name, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("invalid schema at '%s': expected array of strings", keywordPath)
+				}
+				node.required = append(node.required, name)
+			}
+		case "additionalProperties":
+			node.additionalProperties, err = compileSchemaNode(value, keywordPath)
+		case "items":
+			node.items, err = compileSchemaNode(value, keywordPath)
+		case "minItems":
+			node.minItems, err = schemaCount(value, keywordPath)
+		case "maxItems":
+			node.maxItems, err = schemaCount(value, keywordPath)
+		case "minLength":
+			node.minLength, err = schemaCount(value, keywordPath)
+		case "maxLength":
+			node.maxLength, err = schemaCount(value, keywordPath)
+		case "minimum":
+			node.minimum, err = schemaNumber(value, keywordPath)
+		case "maximum":
+			node.maximum, err = schemaNumber(value, keywordPath)
+		case "exclusiveMinimum":
+			node.exclusiveMinimum, err = schemaNumber(value, keywordPath)
+		case "exclusiveMaximum":
+			node.exclusiveMaximum, err = schemaNumber(value, keywordPath)
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid schema at '%s': expected string", keywordPath)
+			}
+			if node.pattern, err = regexp.Compile(pattern); err != nil {
+				return nil, fmt.Errorf("invalid schema at '%s': %w", keywordPath, err)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// schemaTypes 解析 type 关键字
+func schemaTypes(value interface{}, path string) ([]string, error) {
+	var names []interface{}
+	switch v := value.(type) {
+	case string:
+		names = []interface{}{v}
+	case []interface{}:
+		names = v
+	default:
+		return nil, fmt.Errorf("invalid schema at '%s': expected string or array of strings", path)
+	}
+
+	types := make([]string, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+			types = append(types, name.(string))
+		default:
+			return nil, fmt.Errorf("invalid schema at '%s': unknown type %v", path, name)
+		}
+	}
+	return types, nil
+}
+
+// schemaNumber 解析数值关键字
+func schemaNumber(value interface{}, path string) (*float64, error) {
+	n, ok := value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("invalid schema at '%s': expected number", path)
+	}
+	return &n, nil
+}
+
+// schemaCount 解析非负整数关键字
+func schemaCount(value interface{}, path string) (*int, error) {
+	n, ok := value.(float64)
+	if !ok || n < 0 || n != math.Trunc(n) {
+		return nil, fmt.Errorf("invalid schema at '%s': expected non-negative integer", path)
+	}
+	count := int(n)
+	return &count, nil
+}
+
+// validate 校验已经规范化为 JSON 类型的值,把不满足的地方追加到 violations
+func (n *schemaNode) validate(value interface{}, path string, violations *[]SchemaViolation) {
+	report := func(format string, args ...interface{}) {
+		*violations = append(*violations, SchemaViolation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if n.never {
+		report("value is not allowed")
+		return
+	}
+
+	if len(n.types) > 0 && !matchesSchemaType(value, n.types) {
+		report("expected %s, got %s", strings.Join(n.types, " or "), jsonTypeName(value))
+		// 类型不匹配时其他关键字的检查没有意义
+		return
+	}
+
+	if n.enum != nil {
+		found := false
+		for _, item := range n.enum {
+			if jsonEqual(value, item) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			report("value %s is not one of the allowed values", jsonText(value))
+		}
+	}
+	if n.hasConst && !jsonEqual(value, n.constValue) {
+		report("value must be %s", jsonText(n.constValue))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range n.required {
+			if _, ok := v[name]; !ok {
+				report("missing required property '%s'", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			childPath := path + "/" + escapeJSONPointer(name)
+			if sub, ok := n.properties[name]; ok {
+				sub.validate(v[name], childPath, violations)
+			} else if n.additionalProperties != nil {
+				if n.additionalProperties.never {
+					*violations = append(*violations, SchemaViolation{Path: childPath, Message: "additional property is not allowed"})
+				} else {
+					n.additionalProperties.validate(v[name], childPath, violations)
+				}
+			}
+		}
+
+	case []interface{}:
+		if n.minItems != nil && len(v) < *n.minItems {
+			report("expected at least %d items, got %d", *n.minItems, len(v))
+		}
+		if n.maxItems != nil && len(v) > *n.maxItems {
+			report("expected at most %d items, got %d", *n.maxItems, len(v))
+		}
+		if n.items != nil {
+			for i, item := range v {
+				n.items.validate(item, fmt.Sprintf("%s/%d", path, i), violations)
+			}
+		}
+
+	case float64:
+		if n.minimum != nil && v < *n.minimum {
+			report("value %v is less than minimum %v", v, *n.minimum)
+		}
+		if n.maximum != nil && v > *n.maximum {
+			report("value %v is greater than maximum %v", v, *n.maximum)
+		}
+		if n.exclusiveMinimum != nil && v <= *n.exclusiveMinimum {
+			report("value %v must be greater than %v", v, *n.exclusiveMinimum)
+		}
+		if n.exclusiveMaximum != nil && v >= *n.exclusiveMaximum {
+			report("value %v must be less than %v", v, *n.exclusiveMaximum)
+		}
+
+	case string:
+		length := utf8.RuneCountInString(v)
+		if n.minLength != nil && length < *n.minLength {
+			report("expected at least %d characters, got %d", *n.minLength, length)
+		}
+		if n.maxLength != nil && length > *n.maxLength {
+			report("expected at most %d characters, got %d", *n.maxLength, length)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(v) {
+			report("value %q does not match pattern %q", v, n.pattern.String())
+		}
+	}
+}
+
+// matchesSchemaType 判断规范化后的值是否属于给定的类型之一
+func matchesSchemaType(value interface{}, types []string) bool {
+	actual := jsonTypeName(value)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeName 返回规范化后的值的 JSON Schema 类型名,整数值返回 integer
+func jsonTypeName(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// jsonText 返回值的 JSON 文本,用于错误信息
+func jsonText(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
+
+// escapeJSONPointer 按照 RFC 6901 转义 JSON Pointer 中的一段
+func escapeJSONPointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
@@ -0,0 +1,81 @@
+package jsonDB
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+)
+
+const testUserSchema = `{
+	"type": "object",
+	"required": ["id", "name"],
+	"properties": {
+		"id": {"type": "string"},
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0, "maximum": 150},
+		"role": {"enum": ["admin", "member"]},
+		"email": {"type": "string", "pattern": "^[^@]+@[^@]+$"}
+	},
+	"additionalProperties": false
+}`
+
+func TestSchemaValidation(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { cleanupTestDB(t, db) }()
+
+	// 设置模式之前写入的文档不受限制
+	if _, err := db.Insert(map[string]interface{}{"id": "legacy", "name": "Old", "age": "thirty"}); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+
+	schema, err := CompileSchema(testUserSchema)
+	if err != nil {
+		t.Fatalf("Failed to compile schema: %v", err)
+	}
+	if err := db.SetSchema(schema); err != nil {
+		t.Fatalf("Failed to set schema: %v", err)
+	}
+
+	if _, err := db.Insert(map[string]interface{}{"id": "1", "name": "Alice", "age": 30, "role": "admin"}); err != nil {
+		t.Fatalf("Valid document rejected: %v", err)
+	}
+
+	_, err = db.Insert(map[string]interface{}{"id": "2", "age": "thirty", "role": "guest", "extra": true})
+	var validation *ValidationError
+	if !errors.As(err, &validation) || !errors.Is(err, ErrSchemaViolation) {
+		t.Fatalf("Expected ValidationError, got %v", err)
+	}
+	want := map[string]bool{"": true, "/age": true, "/role": true, "/extra": true}
+	for _, v := range validation.Violations {
+		delete(want, v.Path)
+	}
+	if len(want) != 0 {
+		t.Errorf("Missing violations for %v in %v", want, validation.Violations)
+	}
+
+	// 更新和补丁同样会被校验,失败时文档保持不变
+	rev, _ := db.Revision("1")
+	if err := db.Update("1", map[string]interface{}{"age": 200}); !errors.Is(err, ErrSchemaViolation) {
+		t.Errorf("Expected schema violation on update, got %v", err)
+	}
+	if err := db.UpdateMergePatch("1", map[string]interface{}{"email": "not-an-email"}); !errors.Is(err, ErrSchemaViolation) {
+		t.Errorf("Expected schema violation on patch, got %v", err)
+	}
+	if doc, _ := db.Get("1"); !filterEqual(doc["age"], 30) || DocumentRevision(doc) != rev {
+		t.Errorf("Rejected updates should not modify the document: %v", doc)
+	}
+
+	// Validate 报告设置模式之前写入的文档,模式在重启后仍然生效
+	db.writeWg.Wait()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db, err = NewDatabase("id", testDBPath, runtime.NumCPU())
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	invalid := db.Validate()
+	if len(invalid) != 1 || invalid[0].ID != "legacy" || invalid[0].Violations[0].Path != "/age" {
+		t.Errorf("Expected only the legacy document to be invalid, got %v", invalid)
+	}
+}
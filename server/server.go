@@ -0,0 +1,588 @@
+// server.go
+
+// 介绍:
+// server 包实现了 jsondb-server 的 HTTP/JSON 接口,把数据库的集合、文档、查询和索引操作映射为 REST 路由。
+// client 包是这些接口的 Go 客户端。
+//
+// 请求体和响应体都是 JSON。URL 中的集合名称 _default 表示默认集合。
+// 错误响应的格式为 {"error": "...", "code": "..."},code 是稳定的机器可读的错误类型,
+// HTTP 状态码根据数据库返回的错误类型确定,例如文档或集合不存在时为 404,文档已经存在时为 409。
+//
+// 文档的修订号通过 ETag 响应头返回;更新和删除请求带有 If-Match 请求头时,
+// 分别使用 UpdateIf 和 DeleteIf 进行条件写入,修订号不一致时返回 412。
+//
+// 数据库作为 follower 运行时写请求返回 403(read_only)。GET /replication 返回复制状态,
+// POST /replication/promote 把 follower 提升为可以写入的数据库。
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlexiaAshford/jsonDB"
+)
+
+// DefaultCollection 是 URL 中表示默认集合的名称
+const DefaultCollection = "_default"
+
+// maxBodyBytes 是请求体的最大长度
+const maxBodyBytes = 32 << 20
+
+// 错误响应中的错误类型,见 ErrorResponse.Code
+const (
+	CodeBadRequest         = "bad_request"
+	CodeDocumentNotFound   = "document_not_found"
+	CodeCollectionNotFound = "collection_not_found"
+	CodeDocumentExists     = "document_exists"
+	CodeCollectionExists   = "collection_exists"
+	CodeConflict           = "conflict"
+	CodeMissingPrimaryKey  = "missing_primary_key"
+	CodeIndexNotFound      = "index_not_found"
+	CodeValidationFailed   = "validation_failed"
+	CodeReadOnly           = "read_only"
+	CodeNotFollower        = "not_follower"
+	CodeInternal           = "internal"
+)
+
+// server 把一个数据库暴露为 HTTP 接口
+type server struct {
+	db *jsonDB.Database
+}
+
+// ErrorResponse 是所有错误响应的格式
+type ErrorResponse struct {
+	Error      string                   `json:"error"`
+	Code       string                   `json:"code"`
+	Violations []jsonDB.SchemaViolation `json:"violations,omitempty"`
+}
+
+// collectionInfo 描述一个集合
+type collectionInfo struct {
+	Name       string   `json:"name"`
+	PrimaryKey string   `json:"primaryKey"`
+	Count      int64    `json:"count"`
+	Indexes    []string `json:"indexes"`
+}
+
+// reaperInfo 是后台清理器的统计信息
+type reaperInfo struct {
+	Runs         uint64    `json:"runs"`
+	Expired      uint64    `json:"expired"`
+	Errors       uint64    `json:"errors"`
+	LastRun      time.Time `json:"lastRun"`
+	LastDuration string    `json:"lastDuration"`
+	LastExpired  int       `json:"lastExpired"`
+}
+
+// statsResponse 是 /stats 的响应
+type statsResponse struct {
+	Uptime      string           `json:"uptime"`
+	Collections []collectionInfo `json:"collections"`
+	Reaper      reaperInfo       `json:"reaper"`
+}
+
+// New 返回一个把 db 暴露为 HTTP/JSON 接口的 http.Handler
+func New(db *jsonDB.Database) http.Handler {
+	s := &server{db: db}
+	return s.routes()
+}
+
+// routes 返回 server 的所有路由
+func (s *server) routes() http.Handler {
+	started := time.Now()
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		s.handleStats(w, r, started)
+	})
+
+	mux.HandleFunc("GET /replication", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.db.ReplicationStatus())
+	})
+	mux.HandleFunc("POST /replication/promote", s.handlePromote)
+
+	mux.HandleFunc("GET /collections", s.handleListCollections)
+	mux.HandleFunc("POST /collections", s.handleCreateCollection)
+	mux.HandleFunc("GET /collections/{name}", s.handleGetCollection)
+	mux.HandleFunc("DELETE /collections/{name}", s.handleDropCollection)
+
+	mux.HandleFunc("GET /collections/{name}/docs", s.handleGetAll)
+	mux.HandleFunc("POST /collections/{name}/docs", s.handleInsert)
+	mux.HandleFunc("GET /collections/{name}/docs/{id}", s.handleGet)
+	mux.HandleFunc("PATCH /collections/{name}/docs/{id}", s.handleUpdate)
+	mux.HandleFunc("DELETE /collections/{name}/docs/{id}", s.handleDelete)
+	mux.HandleFunc("GET /collections/{name}/count", s.handleCount)
+
+	mux.HandleFunc("POST /collections/{name}/query", s.handleQuery)
+	mux.HandleFunc("POST /collections/{name}/query/range", s.handleRangeQuery)
+	mux.HandleFunc("POST /collections/{name}/query/fuzzy", s.handleFuzzyQuery)
+	mux.HandleFunc("POST /collections/{name}/query/composite", s.handleCompositeQuery)
+	mux.HandleFunc("POST /collections/{name}/find", s.handleFind)
+
+	mux.HandleFunc("GET /collections/{name}/indexes", s.handleListIndexes)
+	mux.HandleFunc("POST /collections/{name}/indexes", s.handleCreateIndex)
+	mux.HandleFunc("DELETE /collections/{name}/indexes/{index}", s.handleDropIndex)
+
+	return mux
+}
+
+// handleStats 返回所有集合的文档数量、索引和后台清理器的统计信息
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request, started time.Time) {
+	names := append([]string{""}, s.db.ListCollections()...)
+	resp := statsResponse{Uptime: time.Since(started).Round(time.Second).String()}
+	for _, name := range names {
+		// 集合可能在列出之后被删除
+		if coll, err := s.db.Collection(name); err == nil {
+			resp.Collections = append(resp.Collections, describeCollection(coll))
+		}
+	}
+	stats := s.db.ReaperStats()
+	resp.Reaper = reaperInfo{
+		Runs:         stats.Runs,
+		Expired:      stats.Expired,
+		Errors:       stats.Errors,
+		LastRun:      stats.LastRun,
+		LastDuration: stats.LastDuration.String(),
+		LastExpired:  stats.LastExpired,
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handlePromote 停止复制,让作为 follower 运行的服务器可以写入
+func (s *server) handlePromote(w http.ResponseWriter, r *http.Request) {
+	if err := s.db.Promote(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.db.ReplicationStatus())
+}
+
+func (s *server) handleListCollections(w http.ResponseWriter, r *http.Request) {
+	names := append([]string{DefaultCollection}, s.db.ListCollections()...)
+	writeJSON(w, http.StatusOK, map[string][]string{"collections": names})
+}
+
+func (s *server) handleCreateCollection(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name       string `json:"name"`
+		PrimaryKey string `json:"primaryKey"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if req.Name == "" || req.Name == DefaultCollection {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Errorf("invalid collection name '%s'", req.Name))
+		return
+	}
+	if req.PrimaryKey == "" {
+		req.PrimaryKey = s.db.PrimaryKey()
+	}
+	coll, err := s.db.CreateCollection(req.Name, req.PrimaryKey)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, describeCollection(coll))
+}
+
+func (s *server) handleGetCollection(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, describeCollection(coll))
+}
+
+func (s *server) handleDropCollection(w http.ResponseWriter, r *http.Request) {
+	name := collectionName(r)
+	if name == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, errors.New("cannot drop the default collection"))
+		return
+	}
+	if err := s.db.DropCollection(name); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handleGetAll(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	writeDocuments(w, coll.GetAll())
+}
+
+func (s *server) handleInsert(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	var doc map[string]interface{}
+	if !decodeBody(w, r, &doc) {
+		return
+	}
+	id, err := coll.Insert(doc)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if rev, ok := coll.Revision(id); ok {
+		setETag(w, rev)
+	}
+	w.Header().Set("Location", r.URL.Path+"/"+id)
+	writeJSON(w, http.StatusCreated, map[string]string{"id": id})
+}
+
+func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	id := r.PathValue("id")
+	doc, exists := coll.Get(id)
+	if !exists {
+		writeDBError(w, &jsonDB.DocumentNotFoundError{ID: id})
+		return
+	}
+	if rev, ok := coll.Revision(id); ok {
+		setETag(w, rev)
+	}
+	writeJSON(w, http.StatusOK, doc)
+}
+
+func (s *server) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	expectedRev, conditional, ok := ifMatch(w, r)
+	if !ok {
+		return
+	}
+	var updates map[string]interface{}
+	if !decodeBody(w, r, &updates) {
+		return
+	}
+
+	id := r.PathValue("id")
+	if conditional {
+		rev, err := coll.UpdateIf(id, expectedRev, updates)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		setETag(w, rev)
+	} else {
+		if err := coll.Update(id, updates); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if rev, ok := coll.Revision(id); ok {
+			setETag(w, rev)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	expectedRev, conditional, ok := ifMatch(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.PathValue("id")
+	var err error
+	if conditional {
+		err = coll.DeleteIf(id, expectedRev)
+	} else {
+		err = coll.Delete(id)
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handleCount(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int64{"count": coll.Count()})
+}
+
+func (s *server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Field string      `json:"field"`
+		Value interface{} `json:"value"`
+	}
+	if !decodeBody(w, r, &req) || !requireField(w, req.Field) {
+		return
+	}
+	writeDocuments(w, coll.Query(req.Field, req.Value))
+}
+
+func (s *server) handleRangeQuery(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Field string      `json:"field"`
+		Min   interface{} `json:"min"`
+		Max   interface{} `json:"max"`
+	}
+	if !decodeBody(w, r, &req) || !requireField(w, req.Field) {
+		return
+	}
+	writeDocuments(w, coll.RangeQuery(req.Field, req.Min, req.Max))
+}
+
+func (s *server) handleFuzzyQuery(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Field   string `json:"field"`
+		Pattern string `json:"pattern"`
+	}
+	if !decodeBody(w, r, &req) || !requireField(w, req.Field) {
+		return
+	}
+	writeDocuments(w, coll.FuzzyQuery(req.Field, req.Pattern))
+}
+
+func (s *server) handleCompositeQuery(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Fields []string      `json:"fields"`
+		Values []interface{} `json:"values"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if len(req.Fields) == 0 || len(req.Fields) != len(req.Values) {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, errors.New("fields and values must be non-empty and of the same length"))
+		return
+	}
+	writeDocuments(w, coll.QueryComposite(req.Fields, req.Values))
+}
+
+func (s *server) handleFind(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Filter jsonDB.Filter `json:"filter"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	writeDocuments(w, coll.Find(req.Filter))
+}
+
+func (s *server) handleListIndexes(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"indexes": nonNil(coll.Indexes())})
+}
+
+func (s *server) handleCreateIndex(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Field      string   `json:"field"`
+		Fields     []string `json:"fields"`
+		TTLSeconds *float64 `json:"ttlSeconds"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	switch {
+	case req.Field != "" && len(req.Fields) == 0:
+		var opts []jsonDB.IndexOption
+		if req.TTLSeconds != nil {
+			opts = append(opts, jsonDB.IndexTTL(time.Duration(*req.TTLSeconds*float64(time.Second))))
+		}
+		coll.CreateIndex(req.Field, opts...)
+	case req.Field == "" && len(req.Fields) > 0 && req.TTLSeconds == nil:
+		coll.CreateCompositeIndex(req.Fields)
+	default:
+		writeError(w, http.StatusBadRequest, CodeBadRequest, errors.New("exactly one of field or fields is required, ttlSeconds only applies to single field indexes"))
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string][]string{"indexes": nonNil(coll.Indexes())})
+}
+
+func (s *server) handleDropIndex(w http.ResponseWriter, r *http.Request) {
+	coll, ok := s.collection(w, r)
+	if !ok {
+		return
+	}
+	if err := coll.DropIndex(r.PathValue("index")); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// collection 返回请求路径中的集合,集合不存在时写入 404 响应
+func (s *server) collection(w http.ResponseWriter, r *http.Request) (*jsonDB.Database, bool) {
+	coll, err := s.db.Collection(collectionName(r))
+	if err != nil {
+		writeDBError(w, err)
+		return nil, false
+	}
+	return coll, true
+}
+
+// collectionName 返回请求路径中的集合名称,默认集合返回空字符串
+func collectionName(r *http.Request) string {
+	name := r.PathValue("name")
+	if name == DefaultCollection {
+		return ""
+	}
+	return name
+}
+
+// describeCollection 返回集合的描述信息
+func describeCollection(coll *jsonDB.Database) collectionInfo {
+	name := coll.Name()
+	if name == "" {
+		name = DefaultCollection
+	}
+	return collectionInfo{
+		Name:       name,
+		PrimaryKey: coll.PrimaryKey(),
+		Count:      coll.Count(),
+		Indexes:    nonNil(coll.Indexes()),
+	}
+}
+
+// ifMatch 解析 If-Match 请求头中的修订号,请求头格式错误时写入 400 响应
+func ifMatch(w http.ResponseWriter, r *http.Request) (rev uint64, present, ok bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, false, true
+	}
+	rev, err := strconv.ParseUint(strings.Trim(header, `"`), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Errorf("invalid If-Match header '%s'", header))
+		return 0, false, false
+	}
+	return rev, true, true
+}
+
+// setETag 把文档的修订号写入 ETag 响应头
+func setETag(w http.ResponseWriter, rev uint64) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatUint(rev, 10)))
+}
+
+// requireField 检查查询请求中的字段名不为空
+func requireField(w http.ResponseWriter, field string) bool {
+	if field == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, errors.New("field is required"))
+		return false
+	}
+	return true
+}
+
+// decodeBody 把请求体解码到 v,失败时写入 400 响应
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+// writeDocuments 写入一组文档,没有文档时返回空数组而不是 null
+func writeDocuments(w http.ResponseWriter, docs []map[string]interface{}) {
+	if docs == nil {
+		docs = []map[string]interface{}{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"documents": docs})
+}
+
+// writeDBError 根据数据库返回的错误类型写入对应的错误响应
+func writeDBError(w http.ResponseWriter, err error) {
+	var validation *jsonDB.ValidationError
+	switch {
+	case errors.Is(err, jsonDB.ErrCollectionNotFound):
+		writeError(w, http.StatusNotFound, CodeCollectionNotFound, err)
+	case errors.Is(err, jsonDB.ErrDocumentNotFound):
+		writeError(w, http.StatusNotFound, CodeDocumentNotFound, err)
+	case errors.Is(err, jsonDB.ErrDocumentExists):
+		writeError(w, http.StatusConflict, CodeDocumentExists, err)
+	case errors.Is(err, jsonDB.ErrCollectionExists):
+		writeError(w, http.StatusConflict, CodeCollectionExists, err)
+	case errors.Is(err, jsonDB.ErrIndexNotFound):
+		writeError(w, http.StatusNotFound, CodeIndexNotFound, err)
+	case errors.Is(err, jsonDB.ErrConflict):
+		writeError(w, http.StatusPreconditionFailed, CodeConflict, err)
+	case errors.As(err, &validation):
+		writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{
+			Error:      err.Error(),
+			Code:       CodeValidationFailed,
+			Violations: validation.Violations,
+		})
+	case errors.Is(err, jsonDB.ErrReadOnly):
+		writeError(w, http.StatusForbidden, CodeReadOnly, err)
+	case errors.Is(err, jsonDB.ErrNotFollower):
+		writeError(w, http.StatusConflict, CodeNotFollower, err)
+	case errors.Is(err, jsonDB.ErrMissingPrimaryKey):
+		writeError(w, http.StatusBadRequest, CodeMissingPrimaryKey, err)
+	default:
+		writeError(w, http.StatusInternalServerError, CodeInternal, err)
+	}
+}
+
+// writeError 写入一个错误响应
+func writeError(w http.ResponseWriter, status int, code string, err error) {
+	writeJSON(w, status, ErrorResponse{Error: err.Error(), Code: code})
+}
+
+// writeJSON 把 v 编码为 JSON 写入响应
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// nonNil 把 nil 切片替换为空切片,使其编码为 [] 而不是 null
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
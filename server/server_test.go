@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AlexiaAshford/jsonDB"
+)
+
+// do 发送一个 JSON 请求并把响应体解码到 out
+func do(t *testing.T, ts *httptest.Server, method, path string, body interface{}, header http.Header, out interface{}) *http.Response {
+	t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("Failed to encode request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("Failed to decode response of %s %s: %v", method, path, err)
+		}
+	}
+	return resp
+}
+
+func TestServer(t *testing.T) {
+	db, err := jsonDB.NewDatabase("id", t.TempDir(), 2)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	db.LogLevelOff()
+
+	ts := httptest.NewServer(New(db))
+	defer ts.Close()
+
+	if resp := do(t, ts, "GET", "/healthz", nil, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected healthz to return 200, got %d", resp.StatusCode)
+	}
+
+	// 插入文档并读取
+	for _, doc := range []map[string]interface{}{
+		{"id": "1", "name": "Alice", "age": 30},
+		{"id": "2", "name": "Bob", "age": 25},
+		{"id": "3", "name": "Anna", "age": 35},
+	} {
+		if resp := do(t, ts, "POST", "/collections/_default/docs", doc, nil, nil); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected insert to return 201, got %d", resp.StatusCode)
+		}
+	}
+	var errResp ErrorResponse
+	if resp := do(t, ts, "POST", "/collections/_default/docs", map[string]interface{}{"id": "1"}, nil, &errResp); resp.StatusCode != http.StatusConflict || errResp.Code != CodeDocumentExists {
+		t.Errorf("Expected 409 document_exists for duplicate insert, got %d %+v", resp.StatusCode, errResp)
+	}
+
+	var doc map[string]interface{}
+	resp := do(t, ts, "GET", "/collections/_default/docs/1", nil, nil, &doc)
+	if resp.StatusCode != http.StatusOK || doc["name"] != "Alice" {
+		t.Fatalf("Unexpected get response: %d %v", resp.StatusCode, doc)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected ETag header with the document revision")
+	}
+
+	// 条件更新: 旧的修订号返回 412
+	if resp := do(t, ts, "PATCH", "/collections/_default/docs/1", map[string]interface{}{"age": 31}, http.Header{"If-Match": {etag}}, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected conditional update to return 204, got %d", resp.StatusCode)
+	}
+	if resp := do(t, ts, "PATCH", "/collections/_default/docs/1", map[string]interface{}{"age": 32}, http.Header{"If-Match": {etag}}, &errResp); resp.StatusCode != http.StatusPreconditionFailed || errResp.Code != CodeConflict {
+		t.Errorf("Expected 412 conflict for stale revision, got %d %+v", resp.StatusCode, errResp)
+	}
+	if resp := do(t, ts, "GET", "/collections/_default/docs/404", nil, nil, &errResp); resp.StatusCode != http.StatusNotFound || errResp.Code != CodeDocumentNotFound {
+		t.Errorf("Expected 404 document_not_found, got %d %+v", resp.StatusCode, errResp)
+	}
+
+	// 查询
+	var result struct {
+		Documents []map[string]interface{} `json:"documents"`
+	}
+	var indexes map[string][]string
+	do(t, ts, "POST", "/collections/_default/indexes", map[string]interface{}{"field": "age"}, nil, nil)
+	do(t, ts, "POST", "/collections/_default/indexes", map[string]interface{}{"field": "name"}, nil, &indexes)
+	if len(indexes["indexes"]) != 2 {
+		t.Errorf("Expected 2 indexes, got %v", indexes)
+	}
+	if resp := do(t, ts, "DELETE", "/collections/_default/indexes/missing", nil, nil, &errResp); resp.StatusCode != http.StatusNotFound || errResp.Code != CodeIndexNotFound {
+		t.Errorf("Expected 404 index_not_found, got %d %+v", resp.StatusCode, errResp)
+	}
+	do(t, ts, "POST", "/collections/_default/query", map[string]interface{}{"field": "age", "value": 31}, nil, &result)
+	if len(result.Documents) != 1 || result.Documents[0]["id"] != "1" {
+		t.Errorf("Unexpected query result: %v", result.Documents)
+	}
+	do(t, ts, "POST", "/collections/_default/query/range", map[string]interface{}{"field": "age", "min": 30, "max": 40}, nil, &result)
+	if len(result.Documents) != 2 {
+		t.Errorf("Expected 2 documents in range, got %v", result.Documents)
+	}
+	do(t, ts, "POST", "/collections/_default/query/fuzzy", map[string]interface{}{"field": "name", "pattern": "A*"}, nil, &result)
+	if len(result.Documents) != 2 {
+		t.Errorf("Expected 2 documents matching A*, got %v", result.Documents)
+	}
+	do(t, ts, "POST", "/collections/_default/find", map[string]interface{}{"filter": map[string]interface{}{"age": map[string]interface{}{"$lt": 30}}}, nil, &result)
+	if len(result.Documents) != 1 || result.Documents[0]["id"] != "2" {
+		t.Errorf("Unexpected find result: %v", result.Documents)
+	}
+
+	// 删除
+	if resp := do(t, ts, "DELETE", "/collections/_default/docs/2", nil, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected delete to return 204, got %d", resp.StatusCode)
+	}
+	var count map[string]int64
+	do(t, ts, "GET", "/collections/_default/count", nil, nil, &count)
+	if count["count"] != 2 {
+		t.Errorf("Expected 2 documents after delete, got %v", count)
+	}
+
+	// 命名集合
+	var info collectionInfo
+	if resp := do(t, ts, "POST", "/collections", map[string]interface{}{"name": "orders", "primaryKey": "orderId"}, nil, &info); resp.StatusCode != http.StatusCreated || info.PrimaryKey != "orderId" {
+		t.Fatalf("Unexpected create collection response: %d %+v", resp.StatusCode, info)
+	}
+	do(t, ts, "POST", "/collections/orders/docs", map[string]interface{}{"orderId": "o1", "total": 10}, nil, nil)
+	if resp := do(t, ts, "GET", "/collections/orders/docs/o1", nil, nil, &doc); resp.StatusCode != http.StatusOK || doc["total"] != float64(10) {
+		t.Errorf("Unexpected document in named collection: %d %v", resp.StatusCode, doc)
+	}
+	var stats statsResponse
+	do(t, ts, "GET", "/stats", nil, nil, &stats)
+	if len(stats.Collections) != 2 || stats.Collections[1].Name != "orders" || stats.Collections[1].Count != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if resp := do(t, ts, "DELETE", "/collections/orders", nil, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected drop collection to return 204, got %d", resp.StatusCode)
+	}
+	if resp := do(t, ts, "GET", "/collections/orders/docs", nil, nil, &errResp); resp.StatusCode != http.StatusNotFound || errResp.Code != CodeCollectionNotFound {
+		t.Errorf("Expected 404 collection_not_found, got %d %+v", resp.StatusCode, errResp)
+	}
+}
+
+func TestServerReplication(t *testing.T) {
+	db, err := jsonDB.NewDatabase("id", t.TempDir(), 2, jsonDB.WithLogLevel(jsonDB.LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	ts := httptest.NewServer(New(db))
+	defer ts.Close()
+
+	// 没有 leader 监听的地址,follower 会一直重试
+	if err := db.Follow("127.0.0.1:1"); err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	var errResp ErrorResponse
+	if resp := do(t, ts, "POST", "/collections/_default/docs", map[string]interface{}{"id": "1"}, nil, &errResp); resp.StatusCode != http.StatusForbidden || errResp.Code != CodeReadOnly {
+		t.Errorf("Expected 403 read_only on a follower, got %d %+v", resp.StatusCode, errResp)
+	}
+	var status jsonDB.ReplicationStatus
+	if do(t, ts, "GET", "/replication", nil, nil, &status); status.Role != jsonDB.RoleFollower || status.Leader != "127.0.0.1:1" {
+		t.Errorf("Unexpected replication status: %+v", status)
+	}
+	if resp := do(t, ts, "POST", "/replication/promote", nil, nil, &status); resp.StatusCode != http.StatusOK || status.Role != jsonDB.RoleLeader {
+		t.Errorf("Expected promotion to succeed, got %d %+v", resp.StatusCode, status)
+	}
+	if resp := do(t, ts, "POST", "/replication/promote", nil, nil, &errResp); resp.StatusCode != http.StatusConflict || errResp.Code != CodeNotFollower {
+		t.Errorf("Expected 409 not_follower, got %d %+v", resp.StatusCode, errResp)
+	}
+	if resp := do(t, ts, "POST", "/collections/_default/docs", map[string]interface{}{"id": "1"}, nil, nil); resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected the promoted database to accept writes, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,94 @@
+// slog.go
+
+// 介绍:
+// 本文件实现了基于标准库 log/slog 的日志器 SlogLogger。
+//
+// SlogLogger 把数据库的日志交给一个 slog.Handler 处理,日志属性(subsystem、op、id、field、duration、count 等)
+// 原样成为 slog 记录的属性,可以使用 slog.NewJSONHandler 输出 JSON 格式的日志,或者接入应用已有的日志管道。
+// 日志级别与 slog 的级别一一对应: LogLevelError 对应 slog.LevelError,LogLevelDebug 对应 slog.LevelDebug。
+// 一条日志只有在 SlogLogger 自身的级别和 Handler.Enabled 都允许时才会被记录,
+// 被关闭的日志在准备属性之前就被跳过。
+
+package jsonDB
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// SlogLogger 是把日志交给 slog.Handler 处理的日志器,实现了 StructuredLogger 接口
+type SlogLogger struct {
+	handler slog.Handler // 处理日志记录的 Handler
+	level   atomic.Int32 // 当前的日志级别,原子地读写
+}
+
+// NewSlogLogger 创建一个使用 handler 的日志器
+// 它的日志级别初始化为 Debug,是否记录一条日志由 handler 的级别决定
+func NewSlogLogger(handler slog.Handler) *SlogLogger {
+	l := &SlogLogger{handler: handler}
+	l.SetLevel(LogLevelDebug)
+	return l
+}
+
+// Handler 返回日志器使用的 slog.Handler
+func (l *SlogLogger) Handler() slog.Handler { return l.handler }
+
+// slogLevel 返回 LogLevel 对应的 slog 级别
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LogLevelError:
+		return slog.LevelError
+	case LogLevelWarn:
+		return slog.LevelWarn
+	case LogLevelInfo:
+		return slog.LevelInfo
+	default:
+		return slog.LevelDebug
+	}
+}
+
+// Enabled 判断 level 级别的日志是否会被记录
+func (l *SlogLogger) Enabled(level LogLevel) bool {
+	return level != LogLevelOff && level <= LogLevel(l.level.Load()) && l.handler.Enabled(context.Background(), slogLevel(level))
+}
+
+// Log 记录一条带有属性的日志
+func (l *SlogLogger) Log(level LogLevel, msg string, attrs ...slog.Attr) {
+	if !l.Enabled(level) {
+		return
+	}
+	r := slog.NewRecord(time.Now(), slogLevel(level), msg, 0)
+	r.AddAttrs(attrs...)
+	_ = l.handler.Handle(context.Background(), r)
+}
+
+// print 记录一条没有属性的日志,只有日志级别被打开时才格式化 v
+func (l *SlogLogger) print(level LogLevel, v ...interface{}) {
+	if l.Enabled(level) {
+		l.Log(level, fmt.Sprint(v...))
+	}
+}
+
+// Info 记录信息级别的日志
+func (l *SlogLogger) Info(v ...interface{}) { l.print(LogLevelInfo, v...) }
+
+// Warn 记录警告级别的日志
+func (l *SlogLogger) Warn(v ...interface{}) { l.print(LogLevelWarn, v...) }
+
+// Error 记录错误级别的日志
+func (l *SlogLogger) Error(v ...interface{}) { l.print(LogLevelError, v...) }
+
+// Debug 记录调试级别的日志
+func (l *SlogLogger) Debug(v ...interface{}) { l.print(LogLevelDebug, v...) }
+
+// SetLevel 设置日志记录的级别,handler 自身的级别仍然生效
+func (l *SlogLogger) SetLevel(level LogLevel) {
+	l.level.Store(int32(level))
+}
+
+// SetOutput 对 SlogLogger 没有作用,日志的输出由 handler 决定
+func (l *SlogLogger) SetOutput(output io.Writer) {}
@@ -0,0 +1,170 @@
+package jsonDB
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// decodeLogRecords 把 JSON handler 输出的每一行解析为一条记录
+func decodeLogRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Failed to decode log record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// findLogRecord 返回第一条消息为 msg 的记录
+func findLogRecord(records []map[string]interface{}, msg string) map[string]interface{} {
+	for _, record := range records {
+		if record["msg"] == msg {
+			return record
+		}
+	}
+	return nil
+}
+
+// countingHandler 记录 Handle 被调用的次数
+type countingHandler struct {
+	slog.Handler
+	mu    sync.Mutex
+	count int
+}
+
+func (h *countingHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	h.count++
+	h.mu.Unlock()
+	return h.Handler.Handle(ctx, r)
+}
+
+// n 返回 Handle 被调用的次数
+func (h *countingHandler) n() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	db, err := NewDatabase("id", t.TempDir(), runtime.NumCPU(), WithLogHandler(handler),
+		WithRedaction(RedactionPolicy{Fields: []string{"age"}}))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	coll, err := db.CreateCollection("users", "id")
+	if err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	coll.Insert(map[string]interface{}{"id": "1", "age": 30})
+	coll.CreateIndex("age")
+	coll.Query("age", 30)
+	db.Close()
+
+	records := decodeLogRecords(t, &buf)
+	query := findLogRecord(records, "Query using index")
+	if query == nil {
+		t.Fatalf("Expected a query record, got %v", records)
+	}
+	if query["level"] != "INFO" || query["subsystem"] != LogSubsystemQuery || query["collection"] != "users" ||
+		query["op"] != "query" || query["field"] != "age" || query["count"] != 1.0 {
+		t.Errorf("Unexpected query record: %v", query)
+	}
+	if _, ok := query["duration"]; !ok {
+		t.Errorf("Expected a duration in the query record: %v", query)
+	}
+	if insert := findLogRecord(records, "Inserted document"); insert == nil || insert["id"] != "1" || insert["subsystem"] != LogSubsystemDB {
+		t.Errorf("Unexpected insert record: %v", insert)
+	}
+	if checkpoint := findLogRecord(records, "Checkpoint completed"); checkpoint == nil || checkpoint["subsystem"] != LogSubsystemWAL {
+		t.Errorf("Unexpected checkpoint record: %v", checkpoint)
+	}
+	if index := findLogRecord(records, "Index created"); index == nil || index["subsystem"] != LogSubsystemIndex {
+		t.Errorf("Unexpected index record: %v", index)
+	}
+
+	// 属性仍然经过脱敏,值的类型只在记录日志时格式化
+	if debug := findLogRecord(records, "Querying documents"); debug == nil || debug["value"] != DefaultRedactionMask || debug["type"] != "int" {
+		t.Errorf("Unexpected debug record: %v", debug)
+	}
+}
+
+func TestSlogLoggerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	handler := &countingHandler{Handler: slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn})}
+	db, err := NewDatabase("id", t.TempDir(), runtime.NumCPU(), WithLogHandler(handler))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	// 被 handler 关闭的级别在交给 handler 之前就被跳过
+	db.Insert(map[string]interface{}{"id": "1"})
+	db.Query("id", "1")
+	if handler.n() != 0 {
+		t.Errorf("Expected no records below the handler level, got %d:\n%s", handler.n(), buf.String())
+	}
+	db.Insert(map[string]interface{}{"id": "1"})
+	if handler.n() != 1 || !strings.Contains(buf.String(), "level=WARN") || !strings.Contains(buf.String(), `msg="Document already exists"`) {
+		t.Errorf("Expected one warning, got %d:\n%s", handler.n(), buf.String())
+	}
+
+	// SetLogLevel 在 handler 的级别之上进一步限制
+	db.SetLogLevel(LogLevelError)
+	db.Insert(map[string]interface{}{"id": "1"})
+	if handler.n() != 1 {
+		t.Errorf("Expected warnings to be skipped, got %d records", handler.n())
+	}
+}
+
+func TestSubsystemLogger(t *testing.T) {
+	var walBuf bytes.Buffer
+	wal := NewSlogLogger(slog.NewJSONHandler(&walBuf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	var buf bytes.Buffer
+	db, err := NewDatabase("id", t.TempDir(), runtime.NumCPU(), WithLogLevel(LogLevelError), WithSubsystemLogger(LogSubsystemWAL, wal))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.SetLogOutput(&buf)
+	db.Insert(map[string]interface{}{"id": "1"})
+	db.Query("id", "1")
+
+	// 只有 WAL 子系统打开了调试日志
+	records := decodeLogRecords(t, &walBuf)
+	if findLogRecord(records, "WAL entry written") == nil || findLogRecord(records, "Recovering from WAL file") == nil {
+		t.Errorf("Expected WAL records, got %v", records)
+	}
+	for _, record := range records {
+		if record["subsystem"] != LogSubsystemWAL {
+			t.Errorf("Unexpected record in the WAL logger: %v", record)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected no records in the database logger:\n%s", buf.String())
+	}
+
+	// 移除之后 WAL 的日志回到数据库的日志器
+	db.SetSubsystemLogger(LogSubsystemWAL, nil)
+	db.SetLogLevel(LogLevelDebug)
+	walBuf.Reset()
+	db.Insert(map[string]interface{}{"id": "2"})
+	db.Close()
+	if walBuf.Len() != 0 || !strings.Contains(buf.String(), "WAL entry written subsystem=wal") {
+		t.Errorf("Expected WAL records in the database logger:\n%s", buf.String())
+	}
+}
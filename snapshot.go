@@ -0,0 +1,370 @@
+// snapshot.go
+
+// 介绍:
+// 本文件实现了多版本并发控制(MVCC)下的快照读。
+//
+// 每条 WAL 记录都有一个单调递增的 LSN,文档的每个版本都记录了写入它的 LSN(Document.seq)。
+// 创建快照时持有提交锁的写锁,读取当前的 LSN 作为快照的序列号,此时没有正在进行的写操作,
+// 因此所有 LSN 不大于该序列号的写入都已经完整地应用到了内存中。
+//
+// 只要存在活跃的快照,写操作就会保留文档的旧版本: 更新时新版本通过 prev 指向旧版本,
+// 删除时旧版本被放入 tombstones。快照读取文档时沿着版本链找到第一个 seq 不大于快照序列号的版本。
+// 快照释放后,不再被任何快照引用的旧版本会被回收。
+//
+// 快照上的查询总是遍历快照中的文档,不使用索引,因为索引只反映最新的数据。
+
+package jsonDB
+
+import (
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot 是数据库在某个 LSN 上的只读视图
+// 使用完毕后必须调用 Release,否则写操作会一直保留旧版本
+type Snapshot struct {
+	db       *Database
+	seq      uint64    // 快照的序列号,LSN 不大于它的写入对快照可见
+	created  time.Time // 快照创建的时间,在这个时间已经过期的文档对快照不可见
+	released int32     // 快照是否已经释放
+}
+
+// tombstone 保存一个被删除文档的最后版本,供删除之前创建的快照读取
+type tombstone struct {
+	seq  uint64     // 删除操作的 LSN
+	doc  *Document  // 被删除时文档的最新版本,可以通过 prev 找到更早的版本
+	next *tombstone // 同一ID更早的删除记录
+}
+
+// Snapshot 方法创建一个固定在当前 LSN 的只读快照
+//
+// 介绍:
+// 快照提供时间点一致的读取: 无论之后发生多少写操作,快照上的 Get、GetAll 和各种查询
+// 返回的结果都与创建快照时完全一致。长时间的全表扫描应当在快照上进行,
+// 这样不会看到一部分文档更新前、一部分文档更新后的状态。
+//
+// 创建快照需要短暂地等待正在进行的写操作完成,之后快照的读取不会阻塞写操作。
+//
+// 返回值:
+// - *Snapshot: 新的快照,使用完毕后需要调用 Release
+func (db *Database) Snapshot() *Snapshot {
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+	return db.newSnapshotLocked()
+}
+
+// newSnapshotLocked 创建并注册一个固定在当前 LSN 的快照,调用方需要持有 commitMu 的写锁
+func (db *Database) newSnapshotLocked() *Snapshot {
+	snap := &Snapshot{db: db, seq: atomic.LoadUint64(&db.lsn), created: time.Now()}
+
+	db.snapshotMu.Lock()
+	db.snapshots[snap] = struct{}{}
+	db.snapshotMu.Unlock()
+	atomic.AddInt32(&db.activeSnapshots, 1)
+
+	db.log(LogLevelDebug, "Created snapshot", slog.Uint64("seq", snap.seq))
+	return snap
+}
+
+// Seq 方法返回快照的序列号(LSN)
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Release 方法释放快照,并回收不再被任何快照引用的旧版本
+// 多次调用 Release 是安全的
+func (s *Snapshot) Release() {
+	if !atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		return
+	}
+
+	db := s.db
+	db.snapshotMu.Lock()
+	delete(db.snapshots, s)
+	db.snapshotMu.Unlock()
+	atomic.AddInt32(&db.activeSnapshots, -1)
+
+	db.log(LogLevelDebug, "Released snapshot", slog.Uint64("seq", s.seq))
+	db.collectVersions()
+}
+
+// Get 方法返回快照中指定ID的文档
+func (s *Snapshot) Get(id string) (map[string]interface{}, bool) {
+	if doc := s.db.versionAt(id, s.seq); doc != nil && !s.db.isExpired(doc.data, s.created) {
+		return s.db.revealFields(doc.data), true
+	}
+	return nil, false
+}
+
+// GetAll 方法返回快照中的所有文档
+func (s *Snapshot) GetAll() []map[string]interface{} {
+	var allDocs []map[string]interface{}
+	s.forEach(func(_ string, data map[string]interface{}) bool {
+		allDocs = append(allDocs, copyDocumentData(data))
+		return true
+	})
+	return s.db.revealAll(allDocs)
+}
+
+// Count 方法返回快照中的文档总数
+func (s *Snapshot) Count() int64 {
+	var count int64
+	s.forEach(func(string, map[string]interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// Find 方法返回快照中所有满足 filter 的文档
+func (s *Snapshot) Find(filter Filter) []map[string]interface{} {
+	filter = s.db.encryptFilter(filter)
+	return s.collect(func(data map[string]interface{}) bool {
+		return matchFilter(data, filter)
+	})
+}
+
+// Query 方法在快照中查询字段值等于 value 的文档,匹配规则与 Database.Query 相同
+func (s *Snapshot) Query(field string, value interface{}) []map[string]interface{} {
+	match := s.db.queryMatcher(field, value)
+	return s.collect(func(data map[string]interface{}) bool {
+		fieldValue, ok := lookupField(data, field)
+		return ok && match(fieldValue)
+	})
+}
+
+// RangeQuery 方法在快照中查询字段值在 [min, max] 范围内的文档,匹配规则与 Database.RangeQuery 相同
+func (s *Snapshot) RangeQuery(field string, min, max interface{}) []map[string]interface{} {
+	minValue := toComparableValue(min)
+	maxValue := toComparableValue(max)
+	return s.collect(func(data map[string]interface{}) bool {
+		fieldValue, ok := data[field]
+		if !ok {
+			return false
+		}
+		docValue := toComparableValue(fieldValue)
+		return compareValues(docValue, minValue) >= 0 && compareValues(docValue, maxValue) <= 0
+	})
+}
+
+// FuzzyQuery 方法在快照中执行模糊查询,pattern 支持 '*' 通配符,匹配规则与没有索引时的 Database.FuzzyQuery 相同
+func (s *Snapshot) FuzzyQuery(field, pattern string) []map[string]interface{} {
+	regex := wildcardToRegexp(pattern)
+	return s.collect(func(data map[string]interface{}) bool {
+		fieldValue, ok := data[field]
+		return ok && regex.MatchString(fmt.Sprintf("%v", fieldValue))
+	})
+}
+
+// QueryComposite 方法在快照中查询多个字段同时等于给定值的文档,匹配规则与 Database.QueryComposite 相同
+func (s *Snapshot) QueryComposite(fields []string, values []interface{}) []map[string]interface{} {
+	if len(fields) != len(values) {
+		return nil
+	}
+	return s.collect(func(data map[string]interface{}) bool {
+		for i, field := range fields {
+			if fmt.Sprintf("%v", data[field]) != fmt.Sprintf("%v", values[i]) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// collect 返回快照中所有满足 match 的文档副本,加密的字段只对得到密钥的调用方解密
+func (s *Snapshot) collect(match func(data map[string]interface{}) bool) []map[string]interface{} {
+	var results []map[string]interface{}
+	s.forEach(func(_ string, data map[string]interface{}) bool {
+		if match(data) {
+			results = append(results, copyDocumentData(data))
+		}
+		return true
+	})
+	return s.db.revealAll(results)
+}
+
+// forEach 遍历快照中可见的每个文档,fn 返回 false 时停止遍历
+func (s *Snapshot) forEach(fn func(id string, data map[string]interface{}) bool) {
+	db := s.db
+	visited := make(map[string]struct{})
+	stopped := false
+
+	db.data.Range(func(key, value interface{}) bool {
+		id := key.(string)
+		if doc := versionAtOrBefore(value.(*Document), s.seq); doc != nil {
+			visited[id] = struct{}{}
+			if !db.isExpired(doc.data, s.created) {
+				stopped = !fn(id, doc.data)
+			}
+		}
+		return !stopped
+	})
+	if stopped {
+		return
+	}
+
+	// 在快照之后被删除(或删除后重新插入)的文档只能在 tombstones 中找到
+	db.tombstones.Range(func(key, _ interface{}) bool {
+		id := key.(string)
+		if _, ok := visited[id]; ok {
+			return true
+		}
+		if doc := db.versionAt(id, s.seq); doc != nil && !db.isExpired(doc.data, s.created) {
+			return fn(id, doc.data)
+		}
+		return true
+	})
+}
+
+// versionAt 返回文档在序列号 seq 时的版本,文档在该时刻不存在时返回 nil
+func (db *Database) versionAt(id string, seq uint64) *Document {
+	if value, ok := db.data.Load(id); ok {
+		if doc := versionAtOrBefore(value.(*Document), seq); doc != nil {
+			return doc
+		}
+	}
+	if value, ok := db.tombstones.Load(id); ok {
+		for ts := value.(*tombstone); ts != nil; ts = ts.next {
+			// 只有在 seq 之后才被删除的文档在 seq 时刻仍然存在
+			if ts.seq > seq {
+				if doc := versionAtOrBefore(ts.doc, seq); doc != nil {
+					return doc
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// versionAtOrBefore 沿着版本链找到第一个 seq 不大于给定序列号的版本
+func versionAtOrBefore(doc *Document, seq uint64) *Document {
+	for ; doc != nil; doc = doc.prev.Load() {
+		if doc.seq <= seq {
+			return doc
+		}
+	}
+	return nil
+}
+
+// newVersion 创建文档的新版本
+// 如果存在活跃的快照,新版本会保留指向旧版本的指针;调用方需要持有 commitMu(读锁或写锁)
+func (db *Database) newVersion(data map[string]interface{}, seq uint64, prev *Document) *Document {
+	doc := &Document{data: data, seq: seq}
+	if prev != nil && atomic.LoadInt32(&db.activeSnapshots) > 0 {
+		doc.prev.Store(prev)
+		atomic.AddInt64(&db.retainedVersions, 1)
+	}
+	return doc
+}
+
+// recordTombstone 在存在活跃快照时保留被删除文档的最后版本
+// 调用方需要持有 commitMu(读锁或写锁)以及被删除文档的写锁
+func (db *Database) recordTombstone(id string, doc *Document, seq uint64) {
+	if atomic.LoadInt32(&db.activeSnapshots) == 0 {
+		return
+	}
+	for {
+		existing, loaded := db.tombstones.Load(id)
+		ts := &tombstone{seq: seq, doc: doc}
+		if !loaded {
+			if _, loaded = db.tombstones.LoadOrStore(id, ts); !loaded {
+				break
+			}
+			continue
+		}
+		ts.next = existing.(*tombstone)
+		if db.tombstones.CompareAndSwap(id, existing, ts) {
+			break
+		}
+	}
+	atomic.AddInt64(&db.retainedVersions, 1)
+}
+
+// collectVersions 回收不再被任何活跃快照引用的旧版本
+// 回收期间持有提交锁的写锁,因此与写操作互斥;快照的读取不受影响
+func (db *Database) collectVersions() {
+	if atomic.LoadInt64(&db.retainedVersions) == 0 {
+		return
+	}
+
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+
+	// 计算仍然活跃的快照中最小的序列号
+	db.snapshotMu.Lock()
+	active := len(db.snapshots)
+	var minSeq uint64
+	for snap := range db.snapshots {
+		if minSeq == 0 || snap.seq < minSeq {
+			minSeq = snap.seq
+		}
+	}
+	db.snapshotMu.Unlock()
+
+	var retained int64
+	for _, coll := range db.allCollections() {
+		retained += coll.trimCollectionVersions(active > 0, minSeq)
+	}
+
+	atomic.StoreInt64(&db.retainedVersions, retained)
+	db.log(LogLevelDebug, "Collected old versions", slog.Int64("retained", retained), slog.Int("snapshots", active))
+}
+
+// trimCollectionVersions 回收集合中不再需要的旧版本和删除记录,返回仍然保留的旧版本数量
+// keep 为 false 表示没有活跃的快照,所有旧版本都可以回收
+func (db *Database) trimCollectionVersions(keep bool, minSeq uint64) int64 {
+	var retained int64
+	db.data.Range(func(_, value interface{}) bool {
+		retained += trimVersions(value.(*Document), keep, minSeq)
+		return true
+	})
+
+	db.tombstones.Range(func(key, value interface{}) bool {
+		// 只保留在最老的快照之后才发生的删除
+		var kept []*tombstone
+		if keep {
+			for ts := value.(*tombstone); ts != nil; ts = ts.next {
+				if ts.seq > minSeq {
+					kept = append(kept, ts)
+				}
+			}
+		}
+		if len(kept) == 0 {
+			db.tombstones.Delete(key)
+			return true
+		}
+
+		// tombstone 节点是不可变的,重新构建链表以便与正在读取的快照安全地并发
+		var head *tombstone
+		for i := len(kept) - 1; i >= 0; i-- {
+			head = &tombstone{seq: kept[i].seq, doc: kept[i].doc, next: head}
+			retained += 1 + trimVersions(head.doc, true, minSeq)
+		}
+		db.tombstones.Store(key, head)
+		return true
+	})
+	return retained
+}
+
+// trimVersions 截断文档的版本链,只保留最老快照仍然需要的版本,返回保留的旧版本数量
+func trimVersions(doc *Document, keep bool, minSeq uint64) int64 {
+	if !keep {
+		doc.prev.Store(nil)
+		return 0
+	}
+
+	var retained int64
+	for v := doc; v != nil; v = v.prev.Load() {
+		if v.seq <= minSeq {
+			// 这个版本是最老快照能看到的版本,更早的版本不再需要
+			v.prev.Store(nil)
+			break
+		}
+		if v.prev.Load() != nil {
+			retained++
+		}
+	}
+	return retained
+}
@@ -0,0 +1,67 @@
+package jsonDB
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestSnapshotIsolation(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	for _, doc := range []map[string]interface{}{
+		{"id": "1", "name": "Alice", "age": 30},
+		{"id": "2", "name": "Bob", "age": 40},
+	} {
+		if _, err := db.Insert(doc); err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+	}
+
+	snap := db.Snapshot()
+
+	// 快照之后的写入对快照不可见
+	if err := db.Update("1", map[string]interface{}{"age": 31}); err != nil {
+		t.Fatalf("Failed to update document: %v", err)
+	}
+	if err := db.Delete("2"); err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+	if _, err := db.Insert(map[string]interface{}{"id": "3", "name": "Carol", "age": 50}); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+
+	if doc, ok := snap.Get("1"); !ok || !filterEqual(doc["age"], 30) {
+		t.Errorf("Snapshot should see the old version of document 1, got %v", doc)
+	}
+	if _, ok := snap.Get("2"); !ok {
+		t.Error("Snapshot should still see deleted document 2")
+	}
+	if _, ok := snap.Get("3"); ok {
+		t.Error("Snapshot should not see document 3 inserted later")
+	}
+	if count := snap.Count(); count != 2 {
+		t.Errorf("Expected 2 documents in snapshot, got %d", count)
+	}
+	if results := snap.Find(Filter{"age": map[string]interface{}{"$gte": 35}}); len(results) != 1 || results[0]["id"] != "2" {
+		t.Errorf("Expected snapshot Find to return document 2, got %v", results)
+	}
+
+	// 数据库本身看到的是最新状态
+	if doc, _ := db.Get("1"); !filterEqual(doc["age"], 31) {
+		t.Errorf("Expected latest age 31, got %v", doc["age"])
+	}
+	if all := db.GetAll(); len(all) != 2 {
+		t.Errorf("Expected 2 documents in database, got %d", len(all))
+	}
+
+	// 释放快照后旧版本被回收
+	snap.Release()
+	snap.Release()
+	if retained := atomic.LoadInt64(&db.retainedVersions); retained != 0 {
+		t.Errorf("Expected old versions to be collected, %d retained", retained)
+	}
+	if value, _ := db.data.Load("1"); value.(*Document).prev.Load() != nil {
+		t.Error("Expected version chain of document 1 to be trimmed")
+	}
+}
@@ -0,0 +1,30 @@
+// store.go
+
+// 介绍:
+// 本文件定义了 Store 接口,它包含了文档读写、查询和索引的常用操作。
+//
+// *Database 和 client 包中的 HTTP 客户端都实现了 Store,业务代码只依赖 Store 时,
+// 可以在嵌入式数据库和远程的 jsondb-server 之间切换而不需要修改代码。
+
+package jsonDB
+
+// Store 是嵌入式数据库和远程客户端共同实现的文档存储接口
+//
+// 各个方法的语义与 *Database 上的同名方法相同。没有错误返回值的方法(例如 Get 和 Query)
+// 在远程调用失败时返回空结果,具体的错误由实现自行报告。
+type Store interface {
+	Insert(docData interface{}) (string, error)
+	Update(id string, updates map[string]interface{}) error
+	Delete(id string) error
+	Get(id string) (map[string]interface{}, bool)
+	GetAll() []map[string]interface{}
+	Query(field string, value interface{}) []map[string]interface{}
+	RangeQuery(field string, min, max interface{}) []map[string]interface{}
+	FuzzyQuery(field, pattern string) []map[string]interface{}
+	QueryComposite(fields []string, values []interface{}) []map[string]interface{}
+	CreateIndex(field string, opts ...IndexOption)
+	Count() int64
+}
+
+// 确保 *Database 实现了 Store
+var _ Store = (*Database)(nil)
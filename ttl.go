@@ -0,0 +1,221 @@
+// ttl.go
+
+// 介绍:
+// 本文件实现了文档的 TTL(生存时间)和自动过期。
+//
+// 通过 CreateIndex(field, IndexTTL(expireAfter)) 创建 TTL 索引后,文档在 field 字段记录的时间
+// 加上 expireAfter 之后过期;expireAfter 为 0 时 field 字段本身就是过期时间。
+// 字段值可以是 time.Time、RFC 3339 格式的字符串或者 Unix 时间戳(秒),没有该字段或者无法解析的文档永不过期。
+// 一个集合上有多个 TTL 索引时,文档在最早的过期时间过期。
+//
+// 过期的文档立即对 Get、Find 和各种查询不可见,Update 也把它们当作不存在;
+// 后台的清理器定期通过正常的删除流程(写入 WAL、更新索引、触发钩子和变更流)删除过期文档,
+// 在被清理之前它们仍然计入 Count。清理的间隔通过 WithTTLInterval 设置。
+//
+// 索引不会被持久化,TTL 索引需要在每次打开数据库后重新创建。
+
+package jsonDB
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// DefaultTTLInterval 是后台清理过期文档的默认间隔
+const DefaultTTLInterval = time.Minute
+
+// errDocumentNotExpired 由清理器的删除检查返回,表示文档在删除前已经不再过期
+var errDocumentNotExpired = errors.New("document not expired")
+
+// ttlRule 描述一个 TTL 索引
+type ttlRule struct {
+	field       string        // 记录时间的字段
+	expireAfter time.Duration // 字段时间之后多久过期
+}
+
+// ReaperStats 是后台清理器的统计信息
+type ReaperStats struct {
+	Runs         uint64        // 已经完成的清理轮数
+	Expired      uint64        // 清理器删除的过期文档总数
+	Errors       uint64        // 删除过期文档失败的次数
+	LastRun      time.Time     // 最近一轮清理开始的时间
+	LastDuration time.Duration // 最近一轮清理的耗时
+	LastExpired  int           // 最近一轮清理删除的文档数量
+}
+
+// IndexTTL 将索引设置为 TTL 索引,文档在索引字段记录的时间加上 expireAfter 之后过期
+func IndexTTL(expireAfter time.Duration) IndexOption {
+	return func(index *Index) {
+		index.ttl = true
+		index.expireAfter = expireAfter
+	}
+}
+
+// TTL 返回 TTL 索引中文档在字段时间之后多久过期,不是 TTL 索引时 ok 为 false
+// 主要用于在数据库之外解析 IndexOption,例如远程客户端
+func (index *Index) TTL() (expireAfter time.Duration, ok bool) {
+	return index.expireAfter, index.ttl
+}
+
+// WithTTLInterval 设置后台清理过期文档的间隔,默认为 DefaultTTLInterval
+func WithTTLInterval(interval time.Duration) Option {
+	return func(db *Database) {
+		if interval > 0 {
+			db.reapInterval = interval
+		}
+	}
+}
+
+// ReapExpired 方法立即删除所有集合中已经过期的文档,返回删除的文档数量
+// 后台清理器按照 WithTTLInterval 设置的间隔调用它
+func (db *Database) ReapExpired() int {
+	if db.readOnly.Load() {
+		// follower 上的过期文档由 leader 删除之后复制过来
+		return 0
+	}
+	start := time.Now()
+	expired := 0
+	var failed uint64
+
+	for _, coll := range db.allCollections() {
+		if coll.ttlRules.Load() == nil {
+			continue
+		}
+		var ids []string
+		coll.data.Range(func(key, value interface{}) bool {
+			doc := value.(*Document)
+			doc.mu.RLock()
+			if coll.isExpired(doc.data, start) {
+				ids = append(ids, key.(string))
+			}
+			doc.mu.RUnlock()
+			return true
+		})
+
+		for _, id := range ids {
+			// 持有文档写锁后再次检查,文档可能在扫描之后被更新而不再过期
+			_, deleted, err := coll.deleteDocument(id, func(current map[string]interface{}) error {
+				if !coll.isExpired(current, time.Now()) {
+					return errDocumentNotExpired
+				}
+				return nil
+			})
+			switch {
+			case deleted:
+				expired++
+			case err != nil && !errors.Is(err, errDocumentNotExpired):
+				failed++
+				db.log(LogLevelError, "Failed to delete expired document", slog.String("id", id), slog.Any("error", err))
+			}
+		}
+	}
+
+	db.reaperMu.Lock()
+	db.reaperStats.Runs++
+	db.reaperStats.Expired += uint64(expired)
+	db.reaperStats.Errors += failed
+	db.reaperStats.LastRun = start
+	db.reaperStats.LastDuration = time.Since(start)
+	db.reaperStats.LastExpired = expired
+	db.reaperMu.Unlock()
+
+	if expired > 0 {
+		db.log(LogLevelInfo, "Reaped expired documents", slog.String("op", "reap"), slog.Int("count", expired))
+	}
+	return expired
+}
+
+// ReaperStats 方法返回后台清理器的统计信息
+func (db *Database) ReaperStats() ReaperStats {
+	db.reaperMu.Lock()
+	defer db.reaperMu.Unlock()
+	return db.reaperStats
+}
+
+// addTTLRule 为集合添加一个 TTL 规则并启动后台清理器
+// 调用方需要持有 db.mu
+func (db *Database) addTTLRule(rule ttlRule) {
+	var rules []ttlRule
+	if current := db.ttlRules.Load(); current != nil {
+		rules = append(rules, *current...)
+	}
+	rules = append(rules, rule)
+	db.ttlRules.Store(&rules)
+
+	db.reaperOnce.Do(func() {
+		db.reaperWg.Add(1)
+		go db.runReaper()
+	})
+}
+
+// removeTTLRule 删除 field 字段上的 TTL 规则,后台清理器继续运行直到数据库被关闭
+// 调用方需要持有 db.mu
+func (db *Database) removeTTLRule(field string) {
+	current := db.ttlRules.Load()
+	if current == nil {
+		return
+	}
+	var rules []ttlRule
+	for _, rule := range *current {
+		if rule.field != field {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		db.ttlRules.Store(nil)
+		return
+	}
+	db.ttlRules.Store(&rules)
+}
+
+// runReaper 按照固定间隔清理过期文档,直到数据库被关闭
+func (db *Database) runReaper() {
+	defer db.reaperWg.Done()
+
+	ticker := time.NewTicker(db.reapInterval)
+	defer ticker.Stop()
+	db.log(LogLevelInfo, "TTL reaper started", slog.Duration("interval", db.reapInterval))
+
+	for {
+		select {
+		case <-ticker.C:
+			db.ReapExpired()
+		case <-db.reaperStop:
+			return
+		}
+	}
+}
+
+// isExpired 判断文档在 now 时是否已经过期
+func (db *Database) isExpired(data map[string]interface{}, now time.Time) bool {
+	rules := db.ttlRules.Load()
+	if rules == nil {
+		return false
+	}
+	for _, rule := range *rules {
+		value, ok := lookupField(data, rule.field)
+		if !ok {
+			continue
+		}
+		if t, ok := ttlTime(value); ok && !now.Before(t.Add(rule.expireAfter)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ttlTime 将 TTL 字段的值解析为时间
+func ttlTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	}
+	if seconds, ok := asNumber(value); ok {
+		return time.Unix(0, int64(seconds*float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
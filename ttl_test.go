@@ -0,0 +1,95 @@
+package jsonDB
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestTTLIndex(t *testing.T) {
+	os.RemoveAll(testDBPath)
+	db, err := NewDatabase("id", testDBPath, runtime.NumCPU(), WithTTLInterval(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer cleanupTestDB(t, db)
+
+	now := time.Now()
+	for _, doc := range []map[string]interface{}{
+		{"id": "expired", "kind": "session", "expiresAt": now.Add(-time.Second)},
+		{"id": "live", "kind": "session", "expiresAt": now.Add(time.Hour)},
+		{"id": "stale", "kind": "cache", "size": 1, "createdAt": now.Add(-2 * time.Hour).Format(time.RFC3339)},
+		{"id": "forever", "kind": "cache", "size": 1},
+	} {
+		if _, err := db.Insert(doc); err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+	}
+
+	// 在创建 TTL 索引之前文档永不过期
+	if _, ok := db.Get("expired"); !ok {
+		t.Fatal("Documents should not expire without a TTL index")
+	}
+
+	db.CreateIndex("expiresAt", IndexTTL(0))
+	db.CreateIndex("createdAt", IndexTTL(time.Hour))
+
+	// 过期但尚未被清理的文档立即不可见
+	if _, ok := db.Get("expired"); ok {
+		t.Error("Expired document should be hidden from Get")
+	}
+	if results := db.Find(Filter{"kind": "session"}); len(results) != 1 || results[0]["id"] != "live" {
+		t.Errorf("Expected only the live session, got %v", results)
+	}
+	if results := db.RangeQuery("size", 0, 2); len(results) != 1 || results[0]["id"] != "forever" {
+		t.Errorf("Expected only the non-expiring cache entry, got %v", results)
+	}
+	if err := db.Update("stale", map[string]interface{}{"kind": "x"}); !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("Expected ErrDocumentNotFound when updating an expired document, got %v", err)
+	}
+
+	// 后台清理器通过正常的删除流程删除过期文档
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Count() != 2 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if count := db.Count(); count != 2 {
+		t.Fatalf("Expected 2 documents after reaping, got %d", count)
+	}
+	stats := db.ReaperStats()
+	if stats.Expired != 2 || stats.Runs == 0 || stats.LastRun.IsZero() {
+		t.Errorf("Unexpected reaper stats: %+v", stats)
+	}
+	if _, ok := db.Get("live"); !ok {
+		t.Error("Live document should not be reaped")
+	}
+}
+
+func TestDropTTLIndex(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	if _, err := db.Insert(map[string]interface{}{"id": "1", "expiresAt": time.Now().Add(-time.Second)}); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	db.CreateIndex("expiresAt", IndexTTL(0))
+	if _, ok := db.Get("1"); ok {
+		t.Fatal("Expired document should be hidden from Get")
+	}
+
+	// 删除 TTL 索引后文档不再过期
+	if err := db.DropIndex("expiresAt"); err != nil {
+		t.Fatalf("Failed to drop index: %v", err)
+	}
+	if _, ok := db.Get("1"); !ok {
+		t.Error("Document should be visible after dropping the TTL index")
+	}
+	if indexes := db.Indexes(); len(indexes) != 0 {
+		t.Errorf("Expected no indexes, got %v", indexes)
+	}
+	if err := db.DropIndex("expiresAt"); !errors.Is(err, ErrIndexNotFound) {
+		t.Errorf("Expected ErrIndexNotFound, got %v", err)
+	}
+}
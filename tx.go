@@ -0,0 +1,408 @@
+// tx.go
+
+// 介绍:
+// 本文件实现了多文档 ACID 事务。
+//
+// 事务采用乐观并发控制: 在事务执行期间,所有写操作都只缓存在 Tx 中,读操作会记录读到的文档版本,
+// 即文档是否存在以及写入这个版本的 WAL 记录的 LSN;提交时持有提交锁(commitMu)的写锁,
+// 检查读过和写过的文档版本是否仍然与事务中记录的一致。如果有其他写操作修改、删除或者重新插入过这些文档,
+// 提交失败并返回 *ConflictError。
+//
+// 检查通过后,事务中的所有操作被写成一条 OperationBatch 类型的 WAL 记录并 fsync,
+// 然后再统一应用到内存和索引中。由于批量记录是一条完整的记录,recoverFromWAL 要么
+// 应用其中的全部操作,要么(记录不完整时)全部丢弃。提交期间读操作被提交锁阻塞,
+// 因此其他读者不会看到事务只应用了一半的状态。
+
+package jsonDB
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrTxDone 表示事务已经提交或回滚,不能再使用
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// Tx 表示一个多文档事务
+// Tx 可以被多个 goroutine 并发使用,但通常由单个 goroutine 持有
+type Tx struct {
+	db     *Database
+	mu     sync.Mutex
+	reads  map[string]txRead                 // 事务读到的文档版本
+	writes map[string]map[string]interface{} // 事务中待写入的文档,nil 表示删除
+	order  []string                          // 文档第一次被写入的顺序,用于生成确定的 WAL 记录
+	done   bool                              // 事务是否已经结束
+}
+
+// txRead 记录事务第一次读取一个文档时看到的版本
+type txRead struct {
+	exists bool   // 文档是否存在
+	rev    uint64 // 文档的修订号
+	seq    uint64 // 写入这个版本的 WAL 记录的 LSN,每次写入都不同,用于检测冲突
+}
+
+// Begin 方法开始一个新的事务
+//
+// 介绍:
+// 事务中的 Get、Insert、Update、Delete 和 Find 操作只作用于事务自身的视图:
+// 事务能看到自己尚未提交的写入,其他人在事务提交前看不到这些写入。
+// 调用 Commit 提交事务,或者调用 Rollback 放弃事务中的所有修改。
+//
+// 返回值:
+// - *Tx: 新的事务对象
+func (db *Database) Begin() *Tx {
+	db.log(LogLevelDebug, "Beginning transaction")
+	return &Tx{
+		db:     db,
+		reads:  make(map[string]txRead),
+		writes: make(map[string]map[string]interface{}),
+	}
+}
+
+// RunInTx 方法在一个事务中执行 fn,fn 返回 nil 时提交事务,否则回滚事务
+func (db *Database) RunInTx(fn func(tx *Tx) error) error {
+	tx := db.Begin()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get 方法在事务视图中获取指定ID的文档
+func (tx *Tx) Get(id string) (map[string]interface{}, bool) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return nil, false
+	}
+	doc := tx.view(id)
+	if doc == nil {
+		return nil, false
+	}
+	return copyDocumentData(tx.db.revealFields(doc)), true
+}
+
+// Insert 方法在事务中插入新文档,输入格式和主键生成规则与 Database.Insert 相同
+// 返回文档主键的字符串形式
+func (tx *Tx) Insert(docData interface{}) (string, error) {
+	doc, id, err := tx.db.parseDocument(docData)
+	if err != nil {
+		return "", err
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return "", ErrTxDone
+	}
+	if tx.view(id) != nil {
+		return "", &DocumentExistsError{ID: id}
+	}
+	if doc, err = tx.db.runBeforeInsert(id, doc); err != nil {
+		return "", err
+	}
+	if err := tx.db.validateDocument(id, doc); err != nil {
+		return "", err
+	}
+	if doc, err = tx.db.encryptFields(doc); err != nil {
+		return "", err
+	}
+	tx.write(id, copyDocumentData(doc))
+	return id, nil
+}
+
+// Update 方法在事务中更新指定ID的文档,更新语义与 Database.Update 相同
+func (tx *Tx) Update(id string, updates map[string]interface{}) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	current := tx.view(id)
+	if current == nil {
+		return &DocumentNotFoundError{ID: id}
+	}
+	// 事务中的写入与存储的文档一样保存密文,更新时先解密
+	current = tx.db.revealFields(current)
+	updated, err := tx.db.runBeforeUpdate(id, current, mergeUpdates(current, updates))
+	if err != nil {
+		return err
+	}
+	if err := tx.db.validateDocument(id, updated); err != nil {
+		return err
+	}
+	if updated, err = tx.db.encryptFields(updated); err != nil {
+		return err
+	}
+	tx.write(id, updated)
+	return nil
+}
+
+// replace 在事务中用 doc 替换文档的全部内容,文档不存在时插入 doc
+// doc 必须已经通过 parseDocument 解析,返回文档是否是新插入的
+func (tx *Tx) replace(id string, doc map[string]interface{}) (bool, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return false, ErrTxDone
+	}
+	current := tx.view(id)
+	var err error
+	if current == nil {
+		doc, err = tx.db.runBeforeInsert(id, doc)
+	} else {
+		doc, err = tx.db.runBeforeUpdate(id, tx.db.revealFields(current), copyDocumentData(doc))
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := tx.db.validateDocument(id, doc); err != nil {
+		return false, err
+	}
+	if doc, err = tx.db.encryptFields(doc); err != nil {
+		return false, err
+	}
+	tx.write(id, copyDocumentData(doc))
+	return current == nil, nil
+}
+
+// Delete 方法在事务中删除指定ID的文档,文档不存在时静默返回
+func (tx *Tx) Delete(id string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	if current := tx.view(id); current != nil {
+		if err := tx.db.runBeforeDelete(id, tx.db.revealFields(current)); err != nil {
+			return err
+		}
+		tx.write(id, nil)
+	}
+	return nil
+}
+
+// Find 方法在事务视图中返回所有满足 filter 的文档
+// 返回的文档都会被记录到事务的读集合中,提交时如果它们被其他人修改过,提交会失败
+func (tx *Tx) Find(filter Filter) []map[string]interface{} {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return nil
+	}
+
+	// 事务视图中的文档保存的是密文,确定性加密的字段需要与加密之后的条件比较
+	encrypted := tx.db.encryptFilter(filter)
+	var results []map[string]interface{}
+	for _, id := range tx.db.matchingIDs(filter) {
+		if _, written := tx.writes[id]; written {
+			continue
+		}
+		if doc := tx.view(id); doc != nil && matchFilter(doc, encrypted) {
+			results = append(results, copyDocumentData(doc))
+		}
+	}
+	// 事务中写入的文档以事务视图为准
+	for _, id := range tx.order {
+		if doc := tx.writes[id]; doc != nil && matchFilter(doc, encrypted) {
+			results = append(results, copyDocumentData(doc))
+		}
+	}
+	return tx.db.revealAll(results)
+}
+
+// Query 方法在事务视图中查询指定字段等于 value 的文档
+func (tx *Tx) Query(field string, value interface{}) []map[string]interface{} {
+	return tx.Find(Filter{field: value})
+}
+
+// Rollback 方法放弃事务中的所有修改
+func (tx *Tx) Rollback() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if !tx.done {
+		tx.done = true
+		tx.db.log(LogLevelDebug, "Transaction rolled back", slog.Int("count", len(tx.writes)))
+	}
+}
+
+// Commit 方法提交事务
+//
+// 介绍:
+// Commit 在提交锁的保护下检查冲突、写入一条批量 WAL 记录,然后把所有修改应用到内存和索引中。
+// 无论提交成功与否,事务都会结束,不能再被使用。
+//
+// 返回值:
+// - error: 如果事务读写的文档被其他写操作修改过,返回 *ConflictError(可以通过 errors.Is(err, ErrConflict) 判断);
+// WAL 写入失败时返回相应的错误,此时所有修改都不会生效
+func (tx *Tx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	db := tx.db
+	if len(tx.writes) == 0 {
+		db.log(LogLevelDebug, "Committed read-only transaction", slog.String("op", "commit"))
+		return nil
+	}
+
+	// after 钩子在事务提交成功并释放提交锁之后调用
+	var committed []walEntry
+	defer func() {
+		for _, op := range committed {
+			db.runAfterHooks(op)
+		}
+	}()
+
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+
+	// 冲突检测: 事务读到的每个文档都必须仍然是同一个版本,
+	// 比较 LSN 而不只是修订号,文档被删除后重新插入时同样会被发现
+	ids := make([]string, 0, len(tx.reads))
+	for id := range tx.reads {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		current, seq, ok := db.getDocumentVersion(id)
+		if read := tx.reads[id]; ok != read.exists || seq != read.seq {
+			actual := documentRevision(current)
+			db.log(LogLevelWarn, "Transaction conflict", slog.String("op", "commit"), slog.String("id", id), slog.Uint64("expected_rev", read.rev), slog.Uint64("actual_rev", actual))
+			return &ConflictError{ID: id, ExpectedRev: read.rev, ActualRev: actual}
+		}
+	}
+
+	// 生成批量 WAL 记录
+	batch := walEntry{Operation: OperationBatch}
+	for _, id := range tx.order {
+		doc := tx.writes[id]
+		before, _ := db.getDocument(id)
+		switch {
+		case doc == nil:
+			batch.Batch = append(batch.Batch, walEntry{Operation: OperationDelete, ID: id, before: before})
+		case !tx.reads[id].exists:
+			stampRevision(doc, db.insertRevision())
+			batch.Batch = append(batch.Batch, walEntry{Operation: OperationInsert, ID: id, Document: doc})
+		default:
+			stampRevision(doc, tx.reads[id].rev+1)
+			batch.Batch = append(batch.Batch, walEntry{Operation: OperationUpdate, ID: id, Document: doc, before: before})
+		}
+	}
+	lsn, err := db.writeWALEntry(batch, true)
+	if err != nil {
+		db.logTo(LogSubsystemWAL, LogLevelError, "Failed to write transaction to WAL", slog.Any("error", err))
+		return fmt.Errorf("failed to write to WAL: %w", err)
+	}
+
+	// 将所有修改应用到内存和索引中,事务中的所有文档共享批量记录的 LSN
+	for _, entry := range batch.Batch {
+		db.applyCommitted(entry, lsn)
+	}
+
+	db.log(LogLevelInfo, "Transaction committed", slog.String("op", "commit"), slog.Int("count", len(batch.Batch)), slog.Uint64("lsn", lsn))
+	committed = batch.Batch
+	return nil
+}
+
+// view 返回文档在事务视图中的当前数据,并在第一次读取已提交数据时记录文档的版本
+// 调用方需要持有 tx.mu
+func (tx *Tx) view(id string) map[string]interface{} {
+	if doc, written := tx.writes[id]; written {
+		return doc
+	}
+	current, seq, ok := tx.db.getDocumentVersion(id)
+	if _, seen := tx.reads[id]; !seen {
+		tx.reads[id] = txRead{exists: ok, rev: documentRevision(current), seq: seq}
+	}
+	return current
+}
+
+// write 在事务中记录一次写入,doc 为 nil 表示删除
+// 调用方需要持有 tx.mu,并且已经通过 view 记录了文档的版本
+func (tx *Tx) write(id string, doc map[string]interface{}) {
+	if _, written := tx.writes[id]; !written {
+		tx.order = append(tx.order, id)
+	}
+	tx.writes[id] = doc
+}
+
+// applyCommitted 将一条已经写入 WAL 的操作应用到内存数据、索引和数据文件
+// seq 是操作所在 WAL 记录的 LSN,调用方需要持有 commitMu 的写锁
+func (db *Database) applyCommitted(entry walEntry, seq uint64) {
+	var oldDoc *Document
+	if value, ok := db.data.Load(entry.ID); ok {
+		oldDoc = value.(*Document)
+	}
+
+	if entry.Operation == OperationDelete {
+		if oldDoc == nil {
+			return
+		}
+		db.data.Delete(entry.ID)
+		db.recordTombstone(entry.ID, oldDoc, seq)
+		db.indexes.Range(func(_, value interface{}) bool {
+			switch idx := value.(type) {
+			case *Index:
+				db.removeFromIndex(entry.ID, oldDoc, idx)
+			case *CompositeIndex:
+				db.removeFromCompositeIndex(entry.ID, oldDoc, idx)
+			}
+			return true
+		})
+		atomic.AddInt64(&db.docCount, -1)
+		return
+	}
+
+	newDoc := db.newVersion(entry.Document, seq, oldDoc)
+	db.data.Store(entry.ID, newDoc)
+	db.indexes.Range(func(_, value interface{}) bool {
+		switch idx := value.(type) {
+		case *Index:
+			if oldDoc != nil {
+				db.updateIndex(entry.ID, oldDoc, newDoc, idx)
+			} else {
+				db.indexDocument(newDoc, entry.ID, idx)
+			}
+		case *CompositeIndex:
+			if oldDoc != nil {
+				db.updateCompositeIndex(entry.ID, oldDoc, newDoc, idx)
+			} else {
+				db.indexDocumentComposite(newDoc, entry.ID, idx)
+			}
+		}
+		return true
+	})
+	if oldDoc == nil {
+		atomic.AddInt64(&db.docCount, 1)
+	}
+
+	// 异步写入数据文件
+	db.writeWg.Add(1)
+	go func() {
+		db.workerPool <- struct{}{}
+		defer func() {
+			<-db.workerPool
+			db.writeWg.Done()
+		}()
+		if err := db.writeToDataFile(entry.ID, entry.Document); err != nil {
+			db.log(LogLevelError, "Failed to write document to data file", slog.String("id", entry.ID), slog.Any("error", err))
+		}
+	}()
+}
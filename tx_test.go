@@ -0,0 +1,127 @@
+package jsonDB
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestTransactionCommitAndConflict(t *testing.T) {
+	db := setupTestDB(t)
+
+	for _, doc := range []string{`{"id": "alice", "balance": 100}`, `{"id": "bob", "balance": 50}`} {
+		if _, err := db.Insert(doc); err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+	}
+
+	// 转账在一个事务中完成
+	err := db.RunInTx(func(tx *Tx) error {
+		alice, _ := tx.Get("alice")
+		bob, _ := tx.Get("bob")
+		if err := tx.Update("alice", map[string]interface{}{"balance": alice["balance"].(float64) - 30}); err != nil {
+			return err
+		}
+		if err := tx.Update("bob", map[string]interface{}{"balance": bob["balance"].(float64) + 30}); err != nil {
+			return err
+		}
+		_, err := tx.Insert(map[string]interface{}{"id": "log1", "amount": 30})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+
+	// 并发写入导致冲突
+	tx := db.Begin()
+	tx.Get("alice")
+	tx.Update("bob", map[string]interface{}{"balance": 0})
+	if err := db.Update("alice", map[string]interface{}{"balance": 1}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+	if bob, _ := db.Get("bob"); bob["balance"] != float64(80) {
+		t.Errorf("Conflicting transaction must not apply, bob balance is %v", bob["balance"])
+	}
+
+	// 回滚的事务不产生任何修改
+	tx = db.Begin()
+	tx.Delete("log1")
+	tx.Rollback()
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Expected ErrTxDone, got %v", err)
+	}
+
+	bobRev, _ := db.Revision("bob")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	// 模拟崩溃: 数据文件丢失,WAL 末尾有一条不完整的记录
+	if err := os.Truncate(filepath.Join(testDBPath, DataFileName), 0); err != nil {
+		t.Fatalf("Failed to truncate data file: %v", err)
+	}
+	wal, err := os.OpenFile(filepath.Join(testDBPath, WALFileName), os.O_WRONLY|os.O_APPEND, DBFilePerm)
+	if err != nil {
+		t.Fatalf("Failed to open WAL file: %v", err)
+	}
+	binary.Write(wal, binary.LittleEndian, uint32(1000))
+	wal.Write([]byte("partial"))
+	wal.Close()
+
+	db, err = NewDatabase("id", testDBPath, runtime.NumCPU())
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer cleanupTestDB(t, db)
+
+	if count := db.Count(); count != 3 {
+		t.Errorf("Expected 3 documents after recovery, got %d", count)
+	}
+	if alice, _ := db.Get("alice"); !filterEqual(alice["balance"], 1) {
+		t.Errorf("Expected alice balance 1 after recovery, got %v", alice["balance"])
+	}
+	if bob, _ := db.Get("bob"); DocumentRevision(bob) != bobRev {
+		t.Errorf("Expected bob at revision %d after recovery, got %d", bobRev, DocumentRevision(bob))
+	}
+}
+
+func TestTransactionConflictOnRecreatedDocument(t *testing.T) {
+	db, err := NewDatabase("id", t.TempDir(), runtime.NumCPU(), WithLogLevel(LogLevelOff))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	db.Insert(map[string]interface{}{"id": "a", "name": "old"})
+
+	// 事务读取之后文档被删除并重新插入,提交时视为冲突
+	tx := db.Begin()
+	tx.Get("a")
+	if err := tx.Update("a", map[string]interface{}{"name": "tx"}); err != nil {
+		t.Fatalf("Failed to update in transaction: %v", err)
+	}
+	db.Delete("a")
+	db.Insert(map[string]interface{}{"id": "a", "name": "new"})
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict for a recreated document, got %v", err)
+	}
+	if doc, _ := db.Get("a"); doc["name"] != "new" {
+		t.Errorf("Conflicting transaction must not overwrite the new document, got %v", doc)
+	}
+
+	// 读取时不存在的文档在提交前被其他人插入,同样视为冲突
+	tx = db.Begin()
+	if _, ok := tx.Get("b"); ok {
+		t.Fatal("Expected b to be missing")
+	}
+	tx.Insert(map[string]interface{}{"id": "c"})
+	db.Insert(map[string]interface{}{"id": "b"})
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict for a document inserted after the read, got %v", err)
+	}
+}
@@ -1,9 +1,11 @@
 package jsonDB
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
 	"os"
+	"reflect"
 	"strings"
 	"time"
 )
@@ -15,6 +17,7 @@ const (
 	// 数据库文件名
 	DataFileName = "data.db"
 	WALFileName  = "wal.log"
+	MetaFileName = "meta.db" // 保存检查点 LSN 等元数据
 
 	// 文件权限
 	DBDirPerm  = 0755
@@ -24,10 +27,20 @@ const (
 	OperationInsert = "INSERT"
 	OperationUpdate = "UPDATE"
 	OperationDelete = "DELETE"
+	OperationBatch  = "BATCH" // 事务提交时写入的批量记录,恢复时全部应用或全部忽略
+
+	// 集合管理操作,记录的 Collection 是被操作的集合
+	OperationCreateCollection = "CREATE_COLLECTION" // 记录的 Definition 是新集合的定义
+	OperationDropCollection   = "DROP_COLLECTION"
+	OperationRenameCollection = "RENAME_COLLECTION" // 记录的 ID 是集合的新名称
+
+	// 文档元数据字段,由数据库在每次写入时维护
+	RevisionField  = "_rev"       // 文档修订号,插入时为 1,每次更新加 1
+	UpdatedAtField = "_updatedAt" // 文档最后一次写入的时间
 
 	// 文件打开模式
 	FileOpenModeRW  = os.O_RDWR | os.O_CREATE
-	FileOpenModeWAL = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	FileOpenModeWAL = os.O_RDWR | os.O_CREATE | os.O_APPEND
 )
 
 func toFloat64(v interface{}) float64 {
@@ -100,3 +113,80 @@ func toComparableValue(v interface{}) interface{} {
 		return v
 	}
 }
+
+// deepCopyValue 递归复制文档中的值
+// map 和切片会被复制为 map[string]interface{} 和 []interface{},其他值直接返回
+func deepCopyValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			copied[k] = deepCopyValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, item := range value {
+			copied[i] = deepCopyValue(item)
+		}
+		return copied
+	case []byte:
+		return append([]byte(nil), value...)
+	case nil:
+		return nil
+	}
+
+	// 处理 []string、map[string]string 等具体类型的容器
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		copied := make([]interface{}, rv.Len())
+		for i := range copied {
+			copied[i] = deepCopyValue(rv.Index(i).Interface())
+		}
+		return copied
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return v
+		}
+		copied := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			copied[iter.Key().String()] = deepCopyValue(iter.Value().Interface())
+		}
+		return copied
+	}
+	return v
+}
+
+// deepCopyDocument 复制整个文档数据
+func deepCopyDocument(doc map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		return nil
+	}
+	return deepCopyValue(doc).(map[string]interface{})
+}
+
+// jsonEqual 按照 JSON 语义比较两个值是否相等
+// 两个值都会先经过 JSON 序列化再反序列化,因此 int 与 float64、[]string 与 []interface{} 被视为相同
+func jsonEqual(a, b interface{}) bool {
+	na, errA := normalizeJSON(a)
+	nb, errB := normalizeJSON(b)
+	if errA != nil || errB != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return reflect.DeepEqual(na, nb)
+}
+
+// normalizeJSON 将值转换为 encoding/json 反序列化后的标准形式
+func normalizeJSON(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var normalized interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
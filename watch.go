@@ -0,0 +1,397 @@
+// watch.go
+
+// 介绍:
+// 本文件实现了变更流(change stream): 调用方通过 Watch 订阅集合上的插入、更新和删除事件,
+// 不再需要反复调用 GetAll 轮询。
+//
+// 事件在 WAL 记录写入成功之后、持有文件锁(db.mu)的情况下发布,因此每个变更流收到的事件
+// 严格按照 LSN 的顺序排列,也不会收到写入 WAL 失败的操作。发布只是把事件放入变更流的队列,
+// 不会等待消费者;由每个变更流自己的 goroutine 把事件交付到 Events 通道。
+// 如果消费者处理得太慢,队列超过上限后变更流会以 ErrChangeStreamOverflow 结束,
+// 消费者可以使用最后一个事件的 Token 重新订阅,从中断的位置继续。
+//
+// 每个事件都带有一个 ResumeToken(LSN 和事件在事务批量记录中的位置)。使用 WatchResumeAfter
+// 重新订阅时,Watch 会先从 WAL 文件中重放该位置之后的事件,再继续交付新的事件。
+// 检查点会清空 WAL,因此只能从最近一次检查点(即最近一次打开数据库)之后的位置恢复,
+// 更早的位置返回 ErrResumeTokenExpired。
+
+package jsonDB
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var (
+	// ErrChangeStreamOverflow 表示消费者处理得太慢,变更流中积压的事件超过了上限
+	ErrChangeStreamOverflow = errors.New("change stream buffer overflow")
+	// ErrResumeTokenExpired 表示恢复位置之后的部分 WAL 记录已经被检查点清除
+	ErrResumeTokenExpired = errors.New("resume token is no longer in the WAL")
+)
+
+// DefaultWatchBufferSize 是变更流默认最多积压的事件数量
+const DefaultWatchBufferSize = 1024
+
+// ResumeToken 标识变更流中的一个事件,用于在重新订阅时从该事件之后继续
+type ResumeToken struct {
+	LSN   uint64 // 事件所在 WAL 记录的 LSN
+	Index int    // 事件在事务批量记录中的位置,单文档操作为 0
+}
+
+// String 返回令牌的字符串形式,可以通过 ParseResumeToken 解析
+func (t ResumeToken) String() string {
+	return fmt.Sprintf("%d.%d", t.LSN, t.Index)
+}
+
+// ParseResumeToken 解析 ResumeToken.String 返回的字符串
+func ParseResumeToken(s string) (ResumeToken, error) {
+	lsnText, indexText, ok := strings.Cut(s, ".")
+	if !ok {
+		return ResumeToken{}, fmt.Errorf("invalid resume token '%s'", s)
+	}
+	lsn, err := strconv.ParseUint(lsnText, 10, 64)
+	if err != nil {
+		return ResumeToken{}, fmt.Errorf("invalid resume token '%s': %w", s, err)
+	}
+	index, err := strconv.Atoi(indexText)
+	if err != nil || index < 0 {
+		return ResumeToken{}, fmt.Errorf("invalid resume token '%s'", s)
+	}
+	return ResumeToken{LSN: lsn, Index: index}, nil
+}
+
+// after 判断 t 是否位于 other 之后
+func (t ResumeToken) after(other ResumeToken) bool {
+	return t.LSN > other.LSN || (t.LSN == other.LSN && t.Index > other.Index)
+}
+
+// ChangeEvent 描述集合上的一次写操作
+type ChangeEvent struct {
+	Operation string                 // 操作类型: OperationInsert、OperationUpdate 或 OperationDelete
+	ID        string                 // 文档ID
+	Document  map[string]interface{} // 写入后的完整文档,删除时为 nil
+	PreImage  map[string]interface{} // 写入前的文档,只在使用 WatchPreImages 订阅时提供,插入和从 WAL 重放的事件为 nil
+	LSN       uint64                 // 操作所在 WAL 记录的 LSN,同一事务中的操作共享同一个 LSN
+	Token     ResumeToken            // 用于从这个事件之后继续订阅
+}
+
+// WatchOption 是 Watch 的可选配置项
+type WatchOption func(*watchConfig)
+
+type watchConfig struct {
+	resumeAfter *ResumeToken
+	preImages   bool
+	bufferSize  int
+}
+
+// WatchResumeAfter 从指定事件之后继续订阅,先重放 WAL 中该事件之后的所有事件
+func WatchResumeAfter(token ResumeToken) WatchOption {
+	return func(c *watchConfig) {
+		c.resumeAfter = &token
+	}
+}
+
+// WatchPreImages 让更新和删除事件携带写入前的文档
+func WatchPreImages() WatchOption {
+	return func(c *watchConfig) {
+		c.preImages = true
+	}
+}
+
+// WatchBufferSize 设置变更流最多积压的事件数量,默认为 DefaultWatchBufferSize
+func WatchBufferSize(size int) WatchOption {
+	return func(c *watchConfig) {
+		if size > 0 {
+			c.bufferSize = size
+		}
+	}
+}
+
+// ChangeStream 是通过 Watch 创建的变更流
+type ChangeStream struct {
+	db        *Database
+	filter    Filter
+	preImages bool
+	limit     int
+
+	events chan ChangeEvent // 交付给消费者的事件
+	notify chan struct{}    // 有新的事件进入队列
+	done   chan struct{}    // 变更流结束时关闭
+
+	mu      sync.Mutex
+	pending []ChangeEvent // 等待交付的事件
+	closed  bool
+	err     error
+}
+
+// Watch 方法订阅集合上的写操作
+//
+// 介绍:
+// 每次 Insert、Update、Delete(包括事务、批量操作和补丁更新)写入 WAL 之后,满足 filter 的操作
+// 会作为 ChangeEvent 发送到变更流的 Events 通道。filter 与 Find 使用相同的语法,
+// 匹配写入后的文档;删除事件匹配被删除的文档,从 WAL 重放的删除事件没有文档可以匹配,总是被交付。
+// filter 为 nil 时订阅所有操作。
+//
+// ctx 被取消、调用 Close、集合被删除或者数据库被关闭时,变更流结束,Events 通道被关闭,
+// 之后可以通过 Err 查看结束的原因。
+//
+// 参数:
+// - ctx: 控制变更流生命周期的上下文
+// - filter: 事件需要满足的条件
+// - opts: 可选配置项,例如 WatchResumeAfter 和 WatchPreImages
+//
+// 返回值:
+// - *ChangeStream: 新的变更流
+// - error: 恢复位置已经不在 WAL 中(ErrResumeTokenExpired)或者读取 WAL 失败时返回错误
+func (db *Database) Watch(ctx context.Context, filter Filter, opts ...WatchOption) (*ChangeStream, error) {
+	cfg := watchConfig{bufferSize: DefaultWatchBufferSize}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	cs := &ChangeStream{
+		db:        db,
+		filter:    filter,
+		preImages: cfg.preImages,
+		limit:     cfg.bufferSize,
+		events:    make(chan ChangeEvent),
+		notify:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	// 持有文件锁完成重放和注册,保证重放的事件与之后发布的事件之间没有遗漏和重复
+	db.mu.Lock()
+	if db.dropped {
+		db.mu.Unlock()
+		return nil, &CollectionNotFoundError{Name: db.name}
+	}
+	if cfg.resumeAfter != nil {
+		if err := db.replayChanges(cs, *cfg.resumeAfter); err != nil {
+			db.mu.Unlock()
+			return nil, err
+		}
+	}
+	replayed := len(cs.pending)
+	db.watchMu.Lock()
+	db.watchers[cs] = struct{}{}
+	db.watchMu.Unlock()
+	db.mu.Unlock()
+
+	go cs.run(ctx)
+
+	db.log(LogLevelDebug, "Started change stream", slog.Int("replayed", replayed))
+	return cs, nil
+}
+
+// Events 返回交付事件的通道,变更流结束时通道被关闭
+func (cs *ChangeStream) Events() <-chan ChangeEvent {
+	return cs.events
+}
+
+// Err 返回变更流结束的原因
+// 通过 Close 结束或者数据库被关闭时返回 nil,ctx 被取消时返回 ctx.Err()
+func (cs *ChangeStream) Err() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.err
+}
+
+// Close 结束变更流,多次调用 Close 是安全的
+func (cs *ChangeStream) Close() {
+	cs.stop(nil)
+}
+
+// stop 结束变更流并记录结束的原因,只有第一次调用生效
+func (cs *ChangeStream) stop(err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closed {
+		return
+	}
+	cs.closed = true
+	cs.err = err
+	cs.pending = nil
+	close(cs.done)
+}
+
+// run 将队列中的事件依次交付到 Events 通道,直到变更流结束
+func (cs *ChangeStream) run(ctx context.Context) {
+	defer func() {
+		cs.db.watchMu.Lock()
+		delete(cs.db.watchers, cs)
+		cs.db.watchMu.Unlock()
+		close(cs.events)
+	}()
+
+	for {
+		cs.mu.Lock()
+		batch := cs.pending
+		cs.pending = nil
+		cs.mu.Unlock()
+
+		for _, event := range batch {
+			select {
+			case cs.events <- event:
+			case <-cs.done:
+				return
+			case <-ctx.Done():
+				cs.stop(ctx.Err())
+				return
+			}
+		}
+		if len(batch) > 0 {
+			continue
+		}
+
+		select {
+		case <-cs.notify:
+		case <-cs.done:
+			return
+		case <-ctx.Done():
+			cs.stop(ctx.Err())
+			return
+		}
+	}
+}
+
+// enqueue 将事件放入队列,队列已满时以 ErrChangeStreamOverflow 结束变更流
+// 重放的事件不受队列上限的限制
+func (cs *ChangeStream) enqueue(event ChangeEvent, replay bool) {
+	cs.mu.Lock()
+	if cs.closed {
+		cs.mu.Unlock()
+		return
+	}
+	if !replay && len(cs.pending) >= cs.limit {
+		cs.mu.Unlock()
+		cs.db.log(LogLevelWarn, "Change stream overflowed", slog.Int("pending", cs.limit))
+		cs.stop(ErrChangeStreamOverflow)
+		return
+	}
+	cs.pending = append(cs.pending, event)
+	cs.mu.Unlock()
+
+	select {
+	case cs.notify <- struct{}{}:
+	default:
+	}
+}
+
+// offer 检查一次写操作是否满足变更流的条件,满足时将事件放入队列
+func (cs *ChangeStream) offer(op walEntry, lsn uint64, index int, replay bool) {
+	match := op.Document
+	if op.Operation == OperationDelete {
+		match = op.before
+	}
+	// 记录中的文档保存的是密文,确定性加密的字段与加密之后的条件比较
+	if match != nil && len(cs.filter) > 0 && !matchFilter(match, cs.db.encryptFilter(cs.filter)) {
+		return
+	}
+
+	event := ChangeEvent{
+		Operation: op.Operation,
+		ID:        op.ID,
+		LSN:       lsn,
+		Token:     ResumeToken{LSN: lsn, Index: index},
+	}
+	if op.Document != nil {
+		event.Document = deepCopyDocument(op.Document)
+	}
+	if cs.preImages && op.before != nil {
+		event.PreImage = deepCopyDocument(op.before)
+	}
+	cs.enqueue(event, replay)
+}
+
+// publishChanges 将一条刚写入 WAL 的记录发布到集合上的所有变更流
+// 调用方需要持有 db.mu
+func (db *Database) publishChanges(entry walEntry) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if len(db.watchers) == 0 {
+		return
+	}
+
+	for cs := range db.watchers {
+		if cs.db != db {
+			continue
+		}
+		forEachChange(entry, func(op walEntry, index int) {
+			cs.offer(op, entry.LSN, index, false)
+		})
+	}
+}
+
+// replayChanges 从 WAL 文件中读取 after 之后属于该集合的操作,放入变更流的队列
+// 调用方需要持有 db.mu
+func (db *Database) replayChanges(cs *ChangeStream, after ResumeToken) error {
+	if after.LSN < db.walStartLSN {
+		return fmt.Errorf("%w: token %v, oldest retained LSN %d", ErrResumeTokenExpired, after, db.walStartLSN+1)
+	}
+	if lsn := atomic.LoadUint64(&db.lsn); after.LSN > lsn {
+		return fmt.Errorf("resume token %v is ahead of the last LSN %d", after, lsn)
+	}
+
+	err := scanRecords(filepath.Join(db.dbPath, WALFileName), WALFileName, fileConfig{keys: db.keys}, nil, func(rec *FileRecord) error {
+		if rec.Err != nil {
+			return &CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: rec.Err}
+		}
+		var entry walEntry
+		if err := msgpack.Unmarshal(rec.Raw, &entry); err != nil {
+			return fmt.Errorf("failed to unmarshal WAL entry: %w", err)
+		}
+		if entry.Collection != db.id || entry.LSN < after.LSN {
+			return nil
+		}
+		forEachChange(entry, func(op walEntry, index int) {
+			if (ResumeToken{LSN: entry.LSN, Index: index}).after(after) {
+				cs.offer(op, entry.LSN, index, true)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read WAL file: %w", err)
+	}
+	return nil
+}
+
+// forEachChange 对 WAL 记录中的每个操作调用 fn,index 是操作在批量记录中的位置
+func forEachChange(entry walEntry, fn func(op walEntry, index int)) {
+	if isCollectionOperation(entry.Operation) {
+		// 集合管理操作不是文档的变更
+		return
+	}
+	if entry.Operation != OperationBatch {
+		fn(entry, 0)
+		return
+	}
+	for i, op := range entry.Batch {
+		fn(op, i)
+	}
+}
+
+// closeWatchers 结束集合上的所有变更流,collection 为 nil 时结束所有变更流
+func (db *Database) closeWatchers(collection *Database, err error) {
+	db.watchMu.Lock()
+	streams := make([]*ChangeStream, 0, len(db.watchers))
+	for cs := range db.watchers {
+		if collection == nil || cs.db == collection {
+			streams = append(streams, cs)
+		}
+	}
+	db.watchMu.Unlock()
+
+	for _, cs := range streams {
+		cs.stop(err)
+	}
+}
@@ -0,0 +1,156 @@
+package jsonDB
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// nextEvent 从变更流中读取一个事件,超时视为测试失败
+func nextEvent(t *testing.T, cs *ChangeStream) ChangeEvent {
+	t.Helper()
+	select {
+	case event, ok := <-cs.Events():
+		if !ok {
+			t.Fatalf("Change stream ended unexpectedly: %v", cs.Err())
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for change event")
+	}
+	return ChangeEvent{}
+}
+
+func TestWatch(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { cleanupTestDB(t, db) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cs, err := db.Watch(ctx, Filter{"age": map[string]interface{}{"$gte": 18}}, WatchPreImages())
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+
+	if _, err := db.Insert(map[string]interface{}{"id": "1", "name": "Alice", "age": 30}); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	if _, err := db.Insert(map[string]interface{}{"id": "2", "name": "Bob", "age": 10}); err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	if err := db.Update("1", map[string]interface{}{"age": 31}); err != nil {
+		t.Fatalf("Failed to update document: %v", err)
+	}
+	if err := db.RunInTx(func(tx *Tx) error {
+		if err := tx.Delete("1"); err != nil {
+			return err
+		}
+		_, err := tx.Insert(map[string]interface{}{"id": "3", "name": "Carol", "age": 40})
+		return err
+	}); err != nil {
+		t.Fatalf("Failed to commit transaction: %v", err)
+	}
+
+	// 文档 2 不满足 filter,不会产生事件
+	insert := nextEvent(t, cs)
+	if insert.Operation != OperationInsert || insert.ID != "1" || insert.PreImage != nil {
+		t.Errorf("Unexpected insert event: %+v", insert)
+	}
+	update := nextEvent(t, cs)
+	if update.Operation != OperationUpdate || !filterEqual(update.Document["age"], 31) || !filterEqual(update.PreImage["age"], 30) {
+		t.Errorf("Unexpected update event: %+v", update)
+	}
+	del := nextEvent(t, cs)
+	txInsert := nextEvent(t, cs)
+	if del.Operation != OperationDelete || del.Document != nil || del.PreImage["id"] != "1" {
+		t.Errorf("Unexpected delete event: %+v", del)
+	}
+	if txInsert.ID != "3" || txInsert.LSN != del.LSN || txInsert.Token != (ResumeToken{LSN: del.LSN, Index: 1}) {
+		t.Errorf("Expected transaction events to share LSN %d, got %+v", del.LSN, txInsert)
+	}
+
+	// 从更新事件之后恢复,先重放 WAL 中的事件
+	resumed, err := db.Watch(ctx, nil, WatchResumeAfter(update.Token))
+	if err != nil {
+		t.Fatalf("Failed to resume watch: %v", err)
+	}
+	if event := nextEvent(t, resumed); event.Token != del.Token || event.PreImage != nil {
+		t.Errorf("Expected replayed delete event without pre-image, got %+v", event)
+	}
+	if event := nextEvent(t, resumed); event.Token != txInsert.Token {
+		t.Errorf("Expected replayed insert event, got %+v", event)
+	}
+	if err := db.Delete("3"); err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+	if event := nextEvent(t, resumed); event.Operation != OperationDelete || event.ID != "3" {
+		t.Errorf("Expected live delete event after replay, got %+v", event)
+	}
+
+	cancel()
+	for range cs.Events() {
+	}
+	if !errors.Is(cs.Err(), context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", cs.Err())
+	}
+
+	// 检查点清空 WAL 之后,之前的位置不能再恢复
+	db.writeWg.Wait()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db, err = NewDatabase("id", testDBPath, runtime.NumCPU())
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if _, err := db.Watch(context.Background(), nil, WatchResumeAfter(update.Token)); !errors.Is(err, ErrResumeTokenExpired) {
+		t.Errorf("Expected ErrResumeTokenExpired, got %v", err)
+	}
+}
+
+func TestWatchOverflow(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	cs, err := db.Watch(context.Background(), nil, WatchBufferSize(2))
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		if _, err := db.Insert(map[string]interface{}{"id": id}); err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+	}
+
+	var last ChangeEvent
+	for event := range cs.Events() {
+		last = event
+	}
+	if !errors.Is(cs.Err(), ErrChangeStreamOverflow) {
+		t.Fatalf("Expected ErrChangeStreamOverflow, got %v", cs.Err())
+	}
+
+	// 从最后收到的事件之后恢复,不会遗漏任何事件
+	resumed, err := db.Watch(context.Background(), nil, WatchResumeAfter(last.Token))
+	if err != nil {
+		t.Fatalf("Failed to resume watch: %v", err)
+	}
+	defer resumed.Close()
+	for want := last.LSN + 1; want <= db.lsn; want++ {
+		if event := nextEvent(t, resumed); event.LSN != want {
+			t.Errorf("Expected event with LSN %d, got %d", want, event.LSN)
+		}
+	}
+}
+
+func TestParseResumeToken(t *testing.T) {
+	token := ResumeToken{LSN: 42, Index: 3}
+	parsed, err := ParseResumeToken(token.String())
+	if err != nil || parsed != token {
+		t.Errorf("Expected %v, got %v, %v", token, parsed, err)
+	}
+	if _, err := ParseResumeToken("42"); err == nil {
+		t.Error("Expected error for malformed token")
+	}
+}
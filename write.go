@@ -17,58 +17,117 @@
 package jsonDB
 
 import (
+	"bufio"                             // 用于带缓冲的写入
 	"encoding/binary"                   // 用于二进制数据的编码和解码
+	"errors"                            // 用于判断截断的 WAL 记录
 	"fmt"                               // 用于格式化字符串
 	"github.com/vmihailenco/msgpack/v5" // 用于数据序列化
 	"io"                                // 提供 I/O 原语
-	"sync/atomic"                       // 提供原子操作
+	"log/slog"
+	"os"            // 提供文件操作
+	"path/filepath" // 用于拼接文件路径
+	"sync/atomic"   // 提供原子操作
+	"time"          // 用于 WAL 记录的时间戳
 )
 
+// walEntry 表示 WAL 文件中的一条记录
+// 批量记录(OperationBatch)的 Batch 字段包含事务中的所有操作,恢复时作为一个整体应用
+type walEntry struct {
+	Operation  string
+	ID         string
+	Document   map[string]interface{}
+	Batch      []walEntry `msgpack:",omitempty"`
+	LSN        uint64     `msgpack:",omitempty"` // 日志序列号,每条记录单调递增
+	Collection uint32     `msgpack:",omitempty"` // 记录所属集合的ID,批量记录中的操作属于同一个集合
+	Time       int64      `msgpack:",omitempty"` // 写入记录的时间(Unix 纳秒),用于按时间点恢复
+
+	// Definition 是创建集合的记录中新集合的定义
+	Definition *collectionMeta `msgpack:",omitempty"`
+
+	before map[string]interface{} // 写入前的文档,不写入 WAL,只用于发布变更事件
+}
+
 // writeWAL 函数用于将操作写入WAL（Write-Ahead Log）文件
 // 参数:
 // - operation: 操作类型 (如 "INSERT", "UPDATE", "DELETE")
 // - id: 文档的唯一标识符
 // - doc: 文档内容
-// 返回: 错误信息 (如果有)
-func (db *Database) writeWAL(operation, id string, doc map[string]interface{}) error {
-	db.logger.Debug(fmt.Sprintf("Writing WAL entry: operation=%s, id=%s", operation, id))
+// - before: 写入前的文档,插入时为 nil,只用于发布变更事件
+// 返回: 分配给这条记录的 LSN 和错误信息 (如果有)
+// 集合上注册了这种操作的 after 钩子时,记录会同步落盘,保证 after 钩子只看到持久化的操作
+func (db *Database) writeWAL(operation, id string, doc, before map[string]interface{}) (uint64, error) {
+	db.logTo(LogSubsystemWAL, LogLevelDebug, "Writing WAL entry", slog.String("op", operation), slog.String("id", id))
 
 	// 创建一个包含操作信息的结构体
-	entry := struct {
-		Operation string
-		ID        string
-		Document  map[string]interface{}
-	}{
+	return db.writeWALEntry(walEntry{
 		Operation: operation,
 		ID:        id,
 		Document:  doc,
+		before:    before,
+	}, db.hasAfterHooks(operation))
+}
+
+// writeWALEntry 函数为一条 WAL 记录分配 LSN,序列化后写入 WAL 文件
+// LSN 在持有文件锁时分配,因此 WAL 文件中记录的顺序与 LSN 的顺序一致。
+// sync 为 true 时会在写入后调用 fsync,事务提交使用这种方式保证批量记录落盘
+func (db *Database) writeWALEntry(entry walEntry, sync bool) (uint64, error) {
+	// 获取数据库的写锁
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 集合的删除同样持有 db.mu,因此删除之后不会再有属于该集合的记录写入 WAL
+	if db.dropped {
+		return 0, &CollectionNotFoundError{Name: db.name}
+	}
+	if db.readOnly.Load() {
+		return 0, ErrReadOnly
+	}
+	entry.Collection = db.id
+	if err := db.appendWALLocked(&entry, sync); err != nil {
+		return 0, err
+	}
+	db.logTo(LogSubsystemWAL, LogLevelDebug, "WAL entry written", slog.String("op", entry.Operation), slog.String("id", entry.ID), slog.Uint64("lsn", entry.LSN))
+
+	// 记录写入成功后发布变更事件,持有 db.mu 保证事件按照 LSN 的顺序发布
+	db.publishChanges(entry)
+	return entry.LSN, nil
+}
+
+// appendWALLocked 函数为一条 WAL 记录分配 LSN 和时间戳,序列化后追加到 WAL 文件
+// 调用方需要持有 db.mu
+func (db *Database) appendWALLocked(entry *walEntry, sync bool) error {
+	entry.LSN = db.lsn + 1
+	if entry.Time == 0 {
+		// 从 leader 复制的记录保留 leader 写入时的时间
+		entry.Time = time.Now().UnixNano()
 	}
 
 	// 使用 MessagePack 序列化 entry 结构体
 	data, err := msgpack.Marshal(entry)
 	if err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to marshal WAL entry: %v", err))
+		db.logTo(LogSubsystemWAL, LogLevelError, "Failed to marshal WAL entry", slog.Any("error", err))
 		return fmt.Errorf("failed to marshal WAL entry: %w", err)
 	}
 
-	// 获取数据库的写锁
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	// 写入数据长度 (4字节无符号整数)
-	if err := binary.Write(db.walFile, binary.LittleEndian, uint32(len(data))); err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to write WAL entry size: %v", err))
-		return fmt.Errorf("failed to write WAL entry size: %w", err)
+	// 写入带有长度前缀的记录,启用加密时记录在写入前被加密
+	n, err := db.walWriter.write(data, entry.LSN, entry.Time)
+	if err != nil {
+		db.logTo(LogSubsystemWAL, LogLevelError, "Failed to write WAL entry", slog.Uint64("lsn", entry.LSN), slog.Any("error", err))
+		return fmt.Errorf("failed to write WAL entry: %w", err)
 	}
 
-	// 写入实际数据
-	_, err = db.walFile.Write(data)
-	if err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to write WAL entry data: %v", err))
-		return fmt.Errorf("failed to write WAL entry data: %w", err)
+	if sync {
+		if err := db.walFile.Sync(); err != nil {
+			db.logTo(LogSubsystemWAL, LogLevelError, "Failed to sync WAL file", slog.Any("error", err))
+			return fmt.Errorf("failed to sync WAL file: %w", err)
+		}
 	}
 
-	db.logger.Debug("WAL entry written successfully")
+	// 记录写入成功后才推进 LSN
+	atomic.StoreUint64(&db.lsn, entry.LSN)
+	db.walSize += n
+	db.feedReplicas(entry, data)
+	db.requestWALRotation()
 	return nil
 }
 
@@ -78,18 +137,12 @@ func (db *Database) writeWAL(operation, id string, doc map[string]interface{}) e
 // - doc: 要写入的文档内容
 // 返回: 错误信息 (如果有)
 func (db *Database) writeToDataFile(id string, doc map[string]interface{}) error {
-	db.logger.Debug(fmt.Sprintf("Writing document to data file: id=%s", id))
+	db.log(LogLevelDebug, "Writing document to data file", slog.String("id", id))
 
 	// 创建一个包含文档ID和数据的结构体,并序列化
-	data, err := msgpack.Marshal(struct {
-		ID   string
-		Data map[string]interface{}
-	}{
-		ID:   id,
-		Data: doc,
-	})
+	data, err := encodeDataRecord(db.id, id, doc)
 	if err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to marshal document: %v", err))
+		db.log(LogLevelError, "Failed to marshal document", slog.String("id", id), slog.Any("error", err))
 		return fmt.Errorf("failed to marshal document: %w", err)
 	}
 
@@ -100,151 +153,429 @@ func (db *Database) writeToDataFile(id string, doc map[string]interface{}) error
 	// 将文件指针移动到文件末尾
 	_, err = db.dataFile.Seek(0, io.SeekEnd)
 	if err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to seek to the end of the data file: %v", err))
+		db.log(LogLevelError, "Failed to seek to the end of the data file", slog.Any("error", err))
 		return fmt.Errorf("failed to seek to the end of the data file: %w", err)
 	}
 
-	// 写入数据长度 (4字节无符号整数)
-	if err := binary.Write(db.dataFile, binary.LittleEndian, uint32(len(data))); err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to write document size: %v", err))
-		return fmt.Errorf("failed to write document size: %w", err)
-	}
-
-	// 写入实际数据
-	_, err = db.dataFile.Write(data)
-	if err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to write document data: %v", err))
-		return fmt.Errorf("failed to write document data: %w", err)
+	// 写入带有长度前缀的记录,启用加密时记录在写入前被加密
+	if _, err := db.dataWriter.write(data, 0, 0); err != nil {
+		db.log(LogLevelError, "Failed to write document", slog.String("id", id), slog.Any("error", err))
+		return fmt.Errorf("failed to write document: %w", err)
 	}
 
-	db.logger.Debug("Document written to data file successfully")
+	db.log(LogLevelDebug, "Document written to data file", slog.String("id", id))
 	return nil
 }
 
 // loadData 函数用于从数据文件加载数据
 // 返回: 错误信息 (如果有)
 func (db *Database) loadData() error {
-	db.logger.Info("Loading data from data file")
-
-	// 将文件指针移动到文件开头
-	_, err := db.dataFile.Seek(0, 0)
-	if err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to seek to the beginning of the data file: %v", err))
-		return fmt.Errorf("failed to seek to the beginning of the data file: %w", err)
-	}
-
-	// 循环读取文件中的所有文档
-	for {
-		var size uint32
-		// 读取数据长度
-		err = binary.Read(db.dataFile, binary.LittleEndian, &size)
-		if err != nil {
-			if err == io.EOF {
-				break // 如果到达文件末尾,退出循环
-			}
-			db.logger.Error(fmt.Sprintf("Failed to read document size: %v", err))
-			return fmt.Errorf("failed to read document size: %w", err)
+	start := time.Now()
+	db.log(LogLevelInfo, "Loading data from data file")
+
+	// 循环读取文件中的所有文档,加密的记录使用 WithEncryption 提供的密钥解密
+	loaded := 0
+	err := scanRecords(filepath.Join(db.dbPath, DataFileName), DataFileName, fileConfig{keys: db.keys}, nil, func(rec *FileRecord) error {
+		if rec.Err != nil {
+			return &CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: rec.Err}
 		}
 
-		// 读取实际数据
-		data := make([]byte, size)
-		_, err = io.ReadFull(db.dataFile, data)
-		if err != nil {
-			db.logger.Error(fmt.Sprintf("Failed to read document data: %v", err))
-			return fmt.Errorf("failed to read document data: %w", err)
+		// 反序列化文档数据
+		var docEntry dataRecord
+		if err := msgpack.Unmarshal(rec.Raw, &docEntry); err != nil {
+			return fmt.Errorf("failed to unmarshal document data: %w", err)
 		}
 
-		// 反序列化文档数据
-		var docEntry struct {
-			ID   string
-			Data map[string]interface{}
+		// 找到文档所属的集合,已经被删除的集合中的文档直接丢弃
+		coll := db.collectionByID(docEntry.Collection)
+		if coll == nil {
+			return nil
 		}
-		err = msgpack.Unmarshal(data, &docEntry)
-		if err != nil {
-			db.logger.Error(fmt.Sprintf("Failed to unmarshal document data: %v", err))
-			return fmt.Errorf("failed to unmarshal document data: %w", err)
+		coll.observeKey(docEntry.ID)
+
+		// 异步写入可能导致同一文档的旧版本排在新版本之后,只保留修订号最大的版本
+		doc := &Document{data: docEntry.Data}
+		if existing, loaded := coll.data.Load(docEntry.ID); loaded {
+			if documentRevision(existing.(*Document).data) > documentRevision(docEntry.Data) {
+				return nil
+			}
+			coll.data.Store(docEntry.ID, doc)
+			return nil
 		}
 
 		// 创建文档对象并存储到内存中
-		doc := &Document{data: docEntry.Data}
-		db.data.Store(docEntry.ID, doc)
+		coll.data.Store(docEntry.ID, doc)
 
 		// 更新索引
-		db.indexes.Range(func(_, indexValue interface{}) bool {
+		coll.indexes.Range(func(_, indexValue interface{}) bool {
 			switch idx := indexValue.(type) {
 			case *Index:
-				db.indexDocument(doc, docEntry.ID, idx)
+				coll.indexDocument(doc, docEntry.ID, idx)
 			case *CompositeIndex:
-				db.indexDocumentComposite(doc, docEntry.ID, idx)
+				coll.indexDocumentComposite(doc, docEntry.ID, idx)
 			}
 			return true
 		})
 
 		// 原子操作增加文档计数
-		atomic.AddInt64(&db.docCount, 1)
+		atomic.AddInt64(&coll.docCount, 1)
+		loaded++
+		return nil
+	})
+	if err != nil {
+		db.log(LogLevelError, "Failed to read data file", slog.Any("error", err))
+		return fmt.Errorf("failed to read data file: %w", err)
 	}
 
-	db.logger.Info(fmt.Sprintf("Loaded %d documents from data file", atomic.LoadInt64(&db.docCount)))
+	db.log(LogLevelInfo, "Loaded documents from data file", slog.Int("count", loaded), slog.Duration("duration", time.Since(start)))
 	return nil
 }
 
 // recoverFromWAL 函数用于从WAL文件恢复数据
+//
+// WAL 记录按照写入顺序重放。如果文件末尾的记录不完整(例如进程在写入过程中崩溃),
+// 这条记录会被截断丢弃,因此事务的批量记录要么全部被应用,要么全部被忽略。
 // 返回: 错误信息 (如果有)
 func (db *Database) recoverFromWAL() error {
-	db.logger.Info("Recovering from WAL file")
-
-	// 将文件指针移动到WAL文件开头
-	_, err := db.walFile.Seek(0, 0)
-	if err != nil {
-		db.logger.Error(fmt.Sprintf("Failed to seek to the beginning of the WAL file: %v", err))
-		return fmt.Errorf("failed to seek to the beginning of the WAL file: %w", err)
-	}
+	start := time.Now()
+	db.logTo(LogSubsystemWAL, LogLevelInfo, "Recovering from WAL file")
 
 	recoveredCount := 0
-	// 循环读取WAL文件中的所有条目
-	for {
-		var size uint32
-		// 读取条目长度
-		err = binary.Read(db.walFile, binary.LittleEndian, &size)
-		if err != nil {
-			if err == io.EOF {
-				break // 如果到达文件末尾,退出循环
-			}
-			db.logger.Error(fmt.Sprintf("Failed to read WAL entry size: %v", err))
-			return fmt.Errorf("failed to read WAL entry size: %w", err)
+	// 循环读取WAL文件中的所有条目,加密的记录使用 WithEncryption 提供的密钥解密
+	err := scanRecords(filepath.Join(db.dbPath, WALFileName), WALFileName, fileConfig{keys: db.keys}, nil, func(rec *FileRecord) error {
+		if rec.Err != nil {
+			return &CorruptRecordError{File: rec.File, Offset: rec.Offset, Err: rec.Err}
 		}
 
-		// 读取实际数据
-		data := make([]byte, size)
-		_, err = io.ReadFull(db.walFile, data)
-		if err != nil {
-			db.logger.Error(fmt.Sprintf("Failed to read WAL entry data: %v", err))
-			return fmt.Errorf("failed to read WAL entry data: %w", err)
+		// 反序列化WAL条目
+		var entry walEntry
+		if err := msgpack.Unmarshal(rec.Raw, &entry); err != nil {
+			return fmt.Errorf("failed to unmarshal WAL entry: %w", err)
 		}
 
-		// 反序列化WAL条目
-		var entry struct {
-			Operation string
-			ID        string
-			Document  map[string]interface{}
+		// 根据操作类型执行相应的恢复操作
+		recoveredCount += db.applyWALEntry(entry, entry.LSN)
+		if entry.LSN > db.lsn {
+			db.lsn = entry.LSN
+		}
+		return nil
+	})
+	var corrupt *CorruptRecordError
+	if errors.As(err, &corrupt) && corrupt.Torn {
+		return db.truncateTornWAL(corrupt.Offset)
+	}
+	if err != nil {
+		db.logTo(LogSubsystemWAL, LogLevelError, "Failed to read WAL file", slog.Any("error", err))
+		return fmt.Errorf("failed to read WAL file: %w", err)
+	}
+
+	db.recountDocuments()
+	db.logTo(LogSubsystemWAL, LogLevelInfo, "Recovered operations from WAL file", slog.Int("count", recoveredCount), slog.Duration("duration", time.Since(start)))
+	return nil
+}
+
+// applyWALEntry 将一条 WAL 记录应用到它所属集合的内存数据中,返回应用的操作数量
+// seq 是这条记录的 LSN,批量记录中的所有操作共享同一个 LSN
+func (db *Database) applyWALEntry(entry walEntry, seq uint64) int {
+	return db.replayWALEntry(entry, seq, (*Database).restoreDocument)
+}
+
+// replayWALEntry 把一条 WAL 记录分发到它所属的集合,返回应用的操作数量
+// 集合管理操作直接重放,文档操作交给 apply。恢复和 follower 应用 leader 的记录都经过这里,
+// 区别只在于文档操作如何应用
+func (db *Database) replayWALEntry(entry walEntry, seq uint64, apply func(coll *Database, op walEntry, seq uint64)) int {
+	if isCollectionOperation(entry.Operation) {
+		db.applyCollectionEntry(entry)
+		return 1
+	}
+
+	coll := db.collectionByID(entry.Collection)
+	if coll == nil {
+		// 集合已经被删除
+		return 0
+	}
+
+	switch entry.Operation {
+	case OperationInsert, OperationUpdate, OperationDelete:
+		apply(coll, entry, seq)
+		return 1
+	case OperationBatch:
+		applied := 0
+		for _, op := range entry.Batch {
+			op.Collection = entry.Collection
+			applied += db.replayWALEntry(op, seq, apply)
 		}
-		err = msgpack.Unmarshal(data, &entry)
+		return applied
+	}
+	db.logTo(LogSubsystemWAL, LogLevelWarn, "Skipping WAL entry with unknown operation", slog.String("op", entry.Operation), slog.Uint64("lsn", entry.LSN))
+	return 0
+}
+
+// restoreDocument 在恢复时把一个文档操作应用到集合的内存数据,索引在恢复之后才会创建
+func (db *Database) restoreDocument(op walEntry, seq uint64) {
+	if op.Operation == OperationDelete {
+		db.data.Delete(op.ID)
+		return
+	}
+	// 被删除文档的主键同样不能被序列重新分配
+	db.observeKey(op.ID)
+	db.data.Store(op.ID, &Document{data: op.Document, seq: seq})
+}
+
+// truncateTornWAL 截断 WAL 文件末尾不完整的记录
+func (db *Database) truncateTornWAL(offset int64) error {
+	db.logTo(LogSubsystemWAL, LogLevelWarn, "WAL file has an incomplete record, discarding it", slog.Int64("offset", offset))
+	if err := db.walFile.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate torn WAL record: %w", err)
+	}
+	db.recountDocuments()
+	return nil
+}
+
+// recountDocuments 根据内存中的数据重新计算每个集合的文档总数
+func (db *Database) recountDocuments() {
+	for _, coll := range db.allCollections() {
+		atomic.StoreInt64(&coll.docCount, int64(syncMapSize(coll.data)))
+	}
+}
+
+// checkpoint 函数将内存中的所有文档重写到新的数据文件,并清空 WAL 文件
+//
+// 新的数据文件先写入临时文件并 fsync,然后通过重命名原子地替换旧文件,
+// 因此在任何时刻崩溃,磁盘上都至少有一份完整的数据文件加上对应的 WAL。
+// 调用方需要保证调用期间没有并发的写操作。
+func (db *Database) checkpoint() error {
+	start := time.Now()
+	db.logTo(LogSubsystemWAL, LogLevelInfo, "Checkpointing data file")
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 每次检查点都使用当前的密钥,KeyProvider 返回新的密钥之后旧的密钥不再用于新写入的文件
+	c, err := currentCipher(db.keys)
+	if err != nil {
+		return fmt.Errorf("failed to get the current encryption key: %w", err)
+	}
+
+	tmpPath := filepath.Join(db.dbPath, DataFileName+".tmp")
+	tmpFile, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, DBFilePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint file: %w", err)
+	}
+
+	writer := bufio.NewWriter(tmpFile)
+	records := newRecordWriter(writer, DataFileName, c)
+	var total int64
+	for _, coll := range db.allCollections() {
+		coll.data.Range(func(key, value interface{}) bool {
+			var data []byte
+			data, err = encodeDataRecord(coll.id, key.(string), value.(*Document).data)
+			if err == nil {
+				_, err = records.write(data, 0, 0)
+				total++
+			}
+			return err == nil
+		})
 		if err != nil {
-			db.logger.Error(fmt.Sprintf("Failed to unmarshal WAL entry: %v", err))
-			return fmt.Errorf("failed to unmarshal WAL entry: %w", err)
+			break
 		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write checkpoint file: %w", err)
+	}
 
-		// 根据操作类型执行相应的恢复操作
-		switch entry.Operation {
-		case OperationInsert, OperationUpdate:
-			db.data.Store(entry.ID, &Document{data: entry.Document})
-			recoveredCount++
-		case OperationDelete:
-			db.data.Delete(entry.ID)
-			recoveredCount++
+	// 用新的数据文件替换旧文件,并重新打开文件句柄
+	if err := db.dataFile.Close(); err != nil {
+		return fmt.Errorf("failed to close data file: %w", err)
+	}
+	dataPath := filepath.Join(db.dbPath, DataFileName)
+	if err := os.Rename(tmpPath, dataPath); err != nil {
+		return fmt.Errorf("failed to replace data file: %w", err)
+	}
+	if db.dataFile, err = os.OpenFile(dataPath, FileOpenModeRW, DBFilePerm); err != nil {
+		return fmt.Errorf("failed to reopen data file: %w", err)
+	}
+	// 之后的文档追加到新的数据文件,写入器记得文件中最后一个密钥帧
+	records.w = db.dataFile
+	db.dataWriter = records
+
+	// 在清空 WAL 之前保存当前 LSN,保证重启后 LSN 继续单调递增
+	if err := db.saveMeta(); err != nil {
+		return fmt.Errorf("failed to save database metadata: %w", err)
+	}
+
+	// 清空之前把 WAL 作为一个段保存到归档目录
+	if err := db.archiveWAL(); err != nil {
+		return fmt.Errorf("failed to archive WAL file: %w", err)
+	}
+
+	// 数据文件已经包含 WAL 中的所有修改,可以清空 WAL
+	if err := db.walFile.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate WAL file: %w", err)
+	}
+	db.walStartLSN = atomic.LoadUint64(&db.lsn)
+	db.walSize = 0
+	db.walWriter = newRecordWriter(db.walFile, WALFileName, c)
+
+	db.logTo(LogSubsystemWAL, LogLevelInfo, "Checkpoint completed", slog.String("op", "checkpoint"), slog.Int64("count", total), slog.Duration("duration", time.Since(start)))
+	return nil
+}
+
+// dataRecord 是数据文件中的一条记录
+type dataRecord struct {
+	ID         string
+	Data       map[string]interface{}
+	Collection uint32 `msgpack:",omitempty"` // 文档所属集合的ID,默认集合为 0
+}
+
+// encodeDataRecord 将文档序列化为数据文件中的一条记录
+func encodeDataRecord(collection uint32, id string, doc map[string]interface{}) ([]byte, error) {
+	return msgpack.Marshal(dataRecord{
+		ID:         id,
+		Data:       doc,
+		Collection: collection,
+	})
+}
+
+// writeFramedRecord 写入一条带有 4 字节长度前缀的记录
+func writeFramedRecord(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// dbMeta 是元数据文件的内容
+type dbMeta struct {
+	LSN              uint64           // 最近一次检查点时的 LSN
+	KeySequence      uint64           `msgpack:",omitempty"` // 最近一次检查点时默认集合整数主键序列的值
+	Schema           []byte           `msgpack:",omitempty"` // 默认集合的 JSON Schema
+	Collections      []collectionMeta `msgpack:",omitempty"` // 所有命名集合
+	NextCollectionID uint32           `msgpack:",omitempty"` // 下一个命名集合的ID
+}
+
+// collectionMeta 是元数据文件中保存的命名集合信息
+type collectionMeta struct {
+	ID          uint32
+	Name        string
+	PrimaryKey  string
+	KeyPolicy   KeyPolicy `msgpack:",omitempty"`
+	KeySequence uint64    `msgpack:",omitempty"`
+	Schema      []byte    `msgpack:",omitempty"`
+}
+
+// loadMeta 函数从元数据文件中读取检查点时保存的 LSN、主键序列、模式和命名集合,文件不存在时保持默认值
+func (db *Database) loadMeta() error {
+	data, err := os.ReadFile(filepath.Join(db.dbPath, MetaFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read metadata file: %w", err)
+	}
+
+	var meta dbMeta
+	if err := msgpack.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	db.lsn = meta.LSN
+	db.keySeq = meta.KeySequence
+
+	// 通过 WithSchema 指定的模式优先于保存的模式
+	if err := db.loadSchema(meta.Schema); err != nil {
+		return err
+	}
+
+	for _, cm := range meta.Collections {
+		coll, err := db.newCollectionFromMeta(cm)
+		if err != nil {
+			return err
 		}
+		db.collections[cm.ID] = coll
+	}
+	if meta.NextCollectionID > db.nextCollectionID {
+		db.nextCollectionID = meta.NextCollectionID
 	}
+	return nil
+}
 
-	db.logger.Info(fmt.Sprintf("Recovered %d operations from WAL file", recoveredCount))
+// loadSchema 编译元数据文件中保存的模式,集合已经设置了模式时保持不变
+func (db *Database) loadSchema(source []byte) error {
+	if len(source) == 0 || db.schema.Load() != nil {
+		return nil
+	}
+	schema, err := CompileSchema(source)
+	if err != nil {
+		return fmt.Errorf("failed to compile saved schema: %w", err)
+	}
+	db.schema.Store(schema)
 	return nil
 }
+
+// saveMeta 函数将当前 LSN、主键序列、模式和命名集合原子地写入元数据文件
+// 调用方需要持有 db.mu
+func (db *Database) saveMeta() error {
+	data, err := msgpack.Marshal(db.buildMeta())
+	if err != nil {
+		return err
+	}
+	return writeMetaFile(db.dbPath, data)
+}
+
+// buildMeta 函数返回当前 LSN、主键序列、模式和命名集合组成的元数据
+func (db *Database) buildMeta() dbMeta {
+	root := db.root
+	meta := dbMeta{
+		LSN:              atomic.LoadUint64(&db.lsn),
+		KeySequence:      atomic.LoadUint64(&root.keySeq),
+		Schema:           root.schema.Load().sourceBytes(),
+		NextCollectionID: db.nextCollectionID,
+	}
+	for _, coll := range db.namedCollections() {
+		meta.Collections = append(meta.Collections, coll.collectionMeta())
+	}
+	return meta
+}
+
+// collectionMeta 函数返回命名集合在元数据文件中保存的信息
+func (db *Database) collectionMeta() collectionMeta {
+	return collectionMeta{
+		ID:          db.id,
+		Name:        db.name,
+		PrimaryKey:  db.primaryKey,
+		KeyPolicy:   db.keyPolicy,
+		KeySequence: atomic.LoadUint64(&db.keySeq),
+		Schema:      db.schema.Load().sourceBytes(),
+	}
+}
+
+// newCollectionFromMeta 函数根据元数据文件中保存的信息创建一个空的命名集合
+func (db *Database) newCollectionFromMeta(cm collectionMeta) (*Database, error) {
+	coll := newCollectionDatabase(db.engine, cm.ID, cm.Name, cm.PrimaryKey)
+	coll.keyPolicy = cm.KeyPolicy
+	coll.keySeq = cm.KeySequence
+	if err := coll.loadSchema(cm.Schema); err != nil {
+		return nil, err
+	}
+	return coll, nil
+}
+
+// writeMetaFile 通过临时文件和重命名原子地替换目录中的元数据文件
+func writeMetaFile(dir string, data []byte) error {
+	path := filepath.Join(dir, MetaFileName)
+	if err := os.WriteFile(path+".tmp", data, DBFilePerm); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}